@@ -0,0 +1,157 @@
+package _4xx
+
+import (
+	"errors"
+	"kapacitor-alerts-api/engine"
+	structs "kapacitor-alerts-api/structs"
+	"kapacitor-alerts-api/utils"
+	"regexp"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const _4xxalerttemplate = `
+[[define "influx_query"]]
+select count("value") from [[ dbrp ]].[[ .Measurement ]] where "fqdn" =~ /[[ .App | influxregex ]]/
+[[end]]
+[[define "alert_message"]]
+[[ .App ]]: {{ if eq .Level "CRITICAL" }}Excessive 4xxs {{ end }}{{ if eq .Level "OK" }}4xxs back to normal {{ end }}{{ if eq .Level "INFO" }}4xxs Returning to Normal {{ end }}{{ if eq .Level "WARNING" }}Elevated 4xxs {{ end }} Metric: {{ .Name }}  Sigma: {{ index .Fields "sigma" | printf "%0.2f" }} Count: {{ index .Fields "count" }}
+[[end]]
+[[define "alert_details"]]
+<h3>{{ .Message }}</h3>
+<a href="https://membanks.octanner.io/dashboard/db/alamo-router-scanner?var-url=[[ .App | urlquery ]]&from=now-1h&to=now&panelId=4&fullscreen">Link To Memory Banks</a>
+[[end]]
+var influx_query string
+var sigma float
+var alert_message string
+var alert_details string
+[[if .Slack ]]
+var slack string
+[[end]]
+[[if .Post ]]
+var post string
+[[end]]
+[[range .Emails ]]
+var [[ . ]] string
+[[end]]
+
+	batch
+    |	query(influx_query)
+        .period(10m)
+        .every(1m)
+    |	eval(lambda: sigma("count"))
+        .as('sigma')
+        .keep('count', 'sigma')
+    |	alert()
+        .crit(lambda: "sigma" > sigma)
+        .warn(lambda: ("sigma" <= sigma AND "sigma" >= 0.1) )
+        .stateChangesOnly()
+        [[if .Slack ]]
+      	  .slack()
+      	  .channel(slack)
+        [[end]]
+        .message(alert_message)
+        .details(alert_details)
+        [[range .Emails ]]
+        	.email([[ . ]])
+        [[end]]
+        [[if .Post ]]
+        	.post(post)
+        [[end]]
+`
+
+var tolerancelist = map[string]string{
+	"low":    "0.5",
+	"medium": "1.0",
+	"high":   "1.5",
+}
+
+var descriptor = engine.Register(&engine.Descriptor{
+	Name:     "4xx",
+	Table:    "_4xx_tasks",
+	Params:   []string{"app"},
+	Columns:  []string{"app"},
+	Template: _4xxalerttemplate,
+	ID:       func(keys []string) string { return keys[0] + "-4xx" },
+	Pattern:  regexp.MustCompile(`-4xx$`),
+	NewSpec:  func() engine.Spec { return &_4xxTaskSpec{} },
+	FromVars: func(vars map[string]structs.Var) engine.Spec {
+		return &_4xxTaskSpec{
+			App:        engine.StringVar(vars, "app"),
+			Fqdn:       engine.StringVar(vars, "fqdn"),
+			Tolerance:  engine.StringVar(vars, "tolerance"),
+			Exclude404: engine.BoolVar(vars, "exclude404"),
+		}
+	},
+	Model: _4xxDBTask{},
+})
+
+// Prepare - Validate the tolerance and choose the status codes to watch
+func (task *_4xxTaskSpec) Prepare() error {
+	sigma, ok := tolerancelist[task.Tolerance]
+	if !ok {
+		return errors.New("Tolerance must be one of low, medium, or high")
+	}
+	task.Sigma = sigma
+
+	// Optionally leave 404s out, as these are often expected (e.g. crawlers, missing assets)
+	status := engine.InfluxRegex(descriptor.Influx().Measurements["router_status"])
+	if task.Exclude404 {
+		task.Measurement = `/` + status + `\.(40[0-35-9]|4[1-9][0-9])/`
+	} else {
+		task.Measurement = `/` + status + `\.(4.*)/`
+	}
+	return nil
+}
+
+// Keys - App
+func (task *_4xxTaskSpec) Keys() []string {
+	return []string{task.App}
+}
+
+// TaskVars - Variables saved with the task in Kapacitor
+func (task *_4xxTaskSpec) TaskVars() map[string]structs.Var {
+	vars := make(map[string]structs.Var)
+	vars = utils.AddVar("app", task.App, "string", vars)
+	vars = utils.AddVar("fqdn", task.Fqdn, "string", vars)
+	vars = utils.AddVar("tolerance", task.Tolerance, "string", vars)
+	vars = utils.AddVar("sigma", task.Sigma, "float", vars)
+	vars = utils.AddVar("exclude404", strconv.FormatBool(task.Exclude404), "bool", vars)
+	return vars
+}
+
+// Row - Values saved to _4xx_tasks
+func (task *_4xxTaskSpec) Row() []interface{} {
+	return []interface{}{task.App, task.Tolerance, task.Slack, task.Post, task.Email, task.Exclude404}
+}
+
+// Process4xxRequest - POST | PATCH /task/4xx
+func Process4xxRequest(c *gin.Context) {
+	engine.ProcessRequest(descriptor, c)
+}
+
+// Preview4xxTask - POST /task/4xx/preview
+func Preview4xxTask(c *gin.Context) {
+	engine.PreviewTask(descriptor, c)
+}
+
+// Delete4xxTask - DELETE /task/4xx/:app
+func Delete4xxTask(c *gin.Context) {
+	engine.DeleteTask(descriptor, c)
+}
+
+// Get4xxTask - GET /task/4xx/:app
+func Get4xxTask(c *gin.Context) {
+	engine.GetTask(descriptor, c)
+}
+
+// List4xxTasks - GET /tasks/4xx
+func List4xxTasks(c *gin.Context) {
+	engine.ListTasks(descriptor, c)
+}
+
+// Get4xxTaskState - GET /task/4xx/:app/state
+func Get4xxTaskState(c *gin.Context) {
+	engine.GetTaskState(descriptor, c)
+}
@@ -0,0 +1,218 @@
+package _4xx
+
+import (
+	"bytes"
+	"encoding/json"
+	"kapacitor-alerts-api/config"
+	"kapacitor-alerts-api/engine"
+	"kapacitor-alerts-api/engine/enginetest"
+	structs "kapacitor-alerts-api/structs"
+	"kapacitor-alerts-api/utils"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gopkg.in/guregu/null.v3/zero"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+/********************************************************
+*    Endpoints tested:
+*
+*    Method   Endpoint              Function
+*    ---------------------------------------------------
+*    POST     /task/4xx             TestCreate4xxTask
+*    PATCH    /task/4xx             TestUpdate4xxTask
+*    POST     /task/4xx/preview     TestHostile4xxInput
+*    DELETE   /task/4xx/:app        TestDelete4xxTask
+*    GET      /tasks/4xx            TestCreate4xxTask
+*    GET      /task/4xx/:app        TestCreate4xxTask
+*    GET      /task/4xx/:app/state  TestGet4xxTaskState
+ */
+
+// setupRouter - Setup Gin routes for current test type
+func setupRouter() *gin.Engine {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Panicln(err)
+	}
+	pool := utils.GetDB(cfg.Database)
+	if pool == nil {
+		log.Panicln("Unable to connect to database")
+	}
+	if err := engine.Configure(cfg); err != nil {
+		log.Panicln(err)
+	}
+
+	router := gin.Default()
+	router.Use(utils.DBMiddleware(pool))
+	router.Use(config.Middleware(cfg))
+
+	router.POST("/task/4xx", Process4xxRequest)
+	router.PATCH("/task/4xx", Process4xxRequest)
+	router.POST("/task/4xx/preview", Preview4xxTask)
+	router.DELETE("/task/4xx/:app", Delete4xxTask)
+	router.GET("/task/4xx/:app", Get4xxTask)
+	router.GET("/task/4xx/:app/state", Get4xxTaskState)
+	router.GET("/tasks/4xx", List4xxTasks)
+
+	return router
+}
+
+// TestCreate4xxTask - Make sure that creating a 4xx task works and we can successfully get info about the created task
+func TestCreate4xxTask(t *testing.T) {
+	router := setupRouter()
+
+	// Create a new task
+	var task _4xxDBTask
+	task.App = "gotest-voltron"
+	task.Tolerance = "low"
+	task.Slack = zero.StringFrom("#cobra")
+	taskBytes, err := json.Marshal(task)
+	assert.Nil(t, err, "Converting from _4xxDBTask to JSON should not throw an error")
+
+	req, _ := http.NewRequest("POST", "/task/4xx", bytes.NewBuffer(taskBytes))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusCreated, w.Code, "HTTP response code for POST /task/4xx should be 201")
+
+	// Check that the new task exists and contains expected data
+	req, _ = http.NewRequest("GET", "/task/4xx/gotest-voltron", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for GET /task/4xx/:app should be 200")
+
+	var returnedTask _4xxDBTask
+	err = json.Unmarshal([]byte(w.Body.String()), &returnedTask)
+
+	assert.Nil(t, err, "Converting from JSON to _4xxDBTask should not throw an error")
+	assert.Equal(t, returnedTask.App, task.App, "Task app name should match")
+	assert.Equal(t, returnedTask.Tolerance, task.Tolerance, "Task tolerance should match")
+	assert.Equal(t, returnedTask.Exclude404, task.Exclude404, "Task exclude404 should match")
+	assert.Equal(t, returnedTask.Slack, task.Slack, "Task slack should match")
+	assert.Equal(t, returnedTask.Email, task.Email, "Task email should match")
+	assert.Equal(t, returnedTask.Post, task.Post, "Task post should match")
+
+	// Check that the new task exists in the list of all tasks
+	req, _ = http.NewRequest("GET", "/tasks/4xx", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for GET /tasks/4xx should be 200")
+
+	var returnedTasks []_4xxDBTask
+	err = json.Unmarshal([]byte(w.Body.String()), &returnedTasks)
+
+	assert.Nil(t, err, "Converting from JSON to []_4xxDBTask should not throw an error")
+
+	var foundTask _4xxDBTask
+
+	for _, n := range returnedTasks {
+		if n.App == task.App {
+			foundTask = n
+		}
+	}
+
+	assert.NotNil(t, foundTask, "Task should exist in returned list of tasks")
+
+	assert.Equal(t, foundTask.App, task.App, "Task app name should match")
+	assert.Equal(t, foundTask.Tolerance, task.Tolerance, "Task tolerance should match")
+	assert.Equal(t, foundTask.Exclude404, task.Exclude404, "Task exclude404 should match")
+	assert.Equal(t, foundTask.Slack, task.Slack, "Task slack should match")
+	assert.Equal(t, foundTask.Email, task.Email, "Task email should match")
+	assert.Equal(t, foundTask.Post, task.Post, "Task post should match")
+}
+
+// TestGet4xxTaskStatus - Make sure that we can get status information about a 4xx task
+func TestGet4xxTaskState(t *testing.T) {
+	router := setupRouter()
+
+	req, _ := http.NewRequest("GET", "/task/4xx/gotest-voltron/state", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for GET /task/4xx/:app/state should be 200")
+
+	var taskState structs.SimpleTaskState
+	err := json.Unmarshal([]byte(w.Body.String()), &taskState)
+
+	assert.Nil(t, err, "Converting from JSON to structs.SimpleTaskState should not throw an error")
+	assert.Equal(t, taskState.App, "gotest-voltron", "Task app name should match")
+	assert.Equal(t, taskState.State, "OK", "Task state should be OK")
+}
+
+// TestUpdate4xxTask - Make sure that updating a 4xx task's config works
+func TestUpdate4xxTask(t *testing.T) {
+	router := setupRouter()
+
+	// Create a task with updated information
+	// Slack - #cobra => nil
+	// Post - nil => http://example.com/
+	// Exclude404 - false => true
+	var task _4xxDBTask
+	task.App = "gotest-voltron"
+	task.Tolerance = "low"
+	task.Exclude404 = true
+	task.Post = zero.StringFrom("http://example.com/")
+	taskBytes, err := json.Marshal(task)
+	assert.Nil(t, err, "Converting from _4xxDBTask to JSON should not throw an error")
+
+	req, _ := http.NewRequest("PATCH", "/task/4xx", bytes.NewBuffer(taskBytes))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusCreated, w.Code, "HTTP response code for PATCH /task/4xx should be 201")
+
+	// Check that the new task exists and contains expected data
+	req, _ = http.NewRequest("GET", "/task/4xx/gotest-voltron", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for GET /task/4xx/:app should be 200")
+
+	var returnedTask _4xxDBTask
+	err = json.Unmarshal([]byte(w.Body.String()), &returnedTask)
+
+	// API sets nil slack channels to #
+	task.Slack = zero.StringFrom("#")
+
+	assert.Nil(t, err, "Converting from JSON to _4xxDBTask should not throw an error")
+	assert.Equal(t, returnedTask.App, task.App, "Task app name should match")
+	assert.Equal(t, returnedTask.Tolerance, task.Tolerance, "Task tolerance should match")
+	assert.Equal(t, returnedTask.Exclude404, task.Exclude404, "Task exclude404 should match")
+	assert.Equal(t, returnedTask.Slack, task.Slack, "Task slack should match")
+	assert.Equal(t, returnedTask.Email, task.Email, "Task email should match")
+	assert.Equal(t, returnedTask.Post, task.Post, "Task post should match")
+}
+
+// TestDelete4xxTask - Make sure that deleting a 4xx task works and that we cannot access it anymore
+func TestDelete4xxTask(t *testing.T) {
+	router := setupRouter()
+
+	// Delete the task that was created in TestCreate4xxTask
+	req, _ := http.NewRequest("DELETE", "/task/4xx/gotest-voltron", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for DELETE /task/4xx/:app should be 200")
+
+	// Check that the deleted task doesn't exist anymore
+	req, _ = http.NewRequest("GET", "/task/4xx/gotest-voltron", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code, "HTTP response code for GET /task/4xx/:app on invalid app should be 404")
+}
+
+// TestHostile4xxInput - Make sure that user input is passed through vars or escaped in the rendered query, or rejected if it cannot be
+func TestHostile4xxInput(t *testing.T) {
+	inputs := append(enginetest.HostileNotify(`"tolerance":"low"`),
+		enginetest.Accepted("dot in app", `{"app":"gotest.hostile","tolerance":"low"}`, [2]string{"influx_query", `"fqdn" =~ /gotest\.hostile/`}, [2]string{"alert_details", `var-url=gotest.hostile&`}),
+	)
+	enginetest.CheckHostileInputs(t, Preview4xxTask, inputs)
+}
@@ -0,0 +1,28 @@
+package _4xx
+
+import (
+	"kapacitor-alerts-api/engine"
+
+	"gopkg.in/guregu/null.v3/zero"
+)
+
+// _4xxTaskSpec - Used to create or update a 4xx task
+type _4xxTaskSpec struct {
+	App         string `json:"app"`
+	Fqdn        string `json:"fqdn"`
+	Tolerance   string `json:"tolerance"`
+	Sigma       string `json:"-"`
+	Exclude404  bool   `json:"exclude404"`
+	Measurement string `json:"-"`
+	engine.Notify
+}
+
+// _4xxDBTask - Used for retrieval of task information from the database
+type _4xxDBTask struct {
+	App        string      `json:"app"`
+	Tolerance  string      `json:"tolerance"`
+	Slack      zero.String `json:"slack"`
+	Post       zero.String `json:"post"`
+	Email      zero.String `json:"email"`
+	Exclude404 bool        `json:"exclude404"`
+}
@@ -3,11 +3,14 @@ package _5xx
 import (
 	"bytes"
 	"encoding/json"
+	"kapacitor-alerts-api/config"
+	"kapacitor-alerts-api/engine"
+	"kapacitor-alerts-api/engine/enginetest"
+	structs "kapacitor-alerts-api/structs"
 	"kapacitor-alerts-api/utils"
 	"log"
 	"net/http"
 	"net/http/httptest"
-	"os"
 	"testing"
 
 	"gopkg.in/guregu/null.v3/zero"
@@ -23,6 +26,7 @@ import (
 *    ---------------------------------------------------
 *    POST     /task/5xx             TestCreate5xxTask
 *    PATCH    /task/5xx             TestUpdate5xxTask
+*    POST     /task/5xx/preview     TestPreview5xxTask
 *    DELETE   /task/5xx/:app        TestDelete5xxTask
 *    GET      /tasks/5xx            TestCreate5xxTask
 *    GET      /task/5xx/:app        TestCreate5xxTask
@@ -31,16 +35,25 @@ import (
 
 // setupRouter - Setup Gin routes for current test type
 func setupRouter() *gin.Engine {
-	pool := utils.GetDB(os.Getenv("DATABASE_URL"))
+	cfg, err := config.Load()
+	if err != nil {
+		log.Panicln(err)
+	}
+	pool := utils.GetDB(cfg.Database)
 	if pool == nil {
 		log.Panicln("Unable to connect to database")
 	}
+	if err := engine.Configure(cfg); err != nil {
+		log.Panicln(err)
+	}
 
 	router := gin.Default()
 	router.Use(utils.DBMiddleware(pool))
+	router.Use(config.Middleware(cfg))
 
 	router.POST("/task/5xx", Process5xxRequest)
 	router.PATCH("/task/5xx", Process5xxRequest)
+	router.POST("/task/5xx/preview", Preview5xxTask)
 	router.DELETE("/task/5xx/:app", Delete5xxTask)
 	router.GET("/task/5xx/:app", Get5xxTask)
 	router.GET("/task/5xx/:app/state", Get5xxTaskState)
@@ -123,10 +136,10 @@ func TestGet5xxTaskState(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for GET /task/5xx/:app/state should be 200")
 
-	var taskState _5xxSimpleTaskState
+	var taskState structs.SimpleTaskState
 	err := json.Unmarshal([]byte(w.Body.String()), &taskState)
 
-	assert.Nil(t, err, "Converting from JSON to _5xxSimpleTaskState should not throw an error")
+	assert.Nil(t, err, "Converting from JSON to structs.SimpleTaskState should not throw an error")
 	assert.Equal(t, taskState.App, "gotest-voltron", "Task app name should match")
 	assert.Equal(t, taskState.State, "OK", "Task state should be OK")
 }
@@ -190,3 +203,62 @@ func TestDelete5xxTask(t *testing.T) {
 
 	assert.Equal(t, http.StatusNotFound, w.Code, "HTTP response code for GET /task/5xx/:app on invalid app should be 404")
 }
+
+// TestPreview5xxTask - Make sure that previewing a 5xx task renders it without creating it
+func TestPreview5xxTask(t *testing.T) {
+	router := setupRouter()
+
+	var task _5xxDBTask
+	task.App = "gotest-preview"
+	task.Tolerance = "high"
+	task.Slack = zero.StringFrom("#cobra")
+	taskBytes, err := json.Marshal(task)
+	assert.Nil(t, err, "Converting from _5xxDBTask to JSON should not throw an error")
+
+	req, _ := http.NewRequest("POST", "/task/5xx/preview", bytes.NewBuffer(taskBytes))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for POST /task/5xx/preview should be 200")
+
+	var preview struct {
+		ID         string                 `json:"id"`
+		TemplateID string                 `json:"template-id"`
+		Vars       map[string]structs.Var `json:"vars"`
+		Template   struct {
+			ID     string `json:"id"`
+			Script string `json:"script"`
+		} `json:"template"`
+	}
+	err = json.Unmarshal([]byte(w.Body.String()), &preview)
+	assert.Nil(t, err, "Converting from JSON to preview should not throw an error")
+	assert.Equal(t, "gotest-preview-5xx", preview.ID, "Task ID should match")
+	assert.Equal(t, "5xx.slack", preview.TemplateID, "Task should be created from the template of its shape")
+	assert.Equal(t, "5xx.slack", preview.Template.ID, "Template should be included")
+	assert.Contains(t, preview.Template.Script, ".channel(slack)", "Template should notify the slack channel in the slack var")
+	assert.Contains(t, preview.Vars["influx_query"].Value, "gotest-preview", "Query should be rendered for the app")
+	assert.Equal(t, "high", preview.Vars["tolerance"].Value, "Tolerance should match")
+
+	// Check that the task was not created
+	req, _ = http.NewRequest("GET", "/task/5xx/gotest-preview", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code, "Previewed task should not be saved")
+
+	// Invalid requests are rejected the same way as when creating a task
+	req, _ = http.NewRequest("POST", "/task/5xx/preview", bytes.NewBuffer([]byte(`{"app":"gotest-preview","tolerance":"extreme"}`)))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code, "HTTP response code for an invalid preview should be 400")
+}
+
+// TestHostile5xxInput - Make sure that user input is passed through vars or escaped in the rendered query, or rejected if it cannot be
+func TestHostile5xxInput(t *testing.T) {
+	inputs := append(enginetest.HostileNotify(`"tolerance":"low"`),
+		enginetest.Accepted("dot in app", `{"app":"gotest.hostile","tolerance":"low"}`, [2]string{"influx_query", `"fqdn" =~ /gotest\.hostile/`}, [2]string{"alert_details", `var-url=gotest.hostile&`}),
+		enginetest.Accepted("regex in fqdn", `{"app":"gotest-hostile","tolerance":"low","fqdn":".*"}`, [2]string{"influx_query", `"fqdn" =~ /gotest-hostile/`}),
+	)
+	enginetest.CheckHostileInputs(t, Preview5xxTask, inputs)
+}
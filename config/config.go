@@ -0,0 +1,383 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Config - Settings of the API, loaded at startup from an optional JSON file and the environment
+type Config struct {
+	Port         string    `json:"port"`
+	Database     Database  `json:"database"`
+	Kapacitor    Kapacitor `json:"kapacitor"`
+	InfluxDB     InfluxDB  `json:"influxdb"`
+	TemplateDir  string    `json:"template_dir"`  // Directory to load alert templates from
+	RunMigration bool      `json:"run_migration"` // Reset the database and import every task from Kapacitor
+	Features     Features  `json:"features"`
+}
+
+// Database - Connection to the Postgres database that stores tasks
+type Database struct {
+	URL             string   `json:"url"`
+	MaxIdleConns    int      `json:"max_idle_conns"`
+	MaxOpenConns    int      `json:"max_open_conns"`
+	ConnMaxLifetime Duration `json:"conn_max_lifetime"` // Zero to keep connections open indefinitely
+	Timeout         Duration `json:"timeout"`           // Time allowed for the queries of each request, or zero for no limit
+}
+
+// Kapacitor - The Kapacitor instances that tasks are deployed to
+type Kapacitor struct {
+	URL           string            `json:"url"` // URL of the default instance
+	Username      string            `json:"username"`
+	Password      string            `json:"password"`
+	Timeout       Duration          `json:"timeout"`        // Time allowed for each request to Kapacitor
+	Retries       int               `json:"retries"`        // Times to retry a GET or DELETE that could not reach Kapacitor
+	RetryBackoff  Duration          `json:"retry_backoff"`  // Delay before the first retry, doubled for each retry after it
+	Instances     map[string]string `json:"instances"`      // URLs of the other instances, by name
+	Spaces        map[string]string `json:"spaces"`         // Instances that the tasks of spaces are routed to, by space
+	Standbys      map[string]string `json:"standbys"`       // Instances that standbys replicate, by standby
+	StandbyStatus string            `json:"standby_status"` // Status of the tasks on standbys - disabled or enabled
+}
+
+// Layout - Where the metrics queried by alert types are stored in InfluxDB. Settings that are empty are not changed.
+type Layout struct {
+	Database        string            `json:"database"`
+	RetentionPolicy string            `json:"retention_policy"`
+	Measurements    map[string]string `json:"measurements"` // Measurements queried by alert types, by name
+}
+
+// InfluxDB - The InfluxDB that alerts query
+type InfluxDB struct {
+	URL     string   `json:"url"`     // Used for the crash history, which is not available if empty
+	Timeout Duration `json:"timeout"` // Time allowed for each crash history query
+	Layout
+	Overrides map[string]Layout `json:"overrides"` // Layouts of single alert types, by type (e.g. memory)
+}
+
+// Features - Parts of the API that can be turned on or off
+type Features struct {
+	Admin           bool `json:"admin"`            // Serve the /admin endpoints, which are off unless turned on
+	DeployTemplates bool `json:"deploy_templates"` // Update the Kapacitor templates whenever templates are loaded
+}
+
+// Duration - A time.Duration written as a string (e.g. 30s) in the config file
+type Duration time.Duration
+
+// UnmarshalJSON - Parse a duration string
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return errors.New("durations must be strings (e.g. 30s)")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON - Write a duration string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// DefaultInstance - Name of the Kapacitor instance at the Kapacitor URL
+const DefaultInstance = "default"
+
+var instanceNameRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Default - The settings used when neither the config file nor the environment set them
+func Default() *Config {
+	return &Config{
+		Port:      "8080",
+		Database:  Database{MaxIdleConns: 4, MaxOpenConns: 20, Timeout: Duration(10 * time.Second)},
+		Kapacitor: Kapacitor{Timeout: Duration(30 * time.Second), Retries: 2, RetryBackoff: Duration(200 * time.Millisecond), StandbyStatus: "disabled"},
+		InfluxDB:  InfluxDB{Timeout: Duration(30 * time.Second)},
+	}
+}
+
+// Load - Read the settings from the JSON file at $CONFIG_FILE (if set), then from the environment, which
+// overrides the file, and validate them
+func Load() (*Config, error) {
+	cfg := Default()
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.New("Unable to read config file " + path + ": " + err.Error())
+		}
+		err = json.Unmarshal(buf, cfg)
+		if err != nil {
+			return nil, errors.New("Invalid config file " + path + ": " + err.Error())
+		}
+	}
+
+	err := cfg.readEnv()
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// lookupEnv - The value of an environment variable, if it is set and not empty
+func lookupEnv(name string) (string, bool) {
+	value := os.Getenv(name)
+	return value, value != ""
+}
+
+// readEnv - Override the settings with those set in the environment. Empty variables are ignored.
+func (cfg *Config) readEnv() error {
+	var err error
+	str := func(name string, v *string) {
+		if value, ok := lookupEnv(name); ok {
+			*v = value
+		}
+	}
+	num := func(name string, v *int) {
+		if value, ok := lookupEnv(name); ok && err == nil {
+			*v, err = strconv.Atoi(value)
+			if err != nil {
+				err = errors.New(name + " must be a number")
+			}
+		}
+	}
+	duration := func(name string, v *Duration) {
+		if value, ok := lookupEnv(name); ok && err == nil {
+			var d time.Duration
+			d, err = time.ParseDuration(value)
+			if err != nil {
+				err = errors.New(name + " must be a duration (e.g. 30s)")
+			}
+			*v = Duration(d)
+		}
+	}
+	boolean := func(name string, v *bool) {
+		if value, ok := lookupEnv(name); ok && err == nil {
+			*v, err = strconv.ParseBool(value)
+			if err != nil {
+				err = errors.New(name + " must be true or false")
+			}
+		}
+	}
+	list := func(name string, v *map[string]string) {
+		if value, ok := lookupEnv(name); ok && err == nil {
+			*v, err = parseList(name, value)
+		}
+	}
+
+	str("PORT", &cfg.Port)
+	str("DATABASE_URL", &cfg.Database.URL)
+	num("DATABASE_MAX_IDLE_CONNS", &cfg.Database.MaxIdleConns)
+	num("DATABASE_MAX_OPEN_CONNS", &cfg.Database.MaxOpenConns)
+	duration("DATABASE_CONN_MAX_LIFETIME", &cfg.Database.ConnMaxLifetime)
+	duration("DATABASE_TIMEOUT", &cfg.Database.Timeout)
+
+	str("KAPACITOR_URL", &cfg.Kapacitor.URL)
+	str("KAPACITOR_USERNAME", &cfg.Kapacitor.Username)
+	str("KAPACITOR_PASSWORD", &cfg.Kapacitor.Password)
+	duration("KAPACITOR_TIMEOUT", &cfg.Kapacitor.Timeout)
+	num("KAPACITOR_RETRIES", &cfg.Kapacitor.Retries)
+	duration("KAPACITOR_RETRY_BACKOFF", &cfg.Kapacitor.RetryBackoff)
+	list("KAPACITOR_INSTANCES", &cfg.Kapacitor.Instances)
+	list("KAPACITOR_SPACES", &cfg.Kapacitor.Spaces)
+	list("KAPACITOR_STANDBYS", &cfg.Kapacitor.Standbys)
+	str("KAPACITOR_STANDBY_STATUS", &cfg.Kapacitor.StandbyStatus)
+
+	str("INFLUXDB_URL", &cfg.InfluxDB.URL)
+	duration("INFLUXDB_TIMEOUT", &cfg.InfluxDB.Timeout)
+	str("INFLUXDB_DATABASE", &cfg.InfluxDB.Database)
+	str("INFLUXDB_RETENTION_POLICY", &cfg.InfluxDB.RetentionPolicy)
+	list("INFLUXDB_MEASUREMENTS", &cfg.InfluxDB.Measurements)
+	if err == nil {
+		err = cfg.InfluxDB.readOverrides()
+	}
+
+	str("TEMPLATE_DIR", &cfg.TemplateDir)
+	if _, ok := os.LookupEnv("RUN_MIGRATION"); ok {
+		cfg.RunMigration = true
+	}
+	boolean("FEATURE_ADMIN", &cfg.Features.Admin)
+	boolean("FEATURE_DEPLOY_TEMPLATES", &cfg.Features.DeployTemplates)
+	return err
+}
+
+// readOverrides - Read the layouts of single alert types from the variables named after them
+// (e.g. $INFLUXDB_DATABASE_MEMORY)
+func (i *InfluxDB) readOverrides() error {
+	overrides := make(map[string]Layout)
+	for name, layout := range i.Overrides {
+		overrides[OverrideName(name)] = layout
+	}
+	i.Overrides = overrides
+
+	settings := []string{"INFLUXDB_DATABASE_", "INFLUXDB_RETENTION_POLICY_", "INFLUXDB_MEASUREMENTS_"}
+	for _, env := range os.Environ() {
+		pair := strings.SplitN(env, "=", 2)
+		for _, setting := range settings {
+			if !strings.HasPrefix(pair[0], setting) || len(pair[0]) == len(setting) {
+				continue
+			}
+			name := OverrideName(pair[0][len(setting):])
+			layout := i.Overrides[name]
+			switch setting {
+			case "INFLUXDB_DATABASE_":
+				layout.Database = pair[1]
+			case "INFLUXDB_RETENTION_POLICY_":
+				layout.RetentionPolicy = pair[1]
+			default:
+				measurements, err := parseList(pair[0], pair[1])
+				if err != nil {
+					return err
+				}
+				layout.Measurements = measurements
+			}
+			i.Overrides[name] = layout
+		}
+	}
+	return nil
+}
+
+// OverrideName - Name of the InfluxDB layout overrides of an alert type - its name in lower case, with '-' as '_'
+func OverrideName(name string) string {
+	return strings.ToLower(strings.Replace(name, "-", "_", -1))
+}
+
+// parseList - Split a comma separated list of name=value pairs
+func parseList(env string, list string) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		pair := strings.SplitN(item, "=", 2)
+		if len(pair) != 2 || strings.TrimSpace(pair[0]) == "" || strings.TrimSpace(pair[1]) == "" {
+			return nil, errors.New("Invalid " + env + " entry " + item + " - entries must be name=value")
+		}
+		name := strings.TrimSpace(pair[0])
+		if _, ok := values[name]; ok {
+			return nil, errors.New(env + " lists " + name + " more than once")
+		}
+		values[name] = strings.TrimSpace(pair[1])
+	}
+	return values, nil
+}
+
+// checkURL - Make sure that a setting is an absolute URL
+func checkURL(name string, value string) error {
+	if u, err := url.Parse(value); err != nil || u.Scheme == "" || u.Host == "" {
+		return errors.New("Invalid URL " + value + " for " + name)
+	}
+	return nil
+}
+
+// Validate - Make sure that the settings can be used
+func (cfg *Config) Validate() error {
+	if port, err := strconv.Atoi(cfg.Port); err != nil || port < 1 || port > 65535 {
+		return errors.New("Port must be a number between 1 and 65535")
+	}
+
+	db := cfg.Database
+	if db.URL == "" {
+		return errors.New("Database URL (DATABASE_URL) is required")
+	}
+	if db.MaxOpenConns < 1 || db.MaxIdleConns < 0 || db.MaxIdleConns > db.MaxOpenConns {
+		return errors.New("Database connections must allow at least one open connection, and no more idle connections than open")
+	}
+	if db.ConnMaxLifetime < 0 {
+		return errors.New("Database connection lifetime cannot be negative")
+	}
+	if db.Timeout < 0 {
+		return errors.New("Database timeout cannot be negative")
+	}
+
+	k := cfg.Kapacitor
+	if k.URL == "" {
+		return errors.New("Kapacitor URL (KAPACITOR_URL) is required")
+	}
+	if err := checkURL("Kapacitor instance "+DefaultInstance, k.URL); err != nil {
+		return err
+	}
+	if k.Timeout <= 0 {
+		return errors.New("Kapacitor timeout must be positive")
+	}
+	if k.Retries < 0 || k.RetryBackoff < 0 {
+		return errors.New("Kapacitor retries and retry backoff cannot be negative")
+	}
+	for _, name := range sortedKeys(k.Instances) {
+		if name == DefaultInstance {
+			return errors.New("Kapacitor instances cannot define " + DefaultInstance + " - it is the instance at the Kapacitor URL")
+		}
+		if !instanceNameRegex.MatchString(name) {
+			return errors.New("Invalid Kapacitor instance name " + name + " - names may only contain letters, numbers, '-', and '_'")
+		}
+		if err := checkURL("Kapacitor instance "+name, k.Instances[name]); err != nil {
+			return err
+		}
+	}
+	if k.StandbyStatus != "disabled" && k.StandbyStatus != "enabled" {
+		return errors.New("Kapacitor standby status must be disabled or enabled")
+	}
+
+	if cfg.InfluxDB.URL != "" {
+		if err := checkURL("InfluxDB", cfg.InfluxDB.URL); err != nil {
+			return err
+		}
+	}
+	if cfg.InfluxDB.Timeout <= 0 {
+		return errors.New("InfluxDB timeout must be positive")
+	}
+	layouts := map[string]Layout{"every alert type": cfg.InfluxDB.Layout}
+	for name, layout := range cfg.InfluxDB.Overrides {
+		layouts[name] = layout
+	}
+	for name, layout := range layouts {
+		for measurement, value := range layout.Measurements {
+			if strings.TrimSpace(value) == "" {
+				return errors.New("InfluxDB measurement " + measurement + " of " + name + " cannot be empty")
+			}
+		}
+	}
+	return nil
+}
+
+// sortedKeys - The keys of a map in order
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Middleware - Add the settings to the Gin context
+func Middleware(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("config", cfg)
+		c.Next()
+	}
+}
+
+// FromContext - Get the settings from the Gin context
+func FromContext(c *gin.Context) (*Config, error) {
+	cfg, exists := c.Get("config")
+	if !exists {
+		return nil, errors.New("Config not available in context")
+	}
+	return cfg.(*Config), nil
+}
@@ -0,0 +1,153 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setEnv - Set environment variables, returning a function that restores their previous values
+func setEnv(env map[string]string) func() {
+	previous := make(map[string]*string)
+	for name, value := range env {
+		if old, ok := os.LookupEnv(name); ok {
+			previous[name] = &old
+		} else {
+			previous[name] = nil
+		}
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name, old := range previous {
+			if old == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *old)
+			}
+		}
+	}
+}
+
+// TestLoad - Make sure that settings are read from the environment on top of the defaults
+func TestLoad(t *testing.T) {
+	defer setEnv(map[string]string{
+		"CONFIG_FILE":                 "",
+		"PORT":                        "9000",
+		"DATABASE_URL":                "postgres://localhost/alerts",
+		"DATABASE_MAX_OPEN_CONNS":     "10",
+		"KAPACITOR_URL":               "http://kapacitor:9092",
+		"KAPACITOR_TIMEOUT":           "5s",
+		"KAPACITOR_RETRIES":           "0",
+		"DATABASE_TIMEOUT":            "2s",
+		"KAPACITOR_INSTANCES":         "eu=http://kapacitor-eu:9092, us=http://kapacitor-us:9092",
+		"KAPACITOR_STANDBY_STATUS":    "",
+		"INFLUXDB_TIMEOUT":            "1m",
+		"INFLUXDB_MEASUREMENTS":       "events=app.events",
+		"INFLUXDB_DATABASE_WEB_CHECK": "checks",
+		"FEATURE_ADMIN":               "true",
+	})()
+
+	cfg, err := Load()
+	assert.Nil(t, err, "Loading the settings should not throw an error")
+	assert.Equal(t, "9000", cfg.Port, "Port should be read from the environment")
+	assert.Equal(t, Database{URL: "postgres://localhost/alerts", MaxIdleConns: 4, MaxOpenConns: 10, Timeout: Duration(2 * time.Second)}, cfg.Database, "Database settings should be read over the defaults")
+	assert.Equal(t, Duration(5*time.Second), cfg.Kapacitor.Timeout, "Kapacitor timeout should be read from the environment")
+	assert.Equal(t, 0, cfg.Kapacitor.Retries, "Kapacitor retries should be read from the environment")
+	assert.Equal(t, Duration(200*time.Millisecond), cfg.Kapacitor.RetryBackoff, "Kapacitor retry backoff should keep its default")
+	assert.Equal(t, map[string]string{"eu": "http://kapacitor-eu:9092", "us": "http://kapacitor-us:9092"}, cfg.Kapacitor.Instances, "Kapacitor instances should be read from the environment")
+	assert.Equal(t, "disabled", cfg.Kapacitor.StandbyStatus, "Empty settings should keep their default")
+	assert.Equal(t, Duration(time.Minute), cfg.InfluxDB.Timeout, "InfluxDB timeout should be read from the environment")
+	assert.Equal(t, map[string]string{"events": "app.events"}, cfg.InfluxDB.Measurements, "Measurements should be read from the environment")
+	assert.Equal(t, "checks", cfg.InfluxDB.Overrides["web_check"].Database, "Overrides should be read from the variables named after the alert type")
+	assert.Equal(t, Features{Admin: true}, cfg.Features, "Features should be read from the environment")
+
+	os.Setenv("DATABASE_MAX_OPEN_CONNS", "many")
+	_, err = Load()
+	assert.NotNil(t, err, "Invalid number should throw an error")
+}
+
+// TestLoadFile - Make sure that settings are read from the config file, and the environment overrides it
+func TestLoadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{
+		"port": "9000",
+		"database": {"url": "postgres://file/alerts", "conn_max_lifetime": "1h"},
+		"kapacitor": {"url": "http://kapacitor:9092", "spaces": {"prod-eu": "eu"}, "instances": {"eu": "http://kapacitor-eu:9092"}},
+		"influxdb": {"url": "http://influx:8086", "overrides": {"Web-Check": {"retention_policy": "short"}}}
+	}`), 0644))
+	defer setEnv(map[string]string{"CONFIG_FILE": path, "PORT": "", "DATABASE_URL": "postgres://env/alerts", "KAPACITOR_URL": "", "KAPACITOR_SPACES": ""})()
+
+	cfg, err := Load()
+	assert.Nil(t, err, "Loading the config file should not throw an error")
+	assert.Equal(t, "9000", cfg.Port, "Port should be read from the file")
+	assert.Equal(t, "postgres://env/alerts", cfg.Database.URL, "Environment should override the file")
+	assert.Equal(t, Duration(time.Hour), cfg.Database.ConnMaxLifetime, "Durations should be read from the file")
+	assert.Equal(t, 20, cfg.Database.MaxOpenConns, "Settings missing from the file should keep their default")
+	assert.Equal(t, map[string]string{"prod-eu": "eu"}, cfg.Kapacitor.Spaces, "Spaces should be read from the file")
+	assert.Equal(t, "short", cfg.InfluxDB.Overrides["web_check"].RetentionPolicy, "Overrides in the file should be named like their variables")
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{"kapacitor": {"timeout": 30}}`), 0644))
+	_, err = Load()
+	assert.NotNil(t, err, "Invalid config file should throw an error")
+	os.Setenv("CONFIG_FILE", filepath.Join(dir, "missing.json"))
+	_, err = Load()
+	assert.NotNil(t, err, "Missing config file should throw an error")
+}
+
+// TestValidate - Make sure that settings that cannot be used are rejected
+func TestValidate(t *testing.T) {
+	valid := func() *Config {
+		cfg := Default()
+		cfg.Database.URL = "postgres://localhost/alerts"
+		cfg.Kapacitor.URL = "http://kapacitor:9092"
+		return cfg
+	}
+	assert.Nil(t, valid().Validate(), "Valid settings should not throw an error")
+	assert.False(t, valid().Features.Admin, "Admin endpoints should be off unless turned on")
+	assert.False(t, valid().Features.DeployTemplates, "Changed templates should only reach tasks through a canary unless turned on")
+
+	invalid := map[string]func(cfg *Config){
+		"port":              func(cfg *Config) { cfg.Port = "http" },
+		"database url":      func(cfg *Config) { cfg.Database.URL = "" },
+		"connection pool":   func(cfg *Config) { cfg.Database.MaxIdleConns = 30 },
+		"kapacitor url":     func(cfg *Config) { cfg.Kapacitor.URL = "kapacitor:9092" },
+		"kapacitor timeout": func(cfg *Config) { cfg.Kapacitor.Timeout = 0 },
+		"kapacitor retries": func(cfg *Config) { cfg.Kapacitor.Retries = -1 },
+		"retry backoff":     func(cfg *Config) { cfg.Kapacitor.RetryBackoff = -1 },
+		"database timeout":  func(cfg *Config) { cfg.Database.Timeout = -1 },
+		"default instance":  func(cfg *Config) { cfg.Kapacitor.Instances = map[string]string{"default": "http://kapacitor:9092"} },
+		"instance name":     func(cfg *Config) { cfg.Kapacitor.Instances = map[string]string{"e u": "http://kapacitor-eu:9092"} },
+		"instance url":      func(cfg *Config) { cfg.Kapacitor.Instances = map[string]string{"eu": "kapacitor-eu"} },
+		"standby status":    func(cfg *Config) { cfg.Kapacitor.StandbyStatus = "paused" },
+		"influxdb url":      func(cfg *Config) { cfg.InfluxDB.URL = "influx" },
+		"influxdb timeout":  func(cfg *Config) { cfg.InfluxDB.Timeout = 0 },
+		"measurement":       func(cfg *Config) { cfg.InfluxDB.Measurements = map[string]string{"memory": ""} },
+		"override measurement": func(cfg *Config) {
+			cfg.InfluxDB.Overrides = map[string]Layout{"memory": {Measurements: map[string]string{"memory": " "}}}
+		},
+	}
+	for name, change := range invalid {
+		cfg := valid()
+		change(cfg)
+		assert.NotNil(t, cfg.Validate(), "Invalid "+name+" should throw an error")
+	}
+}
+
+// TestParseList - Make sure that lists of name=value pairs are parsed, and malformed ones rejected
+func TestParseList(t *testing.T) {
+	values, err := parseList("LIST", " eu=http://kapacitor-eu:9092/ ,, us = http://kapacitor-us:9092")
+	assert.Nil(t, err, "Valid list should not throw an error")
+	assert.Equal(t, map[string]string{"eu": "http://kapacitor-eu:9092/", "us": "http://kapacitor-us:9092"}, values, "Entries should be trimmed")
+
+	for _, list := range []string{"eu", "=http://kapacitor-eu:9092", "eu=", "eu=a,eu=b"} {
+		_, err = parseList("LIST", list)
+		assert.NotNil(t, err, "Invalid list "+list+" should throw an error")
+	}
+}
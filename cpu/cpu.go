@@ -0,0 +1,178 @@
+package cpu
+
+import (
+	"kapacitor-alerts-api/engine"
+	structs "kapacitor-alerts-api/structs"
+	utils "kapacitor-alerts-api/utils"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+)
+
+const cpualerttemplate = `
+[[define "influx_query"]]
+select mean(value) as value from [[ dbrp ]]."[[ .Metric | influxident ]]" where "app"='[[ .App | influxstr ]]' and "dyno" [[ .DynoFilter ]]
+[[end]]
+[[define "alert_message"]]
+CPU usage is {{ .Level }} for {{ .Group }} : {{ index .Fields "rvalue" }}% - limits [[ .Warn ]]%/[[ .Crit ]]%
+[[end]]
+[[define "alert_details"]]
+<h3>{{ .Message }}</h3>
+<h3>Value: {{ index .Fields "rvalue" }}%</h3>
+[[end]]
+var influx_query string
+var crit float
+var warn float
+var window duration
+var every duration
+var alert_message string
+var alert_details string
+[[if .Slack ]]
+var slack string
+[[end]]
+[[if .Post ]]
+var post string
+[[end]]
+[[range .Emails ]]
+var [[ . ]] string
+[[end]]
+
+	batch
+    |	query(influx_query)
+        .period(window)
+        .every(every)
+        .groupBy('app','dyno')
+    |	eval(lambda: ceil("value")).as('rvalue').keep('value','rvalue')
+    |	alert()
+        .crit(lambda: "value" > crit)
+        .warn(lambda: "value" > warn)
+        .stateChangesOnly()
+        [[if .Slack ]]
+        	.slack()
+        	.channel(slack)
+        [[end]]
+        .message(alert_message)
+        .details(alert_details)
+        [[range .Emails ]]
+        	.email([[ . ]])
+        [[end]]
+        [[if .Post ]]
+        	.post(post)
+        [[end]]
+`
+
+// metric - Name of the metric in task IDs, which stays the same if the measurement queried is configured
+const metric = "sample.cpu_usage"
+
+// taskID - Kapacitor task ID of the cpu task of an app and dynotype
+func taskID(keys []string) string {
+	return keys[0] + "-" + metric + "-" + keys[1]
+}
+
+var descriptor = engine.Register(&engine.Descriptor{
+	Name:     "cpu",
+	Table:    "cpu_tasks",
+	Params:   []string{"app", "dyno"},
+	Columns:  []string{"app", "dynotype"},
+	Template: cpualerttemplate,
+	ID:       taskID,
+	Pattern:  regexp.MustCompile(`-sample\.cpu_usage-[-\w]+$`),
+	NewSpec:  func() engine.Spec { return &CPUTaskSpec{} },
+	FromVars: func(vars map[string]structs.Var) engine.Spec {
+		return &CPUTaskSpec{
+			App:      engine.StringVar(vars, "app"),
+			Dynotype: engine.StringVar(vars, "dynotyperequest"),
+			Crit:     engine.StringVar(vars, "crit"),
+			Warn:     engine.StringVar(vars, "warn"),
+			Window:   engine.DurationVar(vars, "window"),
+			Every:    engine.DurationVar(vars, "every"),
+		}
+	},
+	Model: CPUDBTask{},
+})
+
+// checkSettings - Make sure that the thresholds and intervals can be rendered into the TICKscript
+func checkSettings(crit string, warn string, window string, every string) error {
+	if err := engine.CheckNumber("Crit", crit, "percent"); err != nil {
+		return err
+	}
+	if err := engine.CheckNumber("Warn", warn, "percent"); err != nil {
+		return err
+	}
+	if err := engine.CheckDuration("Window", window); err != nil {
+		return err
+	}
+	return engine.CheckDuration("Every", every)
+}
+
+// Prepare - Choose the dynos to watch and validate the thresholds and intervals
+func (task *CPUTaskSpec) Prepare() error {
+	task.Metric = descriptor.Influx().Measurements["cpu"]
+
+	if task.Dynotype == "all" {
+		task.DynoFilter = " =~ /.*/ "
+	} else if task.Dynotype == "web" {
+		task.DynoFilter = " !~ /--/ "
+	} else {
+		task.DynoFilter = " =~ /" + engine.InfluxRegex(task.Dynotype) + "/ "
+	}
+
+	return checkSettings(task.Crit, task.Warn, task.Window, task.Every)
+}
+
+// Keys - App and dynotype
+func (task *CPUTaskSpec) Keys() []string {
+	return []string{task.App, task.Dynotype}
+}
+
+// TaskVars - Variables saved with the task in Kapacitor
+func (task *CPUTaskSpec) TaskVars() map[string]structs.Var {
+	vars := make(map[string]structs.Var)
+	vars = utils.AddVar("metric", task.Metric, "string", vars)
+	vars = utils.AddVar("dynotyperequest", task.Dynotype, "string", vars)
+	vars = utils.AddVar("dynotype", task.DynoFilter, "string", vars)
+	vars = utils.AddVar("app", task.App, "string", vars)
+	vars = utils.AddVar("crit", task.Crit, "float", vars)
+	vars = utils.AddVar("warn", task.Warn, "float", vars)
+	vars = utils.AddVar("window", task.Window, "duration", vars)
+	vars = utils.AddVar("every", task.Every, "duration", vars)
+	return vars
+}
+
+// Row - Values saved to cpu_tasks
+func (task *CPUTaskSpec) Row() []interface{} {
+	return []interface{}{
+		taskID(task.Keys()), task.App, task.Dynotype, task.Crit, task.Warn,
+		task.Window, task.Every, task.Slack, task.Post, task.Email,
+	}
+}
+
+// ProcessInstanceCPURequest - POST | PATCH /task/cpu
+func ProcessInstanceCPURequest(c *gin.Context) {
+	engine.ProcessRequest(descriptor, c)
+}
+
+// PreviewCPUTask - POST /task/cpu/preview
+func PreviewCPUTask(c *gin.Context) {
+	engine.PreviewTask(descriptor, c)
+}
+
+// DeleteCPUTask - DELETE /task/cpu/:app/:dyno
+func DeleteCPUTask(c *gin.Context) {
+	engine.DeleteTask(descriptor, c)
+}
+
+// GetCPUTask - GET /tasks/cpu/:app/:dyno
+func GetCPUTask(c *gin.Context) {
+	engine.GetTask(descriptor, c)
+}
+
+// GetCPUTasksForApp - GET /tasks/cpu/:app
+func GetCPUTasksForApp(c *gin.Context) {
+	engine.ListTasks(descriptor, c)
+}
+
+// ListCPUTasks - GET /tasks/cpu
+func ListCPUTasks(c *gin.Context) {
+	engine.ListTasks(descriptor, c)
+}
@@ -0,0 +1,314 @@
+package cpu
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"kapacitor-alerts-api/config"
+	"kapacitor-alerts-api/engine"
+	"kapacitor-alerts-api/engine/enginetest"
+	"kapacitor-alerts-api/utils"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gopkg.in/guregu/null.v3/zero"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+/********************************************************
+*    Endpoints tested:
+*
+*    Method   Endpoint                    Function
+*    ---------------------------------------------------
+*    POST     /task/cpu                TestCreateCPUTask
+*    PATCH    /task/cpu                TestUpdateCPUTask
+*    POST     /task/cpu/preview        TestHostileCPUInput
+*    DELETE   /task/cpu/:app/:dyno     TestDeleteCPUTask
+*    GET      /tasks/cpu               TestCreateCPUTask
+*    GET      /tasks/cpu/:app          TestCreateCPUTask
+*    GET      /tasks/cpu/:app/:dyno    TestCreateCPUTask
+ */
+
+// setupRouter - Setup Gin routes for current test type
+func setupRouter() *gin.Engine {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Panicln(err)
+	}
+	pool := utils.GetDB(cfg.Database)
+	if pool == nil {
+		log.Panicln("Unable to connect to database")
+	}
+	if err := engine.Configure(cfg); err != nil {
+		log.Panicln(err)
+	}
+
+	router := gin.Default()
+	router.Use(utils.DBMiddleware(pool))
+	router.Use(config.Middleware(cfg))
+
+	router.POST("/task/cpu", ProcessInstanceCPURequest)
+	router.PATCH("/task/cpu", ProcessInstanceCPURequest)
+	router.POST("/task/cpu/preview", PreviewCPUTask)
+	router.DELETE("/task/cpu/:app/:dyno", DeleteCPUTask)
+	router.GET("/tasks/cpu/:app", GetCPUTasksForApp)
+	router.GET("/tasks/cpu/:app/:dyno", GetCPUTask)
+	router.GET("/tasks/cpu", ListCPUTasks)
+
+	return router
+}
+
+// TestCreateCPUTask - Make sure that creating a CPU task works and we can successfully get info about the created task
+func TestCreateCPUTask(t *testing.T) {
+	router := setupRouter()
+
+	// Create two new tasks (testing multiple dyno types)
+	var task1 CPUDBTask
+	task1.ID = ""
+	task1.App = "gotest-voltron"
+	task1.Dynotype = "web"
+	task1.Crit = "90"
+	task1.Warn = "75"
+	task1.Wind = "12h"
+	task1.Every = "1m"
+	task1.Slack = zero.StringFrom("#cobra")
+
+	var task2 CPUDBTask
+	task2.ID = ""
+	task2.App = "gotest-voltron"
+	task2.Dynotype = "worker"
+	task2.Crit = "80"
+	task2.Warn = "60"
+	task2.Wind = "6h"
+	task2.Every = "30s"
+	task2.Slack = zero.StringFrom("#cobra")
+
+	task1Bytes, err := json.Marshal(task1)
+	assert.Nil(t, err, "Converting from CPUDBTask to JSON should not throw an error")
+
+	task2Bytes, err := json.Marshal(task2)
+	assert.Nil(t, err, "Converting from CPUDBTask to JSON should not throw an error")
+
+	req, _ := http.NewRequest("POST", "/task/cpu", bytes.NewBuffer(task1Bytes))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusCreated, w.Code, "HTTP response code for POST /task/cpu should be 201")
+
+	req, _ = http.NewRequest("POST", "/task/cpu", bytes.NewBuffer(task2Bytes))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusCreated, w.Code, "HTTP response code for POST /task/cpu should be 201")
+
+	// Check that both tasks exist, contain expected data
+	req, _ = http.NewRequest("GET", "/tasks/cpu/gotest-voltron", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for GET /tasks/cpu/:app should be 200")
+
+	var returnedTasks []CPUDBTask
+	err = json.Unmarshal([]byte(w.Body.String()), &returnedTasks)
+	assert.Nil(t, err, "Converting from JSON to CPUDBTask should not throw an error")
+
+	// Check each task for valid data
+	for _, returnedTask := range returnedTasks {
+		var compareTask CPUDBTask
+		if returnedTask.Dynotype == "web" {
+			compareTask = task1
+			task1.ID = returnedTask.ID
+		} else if returnedTask.Dynotype == "worker" {
+			compareTask = task2
+			task2.ID = returnedTask.ID
+		} else {
+			assert.Error(t, errors.New("Invalid dynotype"), "Task list should not contain a dynotype other than web or worker")
+		}
+
+		assert.Equal(t, returnedTask.App, compareTask.App, "Task app name should match")
+		assert.Equal(t, returnedTask.Dynotype, compareTask.Dynotype, "Task dynotype should match")
+		assert.Equal(t, returnedTask.Crit, compareTask.Crit, "Task crit should match")
+		assert.Equal(t, returnedTask.Warn, compareTask.Warn, "Task warn should match")
+		assert.Equal(t, returnedTask.Wind, compareTask.Wind, "Task window should match")
+		assert.Equal(t, returnedTask.Every, compareTask.Every, "Task every should match")
+		assert.Equal(t, returnedTask.Slack, compareTask.Slack, "Task slack should match")
+		assert.Equal(t, returnedTask.Email, compareTask.Email, "Task email should match")
+		assert.Equal(t, returnedTask.Post, compareTask.Post, "Task post should match")
+	}
+
+	// Check individual task endpoints
+	for _, returnedTask := range returnedTasks {
+		req, _ = http.NewRequest("GET", "/tasks/cpu/gotest-voltron/"+returnedTask.Dynotype, nil)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for GET /tasks/cpu/:app/:id should be 200")
+
+		var verifyTask CPUDBTask
+		err = json.Unmarshal([]byte(w.Body.String()), &verifyTask)
+		assert.Nil(t, err, "Converting from JSON to CPUDBTask should not throw an error")
+
+		assert.Equal(t, returnedTask.App, verifyTask.App, "Task app name should match")
+		assert.Equal(t, returnedTask.Dynotype, verifyTask.Dynotype, "Task dynotype should match")
+		assert.Equal(t, returnedTask.Crit, verifyTask.Crit, "Task crit should match")
+		assert.Equal(t, returnedTask.Warn, verifyTask.Warn, "Task warn should match")
+		assert.Equal(t, returnedTask.Wind, verifyTask.Wind, "Task window should match")
+		assert.Equal(t, returnedTask.Every, verifyTask.Every, "Task every should match")
+		assert.Equal(t, returnedTask.Slack, verifyTask.Slack, "Task slack should match")
+		assert.Equal(t, returnedTask.Email, verifyTask.Email, "Task email should match")
+		assert.Equal(t, returnedTask.Post, verifyTask.Post, "Task post should match")
+	}
+
+	// Check that the new tasks exist in the list of all tasks
+	req, _ = http.NewRequest("GET", "/tasks/cpu", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for GET /tasks/cpu should be 200")
+
+	var returnedTasks2 []CPUDBTask
+	err = json.Unmarshal([]byte(w.Body.String()), &returnedTasks2)
+
+	assert.Nil(t, err, "Converting from JSON to []CPUDBTask should not throw an error")
+
+	found := []bool{false, false}
+
+	for _, returnedTask := range returnedTasks2 {
+		var verifyTask CPUDBTask
+		if returnedTask.ID == task1.ID {
+			verifyTask = task1
+			found[0] = true
+		} else if returnedTask.ID == task2.ID {
+			verifyTask = task2
+			found[1] = true
+		} else {
+			continue
+		}
+
+		assert.Equal(t, returnedTask.App, verifyTask.App, "Task app name should match")
+		assert.Equal(t, returnedTask.Dynotype, verifyTask.Dynotype, "Task dynotype should match")
+		assert.Equal(t, returnedTask.Crit, verifyTask.Crit, "Task crit should match")
+		assert.Equal(t, returnedTask.Warn, verifyTask.Warn, "Task warn should match")
+		assert.Equal(t, returnedTask.Wind, verifyTask.Wind, "Task window should match")
+		assert.Equal(t, returnedTask.Every, verifyTask.Every, "Task every should match")
+		assert.Equal(t, returnedTask.Slack, verifyTask.Slack, "Task slack should match")
+		assert.Equal(t, returnedTask.Email, verifyTask.Email, "Task email should match")
+		assert.Equal(t, returnedTask.Post, verifyTask.Post, "Task post should match")
+	}
+
+	assert.True(t, found[0], "Task 1 should exist in list of all tasks")
+	assert.True(t, found[1], "Task 2 should exist in list of all tasks")
+}
+
+// TestUpdateCPUTask - Make sure that updating a CPU task's config works
+func TestUpdateCPUTask(t *testing.T) {
+	router := setupRouter()
+
+	// Create a task with updated information
+	// Crit - 90 => 95
+	// Warn - 75 => 85
+	// Wind - 12h => 1d
+	// Every - 1m => 2m
+	// Slack - #cobra => nil
+	// Post - nil => http://example.com/
+	var task CPUDBTask
+	task.ID = ""
+	task.App = "gotest-voltron"
+	task.Dynotype = "web"
+	task.Crit = "95"
+	task.Warn = "85"
+	task.Wind = "1d"
+	task.Every = "2m"
+	task.Post = zero.StringFrom("http://example.com")
+
+	taskBytes, err := json.Marshal(task)
+	assert.Nil(t, err, "Converting from CPUDBTask to JSON should not throw an error")
+
+	req, _ := http.NewRequest("PATCH", "/task/cpu", bytes.NewBuffer(taskBytes))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusCreated, w.Code, "HTTP response code for PATCH /task/cpu should be 201")
+
+	// Check that the new task exists and contains expected data
+	req, _ = http.NewRequest("GET", "/tasks/cpu/gotest-voltron/web", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for GET /tasks/cpu/:app/dyno should be 200")
+
+	var returnedTask CPUDBTask
+	err = json.Unmarshal([]byte(w.Body.String()), &returnedTask)
+	assert.Nil(t, err, "JSON error")
+
+	// API sets nil slack channels to #
+	task.Slack = zero.StringFrom("#")
+
+	assert.Equal(t, returnedTask.App, task.App, "Task app name should match")
+	assert.Equal(t, returnedTask.Dynotype, task.Dynotype, "Task dynotype should match")
+	assert.Equal(t, returnedTask.Crit, task.Crit, "Task crit should match")
+	assert.Equal(t, returnedTask.Warn, task.Warn, "Task warn should match")
+	assert.Equal(t, returnedTask.Wind, task.Wind, "Task window should match")
+	assert.Equal(t, returnedTask.Every, task.Every, "Task every should match")
+	assert.Equal(t, returnedTask.Slack, task.Slack, "Task slack should match")
+	assert.Equal(t, returnedTask.Email, task.Email, "Task email should match")
+	assert.Equal(t, returnedTask.Post, task.Post, "Task post should match")
+}
+
+// TestDeleteCPUTask - Make sure that deleting a CPU task works and that we cannot access it anymore
+func TestDeleteCPUTask(t *testing.T) {
+	router := setupRouter()
+
+	// Delete the tasks that were created in TestCreateCPUTask
+	req, _ := http.NewRequest("DELETE", "/task/cpu/gotest-voltron/web", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for DELETE /task/cpu/:app/:dyno should be 200")
+
+	req, _ = http.NewRequest("DELETE", "/task/cpu/gotest-voltron/worker", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for DELETE /task/cpu/:app/:dyno should be 200")
+
+	// Check that the deleted tasks don't exist anymore
+	req, _ = http.NewRequest("GET", "/tasks/cpu/gotest-voltron/web", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code, "HTTP response code for GET /task/cpu/:app/:dyno on invalid app should be 404")
+
+	req, _ = http.NewRequest("GET", "/tasks/cpu/gotest-voltron/worker", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code, "HTTP response code for GET /task/cpu/:app/:dyno on invalid app should be 404")
+
+	req, _ = http.NewRequest("GET", "/tasks/cpu/gotest-voltron", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var response map[string]string
+	err := json.Unmarshal([]byte(w.Body.String()), &response)
+	assert.Nil(t, err, "Converting from JSON to map[string]string should not throw an error")
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response for GET /tasks/cpu/:app should be 200")
+	assert.Equal(t, len(response), 0, "Result for GET /tasks/cpu/:app should be empty when no tasks are present")
+}
+
+// TestHostileCPUInput - Make sure that user input is passed through vars or escaped in the rendered query, or rejected if it cannot be
+func TestHostileCPUInput(t *testing.T) {
+	inputs := append(enginetest.HostileNotify(`"dynotype":"worker","crit":"90","warn":"80","window":"5m","every":"1m"`),
+		enginetest.Accepted("dot in app", `{"app":"gotest.hostile","dynotype":"worker","crit":"90","warn":"80","window":"5m","every":"1m"}`, [2]string{"influx_query", `"app"='gotest.hostile'`}),
+		enginetest.Rejected("regex in dynotype", `{"app":"gotest-hostile","dynotype":"web|worker","crit":"90","warn":"80","window":"5m","every":"1m"}`),
+		enginetest.Rejected("wildcard dynotype", `{"app":"gotest-hostile","dynotype":".*","crit":"90","warn":"80","window":"5m","every":"1m"}`),
+		enginetest.Accepted("dot in dynotype", `{"app":"gotest-hostile","dynotype":"w.b","crit":"90","warn":"80","window":"5m","every":"1m"}`, [2]string{"influx_query", `"dyno"  =~ /w\.b/`}),
+		enginetest.Rejected("expression in crit", `{"app":"gotest-hostile","dynotype":"worker","crit":"1 OR true","warn":"80","window":"5m","every":"1m"}`),
+		enginetest.Rejected("expression in window", `{"app":"gotest-hostile","dynotype":"worker","crit":"90","warn":"80","window":"10m) |log(","every":"1m"}`),
+	)
+	enginetest.CheckHostileInputs(t, PreviewCPUTask, inputs)
+}
@@ -0,0 +1,34 @@
+package cpu
+
+import (
+	"kapacitor-alerts-api/engine"
+
+	"gopkg.in/guregu/null.v3/zero"
+)
+
+// CPUTaskSpec - Used to create or update a CPU task
+type CPUTaskSpec struct {
+	App        string `json:"app"`
+	Dynotype   string `json:"dynotype"`
+	Crit       string `json:"crit"`
+	Warn       string `json:"warn"`
+	Window     string `json:"window"`
+	Every      string `json:"every"`
+	Metric     string `json:"-"`
+	DynoFilter string `json:"-"`
+	engine.Notify
+}
+
+// CPUDBTask - Used for retrieval of task information from the database
+type CPUDBTask struct {
+	ID       string      `json:"id"`
+	App      string      `json:"app"`
+	Dynotype string      `json:"dynotype"`
+	Crit     string      `json:"crit"`
+	Warn     string      `json:"warn"`
+	Wind     string      `json:"window"`
+	Every    string      `json:"every"`
+	Slack    zero.String `json:"slack"`
+	Post     zero.String `json:"post"`
+	Email    zero.String `json:"email"`
+}
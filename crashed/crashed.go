@@ -1,264 +1,241 @@
 package crashed
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
+	"kapacitor-alerts-api/config"
+	"kapacitor-alerts-api/engine"
 	structs "kapacitor-alerts-api/structs"
 	"kapacitor-alerts-api/utils"
+	"log"
 	"net/http"
-	"os"
-	"strings"
+	"net/url"
+	"regexp"
+	"strconv"
 	"text/template"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"gopkg.in/guregu/null.v3/zero"
 )
 
 const crashalerttemplate = `
+[[define "influx_query"]]
+[[if .Threshold ]]
+select count(text) as count from [[ dbrp ]]."[[ measurement "events" | influxident ]]" where "app"='[[ .App | influxstr ]]' and "title"= 'crashed' and text ='App crashed' and tags =~ /[[ .Space | influxregex ]],[[ .Shortapp | influxregex ]],/
+[[else]]
+select text,title,app,tags from [[ dbrp ]]."[[ measurement "events" | influxident ]]" where "app"='[[ .App | influxstr ]]' and "title"= 'crashed' and text ='App crashed' and tags =~ /[[ .Space | influxregex ]],[[ .Shortapp | influxregex ]],/
+[[end]]
+[[end]]
+[[define "alert_message"]]
+[[if .Message ]]
+[[ .Message ]]
+[[else if .Threshold ]]
+[[ .App ]] {{ if eq .Level "OK" }}is no longer crashing{{ else }}crashed {{ index .Fields "count" }} times in the last [[ .Window ]]{{ end }}
+[[else]]
+{{ index .Fields "app" }} crashed ({{ index .Fields "dynotype" }} dyno {{ index .Fields "dyno" }} in {{ index .Fields "space" }}){{ if index .Fields "exitcode" }} - exit code {{ index .Fields "exitcode" }}{{ end }}{{ if index .Fields "reason" }}: {{ index .Fields "reason" }}{{ end }}
+[[end]]
+[[end]]
+[[define "alert_details"]]
+<h3>{{ .Message }}</h3>
+[[if not .Threshold ]]
+<p>Space: {{ index .Fields "space" }}</p>
+<p>Dyno: {{ index .Fields "dynotype" }} ({{ index .Fields "dyno" }})</p>
+{{ if index .Fields "exitcode" }}<p>Exit code: {{ index .Fields "exitcode" }}</p>{{ end }}
+{{ if index .Fields "reason" }}<p>Reason: {{ index .Fields "reason" }}</p>{{ end }}
+[[end]]
+[[end]]
+var influx_query string
+var alert_message string
+var alert_details string
+[[if .Options.threshold ]]
+var threshold int
+var window duration
+[[end]]
+[[if .Options.crit ]]
+var crit int
+[[end]]
+[[if .Slack ]]
+var slack string
+[[end]]
+[[if .Post ]]
+var post string
+[[end]]
+[[range .Emails ]]
+var [[ . ]] string
+[[end]]
+
+	[[if .Options.threshold ]]
+	var crashes = batch
+		|	query(influx_query)
+				.period(window)
+				.every(1m)
+		|	last('count')
+				.as('count')
+
+	// The query returns nothing once the window holds no crashes, so a zero count is sent
+	// whenever it has returned nothing for two minutes, which lets the alert recover
+	var recovered = crashes
+		|	stats(2m)
+		|	derivative('emitted')
+				.nonNegative()
+		|	where(lambda: "emitted" == 0)
+		|	eval(lambda: 0)
+				.as('count')
+				.keep('count')
+
+	crashes
+		|	union(recovered)
+		|	alert()
+				[[if .Options.crit ]]
+				.crit(lambda: "count" >= crit)
+				[[end]]
+				.warn(lambda: "count" >= threshold)
+				.stateChangesOnly()
+	[[else]]
 	batch
-		|	query('''
-				select text,title,app,tags from "opentsdb"."retention_policy"."events" where "app"='[[ .App ]]' and "title"= 'crashed' and text ='App crashed' and tags =~ /[[ .Space ]],[[ .Shortapp ]],/
-			''')
+		|	query(influx_query)
 				.period(60s)
 				.every(61s)
+		[[ crashtags ]]
 		|	alert()
 				.warn(lambda: 1 > 0)
+	[[end]]
 				[[if .Slack ]]
 					.slack()
-					.channel('[[ .Slack ]]')
+					.channel(slack)
 				[[end]]
-				.message('{{ index .Fields "app" }} crashed. Info: {{ index .Fields "tags" }}')
-				.details('''
-					<h3>{{ .Message }}</h3>
-					{{ index .Fields "app" }} crashed. Info: {{ index .Fields "tags" }} 
-				''')
-				[[if .Email]]
-					[[ range $email := .EmailArray ]] 
-						.email('[[ $email ]]')
-					[[end]]
+				.message(alert_message)
+				.details(alert_details)
+				[[range .Emails ]]
+					.email([[ . ]])
 				[[end]]
-				[[if .Post]]
-					.post('[[ .Post ]]')
+				[[if .Post ]]
+					.post(post)
 				[[end]]
 `
 
-// getTaskByName - Get a task from the database
-func getTaskByName(app string, c *gin.Context) (*CrashedDBTask, error) {
-	db, err := utils.GetDBFromContext(c)
-	if err != nil {
-		return nil, errors.New("Unable to access database")
-	}
-
-	task := CrashedDBTask{}
-
-	err = db.Get(&task, "SELECT * FROM crashed_tasks WHERE app=$1", app)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, sql.ErrNoRows
+var descriptor = engine.Register(&engine.Descriptor{
+	Name:     "crashed",
+	Table:    "crashed_tasks",
+	Params:   []string{"app"},
+	Columns:  []string{"app"},
+	Template: crashalerttemplate,
+	Funcs:    template.FuncMap{"crashtags": utils.CrashTagsEval},
+	ID:       func(keys []string) string { return keys[0] + "-crash" },
+	Pattern:  regexp.MustCompile(`-crash$`),
+	NewSpec:  func() engine.Spec { return &CrashedTaskSpec{} },
+	FromVars: func(vars map[string]structs.Var) engine.Spec {
+		return &CrashedTaskSpec{
+			App:       engine.StringVar(vars, "app"),
+			Threshold: engine.StringVar(vars, "threshold"),
+			Crit:      engine.StringVar(vars, "crit"),
+			Window:    engine.DurationVar(vars, "window"),
+			Message:   engine.StringVar(vars, "message"),
 		}
-		return nil, errors.New("Unable to access database")
-	}
-	return &task, nil
-}
-
-// ProcessCrashedRequest - POST | PATCH /task/crashed
-func ProcessCrashedRequest(c *gin.Context) {
-	var vars map[string]structs.Var
-	vars = make(map[string]structs.Var)
-
-	bodybytes, err := ioutil.ReadAll(c.Request.Body)
-	if err != nil {
-		utils.ReportError(err, c, "Server Error while reading response")
-		return
-	}
-
-	var dbrps []structs.DbrpSpec
-	var dbrp structs.DbrpSpec
-	var task CrashedTaskSpec
-	err = json.Unmarshal(bodybytes, &task)
-	if err != nil {
-		utils.ReportError(err, c, "Server Error while reading response")
-		return
-	}
-
-	task.ID = task.App + "-crash"
-	task.Type = "batch"
-	vars = utils.AddVar("type", task.Type, "string", vars)
-
-	dbrp.Db = "opentsdb"
-	dbrp.Rp = "retention_policy"
-	dbrps = append(dbrps, dbrp)
-	task.Dbrps = dbrps
-	task.Script = ""
-	task.Status = "enabled"
-	task.Shortapp, task.Dynotype, task.Space = parseforparts(task.App)
-	if !strings.HasPrefix(task.Slack, "#") && !strings.HasPrefix(task.Slack, "@") {
-		task.Slack = "#" + task.Slack
-	}
-
-	task.EmailArray = strings.Split(task.Email, ",")
-
-	t := template.Must(template.New("crashalerttemplate").Delims("[[", "]]").Parse(crashalerttemplate))
-	var sb bytes.Buffer
-	swr := bufio.NewWriter(&sb)
-	err = t.Execute(swr, task)
-	if err != nil {
-		utils.ReportError(err, c, "Server Error while reading response")
-		return
-	}
-
-	swr.Flush()
-	task.Script = string(sb.Bytes())
-	vars = utils.AddVar("app", task.App, "string", vars)
-	vars = utils.AddVar("slack", task.Slack, "string", vars)
-	vars = utils.AddVar("post", task.Post, "string", vars)
-	vars = utils.AddVar("email", task.Email, "string", vars)
-
-	task.Vars = vars
-
-	bodybytes, err = json.Marshal(task)
-	if err != nil {
-		utils.ReportError(err, c, "Server Error while reading response")
-		return
-	}
-
-	if c.Request.Method == "POST" {
-		err = createCrashedTask(task, c)
-		if err != nil {
-			utils.ReportError(err, c, "")
-			return
+	},
+	Model: CrashedDBTask{},
+})
+
+// Prepare - Validate the crash count settings and split the app name for matching event tags
+func (task *CrashedTaskSpec) Prepare() error {
+	parts := utils.ParseAppName(task.App)
+	task.Shortapp, task.Dynotype, task.Space = parts.App, parts.Dynotype, parts.Space
+
+	// Optionally only alert when a number of crashes happen within the window (e.g. a crash loop)
+	if task.Threshold != "" {
+		threshold, err := strconv.Atoi(task.Threshold)
+		if err != nil || threshold < 1 {
+			return errors.New("Threshold must be a number of crashes (1 or more)")
 		}
-	}
-
-	if c.Request.Method == "PATCH" {
-		// Check if task exists before trying to patch it
-		_, err := getTaskByName(task.App, c)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				c.JSON(404, nil)
-			} else {
-				utils.ReportError(err, c, "")
+		if task.Crit != "" {
+			crit, err := strconv.Atoi(task.Crit)
+			if err != nil || crit <= threshold {
+				return errors.New("Crit must be a number of crashes greater than the threshold")
 			}
-			return
 		}
-
-		err = deleteCrashedTask(task.App, c)
-		if err != nil {
-			utils.ReportError(err, c, "")
-			return
+		if task.Window == "" {
+			task.Window = "10m"
 		}
-
-		err = createCrashedTask(task, c)
-		if err != nil {
-			utils.ReportError(err, c, "")
-			return
+		if err := engine.CheckDuration("Window", task.Window); err != nil {
+			return err
 		}
+	} else {
+		task.Crit = ""
+		task.Window = ""
 	}
-
-	c.String(201, "")
-}
-
-func deleteCrashedTask(app string, c *gin.Context) error {
-	db, err := utils.GetDBFromContext(c)
-	if err != nil {
-		return errors.New("Unable to access database")
-	}
-
-	client := http.Client{}
-
-	req, err := http.NewRequest("DELETE", os.Getenv("KAPACITOR_URL")+"/kapacitor/v1/tasks/"+app+"-crash", nil)
-	if err != nil {
-		return errors.New("Server Error while reading response")
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return errors.New("Server Error while reading response")
-	}
-
-	defer resp.Body.Close()
-	bodybytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return errors.New("Server Error while reading response")
-	}
-
-	if resp.StatusCode != 204 {
-		var er structs.ErrorResponse
-		err = json.Unmarshal(bodybytes, &er)
-		if err != nil {
-			return errors.New("Server Error while reading response")
-		}
-		return errors.New(er.Error)
-	}
-
-	_, err = db.Exec("DELETE FROM crashed_tasks WHERE app=$1", app)
-	if err != nil {
-		return errors.New("Unable to access database")
-	}
-
 	return nil
 }
 
-// createCrashedTask - Create a task in Kapacitor and save the config to the database
-func createCrashedTask(task CrashedTaskSpec, c *gin.Context) error {
-	db, err := utils.GetDBFromContext(c)
-	if err != nil {
-		return errors.New("Unable to access database")
-	}
-
-	client := http.Client{}
+// Options - Alerting on a number of crashes within the window, and a critical number of crashes
+func (task *CrashedTaskSpec) Options() map[string]bool {
+	return map[string]bool{"threshold": task.Threshold != "", "crit": task.Crit != ""}
+}
 
-	p, err := json.Marshal(task)
-	if err != nil {
-		return errors.New("Server Error while reading response")
-	}
+// Keys - App
+func (task *CrashedTaskSpec) Keys() []string {
+	return []string{task.App}
+}
 
-	req, err := http.NewRequest("POST", os.Getenv("KAPACITOR_URL")+"/kapacitor/v1/tasks", bytes.NewBuffer(p))
-	if err != nil {
-		return errors.New("Server Error while reading response")
-	}
+// TaskVars - Variables saved with the task in Kapacitor
+func (task *CrashedTaskSpec) TaskVars() map[string]structs.Var {
+	vars := make(map[string]structs.Var)
+	vars = utils.AddVar("app", task.App, "string", vars)
+	vars = utils.AddVar("threshold", task.Threshold, "int", vars)
+	vars = utils.AddVar("crit", task.Crit, "int", vars)
+	vars = utils.AddVar("window", task.Window, "duration", vars)
+	vars = utils.AddVar("message", task.Message, "string", vars)
+	return vars
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return errors.New("Server Error while reading response")
+// Row - Values saved to crashed_tasks
+func (task *CrashedTaskSpec) Row() []interface{} {
+	return []interface{}{
+		task.App, task.Slack, task.Post, task.Email,
+		zero.StringFrom(task.Threshold), zero.StringFrom(task.Crit), zero.StringFrom(task.Window),
+		zero.StringFrom(task.Message),
 	}
+}
 
-	defer resp.Body.Close()
-	bodybytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return errors.New("Server Error while reading response")
-	}
+// ProcessCrashedRequest - POST | PATCH /task/crashed
+func ProcessCrashedRequest(c *gin.Context) {
+	engine.ProcessRequest(descriptor, c)
+}
 
-	if resp.StatusCode != 200 {
-		var er structs.ErrorResponse
-		err = json.Unmarshal(bodybytes, &er)
-		if err != nil {
-			return errors.New("Server Error while reading response")
-		}
-		return errors.New(er.Error)
-	}
+// PreviewCrashedTask - POST /task/crashed/preview
+func PreviewCrashedTask(c *gin.Context) {
+	engine.PreviewTask(descriptor, c)
+}
 
-	_, err = db.Exec(
-		"INSERT INTO crashed_tasks VALUES ($1, $2, $3, $4)",
-		task.App, task.Slack, task.Post, task.Email,
-	)
+// DeleteCrashedTask - DELETE /task/crashed/:app
+func DeleteCrashedTask(c *gin.Context) {
+	engine.DeleteTask(descriptor, c)
+}
 
-	if err != nil {
-		return errors.New("Unable to save to database")
-	}
+// GetCrashedTask - GET /task/crashed/:app
+func GetCrashedTask(c *gin.Context) {
+	engine.GetTask(descriptor, c)
+}
 
-	return nil
+// ListCrashedTasks - GET /tasks/crashed
+func ListCrashedTasks(c *gin.Context) {
+	engine.ListTasks(descriptor, c)
 }
 
-// DeleteCrashedTask - DELETE /task/crashed/:app
-func DeleteCrashedTask(c *gin.Context) {
+// GetCrashedTaskHistory - GET /task/crashed/:app/history
+func GetCrashedTaskHistory(c *gin.Context) {
 	app := c.Param("app")
+	since := c.DefaultQuery("since", "24h")
 
-	// Check if task exists before trying to delete it
-	_, err := getTaskByName(app, c)
+	if err := engine.CheckDuration("Since", since); err != nil {
+		utils.ReportInvalidRequest(c, err.Error())
+		return
+	}
+
+	_, err := descriptor.Find([]string{app}, c)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.JSON(404, nil)
@@ -268,65 +245,93 @@ func DeleteCrashedTask(c *gin.Context) {
 		return
 	}
 
-	// Delete the task from Kapacitor and remove the config from the database
-	err = deleteCrashedTask(app, c)
+	cfg, err := config.FromContext(c)
 	if err != nil {
-		utils.ReportError(err, c, "")
-	} else {
-		c.String(200, "")
+		utils.ReportError(err, c, "Unable to read configuration")
+		return
+	}
+	influxURL := cfg.InfluxDB.URL
+	if influxURL == "" {
+		c.JSON(501, structs.ErrorResponse{Error: "Crash history is not available - INFLUXDB_URL is not set"})
+		return
 	}
-}
 
-// GetCrashedTask - GET /task/crashed/:app
-func GetCrashedTask(c *gin.Context) {
-	app := c.Param("app")
+	influx := descriptor.Influx()
+	query := `select text,title,app,tags from "` + engine.InfluxIdent(influx.RetentionPolicy) + `"."` + engine.InfluxIdent(influx.Measurements["events"]) +
+		`" where "app"='` + engine.InfluxString(app) + `' and "title"='crashed' and time > now() - ` + since
 
-	task, err := getTaskByName(app, c)
+	req, err := http.NewRequest("GET", influxURL+"/query?db="+url.QueryEscape(influx.Database)+"&q="+url.QueryEscape(query), nil)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(404, nil)
-		} else {
-			utils.ReportError(err, c, "")
-		}
+		utils.ReportError(err, c, "Server Error while reading response")
 		return
 	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), time.Duration(cfg.InfluxDB.Timeout))
+	defer cancel()
 
-	c.JSON(200, task)
-}
-
-// ListCrashedTasks - GET /tasks/crashed
-func ListCrashedTasks(c *gin.Context) {
-	db, err := utils.GetDBFromContext(c)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
 	if err != nil {
-		utils.ReportError(err, c, "Unable to access database")
+		utils.ReportError(&utils.UnreachableError{Service: "InfluxDB", Err: err}, c, "")
 		return
 	}
 
-	tasks := []CrashedDBTask{}
-
-	err = db.Select(&tasks, "SELECT * FROM crashed_tasks ORDER BY app ASC")
+	defer resp.Body.Close()
+	bodybytes, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		utils.ReportError(err, c, "Unable to access database")
+		utils.ReportError(err, c, "Server Error while reading response")
 		return
 	}
 
-	if len(tasks) == 0 {
-		c.JSON(200, nil)
+	result, err := decodeInfluxResponse(resp.StatusCode, bodybytes)
+	if err != nil {
+		log.Println(err)
+		utils.ReportBadGateway(c, "Unable to query crash history: "+err.Error())
 		return
 	}
 
-	c.JSON(200, tasks)
+	history := []CrashedEvent{}
+	for _, r := range result.Results {
+		for _, series := range r.Series {
+			for _, values := range series.Values {
+				event := make(map[string]string)
+				for i, column := range series.Columns {
+					if i >= len(values) {
+						break
+					}
+					if value, ok := values[i].(string); ok {
+						event[column] = value
+					}
+				}
+				history = append(history, CrashedEvent{
+					Time:    event["time"],
+					App:     event["app"],
+					Text:    event["text"],
+					Details: utils.ParseCrashTags(event["tags"]),
+				})
+			}
+		}
+	}
+
+	c.JSON(200, history)
 }
 
-func parseforparts(full string) (a string, d string, s string) {
-	if strings.Contains(full, "--") {
-		a = strings.Split(full, "--")[0]
-		d = strings.Split(strings.Split(full, "--")[1], "-")[0]
-		s = strings.Join(strings.Split(strings.Split(full, "--")[1], "-")[1:], "-")
-	} else {
-		a = strings.Split(full, "-")[0]
-		d = "web"
-		s = strings.Join(strings.Split(full, "-")[1:], "-")
+// decodeInfluxResponse - Read the response to an InfluxDB query, returning the error InfluxDB reports for the
+// request or any of its statements
+func decodeInfluxResponse(status int, body []byte) (*influxResponse, error) {
+	var result influxResponse
+	err := json.Unmarshal(body, &result)
+	if result.Error != "" {
+		return nil, errors.New(result.Error)
+	}
+	if status != 200 {
+		return nil, errors.New("InfluxDB responded with " + strconv.Itoa(status))
+	}
+	if err != nil {
+		return nil, errors.New("Invalid response from InfluxDB")
+	}
+	for _, r := range result.Results {
+		if r.Error != "" {
+			return nil, errors.New(r.Error)
+		}
 	}
-	return a, d, s
+	return &result, nil
 }
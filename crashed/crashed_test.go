@@ -3,11 +3,13 @@ package crashed
 import (
 	"bytes"
 	"encoding/json"
+	"kapacitor-alerts-api/config"
+	"kapacitor-alerts-api/engine"
+	"kapacitor-alerts-api/engine/enginetest"
 	"kapacitor-alerts-api/utils"
 	"log"
 	"net/http"
 	"net/http/httptest"
-	"os"
 	"testing"
 
 	"gopkg.in/guregu/null.v3/zero"
@@ -23,6 +25,7 @@ import (
 *    ---------------------------------------------------
 *    POST     /task/crashed         TestCreateCrashedTask
 *    PATCH    /task/crashed         TestUpdateCrashedTask
+*    POST     /task/crashed/preview TestHostileCrashedInput
 *    DELETE   /task/crashed/:app    TestDeleteCrashedTask
 *    GET      /tasks/crashed        TestCreateCrashedTask
 *    GET      /task/crashed/:app    TestCreateCrashedTask
@@ -30,18 +33,27 @@ import (
 
 // setupRouter - Setup Gin routes for current test type
 func setupRouter() *gin.Engine {
-	pool := utils.GetDB(os.Getenv("DATABASE_URL"))
+	cfg, err := config.Load()
+	if err != nil {
+		log.Panicln(err)
+	}
+	pool := utils.GetDB(cfg.Database)
 	if pool == nil {
 		log.Panicln("Unable to connect to database")
 	}
+	if err := engine.Configure(cfg); err != nil {
+		log.Panicln(err)
+	}
 
 	router := gin.Default()
 	gin.SetMode(gin.DebugMode)
 	router.Use(utils.DBMiddleware(pool))
+	router.Use(config.Middleware(cfg))
 
 	router.POST("/task/crashed", ProcessCrashedRequest)
 	router.GET("/task/crashed/:app", GetCrashedTask)
 	router.PATCH("/task/crashed", ProcessCrashedRequest)
+	router.POST("/task/crashed/preview", PreviewCrashedTask)
 	router.DELETE("/task/crashed/:app", DeleteCrashedTask)
 	router.GET("/tasks/crashed", ListCrashedTasks)
 
@@ -116,9 +128,15 @@ func TestUpdateCrashedTask(t *testing.T) {
 	// Create a task with updated information
 	// Slack - #cobra => nil
 	// Post - nil => http://example.com/
+	// Threshold - nil => 3 crashes (critical at 10) in 15m
+	// Message - nil => custom message
 	var task CrashedDBTask
 	task.App = "gotest-voltron"
 	task.Post = zero.StringFrom("http://example.com/")
+	task.Threshold = zero.StringFrom("3")
+	task.Crit = zero.StringFrom("10")
+	task.Wind = zero.StringFrom("15m")
+	task.Message = zero.StringFrom("{{ index .Tags \"app\" }} isn't stable")
 	taskBytes, err := json.Marshal(task)
 	assert.Nil(t, err, "Converting from CrashedDBTask to JSON should not throw an error")
 
@@ -146,6 +164,10 @@ func TestUpdateCrashedTask(t *testing.T) {
 	assert.Equal(t, returnedTask.Slack, task.Slack, "Task slack should match")
 	assert.Equal(t, returnedTask.Email, task.Email, "Task email should match")
 	assert.Equal(t, returnedTask.Post, task.Post, "Task post should match")
+	assert.Equal(t, returnedTask.Threshold, task.Threshold, "Task threshold should match")
+	assert.Equal(t, returnedTask.Crit, task.Crit, "Task crit should match")
+	assert.Equal(t, returnedTask.Wind, task.Wind, "Task window should match")
+	assert.Equal(t, returnedTask.Message, task.Message, "Task message should match")
 }
 
 // TestDeleteCrashedTask - Make sure that deleting a crashed task works and that we cannot access it anymore
@@ -166,3 +188,37 @@ func TestDeleteCrashedTask(t *testing.T) {
 
 	assert.Equal(t, http.StatusNotFound, w.Code, "HTTP response code for GET /task/crashed/:app on invalid app should be 404")
 }
+
+// TestHostileCrashedInput - Make sure that user input is passed through vars or escaped in the rendered query, or rejected if it cannot be
+func TestHostileCrashedInput(t *testing.T) {
+	inputs := append(enginetest.HostileNotify(""),
+		enginetest.Accepted("dot in app", `{"app":"gotest.hostile-default"}`, [2]string{"influx_query", `"app"='gotest.hostile-default'`}, [2]string{"influx_query", `tags =~ /default,gotest\.hostile,/`}),
+		enginetest.Accepted("quote in message", `{"app":"gotest-hostile","message":"it's down\\ {{ .Level }}"}`, [2]string{"alert_message", `it's down\ {{ .Level }}`}),
+		enginetest.Rejected("expression in window", `{"app":"gotest-hostile","threshold":"3","window":"10m) |log("}`),
+	)
+	enginetest.CheckHostileInputs(t, PreviewCrashedTask, inputs)
+}
+
+// TestDecodeInfluxResponse - Make sure that errors returned by InfluxDB are reported instead of an empty history
+func TestDecodeInfluxResponse(t *testing.T) {
+	result, err := decodeInfluxResponse(200, []byte(`{"results":[{"series":[{"name":"events","columns":["time","app"],"values":[["2020-04-20T16:20:00Z","foo-space"]]}]}]}`))
+	assert.Nil(t, err, "Valid response should not throw an error")
+	assert.Len(t, result.Results[0].Series[0].Values, 1, "Events should be read from the response")
+
+	failures := map[string]struct {
+		status int
+		body   string
+		err    string
+	}{
+		"request error":   {400, `{"error":"error parsing query: found EOF"}`, "error parsing query: found EOF"},
+		"statement error": {200, `{"results":[{"error":"database not found: opentsdb"}]}`, "database not found: opentsdb"},
+		"error page":      {502, `<html>Bad Gateway</html>`, "InfluxDB responded with 502"},
+		"invalid body":    {200, `<html>`, "Invalid response from InfluxDB"},
+	}
+	for name, f := range failures {
+		_, err := decodeInfluxResponse(f.status, []byte(f.body))
+		if assert.NotNil(t, err, "Response with a "+name+" should throw an error") {
+			assert.Equal(t, f.err, err.Error(), "Error for a "+name+" should be reported")
+		}
+	}
+}
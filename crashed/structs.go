@@ -1,73 +1,53 @@
 package crashed
 
 import (
-	structs "kapacitor-alerts-api/structs"
+	"kapacitor-alerts-api/engine"
+	utils "kapacitor-alerts-api/utils"
 
 	"gopkg.in/guregu/null.v3/zero"
 )
 
-type CrashedVars struct {
-	App struct {
-		Type        string `json:"type"`
-		Value       string `json:"value"`
-		Description string `json:"description"`
-	} `json:"app"`
-	ID struct {
-		Type        string `json:"type"`
-		Value       string `json:"value"`
-		Description string `json:"description"`
-	} `json:"id"`
-	Slack struct {
-		Type        string `json:"type"`
-		Value       string `json:"value"`
-		Description string `json:"description"`
-	} `json:"slack"`
-	Type struct {
-		Type        string `json:"type"`
-		Value       string `json:"value"`
-		Description string `json:"description"`
-	} `json:"type"`
-	Email struct {
-		Type        string `json:"type"`
-		Value       string `json:"value"`
-		Description string `json:"description"`
-	} `json:"email"`
-	Post struct {
-		Type        string `json:"type"`
-		Value       string `json:"value"`
-		Description string `json:"description"`
-	} `json:"post"`
+// CrashedTaskSpec - Used to create or update a crashed task
+type CrashedTaskSpec struct {
+	App       string `json:"app"`
+	Threshold string `json:"threshold"`
+	Crit      string `json:"crit"`
+	Window    string `json:"window"`
+	Message   string `json:"message"`
+	Shortapp  string `json:"-"`
+	Dynotype  string `json:"-"`
+	Space     string `json:"-"`
+	engine.Notify
 }
 
-type CrashedTaskList struct {
-	Tasks []struct {
-		ID   string      `json:"id"`
-		Vars CrashedVars `json:"vars"`
-	} `json:"tasks"`
+// CrashedDBTask - Used for retrieval of task information from the database
+type CrashedDBTask struct {
+	App       string      `json:"app"`
+	Slack     zero.String `json:"slack"`
+	Post      zero.String `json:"post"`
+	Email     zero.String `json:"email"`
+	Threshold zero.String `json:"threshold"`
+	Crit      zero.String `json:"crit"`
+	Wind      zero.String `json:"window"`
+	Message   zero.String `json:"message"`
 }
 
-type CrashedTaskSpec struct {
-	ID         string             `json:"id"`
-	Type       string             `json:"type"`
-	Dbrps      []structs.DbrpSpec `json:"dbrps"`
-	Status     string             `json:"status"`
-	Script     string             `json:"script"`
-	App        string             `json:"app"`
-	Slack      string             `json:"slack"`
-	Post       string             `json:"post"`
-	Email      string             `json:"email"`
-	EmailArray []string           `json:"emailarray"`
-	//    Opsgenie string         `json:"opsgenie"`
-	Vars     map[string]structs.Var `json:"vars"`
-	Shortapp string                 `json:"shortapp"`
-	Dynotype string                 `json:"dynotype"`
-	Space    string                 `json:"space"`
+// CrashedEvent - A crash of an app, with the details parsed from the event tags
+type CrashedEvent struct {
+	Time    string             `json:"time"`
+	App     string             `json:"app"`
+	Text    string             `json:"text"`
+	Details utils.CrashDetails `json:"details"`
 }
 
-// CrashedDBTask - Used for retrieval of task information from the database
-type CrashedDBTask struct {
-	App   string      `json:"app"`
-	Slack zero.String `json:"slack"`
-	Post  zero.String `json:"post"`
-	Email zero.String `json:"email"`
+type influxResponse struct {
+	Results []struct {
+		Series []struct {
+			Name    string          `json:"name"`
+			Columns []string        `json:"columns"`
+			Values  [][]interface{} `json:"values"`
+		} `json:"series"`
+		Error string `json:"error"`
+	} `json:"results"`
+	Error string `json:"error"` // Set instead of results if the request failed
 }
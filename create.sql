@@ -20,6 +20,30 @@ begin
     )
   );
 
+  ALTER TABLE memory_tasks ADD COLUMN IF NOT EXISTS growth TEXT;          -- Threshold for memory growth alert, in MB/hour (optional)
+  ALTER TABLE memory_tasks ADD COLUMN IF NOT EXISTS growthwindow TEXT;    -- How long memory must keep growing before alerting (e.g. 3h, 6h)
+  ALTER TABLE memory_tasks ADD COLUMN IF NOT EXISTS aggregate TEXT NOT NULL DEFAULT 'mean';     -- Aggregate function [mean, max, p1 - p99]
+  ALTER TABLE memory_tasks ADD COLUMN IF NOT EXISTS groupby TEXT NOT NULL DEFAULT 'instance';    -- Alert per dyno instance or per dynotype [instance, dynotype]
+
+  CREATE TABLE IF NOT EXISTS cpu_tasks
+  (
+    id TEXT NOT NULL UNIQUE,                            -- ID of task (from kapacitor)
+    app TEXT NOT NULL,                                  -- Name of app to monitor
+    dynotype TEXT NOT NULL,                             -- Dyno to monitor on app
+    crit TEXT NOT NULL,                                 -- Threshold for critical alert, in percent
+    warn TEXT NOT NULL,                                 -- Threshold for warning alert, in percent
+    wind TEXT NOT NULL,                                 -- How far back to retrieve data (e.g. 10m, 30m, 1h)
+    every TEXT NOT NULL,                                -- Frequency to check (e.g. 30s, 1m, 10m)
+    slack TEXT,                                         -- Slack channel to notify
+    post TEXT,                                          -- HTTP endpoint to notify (POST)
+    email TEXT,                                         -- Email address to notify
+    CONSTRAINT notify_present CHECK (                   -- Got to have a value in either slack, post, or email
+      (CASE WHEN slack IS NULL THEN 0 ELSE 1 END) +
+      (CASE WHEN post IS NULL THEN 0 ELSE 1 END) +
+      (CASE WHEN email IS NULL THEN 0 ELSE 1 END) > 0
+    )
+  );
+
   CREATE TABLE IF NOT EXISTS _5xx_tasks 
   (
     app TEXT NOT NULL UNIQUE,                           -- Name of app to monitor
@@ -34,6 +58,55 @@ begin
     )
   );
 
+  CREATE TABLE IF NOT EXISTS _4xx_tasks
+  (
+    app TEXT NOT NULL UNIQUE,                           -- Name of app to monitor
+    tolerance TEXT NOT NULL,                            -- How sensitive should checks be? [low, medium, high]
+    slack TEXT,                                         -- Slack channel to notify
+    post TEXT,                                          -- HTTP endpoint to notify (POST)
+    email TEXT,                                         -- Email address to notify
+    exclude404 BOOLEAN NOT NULL DEFAULT false,          -- Ignore 404 status codes
+    CONSTRAINT notify_present CHECK (                   -- Got to have a value in either slack, post, or email
+      (CASE WHEN slack IS NULL THEN 0 ELSE 1 END) +
+      (CASE WHEN post IS NULL THEN 0 ELSE 1 END) +
+      (CASE WHEN email IS NULL THEN 0 ELSE 1 END) > 0
+    )
+  );
+
+  CREATE TABLE IF NOT EXISTS latency_tasks
+  (
+    app TEXT NOT NULL UNIQUE,                           -- Name of app to monitor
+    aggregate TEXT NOT NULL,                            -- Aggregate function for response times [mean, p1 - p99]
+    crit TEXT NOT NULL,                                 -- Threshold for critical alert, in ms
+    warn TEXT NOT NULL,                                 -- Threshold for warning alert, in ms
+    wind TEXT NOT NULL,                                 -- How far back to retrieve data (e.g. 10m, 30m, 1h)
+    every TEXT NOT NULL,                                -- Frequency to check (e.g. 30s, 1m, 10m)
+    slack TEXT,                                         -- Slack channel to notify
+    post TEXT,                                          -- HTTP endpoint to notify (POST)
+    email TEXT,                                         -- Email address to notify
+    CONSTRAINT notify_present CHECK (                   -- Got to have a value in either slack, post, or email
+      (CASE WHEN slack IS NULL THEN 0 ELSE 1 END) +
+      (CASE WHEN post IS NULL THEN 0 ELSE 1 END) +
+      (CASE WHEN email IS NULL THEN 0 ELSE 1 END) > 0
+    )
+  );
+
+  CREATE TABLE IF NOT EXISTS deadman_tasks
+  (
+    app TEXT NOT NULL UNIQUE,                           -- Name of app to monitor
+    source TEXT NOT NULL,                               -- Metrics to watch for throughput [router, memory]
+    threshold TEXT NOT NULL,                            -- Alert when throughput is at or below this, in points per interval
+    period TEXT NOT NULL,                               -- Interval to measure throughput over (e.g. 5m, 10m, 1h)
+    slack TEXT,                                         -- Slack channel to notify
+    post TEXT,                                          -- HTTP endpoint to notify (POST)
+    email TEXT,                                         -- Email address to notify
+    CONSTRAINT notify_present CHECK (                   -- Got to have a value in either slack, post, or email
+      (CASE WHEN slack IS NULL THEN 0 ELSE 1 END) +
+      (CASE WHEN post IS NULL THEN 0 ELSE 1 END) +
+      (CASE WHEN email IS NULL THEN 0 ELSE 1 END) > 0
+    )
+  );
+
   CREATE TABLE IF NOT EXISTS crashed_tasks
   (
     app TEXT NOT NULL UNIQUE,                           -- Name of app to monitor
@@ -47,6 +120,11 @@ begin
     )
   );
 
+  ALTER TABLE crashed_tasks ADD COLUMN IF NOT EXISTS threshold TEXT;     -- Only alert when this many crashes happen within the window (optional)
+  ALTER TABLE crashed_tasks ADD COLUMN IF NOT EXISTS crit TEXT;          -- Escalate to critical when this many crashes happen within the window (optional)
+  ALTER TABLE crashed_tasks ADD COLUMN IF NOT EXISTS wind TEXT;          -- Window to count crashes over (e.g. 10m, 30m, 1h)
+  ALTER TABLE crashed_tasks ADD COLUMN IF NOT EXISTS message TEXT;       -- Custom alert message (optional)
+
   CREATE TABLE IF NOT EXISTS released_tasks
   (
     app TEXT NOT NULL UNIQUE,                           -- Name of app to monitor
@@ -60,5 +138,83 @@ begin
     )
   );
 
+  ALTER TABLE released_tasks ADD COLUMN IF NOT EXISTS pipeline TEXT;                          -- Only alert on releases promoted through this pipeline (optional)
+  ALTER TABLE released_tasks ADD COLUMN IF NOT EXISTS outcome TEXT NOT NULL DEFAULT 'all';    -- Releases to alert on [all, succeeded, failed]
+  ALTER TABLE released_tasks ADD COLUMN IF NOT EXISTS previous BOOLEAN NOT NULL DEFAULT false; -- Include the previous image in alerts
+  ALTER TABLE released_tasks ADD COLUMN IF NOT EXISTS space TEXT;                             -- Only alert on releases in this space (optional)
+
+  CREATE TABLE IF NOT EXISTS event_tasks
+  (
+    app TEXT NOT NULL UNIQUE,                           -- Name of app to monitor
+    events TEXT[] NOT NULL,                             -- Titles of Akkeris events to notify about (e.g. released, crashed, restarted)
+    slack TEXT,                                         -- Slack channel to notify
+    post TEXT,                                          -- HTTP endpoint to notify (POST)
+    email TEXT,                                         -- Email address to notify
+    CONSTRAINT notify_present CHECK (                   -- Got to have a value in either slack, post, or email
+      (CASE WHEN slack IS NULL THEN 0 ELSE 1 END) +
+      (CASE WHEN post IS NULL THEN 0 ELSE 1 END) +
+      (CASE WHEN email IS NULL THEN 0 ELSE 1 END) > 0
+    )
+  );
+
+  CREATE TABLE IF NOT EXISTS alert_types
+  (
+    name TEXT NOT NULL UNIQUE,                          -- Name of the alert type (used in /task/custom/:type)
+    description TEXT,                                   -- Description of the alert type
+    tasktype TEXT NOT NULL DEFAULT 'batch',             -- Kapacitor task type [batch, stream]
+    template TEXT NOT NULL,                             -- TICKscript template rendered for each task
+    schema JSONB NOT NULL                               -- JSON schema of the variables of the alert type
+  );
+
+  CREATE TABLE IF NOT EXISTS custom_tasks
+  (
+    id TEXT NOT NULL UNIQUE,                            -- Kapacitor task ID
+    alerttype TEXT NOT NULL REFERENCES alert_types(name), -- Alert type of the task
+    app TEXT NOT NULL,                                  -- Name of app to monitor
+    vars JSONB NOT NULL,                                -- Variables of the task (validated against the alert type schema)
+    slack TEXT,                                         -- Slack channel to notify
+    post TEXT,                                          -- HTTP endpoint to notify (POST)
+    email TEXT,                                         -- Email address to notify
+    UNIQUE (alerttype, app),
+    CONSTRAINT notify_present CHECK (                   -- Got to have a value in either slack, post, or email
+      (CASE WHEN slack IS NULL THEN 0 ELSE 1 END) +
+      (CASE WHEN post IS NULL THEN 0 ELSE 1 END) +
+      (CASE WHEN email IS NULL THEN 0 ELSE 1 END) > 0
+    )
+  );
+
+  CREATE TABLE IF NOT EXISTS template_rollouts
+  (
+    alerttype TEXT NOT NULL UNIQUE,                     -- Built-in alert type whose template is rolled out
+    status TEXT NOT NULL,                               -- State of the rollout [canary, promoted, rolledback]
+    stable TEXT NOT NULL,                               -- Template run by the tasks outside the canary
+    canary TEXT NOT NULL,                               -- Template rolled out to the canary
+    apps TEXT[] NOT NULL DEFAULT '{}',                  -- Apps whose tasks run the canary
+    percent INTEGER NOT NULL DEFAULT 0,                 -- Percentage of the other apps whose tasks run the canary
+    started TIMESTAMPTZ NOT NULL DEFAULT now()          -- When the canary was started or last changed
+  );
+
+  CREATE TABLE IF NOT EXISTS task_templates
+  (
+    id TEXT NOT NULL UNIQUE,                            -- Kapacitor task ID
+    alerttype TEXT NOT NULL,                            -- Alert type of the task
+    version TEXT NOT NULL,                              -- Version of the template the task runs
+    updated TIMESTAMPTZ NOT NULL DEFAULT now()          -- When the task last changed version
+  );
+
+  CREATE TABLE IF NOT EXISTS task_instances
+  (
+    id TEXT NOT NULL UNIQUE,                            -- Kapacitor task ID
+    alerttype TEXT NOT NULL,                            -- Alert type of the task
+    instance TEXT NOT NULL                              -- Name of the Kapacitor instance the task runs on
+  );
+
+  CREATE TABLE IF NOT EXISTS kapacitor_failovers
+  (
+    instance TEXT NOT NULL UNIQUE,                      -- Kapacitor instance that failed over
+    standby TEXT NOT NULL,                              -- Standby the tasks of the instance run on
+    started TIMESTAMPTZ NOT NULL DEFAULT now()          -- When the instance failed over
+  );
+
 end
 $$;
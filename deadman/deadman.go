@@ -0,0 +1,160 @@
+package deadman
+
+import (
+	"errors"
+	"kapacitor-alerts-api/engine"
+	structs "kapacitor-alerts-api/structs"
+	"kapacitor-alerts-api/utils"
+	"regexp"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const deadmanalerttemplate = `
+[[define "influx_query"]]
+select "value" from [[ dbrp ]].[[ .Measurement ]] where [[ .Filter ]]
+[[end]]
+[[define "alert_message"]]
+[[ .App ]]: {{ if eq .Level "OK" }}[[ .Source ]] metrics are being received again{{ else }}No [[ .Source ]] metrics received{{ end }} - {{ index .Fields "emitted" | printf "%0.0f" }} points in the last [[ .Interval ]] (threshold [[ .Threshold ]])
+[[end]]
+[[define "alert_details"]]
+<h3>{{ .Message }}</h3>
+[[end]]
+var influx_query string
+var threshold float
+var interval duration
+var alert_message string
+var alert_details string
+[[if .Slack ]]
+var slack string
+[[end]]
+[[if .Post ]]
+var post string
+[[end]]
+[[range .Emails ]]
+var [[ . ]] string
+[[end]]
+
+	batch
+    |	query(influx_query)
+        .period(interval)
+        .every(interval)
+    |	deadman(threshold, interval)
+        .stateChangesOnly()
+        [[if .Slack ]]
+      	  .slack()
+      	  .channel(slack)
+        [[end]]
+        .message(alert_message)
+        .details(alert_details)
+        [[range .Emails ]]
+        	.email([[ . ]])
+        [[end]]
+        [[if .Post ]]
+        	.post(post)
+        [[end]]
+`
+
+var descriptor = engine.Register(&engine.Descriptor{
+	Name:     "deadman",
+	Table:    "deadman_tasks",
+	Params:   []string{"app"},
+	Columns:  []string{"app"},
+	Template: deadmanalerttemplate,
+	ID:       func(keys []string) string { return keys[0] + "-deadman" },
+	Pattern:  regexp.MustCompile(`-deadman$`),
+	NewSpec:  func() engine.Spec { return &DeadmanTaskSpec{} },
+	FromVars: func(vars map[string]structs.Var) engine.Spec {
+		return &DeadmanTaskSpec{
+			App:       engine.StringVar(vars, "app"),
+			Source:    engine.StringVar(vars, "source"),
+			Threshold: engine.StringVar(vars, "threshold"),
+			Interval:  engine.DurationVar(vars, "interval"),
+		}
+	},
+	Model: DeadmanDBTask{},
+})
+
+// Prepare - Validate the source and threshold and fill in the default interval
+func (task *DeadmanTaskSpec) Prepare() error {
+	// Watch either the router (incoming requests) or the memory (any running dyno) metrics for the app
+	if task.Source == "" {
+		task.Source = "router"
+	}
+	measurements := descriptor.Influx().Measurements
+	if task.Source == "router" {
+		task.Measurement = `/` + engine.InfluxRegex(measurements["router_status"]) + `\..*/`
+		task.Filter = `"fqdn" =~ /` + engine.InfluxRegex(task.App) + `/`
+	} else if task.Source == "memory" {
+		task.Measurement = `"` + engine.InfluxIdent(measurements["memory"]) + `"`
+		task.Filter = `"app"='` + engine.InfluxString(task.App) + `'`
+	} else {
+		return errors.New("Source must be one of router or memory")
+	}
+
+	if task.Threshold == "" {
+		task.Threshold = "0"
+	}
+	if _, err := strconv.ParseFloat(task.Threshold, 64); err != nil {
+		return errors.New("Threshold must be a number (in points per interval)")
+	}
+
+	if task.Interval == "" {
+		task.Interval = "10m"
+	}
+	return engine.CheckDuration("Interval", task.Interval)
+}
+
+// Keys - App
+func (task *DeadmanTaskSpec) Keys() []string {
+	return []string{task.App}
+}
+
+// TaskVars - Variables saved with the task in Kapacitor
+func (task *DeadmanTaskSpec) TaskVars() map[string]structs.Var {
+	vars := make(map[string]structs.Var)
+	vars = utils.AddVar("app", task.App, "string", vars)
+	vars = utils.AddVar("source", task.Source, "string", vars)
+	vars = utils.AddVar("threshold", task.Threshold, "float", vars)
+	vars = utils.AddVar("interval", task.Interval, "duration", vars)
+	return vars
+}
+
+// Row - Values saved to deadman_tasks
+func (task *DeadmanTaskSpec) Row() []interface{} {
+	return []interface{}{
+		task.App, task.Source, task.Threshold, task.Interval,
+		task.Slack, task.Post, task.Email,
+	}
+}
+
+// ProcessDeadmanRequest - POST | PATCH /task/deadman
+func ProcessDeadmanRequest(c *gin.Context) {
+	engine.ProcessRequest(descriptor, c)
+}
+
+// PreviewDeadmanTask - POST /task/deadman/preview
+func PreviewDeadmanTask(c *gin.Context) {
+	engine.PreviewTask(descriptor, c)
+}
+
+// DeleteDeadmanTask - DELETE /task/deadman/:app
+func DeleteDeadmanTask(c *gin.Context) {
+	engine.DeleteTask(descriptor, c)
+}
+
+// GetDeadmanTask - GET /task/deadman/:app
+func GetDeadmanTask(c *gin.Context) {
+	engine.GetTask(descriptor, c)
+}
+
+// ListDeadmanTasks - GET /tasks/deadman
+func ListDeadmanTasks(c *gin.Context) {
+	engine.ListTasks(descriptor, c)
+}
+
+// GetDeadmanTaskState - GET /task/deadman/:app/state
+func GetDeadmanTaskState(c *gin.Context) {
+	engine.GetTaskState(descriptor, c)
+}
@@ -0,0 +1,229 @@
+package deadman
+
+import (
+	"bytes"
+	"encoding/json"
+	"kapacitor-alerts-api/config"
+	"kapacitor-alerts-api/engine"
+	"kapacitor-alerts-api/engine/enginetest"
+	structs "kapacitor-alerts-api/structs"
+	"kapacitor-alerts-api/utils"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gopkg.in/guregu/null.v3/zero"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+/********************************************************
+*    Endpoints tested:
+*
+*    Method   Endpoint              Function
+*    ---------------------------------------------------
+*    POST     /task/deadman             TestCreateDeadmanTask
+*    PATCH    /task/deadman             TestUpdateDeadmanTask
+*    POST     /task/deadman/preview     TestHostileDeadmanInput
+*    DELETE   /task/deadman/:app        TestDeleteDeadmanTask
+*    GET      /tasks/deadman            TestCreateDeadmanTask
+*    GET      /task/deadman/:app        TestCreateDeadmanTask
+*    GET      /task/deadman/:app/state  TestGetDeadmanTaskState
+ */
+
+// setupRouter - Setup Gin routes for current test type
+func setupRouter() *gin.Engine {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Panicln(err)
+	}
+	pool := utils.GetDB(cfg.Database)
+	if pool == nil {
+		log.Panicln("Unable to connect to database")
+	}
+	if err := engine.Configure(cfg); err != nil {
+		log.Panicln(err)
+	}
+
+	router := gin.Default()
+	router.Use(utils.DBMiddleware(pool))
+	router.Use(config.Middleware(cfg))
+
+	router.POST("/task/deadman", ProcessDeadmanRequest)
+	router.PATCH("/task/deadman", ProcessDeadmanRequest)
+	router.POST("/task/deadman/preview", PreviewDeadmanTask)
+	router.DELETE("/task/deadman/:app", DeleteDeadmanTask)
+	router.GET("/task/deadman/:app", GetDeadmanTask)
+	router.GET("/task/deadman/:app/state", GetDeadmanTaskState)
+	router.GET("/tasks/deadman", ListDeadmanTasks)
+
+	return router
+}
+
+// TestCreateDeadmanTask - Make sure that creating a deadman task works and we can successfully get info about the created task
+func TestCreateDeadmanTask(t *testing.T) {
+	router := setupRouter()
+
+	// Create a new task
+	var task DeadmanDBTask
+	task.App = "gotest-voltron"
+	task.Source = "router"
+	task.Threshold = "0"
+	task.Period = "10m"
+	task.Slack = zero.StringFrom("#cobra")
+	taskBytes, err := json.Marshal(task)
+	assert.Nil(t, err, "Converting from DeadmanDBTask to JSON should not throw an error")
+
+	req, _ := http.NewRequest("POST", "/task/deadman", bytes.NewBuffer(taskBytes))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusCreated, w.Code, "HTTP response code for POST /task/deadman should be 201")
+
+	// Check that the new task exists and contains expected data
+	req, _ = http.NewRequest("GET", "/task/deadman/gotest-voltron", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for GET /task/deadman/:app should be 200")
+
+	var returnedTask DeadmanDBTask
+	err = json.Unmarshal([]byte(w.Body.String()), &returnedTask)
+
+	assert.Nil(t, err, "Converting from JSON to DeadmanDBTask should not throw an error")
+	assert.Equal(t, returnedTask.App, task.App, "Task app name should match")
+	assert.Equal(t, returnedTask.Source, task.Source, "Task source should match")
+	assert.Equal(t, returnedTask.Threshold, task.Threshold, "Task threshold should match")
+	assert.Equal(t, returnedTask.Period, task.Period, "Task interval should match")
+	assert.Equal(t, returnedTask.Slack, task.Slack, "Task slack should match")
+	assert.Equal(t, returnedTask.Email, task.Email, "Task email should match")
+	assert.Equal(t, returnedTask.Post, task.Post, "Task post should match")
+
+	// Check that the new task exists in the list of all tasks
+	req, _ = http.NewRequest("GET", "/tasks/deadman", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for GET /tasks/deadman should be 200")
+
+	var returnedTasks []DeadmanDBTask
+	err = json.Unmarshal([]byte(w.Body.String()), &returnedTasks)
+
+	assert.Nil(t, err, "Converting from JSON to []DeadmanDBTask should not throw an error")
+
+	var foundTask DeadmanDBTask
+
+	for _, n := range returnedTasks {
+		if n.App == task.App {
+			foundTask = n
+		}
+	}
+
+	assert.NotNil(t, foundTask, "Task should exist in returned list of tasks")
+
+	assert.Equal(t, foundTask.App, task.App, "Task app name should match")
+	assert.Equal(t, foundTask.Source, task.Source, "Task source should match")
+	assert.Equal(t, foundTask.Threshold, task.Threshold, "Task threshold should match")
+	assert.Equal(t, foundTask.Period, task.Period, "Task interval should match")
+	assert.Equal(t, foundTask.Slack, task.Slack, "Task slack should match")
+	assert.Equal(t, foundTask.Email, task.Email, "Task email should match")
+	assert.Equal(t, foundTask.Post, task.Post, "Task post should match")
+}
+
+// TestGetDeadmanTaskStatus - Make sure that we can get status information about a deadman task
+func TestGetDeadmanTaskState(t *testing.T) {
+	router := setupRouter()
+
+	req, _ := http.NewRequest("GET", "/task/deadman/gotest-voltron/state", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for GET /task/deadman/:app/state should be 200")
+
+	var taskState structs.SimpleTaskState
+	err := json.Unmarshal([]byte(w.Body.String()), &taskState)
+
+	assert.Nil(t, err, "Converting from JSON to structs.SimpleTaskState should not throw an error")
+	assert.Equal(t, taskState.App, "gotest-voltron", "Task app name should match")
+	assert.Equal(t, taskState.State, "OK", "Task state should be OK")
+}
+
+// TestUpdateDeadmanTask - Make sure that updating a deadman task's config works
+func TestUpdateDeadmanTask(t *testing.T) {
+	router := setupRouter()
+
+	// Create a task with updated information
+	// Slack - #cobra => nil
+	// Post - nil => http://example.com/
+	// Source - router => memory
+	// Threshold - 0 => 5
+	// Interval - 10m => 30m
+	var task DeadmanDBTask
+	task.App = "gotest-voltron"
+	task.Source = "memory"
+	task.Threshold = "5"
+	task.Period = "30m"
+	task.Post = zero.StringFrom("http://example.com/")
+	taskBytes, err := json.Marshal(task)
+	assert.Nil(t, err, "Converting from DeadmanDBTask to JSON should not throw an error")
+
+	req, _ := http.NewRequest("PATCH", "/task/deadman", bytes.NewBuffer(taskBytes))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusCreated, w.Code, "HTTP response code for PATCH /task/deadman should be 201")
+
+	// Check that the new task exists and contains expected data
+	req, _ = http.NewRequest("GET", "/task/deadman/gotest-voltron", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for GET /task/deadman/:app should be 200")
+
+	var returnedTask DeadmanDBTask
+	err = json.Unmarshal([]byte(w.Body.String()), &returnedTask)
+
+	// API sets nil slack channels to #
+	task.Slack = zero.StringFrom("#")
+
+	assert.Nil(t, err, "Converting from JSON to DeadmanDBTask should not throw an error")
+	assert.Equal(t, returnedTask.App, task.App, "Task app name should match")
+	assert.Equal(t, returnedTask.Source, task.Source, "Task source should match")
+	assert.Equal(t, returnedTask.Threshold, task.Threshold, "Task threshold should match")
+	assert.Equal(t, returnedTask.Period, task.Period, "Task interval should match")
+	assert.Equal(t, returnedTask.Slack, task.Slack, "Task slack should match")
+	assert.Equal(t, returnedTask.Email, task.Email, "Task email should match")
+	assert.Equal(t, returnedTask.Post, task.Post, "Task post should match")
+}
+
+// TestDeleteDeadmanTask - Make sure that deleting a deadman task works and that we cannot access it anymore
+func TestDeleteDeadmanTask(t *testing.T) {
+	router := setupRouter()
+
+	// Delete the task that was created in TestCreateDeadmanTask
+	req, _ := http.NewRequest("DELETE", "/task/deadman/gotest-voltron", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for DELETE /task/deadman/:app should be 200")
+
+	// Check that the deleted task doesn't exist anymore
+	req, _ = http.NewRequest("GET", "/task/deadman/gotest-voltron", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code, "HTTP response code for GET /task/deadman/:app on invalid app should be 404")
+}
+
+// TestHostileDeadmanInput - Make sure that user input is passed through vars or escaped in the rendered query, or rejected if it cannot be
+func TestHostileDeadmanInput(t *testing.T) {
+	inputs := append(enginetest.HostileNotify(""),
+		enginetest.Accepted("dot in app", `{"app":"gotest.hostile"}`, [2]string{"influx_query", `"fqdn" =~ /gotest\.hostile/`}),
+		enginetest.Accepted("dot in app with memory source", `{"app":"gotest.hostile","source":"memory"}`, [2]string{"influx_query", `"app"='gotest.hostile'`}),
+		enginetest.Rejected("expression in threshold", `{"app":"gotest-hostile","threshold":"0, 1m) |log("}`),
+		enginetest.Rejected("expression in interval", `{"app":"gotest-hostile","interval":"10m) |log("}`),
+	)
+	enginetest.CheckHostileInputs(t, PreviewDeadmanTask, inputs)
+}
@@ -0,0 +1,29 @@
+package deadman
+
+import (
+	"kapacitor-alerts-api/engine"
+
+	"gopkg.in/guregu/null.v3/zero"
+)
+
+// DeadmanTaskSpec - Used to create or update a deadman task
+type DeadmanTaskSpec struct {
+	App         string `json:"app"`
+	Source      string `json:"source"`
+	Measurement string `json:"-"`
+	Filter      string `json:"-"`
+	Threshold   string `json:"threshold"`
+	Interval    string `json:"interval"`
+	engine.Notify
+}
+
+// DeadmanDBTask - Used for retrieval of task information from the database
+type DeadmanDBTask struct {
+	App       string      `json:"app"`
+	Source    string      `json:"source"`
+	Threshold string      `json:"threshold"`
+	Period    string      `json:"interval"`
+	Slack     zero.String `json:"slack"`
+	Post      zero.String `json:"post"`
+	Email     zero.String `json:"email"`
+}
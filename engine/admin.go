@@ -0,0 +1,407 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"kapacitor-alerts-api/config"
+	utils "kapacitor-alerts-api/utils"
+	"log"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+// TemplateReload - Templates loaded by a reload, and the Kapacitor templates that were updated to match them
+type TemplateReload struct {
+	Templates []TemplateInfo `json:"templates"`
+	Updated   []string       `json:"updated"`
+}
+
+// ReloadTemplates - Reload the alert templates from a directory (or the embedded defaults if it is empty)
+func ReloadTemplates(dir string) ([]TemplateInfo, error) {
+	info, err := LoadTemplates(dir)
+	if err != nil {
+		log.Println("✖ Unable to reload templates: " + err.Error())
+		return nil, err
+	}
+	for _, t := range info {
+		log.Println("✓ Loaded " + t.Type + " template from " + t.Source)
+	}
+	return info, nil
+}
+
+// DeployTemplates - Update the Kapacitor templates of every alert type to match the loaded templates
+func DeployTemplates(ctx context.Context, db *sqlx.DB) ([]string, error) {
+	var updated []string
+	var failed []error
+	for _, d := range descriptors {
+		ids, err := d.Deploy(ctx, db)
+		updated = append(updated, ids...)
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+
+	for _, id := range updated {
+		log.Println("✓ Updated Kapacitor template " + id)
+	}
+	if len(failed) > 0 {
+		err := joinErrors(failed, "; ")
+		log.Println("✖ Unable to update Kapacitor templates: " + err.Error())
+		return updated, err
+	}
+	return updated, nil
+}
+
+// GetTemplates - GET /admin/templates
+func GetTemplates(c *gin.Context) {
+	c.JSON(200, Templates())
+}
+
+// ProcessTemplateReload - POST /admin/templates/reload
+func ProcessTemplateReload(c *gin.Context) {
+	cfg, err := config.FromContext(c)
+	if err != nil {
+		utils.ReportError(err, c, "Unable to read configuration")
+		return
+	}
+
+	info, err := ReloadTemplates(cfg.TemplateDir)
+	if err != nil {
+		utils.ReportInvalidRequest(c, "Unable to reload templates: "+err.Error())
+		return
+	}
+	if !cfg.Features.DeployTemplates {
+		c.JSON(200, TemplateReload{Templates: info, Updated: []string{}})
+		return
+	}
+
+	db, err := utils.GetDBFromContext(c)
+	if err != nil {
+		utils.ReportError(err, c, "Unable to access database")
+		return
+	}
+
+	updated, err := DeployTemplates(c.Request.Context(), db)
+	if err != nil {
+		utils.ReportError(err, c, "")
+		return
+	}
+	c.JSON(200, TemplateReload{Templates: info, Updated: updated})
+}
+
+// ProcessRedeploy - POST /admin/redeploy
+func ProcessRedeploy(c *gin.Context) {
+	var r RedeployRequest
+	if !readConcurrency(c, &r, &r.Concurrency) {
+		return
+	}
+
+	db, err := utils.GetDBFromContext(c)
+	if err != nil {
+		utils.ReportError(err, c, "Unable to access database")
+		return
+	}
+
+	job, err := StartRedeploy(db, r)
+	if err == ErrRedeployRunning {
+		utils.ReportConflict(c, err.Error())
+		return
+	}
+	if err != nil {
+		utils.ReportError(err, c, "")
+		return
+	}
+	if job == nil {
+		c.JSON(404, nil)
+		return
+	}
+
+	c.JSON(202, job.Snapshot())
+}
+
+// GetInstances - GET /admin/instances
+func GetInstances(c *gin.Context) {
+	c.JSON(200, Instances())
+}
+
+// ProcessMove - POST /admin/move
+func ProcessMove(c *gin.Context) {
+	var r MoveRequest
+	if !readConcurrency(c, &r, &r.Concurrency) {
+		return
+	}
+	if r.Target == "" {
+		utils.ReportInvalidRequest(c, "Target is required")
+		return
+	}
+
+	db, err := utils.GetDBFromContext(c)
+	if err != nil {
+		utils.ReportError(err, c, "Unable to access database")
+		return
+	}
+
+	job, err := StartMove(db, r)
+	if _, ok := err.(moveError); ok {
+		utils.ReportInvalidRequest(c, err.Error())
+		return
+	}
+	if err == ErrRedeployRunning {
+		utils.ReportConflict(c, err.Error())
+		return
+	}
+	if err != nil {
+		utils.ReportError(err, c, "")
+		return
+	}
+	if job == nil {
+		c.JSON(404, nil)
+		return
+	}
+
+	c.JSON(202, job.Snapshot())
+}
+
+// GetFailovers - GET /admin/failover
+func GetFailovers(c *gin.Context) {
+	c.JSON(200, Failovers())
+}
+
+// ProcessFailover - POST /admin/failover
+func ProcessFailover(c *gin.Context) {
+	bodybytes, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		utils.ReportError(err, c, "Server Error while reading response")
+		return
+	}
+
+	var r FailoverRequest
+	err = json.Unmarshal(bodybytes, &r)
+	if err != nil {
+		utils.ReportInvalidRequest(c, "Invalid request: "+err.Error())
+		return
+	}
+	if r.Instance == "" {
+		utils.ReportInvalidRequest(c, "Instance is required")
+		return
+	}
+
+	db, err := utils.GetDBFromContext(c)
+	if err != nil {
+		utils.ReportError(err, c, "Unable to access database")
+		return
+	}
+
+	ctx, cancel := utils.DBContext(c)
+	defer cancel()
+	f, err := StartFailover(ctx, db, r)
+	if _, ok := err.(failoverError); ok {
+		utils.ReportInvalidRequest(c, err.Error())
+		return
+	}
+	if err != nil {
+		utils.ReportError(err, c, "")
+		return
+	}
+	if f == nil {
+		c.JSON(404, nil)
+		return
+	}
+	c.JSON(200, f)
+}
+
+// ProcessFailBack - DELETE /admin/failover/:instance
+func ProcessFailBack(c *gin.Context) {
+	var r RedeployRequest
+	if !readConcurrency(c, &r, &r.Concurrency) {
+		return
+	}
+
+	db, err := utils.GetDBFromContext(c)
+	if err != nil {
+		utils.ReportError(err, c, "Unable to access database")
+		return
+	}
+
+	ctx, cancel := utils.DBContext(c)
+	defer cancel()
+	job, err := FailBack(ctx, db, c.Param("instance"), r.Concurrency)
+	if err == ErrNoFailover {
+		utils.ReportNotFound(c, err.Error())
+		return
+	}
+	if err == ErrRedeployRunning {
+		utils.ReportConflict(c, err.Error())
+		return
+	}
+	if err != nil {
+		utils.ReportError(err, c, "")
+		return
+	}
+	if job == nil {
+		c.JSON(404, nil)
+		return
+	}
+	c.JSON(202, job.Snapshot())
+}
+
+// GetRedeployStatus - GET /admin/redeploy/:id
+func GetRedeployStatus(c *gin.Context) {
+	job := GetRedeploy(c.Param("id"))
+	if job == nil {
+		c.JSON(404, nil)
+		return
+	}
+	c.JSON(200, job.Snapshot())
+}
+
+// readConcurrency - Read the concurrency of a redeploy from an optional request body, reporting any errors to the client
+func readConcurrency(c *gin.Context, body interface{}, concurrency *int) bool {
+	bodybytes, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		utils.ReportError(err, c, "Server Error while reading response")
+		return false
+	}
+	if len(bodybytes) > 0 {
+		err = json.Unmarshal(bodybytes, body)
+		if err != nil {
+			utils.ReportInvalidRequest(c, "Invalid request: "+err.Error())
+			return false
+		}
+	}
+	if *concurrency < 0 || *concurrency > MaxConcurrency {
+		utils.ReportInvalidRequest(c, "Concurrency must be between 1 and "+strconv.Itoa(MaxConcurrency))
+		return false
+	}
+	return true
+}
+
+// reportRollout - Send the result of a change to a canary to the client
+func reportRollout(c *gin.Context, rollout *Rollout, err error) {
+	if _, ok := err.(canaryError); ok {
+		utils.ReportInvalidRequest(c, err.Error())
+		return
+	}
+	if err == ErrRedeployRunning {
+		utils.ReportConflict(c, err.Error())
+		return
+	}
+	if err == ErrNoCanary {
+		utils.ReportNotFound(c, err.Error())
+		return
+	}
+	if err != nil {
+		utils.ReportError(err, c, "")
+		return
+	}
+	if rollout == nil {
+		c.JSON(404, nil)
+		return
+	}
+	c.JSON(202, rollout)
+}
+
+// ProcessCanary - POST /admin/canary
+func ProcessCanary(c *gin.Context) {
+	var r CanaryRequest
+	if !readConcurrency(c, &r, &r.Concurrency) {
+		return
+	}
+	if r.Percent < 0 || r.Percent > 100 {
+		utils.ReportInvalidRequest(c, "Percent must be between 0 and 100")
+		return
+	}
+	if len(r.Apps) == 0 && r.Percent == 0 {
+		utils.ReportInvalidRequest(c, "Apps or percent is required")
+		return
+	}
+
+	cfg, err := config.FromContext(c)
+	if err != nil {
+		utils.ReportError(err, c, "Unable to read configuration")
+		return
+	}
+
+	db, err := utils.GetDBFromContext(c)
+	if err != nil {
+		utils.ReportError(err, c, "Unable to access database")
+		return
+	}
+
+	ctx, cancel := utils.DBContext(c)
+	defer cancel()
+	rollout, err := StartCanary(ctx, db, cfg.TemplateDir, r)
+	reportRollout(c, rollout, err)
+}
+
+// ProcessCanaryPromote - POST /admin/canary/:type/promote
+func ProcessCanaryPromote(c *gin.Context) {
+	var r RedeployRequest
+	if !readConcurrency(c, &r, &r.Concurrency) {
+		return
+	}
+
+	cfg, err := config.FromContext(c)
+	if err != nil {
+		utils.ReportError(err, c, "Unable to read configuration")
+		return
+	}
+
+	db, err := utils.GetDBFromContext(c)
+	if err != nil {
+		utils.ReportError(err, c, "Unable to access database")
+		return
+	}
+
+	ctx, cancel := utils.DBContext(c)
+	defer cancel()
+	rollout, err := PromoteCanary(ctx, db, cfg.TemplateDir, c.Param("type"), r.Concurrency)
+	reportRollout(c, rollout, err)
+}
+
+// ProcessCanaryRollback - POST /admin/canary/:type/rollback
+func ProcessCanaryRollback(c *gin.Context) {
+	var r RedeployRequest
+	if !readConcurrency(c, &r, &r.Concurrency) {
+		return
+	}
+
+	db, err := utils.GetDBFromContext(c)
+	if err != nil {
+		utils.ReportError(err, c, "Unable to access database")
+		return
+	}
+
+	ctx, cancel := utils.DBContext(c)
+	defer cancel()
+	rollout, err := RollbackCanary(ctx, db, c.Param("type"), r.Concurrency)
+	reportRollout(c, rollout, err)
+}
+
+// GetCanaries - GET /admin/canary[/:type]
+func GetCanaries(c *gin.Context) {
+	db, err := utils.GetDBFromContext(c)
+	if err != nil {
+		utils.ReportError(err, c, "Unable to access database")
+		return
+	}
+
+	ctx, cancel := utils.DBContext(c)
+	defer cancel()
+	canaries, err := Canaries(ctx, db, c.Param("type"))
+	if err != nil {
+		utils.ReportError(err, c, "")
+		return
+	}
+
+	if c.Param("type") == "" {
+		c.JSON(200, canaries)
+	} else if len(canaries) == 0 {
+		c.JSON(404, nil)
+	} else {
+		c.JSON(200, canaries[0])
+	}
+}
@@ -0,0 +1,398 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Canary - A template being rolled out to the tasks of some apps before the rest of the tasks of a built-in
+// alert type, which keep running the stable template until the canary is promoted or rolled back
+type Canary struct {
+	Type    string         `json:"type"`
+	Status  string         `json:"status"`          // canary, promoted, or rolledback
+	Stable  string         `json:"stable"`          // Version of the template the rest of the tasks run
+	Version string         `json:"version"`         // Version of the template being rolled out
+	Apps    []string       `json:"apps"`            // Apps whose tasks run the canary
+	Percent int            `json:"percent"`         // Percentage of the other apps whose tasks run the canary
+	Started time.Time      `json:"started"`         // When the canary was started or last changed
+	Tasks   map[string]int `json:"tasks,omitempty"` // Number of tasks running each version of the template
+}
+
+// CanaryRequest - Which apps to roll the template of an alert type in the template directory out to
+type CanaryRequest struct {
+	Type        string   `json:"type"`
+	Apps        []string `json:"apps"`
+	Percent     int      `json:"percent"`
+	Concurrency int      `json:"concurrency"` // Number of tasks to redeploy at once
+}
+
+// Rollout - A change to a canary, and the redeploy that applies it to the tasks of the alert type
+type Rollout struct {
+	Canary   Canary   `json:"canary"`
+	Redeploy Redeploy `json:"redeploy"`
+}
+
+// rollout - The canary of an alert type along with its templates
+type rollout struct {
+	Canary
+	stable         string             // Text of the stable template
+	stableTemplate *template.Template // Stable template, which stays the current template of the alert type
+	canary         string             // Text of the template being rolled out
+	template       *template.Template // Template being rolled out
+}
+
+// rolloutRow - A rollout saved to the database
+type rolloutRow struct {
+	Alerttype string         `db:"alerttype"`
+	Status    string         `db:"status"`
+	Stable    string         `db:"stable"`
+	Canary    string         `db:"canary"`
+	Apps      pq.StringArray `db:"apps"`
+	Percent   int            `db:"percent"`
+	Started   time.Time      `db:"started"`
+}
+
+// ErrNoCanary - Only a canary that is being rolled out can be promoted or rolled back
+var ErrNoCanary = errors.New("No canary is being rolled out")
+
+// canaryError - A canary that cannot be rolled out, reported to the client as a bad request
+type canaryError string
+
+func (e canaryError) Error() string {
+	return string(e)
+}
+
+// includes - Whether the tasks of an app run the canary. Apps are picked by percentage with a hash of their
+// name, so every task of an app runs the same template and raising the percentage only adds apps.
+func (r *rollout) includes(app string) bool {
+	for _, a := range r.Apps {
+		if a == app {
+			return true
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(app))
+	return int(h.Sum32()%100) < r.Percent
+}
+
+// pinned - Whether the current template of the alert type is kept when the given template is loaded - while a
+// canary is being rolled out, or if the template is the one that was rolled back
+func (d *Descriptor) pinned(text string) bool {
+	r := d.rollout
+	return r != nil && (r.Status == "canary" || r.Status == "rolledback" && TemplateVersion(text) == r.Version)
+}
+
+// pin - Set the rollout of the alert type, making its stable template the current template if it is pinned.
+// Must be called with templatesLock held.
+func (d *Descriptor) pin(r *rollout) {
+	d.rollout = r
+	if d.pinned(d.text) {
+		d.template, d.text, d.source = r.stableTemplate, r.stable, "rollout"
+	}
+}
+
+// parseRollout - Parse the templates of a saved rollout
+func (d *Descriptor) parseRollout(row rolloutRow) (*rollout, error) {
+	stable, err := d.checkTemplate(row.Stable)
+	if err != nil {
+		return nil, errors.New("Invalid stable template: " + err.Error())
+	}
+	canary, err := d.checkTemplate(row.Canary)
+	if err != nil {
+		return nil, errors.New("Invalid canary template: " + err.Error())
+	}
+
+	return row.rollout(stable, canary), nil
+}
+
+// canary - The canary described by a saved rollout
+func (row rolloutRow) canary() Canary {
+	return Canary{
+		Type:    row.Alerttype,
+		Status:  row.Status,
+		Stable:  TemplateVersion(row.Stable),
+		Version: TemplateVersion(row.Canary),
+		Apps:    append([]string{}, row.Apps...),
+		Percent: row.Percent,
+		Started: row.Started,
+	}
+}
+
+// rollout - A saved rollout along with its parsed templates
+func (row rolloutRow) rollout(stable *template.Template, canary *template.Template) *rollout {
+	return &rollout{
+		Canary:         row.canary(),
+		stable:         row.Stable,
+		stableTemplate: stable,
+		canary:         row.Canary,
+		template:       canary,
+	}
+}
+
+// builtin - The built-in alert type with the given name, or nil if there is none
+func builtin(name string) *Descriptor {
+	for _, d := range descriptors {
+		if d.Name == name {
+			return d
+		}
+	}
+	return nil
+}
+
+// LoadCanaries - Restore the rollouts saved in the database, pinning the stable template of every alert type
+// with a canary or a rolled back template. Must be called after the templates are loaded.
+func LoadCanaries(ctx context.Context, db *sqlx.DB) error {
+	var rows []rolloutRow
+	err := db.SelectContext(ctx, &rows, "SELECT alerttype, status, stable, canary, apps, percent, started FROM template_rollouts")
+	if err != nil {
+		return errors.New("Unable to access database")
+	}
+
+	for _, row := range rows {
+		d := builtin(row.Alerttype)
+		if d == nil || row.Status == "promoted" {
+			continue
+		}
+		r, err := d.parseRollout(row)
+		if err != nil {
+			return errors.New("Unable to load rollout of " + d.Name + ": " + err.Error())
+		}
+
+		templatesLock.Lock()
+		d.pin(r)
+		templatesLock.Unlock()
+		if r.Status == "canary" {
+			log.Println("✓ Rolling out " + d.Name + " template " + r.Version + " to some tasks, the rest run " + r.Stable)
+		}
+	}
+	return nil
+}
+
+// StartCanary - Roll the template of an alert type in the template directory out to the tasks of some apps, keeping the
+// current template for the rest. If a canary is already being rolled out, it is replaced. Returns nil if the
+// alert type does not exist.
+func StartCanary(ctx context.Context, db *sqlx.DB, dir string, r CanaryRequest) (*Rollout, error) {
+	d := builtin(r.Type)
+	if d == nil {
+		return nil, nil
+	}
+	if running() {
+		return nil, ErrRedeployRunning
+	}
+
+	if dir == "" {
+		return nil, canaryError("Canaries are rolled out from the template files in TEMPLATE_DIR, which is not set")
+	}
+	path := TemplatePath(dir, d.Name)
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, canaryError("Unable to read " + path + ": " + err.Error())
+	}
+	t, err := d.checkTemplate(string(buf))
+	if err != nil {
+		return nil, canaryError("Invalid template " + path + " for " + d.Name + ": " + err.Error())
+	}
+
+	templatesLock.RLock()
+	stable, stableTemplate := d.text, d.template
+	templatesLock.RUnlock()
+	if TemplateVersion(string(buf)) == TemplateVersion(stable) {
+		return nil, canaryError(path + " is the current template of " + d.Name)
+	}
+
+	row := rolloutRow{
+		Alerttype: d.Name,
+		Status:    "canary",
+		Stable:    stable,
+		Canary:    string(buf),
+		Apps:      r.Apps,
+		Percent:   r.Percent,
+		Started:   time.Now(),
+	}
+	_, err = db.ExecContext(ctx, `INSERT INTO template_rollouts (alerttype, status, stable, canary, apps, percent, started)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (alerttype) DO UPDATE SET status = $2, stable = $3, canary = $4, apps = $5, percent = $6, started = $7`,
+		row.Alerttype, row.Status, row.Stable, row.Canary, pq.StringArray(append([]string{}, row.Apps...)), row.Percent, row.Started)
+	if err != nil {
+		return nil, errors.New("Unable to save to database")
+	}
+
+	rollout := row.rollout(stableTemplate, t)
+	templatesLock.Lock()
+	d.pin(rollout)
+	templatesLock.Unlock()
+
+	log.Println("✓ Rolling out " + d.Name + " template " + rollout.Version + " to " + strconv.Itoa(len(r.Apps)) +
+		" apps and " + strconv.Itoa(r.Percent) + "% of the rest")
+	return d.redeployRollout(ctx, db, r.Concurrency, nil)
+}
+
+// PromoteCanary - Make the template being rolled out the current template of an alert type, and move every
+// task to it. Returns nil if the alert type does not exist.
+func PromoteCanary(ctx context.Context, db *sqlx.DB, dir string, name string, concurrency int) (*Rollout, error) {
+	d, r, err := canaryOf(name)
+	if d == nil || err != nil {
+		return nil, err
+	}
+
+	_, err = db.ExecContext(ctx, "UPDATE template_rollouts SET status = 'promoted' WHERE alerttype = $1", d.Name)
+	if err != nil {
+		return nil, errors.New("Unable to access database")
+	}
+
+	templatesLock.Lock()
+	d.template, d.text, d.source, d.rollout = r.template, r.canary, TemplatePath(dir, d.Name), nil
+	templatesLock.Unlock()
+
+	log.Println("✓ Promoted " + d.Name + " template " + r.Version)
+	return d.redeployRollout(ctx, db, concurrency, d.removeCanaryTemplates)
+}
+
+// RollbackCanary - Move the tasks running the template being rolled out back to the stable template. The
+// rolled back template stays out of use until its file changes. Returns nil if the alert type does not exist.
+func RollbackCanary(ctx context.Context, db *sqlx.DB, name string, concurrency int) (*Rollout, error) {
+	d, r, err := canaryOf(name)
+	if d == nil || err != nil {
+		return nil, err
+	}
+
+	_, err = db.ExecContext(ctx, "UPDATE template_rollouts SET status = 'rolledback' WHERE alerttype = $1", d.Name)
+	if err != nil {
+		return nil, errors.New("Unable to access database")
+	}
+
+	rolledback := *r
+	rolledback.Status = "rolledback"
+	templatesLock.Lock()
+	d.pin(&rolledback)
+	templatesLock.Unlock()
+
+	log.Println("✓ Rolled back " + d.Name + " template " + r.Version + " to " + r.Stable)
+	return d.redeployRollout(ctx, db, concurrency, d.removeCanaryTemplates)
+}
+
+// canaryOf - The built-in alert type with the given name and the canary being rolled out for it
+func canaryOf(name string) (*Descriptor, *rollout, error) {
+	d := builtin(name)
+	if d == nil {
+		return nil, nil, nil
+	}
+
+	templatesLock.RLock()
+	r := d.rollout
+	templatesLock.RUnlock()
+	if r == nil || r.Status != "canary" {
+		return d, nil, ErrNoCanary
+	}
+	if running() {
+		return d, nil, ErrRedeployRunning
+	}
+	return d, r, nil
+}
+
+// redeployRollout - Redeploy the tasks of the alert type to apply a change to its rollout
+func (d *Descriptor) redeployRollout(ctx context.Context, db *sqlx.DB, concurrency int, after func(job *Redeploy)) (*Rollout, error) {
+	job, err := startRedeploy(db, []*Descriptor{d}, RedeployRequest{Type: d.Name, Concurrency: concurrency}, nil, after)
+	if err != nil {
+		return nil, err
+	}
+
+	canaries, err := Canaries(ctx, db, d.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &Rollout{Canary: canaries[0], Redeploy: job.Snapshot()}, nil
+}
+
+// removeCanaryTemplates - Delete the Kapacitor templates of a canary once every task has been moved off them
+func (d *Descriptor) removeCanaryTemplates(job *Redeploy) {
+	if failed := len(job.Snapshot().Failed); failed > 0 {
+		log.Println("✖ Keeping the canary templates of " + d.Name + " - " + strconv.Itoa(failed) + " tasks could not be redeployed")
+		return
+	}
+
+	ctx := context.Background()
+	for _, k := range Instances() {
+		templates, err := d.templates(ctx, k)
+		if err != nil {
+			log.Println("✖ Unable to remove the canary templates of " + d.Name + " from " + k.Name + ": " + err.Error())
+			continue
+		}
+		for _, t := range templates {
+			if shape, _ := d.parseTemplateID(t.ID); !shape.canary {
+				continue
+			}
+			forgetTemplate(k, t.ID)
+			if err := deleteKapacitorTemplate(ctx, k, t.ID); err != nil {
+				log.Println("✖ Unable to remove Kapacitor template " + qualifiedID(k, t.ID) + ": " + err.Error())
+			}
+		}
+	}
+}
+
+// Canaries - The rollouts of every built-in alert type, or of the named one, with the number of tasks running
+// each version of its template
+func Canaries(ctx context.Context, db *sqlx.DB, name string) ([]Canary, error) {
+	query := "SELECT alerttype, status, stable, canary, apps, percent, started FROM template_rollouts"
+	var rows []rolloutRow
+	var err error
+	if name != "" {
+		err = db.SelectContext(ctx, &rows, query+" WHERE alerttype = $1", name)
+	} else {
+		err = db.SelectContext(ctx, &rows, query+" ORDER BY alerttype ASC")
+	}
+	if err != nil {
+		return nil, errors.New("Unable to access database")
+	}
+
+	var canaries []Canary
+	for _, row := range rows {
+		canary := row.canary()
+
+		var counts []struct {
+			Version string `db:"version"`
+			Count   int    `db:"count"`
+		}
+		err = db.SelectContext(ctx, &counts, "SELECT version, count(*) AS count FROM task_templates WHERE alerttype = $1 GROUP BY version", row.Alerttype)
+		if err != nil {
+			return nil, errors.New("Unable to access database")
+		}
+		canary.Tasks = make(map[string]int)
+		for _, c := range counts {
+			canary.Tasks[c.Version] = c.Count
+		}
+		canaries = append(canaries, canary)
+	}
+	return canaries, nil
+}
+
+// legacyVersion - Version recorded for imported tasks that may not run the current template
+const legacyVersion = "legacy"
+
+// saveVersion - Record the version of the template that a task runs
+func (d *Descriptor) saveVersion(ctx context.Context, db sqlx.ExecerContext, id string, version string) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO task_templates (id, alerttype, version) VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET alerttype = $2, version = $3, updated = now()`, id, d.Name, version)
+	if err != nil {
+		return errors.New("Unable to save to database")
+	}
+	return nil
+}
+
+// deleteVersion - Forget the template version of a deleted task
+func (d *Descriptor) deleteVersion(ctx context.Context, db *sqlx.DB, id string) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM task_templates WHERE id = $1", id)
+	if err != nil {
+		return errors.New("Unable to access database")
+	}
+	return nil
+}
@@ -0,0 +1,312 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	structs "kapacitor-alerts-api/structs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Descriptor - Declares an alert type. The engine provides the create, update, delete, get, list,
+// state, and migration behavior of every alert type from its descriptor.
+type Descriptor struct {
+	Name     string                                 // Name of the alert type (e.g. memory, 5xx)
+	Table    string                                 // Table that the config of each task is saved to
+	Params   []string                               // Route parameters that identify a task (e.g. app, dyno)
+	Columns  []string                               // Columns of the table that match Params
+	Scope    []string                               // Leading keys shared by every task of the alert type (e.g. the name of a registered alert type)
+	TaskType string                                 // Kapacitor task type - batch (default) or stream
+	Template string                                 // TICKscript template - the body is rendered with a Shape, and each [[define]] with a Spec
+	Funcs    template.FuncMap                       // Extra functions available to the template
+	ID       func(keys []string) string             // Kapacitor task ID of the task identified by Params
+	Pattern  *regexp.Regexp                         // Matches the Kapacitor task IDs of the alert type
+	NewSpec  func() Spec                            // Returns an empty create or update request
+	FromVars func(vars map[string]structs.Var) Spec // Rebuilds a request from the vars of a Kapacitor task
+	Model    interface{}                            // Struct that rows of the table are read into
+
+	template *template.Template
+	text     string
+	source   string
+	rollout  *rollout
+}
+
+// Spec - A request to create or update a task. Specs are rendered with the [[define]] blocks of the
+// template of their alert type, so any fields used by the template must be exported.
+type Spec interface {
+	// Prepare - Validate the request and fill in defaults. Errors are sent to the client as a bad request.
+	Prepare() error
+	// Keys - Values that identify the task, in the same order as the Params of the alert type
+	Keys() []string
+	// TaskVars - Variables saved with the task in Kapacitor (used to rebuild the task in migrations)
+	TaskVars() map[string]structs.Var
+	// Row - Values saved to the table of the alert type, in column order
+	Row() []interface{}
+
+	notify() *Notify
+}
+
+// Optional - Implemented by the specs of alert types with optional parts in their script (e.g. growth detection).
+// Options must return every option of the alert type, whether or not it is enabled.
+type Optional interface {
+	Options() map[string]bool
+}
+
+// Shape - What the body of a template is rendered with. Tasks with the same shape share a Kapacitor template,
+// so the body can only depend on the structure of a task - its values are passed to the template as vars.
+type Shape struct {
+	Options map[string]bool // Optional parts of the script that are enabled
+	Slack   bool            // Notify the slack channel in var slack
+	Post    bool            // Post to the URL in var post
+	Emails  []string        // Names of the vars holding each email address to notify (email_0, email_1, ...)
+
+	canary bool // Rendered with the template being rolled out to the task
+}
+
+// emailVarRegex - Names of the vars holding email addresses
+var emailVarRegex = regexp.MustCompile(`^email_[0-9]+$`)
+
+// Notify - Where to send the alerts of a task, and where to run it. Embedded in every Spec.
+type Notify struct {
+	Slack      string   `json:"slack"`
+	Post       string   `json:"post"`
+	Email      string   `json:"email"`
+	Region     string   `json:"region,omitempty"` // Kapacitor instance to run the task on, instead of the one of its space
+	EmailArray []string `json:"-"`
+}
+
+func (n *Notify) notify() *Notify {
+	return n
+}
+
+// prepare - Normalize the slack channel and split the email addresses
+func (n *Notify) prepare() {
+	if !strings.HasPrefix(n.Slack, "#") && !strings.HasPrefix(n.Slack, "@") {
+		n.Slack = "#" + n.Slack
+	}
+	n.EmailArray = strings.Split(n.Email, ",")
+}
+
+// emails - The email addresses to notify
+func (n *Notify) emails() []string {
+	var emails []string
+	for _, email := range n.EmailArray {
+		if email = strings.TrimSpace(email); email != "" {
+			emails = append(emails, email)
+		}
+	}
+	return emails
+}
+
+var descriptors []*Descriptor
+
+// New - Parse the template of an alert type
+func New(d *Descriptor) (*Descriptor, error) {
+	if len(d.Params) != len(d.Columns) {
+		return nil, errors.New("Alert type " + d.Name + " must have a column for each parameter")
+	}
+	if d.TaskType == "" {
+		d.TaskType = "batch"
+	}
+	t, err := d.parseTemplate(d.Template)
+	if err != nil {
+		return nil, err
+	}
+	d.template, d.text, d.source = t, d.Template, "embedded"
+	return d, nil
+}
+
+// Register - Parse the template of a built-in alert type and add it to the list used for migrations
+func Register(d *Descriptor) *Descriptor {
+	d, err := New(d)
+	if err == nil {
+		_, err = d.checkTemplate(d.Template)
+	}
+	if err != nil {
+		panic("✖ Invalid alert type " + d.Name + ": " + err.Error())
+	}
+	descriptors = append(descriptors, d)
+	return d
+}
+
+// Descriptors - All registered alert types
+func Descriptors() []*Descriptor {
+	return descriptors
+}
+
+// shape - The structure of the script of a task
+func (d *Descriptor) shape(spec Spec) Shape {
+	shape := Shape{Options: make(map[string]bool)}
+	if o, ok := spec.(Optional); ok {
+		shape.Options = o.Options()
+	}
+
+	n := spec.notify()
+	shape.Slack = n.Slack != ""
+	shape.Post = n.Post != ""
+	for i := range n.emails() {
+		shape.Emails = append(shape.Emails, "email_"+strconv.Itoa(i))
+	}
+	return shape
+}
+
+// options - Every option of the alert type, disabled
+func (d *Descriptor) options() map[string]bool {
+	options := make(map[string]bool)
+	if d.NewSpec == nil {
+		return options
+	}
+	if o, ok := d.NewSpec().(Optional); ok {
+		for name := range o.Options() {
+			options[name] = false
+		}
+	}
+	return options
+}
+
+// TemplateID - ID of the Kapacitor template of a shape, e.g. memory.growth.slack.email2, or
+// memory.canary.growth.slack.email2 for tasks running the template being rolled out
+func (d *Descriptor) TemplateID(shape Shape) string {
+	var options []string
+	for name, enabled := range shape.Options {
+		if enabled {
+			options = append(options, name)
+		}
+	}
+	sort.Strings(options)
+
+	parts := []string{d.Name}
+	if shape.canary {
+		parts = append(parts, "canary")
+	}
+	parts = append(parts, options...)
+	if shape.Slack {
+		parts = append(parts, "slack")
+	}
+	if shape.Post {
+		parts = append(parts, "post")
+	}
+	if len(shape.Emails) > 0 {
+		parts = append(parts, "email"+strconv.Itoa(len(shape.Emails)))
+	}
+	return strings.Join(parts, ".")
+}
+
+// parseTemplateID - The shape of a Kapacitor template of the alert type. Returns false if the template
+// does not belong to the alert type.
+func (d *Descriptor) parseTemplateID(id string) (Shape, bool) {
+	parts := strings.Split(id, ".")
+	shape := Shape{Options: d.options()}
+	if parts[0] != d.Name {
+		return shape, false
+	}
+
+	for i, part := range parts[1:] {
+		if part == "canary" && i == 0 {
+			shape.canary = true
+		} else if _, ok := shape.Options[part]; ok {
+			shape.Options[part] = true
+		} else if part == "slack" {
+			shape.Slack = true
+		} else if part == "post" {
+			shape.Post = true
+		} else if n, err := strconv.Atoi(strings.TrimPrefix(part, "email")); err == nil && strings.HasPrefix(part, "email") {
+			for i := 0; i < n; i++ {
+				shape.Emails = append(shape.Emails, "email_"+strconv.Itoa(i))
+			}
+		} else {
+			return shape, false
+		}
+	}
+	return shape, true
+}
+
+// execute - Render a template, or one of its [[define]] blocks
+func execute(t *template.Template, data interface{}) (string, error) {
+	var sb bytes.Buffer
+	swr := bufio.NewWriter(&sb)
+	err := t.Execute(swr, data)
+	if err != nil {
+		return "", err
+	}
+	swr.Flush()
+	return string(sb.Bytes()), nil
+}
+
+// current - The current template of the alert type
+func (d *Descriptor) current() *template.Template {
+	templatesLock.RLock()
+	defer templatesLock.RUnlock()
+	return d.template
+}
+
+// templateFor - The template a task runs - the template being rolled out if the task is part of a canary,
+// otherwise the current template. Returns the template, its version, and whether it is the canary.
+func (d *Descriptor) templateFor(spec Spec) (*template.Template, string, bool) {
+	templatesLock.RLock()
+	defer templatesLock.RUnlock()
+	if r := d.rollout; r != nil && r.Status == "canary" && r.includes(d.app(spec.Keys())) {
+		return r.template, r.Version, true
+	}
+	return d.template, TemplateVersion(d.text), false
+}
+
+// templateOf - The template that renders a shape, or nil for a canary shape when no canary is being rolled out
+func (d *Descriptor) templateOf(shape Shape) *template.Template {
+	templatesLock.RLock()
+	defer templatesLock.RUnlock()
+	if !shape.canary {
+		return d.template
+	}
+	if r := d.rollout; r != nil && r.Status == "canary" {
+		return r.template
+	}
+	return nil
+}
+
+// script - Render the Kapacitor template of a shape
+func (d *Descriptor) script(shape Shape) (string, error) {
+	t := d.templateOf(shape)
+	if t == nil {
+		return "", errors.New("No canary of " + d.Name + " is being rolled out")
+	}
+	return execute(t, shape)
+}
+
+// app - The app of a task, from the keys that identify it
+func (d *Descriptor) app(keys []string) string {
+	for i, param := range d.Params {
+		if param == "app" && i < len(keys) {
+			return keys[i]
+		}
+	}
+	return ""
+}
+
+// defines - Render each [[define]] block of a template with a task into a string var of the same name
+func (d *Descriptor) defines(spec Spec, t *template.Template, vars map[string]structs.Var) (map[string]structs.Var, error) {
+	for _, define := range t.Templates() {
+		if define.Name() == t.Name() {
+			continue
+		}
+		value, err := execute(define, spec)
+		if err != nil {
+			return nil, err
+		}
+		vars[define.Name()] = structs.Var{Value: strings.TrimSpace(value), Type: "string", Description: define.Name()}
+	}
+	return vars, nil
+}
+
+// where - SQL condition that selects the task identified by the given number of Params
+func (d *Descriptor) where(n int) string {
+	var conds []string
+	for i := 0; i < n; i++ {
+		conds = append(conds, d.Columns[i]+"=$"+strconv.Itoa(i+1))
+	}
+	return strings.Join(conds, " AND ")
+}
@@ -0,0 +1,1060 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"kapacitor-alerts-api/config"
+	structs "kapacitor-alerts-api/structs"
+	"kapacitor-alerts-api/utils"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSpec - A minimal alert type with two keys
+type testSpec struct {
+	App      string `json:"app"`
+	Dynotype string `json:"dynotype"`
+	Crit     string `json:"crit"`
+	Notify
+}
+
+func (task *testSpec) Prepare() error {
+	if task.Crit == "" {
+		return errors.New("Crit is required")
+	}
+	return nil
+}
+
+func (task *testSpec) Keys() []string {
+	return []string{task.App, task.Dynotype}
+}
+
+func (task *testSpec) TaskVars() map[string]structs.Var {
+	vars := make(map[string]structs.Var)
+	vars = utils.AddVar("app", task.App, "string", vars)
+	vars = utils.AddVar("dynotype", task.Dynotype, "string", vars)
+	vars = utils.AddVar("crit", task.Crit, "int", vars)
+	return vars
+}
+
+func (task *testSpec) Options() map[string]bool {
+	return map[string]bool{"web": task.Dynotype == "web"}
+}
+
+func (task *testSpec) Row() []interface{} {
+	return []interface{}{task.App, task.Dynotype, task.Crit, task.Slack, task.Post, task.Email}
+}
+
+// testTemplate - The body lists what the shape enables, and the summary var holds the values of the task
+const testTemplate = `[[define "summary"]][[ .App ]] [[ .Dynotype ]] > [[ .Crit ]][[end]]` +
+	`[[if .Options.web ]]web [[end]]crit[[if .Slack ]] slack[[end]][[if .Post ]] post[[end]][[range .Emails ]] [[ . ]][[end]]`
+
+func newTestDescriptor(t *testing.T) *Descriptor {
+	d, err := New(&Descriptor{
+		Name:     "test",
+		Table:    "test_tasks",
+		Params:   []string{"app", "dyno"},
+		Columns:  []string{"app", "dynotype"},
+		Template: testTemplate,
+		ID:       func(keys []string) string { return keys[0] + "-test-" + keys[1] },
+		Pattern:  regexp.MustCompile(`-test-\w+$`),
+		NewSpec:  func() Spec { return &testSpec{} },
+		FromVars: func(vars map[string]structs.Var) Spec {
+			return &testSpec{
+				App:      StringVar(vars, "app"),
+				Dynotype: StringVar(vars, "dynotype"),
+				Crit:     StringVar(vars, "crit"),
+			}
+		},
+		Model: struct{}{},
+	})
+	assert.Nil(t, err, "Valid descriptor should not throw an error")
+	return d
+}
+
+// TestNew - Make sure that invalid descriptors are rejected
+func TestNew(t *testing.T) {
+	d := newTestDescriptor(t)
+	assert.Equal(t, "batch", d.TaskType, "Task type should default to batch")
+
+	_, err := New(&Descriptor{Name: "test", Template: "[[ if .App ]]"})
+	assert.NotNil(t, err, "Invalid template should throw an error")
+
+	_, err = New(&Descriptor{Name: "test", Params: []string{"app"}})
+	assert.NotNil(t, err, "Params without matching columns should throw an error")
+}
+
+// TestBuild - Make sure that tasks are created from the template of their shape, with their values as vars
+func TestBuild(t *testing.T) {
+	d := newTestDescriptor(t)
+
+	spec := d.FromVars(map[string]structs.Var{
+		"app":      {Value: "foo-space"},
+		"dynotype": {Value: "web"},
+		"crit":     {Value: float64(500)},
+	})
+	assert.Nil(t, spec.Prepare(), "Valid spec should not throw an error")
+	n := spec.notify()
+	n.Email = "a@example.com, b@example.com,"
+	n.prepare()
+
+	task, tpl, err := d.build(spec)
+	assert.Nil(t, err, "Rendering the template should not throw an error")
+	assert.Equal(t, "test.web.slack.email2", tpl.ID, "Template ID should be built from the shape")
+	assert.Equal(t, "batch", tpl.Type, "Template type should match")
+	assert.Equal(t, "web crit slack email_0 email_1", tpl.Script, "Template should be rendered with the shape")
+	assert.Equal(t, "foo-space-test-web", task.ID, "Task ID should be built from the keys")
+	assert.Equal(t, tpl.ID, task.TemplateID, "Task should be created from the template")
+	assert.Equal(t, "foo-space web > 500", task.Vars["summary"].Value, "Defines should be rendered into vars")
+	assert.Equal(t, "a@example.com", task.Vars["email_0"].Value, "Each email address should have a var")
+	assert.Equal(t, "b@example.com", task.Vars["email_1"].Value, "Each email address should have a var")
+	assert.Equal(t, "#", task.Vars["slack"].Value, "Slack channels should be prefixed with #")
+	assert.Equal(t, 500, task.Vars["crit"].Value, "Vars should be typed")
+	assert.Equal(t, "foo-space-test-web", task.Vars["id"].Value, "ID should be saved as a var")
+}
+
+// TestTemplateID - Make sure that template IDs can be turned back into the shape they were built from
+func TestTemplateID(t *testing.T) {
+	d := newTestDescriptor(t)
+
+	shape := Shape{Options: map[string]bool{"web": true}, Post: true, Emails: []string{"email_0", "email_1", "email_2"}}
+	assert.Equal(t, "test.web.post.email3", d.TemplateID(shape), "Template ID should list the enabled parts of the shape")
+	parsed, ok := d.parseTemplateID("test.web.post.email3")
+	assert.True(t, ok, "Template of the alert type should be recognized")
+	assert.Equal(t, shape, parsed, "Shape should be parsed from the template ID")
+
+	parsed, ok = d.parseTemplateID("test")
+	assert.True(t, ok, "Template without options should be recognized")
+	assert.Equal(t, Shape{Options: map[string]bool{"web": false}}, parsed, "Options should default to disabled")
+
+	shape = Shape{Options: map[string]bool{"web": false}, Slack: true, canary: true}
+	assert.Equal(t, "test.canary.slack", d.TemplateID(shape), "Template ID should mark canary templates")
+	parsed, ok = d.parseTemplateID("test.canary.slack")
+	assert.True(t, ok, "Canary template of the alert type should be recognized")
+	assert.Equal(t, shape, parsed, "Canary shape should be parsed from the template ID")
+
+	for _, id := range []string{"testing.slack", "test.worker", "test.emailx", "test.slack.canary"} {
+		_, ok = d.parseTemplateID(id)
+		assert.False(t, ok, "Template "+id+" should not belong to the alert type")
+	}
+}
+
+// TestWhere - Make sure that tasks are selected by their leading keys
+func TestWhere(t *testing.T) {
+	d := newTestDescriptor(t)
+	assert.Equal(t, "app=$1", d.where(1), "Condition should select by app")
+	assert.Equal(t, "app=$1 AND dynotype=$2", d.where(2), "Condition should select by app and dynotype")
+}
+
+// TestVarHelpers - Make sure that Kapacitor vars are converted back into request values
+func TestVarHelpers(t *testing.T) {
+	vars := map[string]structs.Var{
+		"name":   {Value: "foo"},
+		"count":  {Value: float64(3)},
+		"ratio":  {Value: 1.5},
+		"enable": {Value: true},
+	}
+	assert.Equal(t, "foo", StringVar(vars, "name"), "Strings should be returned as is")
+	assert.Equal(t, "3", StringVar(vars, "count"), "Whole numbers should not have a decimal point")
+	assert.Equal(t, "1.5", StringVar(vars, "ratio"), "Decimals should be kept")
+	assert.Equal(t, "", StringVar(vars, "missing"), "Missing vars should be empty")
+	assert.True(t, BoolVar(vars, "enable"), "Booleans should be returned as is")
+	assert.False(t, BoolVar(vars, "missing"), "Missing booleans should be false")
+
+	vars = map[string]structs.Var{
+		"window": {Value: "10m"},
+		"every":  {Value: float64(90 * time.Second)},
+		"period": {Value: float64(2 * time.Hour)},
+	}
+	assert.Equal(t, "10m", DurationVar(vars, "window"), "Durations saved as strings should be returned as is")
+	assert.Equal(t, "90s", DurationVar(vars, "every"), "Durations should be formatted in the largest whole unit")
+	assert.Equal(t, "2h", DurationVar(vars, "period"), "Durations should be formatted in the largest whole unit")
+	assert.Equal(t, "", DurationVar(vars, "missing"), "Missing durations should be empty")
+}
+
+// TestLoadTemplates - Make sure that templates are loaded from files, validated, and fall back to the embedded defaults
+func TestLoadTemplates(t *testing.T) {
+	d := Register(newTestDescriptor(t))
+	defer func() { descriptors = nil }()
+
+	spec := &testSpec{App: "foo-space", Dynotype: "web", Crit: "500"}
+
+	dir, err := ioutil.TempDir("", "templates")
+	assert.Nil(t, err, "Creating a temporary directory should not throw an error")
+	defer os.RemoveAll(dir)
+
+	// No file - the embedded default is used
+	info, err := LoadTemplates(dir)
+	assert.Nil(t, err, "Missing template files should not throw an error")
+	assert.Equal(t, []TemplateInfo{{Type: "test", Source: "embedded", Version: TemplateVersion(testTemplate)}}, info, "Missing template files should fall back to the embedded default")
+
+	// Valid file - the template is replaced
+	path := TemplatePath(dir, "test")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`[[define "summary"]][[ .App ]] crit [[ .Crit ]][[end]]crit`), 0644))
+	info, err = LoadTemplates(dir)
+	assert.Nil(t, err, "Valid template file should not throw an error")
+	assert.Equal(t, path, info[0].Source, "Template should be loaded from the file")
+	task, tpl, err := d.build(spec)
+	assert.Nil(t, err, "Rendering the template should not throw an error")
+	assert.Equal(t, "crit", tpl.Script, "Template should be rendered with the loaded template")
+	assert.Equal(t, "foo-space crit 500", task.Vars["summary"].Value, "Vars should be rendered with the loaded template")
+
+	// Invalid files - the current template is kept
+	invalid := []string{
+		`[[ if .App ]]`,
+		`[[define "summary"]][[ .Warn ]][[end]]`,
+		`[[ .App ]]`,
+		`[[define "slack"]][[ .App ]][[end]]`,
+		`[[define "not-a-var"]][[ .App ]][[end]]`,
+	}
+	for _, text := range invalid {
+		assert.Nil(t, ioutil.WriteFile(path, []byte(text), 0644))
+		_, err = LoadTemplates(dir)
+		assert.NotNil(t, err, "Invalid template "+text+" should throw an error")
+	}
+	assert.Equal(t, path, Templates()[0].Source, "Invalid template should not replace the current one")
+	task, _, _ = d.build(spec)
+	assert.Equal(t, "foo-space crit 500", task.Vars["summary"].Value, "Invalid template should not replace the current one")
+
+	// No directory - back to the embedded default
+	info, err = LoadTemplates("")
+	assert.Nil(t, err, "Loading the embedded templates should not throw an error")
+	assert.Equal(t, "embedded", info[0].Source, "Templates should fall back to the embedded defaults")
+}
+
+// TestPreviewTask - Make sure that previews are rendered and validated like new tasks, without needing a database
+func TestPreviewTask(t *testing.T) {
+	d := newTestDescriptor(t)
+	router := gin.New()
+	router.POST("/task/test/preview", func(c *gin.Context) { PreviewTask(d, c) })
+
+	req, _ := http.NewRequest("POST", "/task/test/preview", strings.NewReader(`{"app":"foo-space","dynotype":"web","crit":"500","slack":"alerts"}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for a valid preview should be 200")
+	var task preview
+	err := json.Unmarshal(w.Body.Bytes(), &task)
+	assert.Nil(t, err, "Converting from JSON to a task should not throw an error")
+	assert.Equal(t, "foo-space-test-web", task.ID, "Task ID should be built from the keys")
+	assert.Equal(t, "test.web.slack", task.TemplateID, "Task should be created from the template of its shape")
+	assert.Equal(t, "test.web.slack", task.Template.ID, "Template should be included")
+	assert.Equal(t, "web crit slack", task.Template.Script, "Template should be rendered with the shape of the request")
+	assert.Equal(t, "foo-space web > 500", task.Vars["summary"].Value, "Vars should be rendered with the request")
+	assert.Equal(t, "#alerts", task.Vars["slack"].Value, "Slack channels should be prefixed with #")
+
+	req, _ = http.NewRequest("POST", "/task/test/preview", strings.NewReader(`{"app":"foo-space","dynotype":"web"}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "Request that fails validation should be rejected")
+
+	req, _ = http.NewRequest("POST", "/task/test/preview", strings.NewReader(`{"dynotype":"web","crit":"500"}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "Request without a key should be rejected")
+}
+
+// kapacitorRequestBody - The fields of tasks and templates that the fake Kapacitor looks at
+type kapacitorRequestBody struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Script string `json:"script"`
+}
+
+// useKapacitor - Point the default Kapacitor instance at a fake Kapacitor, returning a function that removes it
+func useKapacitor(t *testing.T, url string) func() {
+	return useInstances(t, config.Kapacitor{URL: url})
+}
+
+// useInstances - Load the configured Kapacitor instances, returning a function that removes them
+func useInstances(t *testing.T, cfg config.Kapacitor) func() {
+	if cfg.StandbyStatus == "" {
+		cfg.StandbyStatus = "disabled"
+	}
+	assert.Nil(t, LoadInstances(cfg), "Loading the Kapacitor instances should not throw an error")
+	return func() {
+		instances, spaces, failovers = nil, nil, make(map[string]Failover)
+	}
+}
+
+// TestScriptValidation - Make sure that templates rejected by Kapacitor are reported with the offending line before anything is changed
+func TestScriptValidation(t *testing.T) {
+	deployed = make(map[string]string)
+	var requests, ids []string
+	validationIDRegex := regexp.MustCompile(`validate-[0-9a-f]{16}`)
+	kapacitor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body kapacitorRequestBody
+		json.NewDecoder(r.Body).Decode(&body)
+		if validationIDRegex.MatchString(body.ID) {
+			ids = append(ids, body.ID)
+		}
+		request := strings.TrimSpace(r.Method + " " + r.URL.Path + " " + body.ID + " " + body.Status)
+		requests = append(requests, validationIDRegex.ReplaceAllString(request, "validate-<id>"))
+		if r.Method == "GET" {
+			w.WriteHeader(404)
+			w.Write([]byte(`{"error":"no template exists"}`))
+			return
+		}
+		if r.Method == "POST" && strings.Contains(body.Script, "slack") {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error":"parser: unexpected identifier line 1 char 5 in \"slack\""}`))
+			return
+		}
+		if r.Method == "DELETE" {
+			w.WriteHeader(204)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer kapacitor.Close()
+	defer useKapacitor(t, kapacitor.URL)()
+
+	d := newTestDescriptor(t)
+	router := gin.New()
+	router.POST("/task/test", func(c *gin.Context) { ProcessRequest(d, c) })
+
+	req, _ := http.NewRequest("POST", "/task/test", strings.NewReader(`{"app":"foo-space","dynotype":"web","crit":"500","slack":"alerts"}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code, "HTTP response code for an invalid template should be 400")
+	var er structs.ScriptErrorResponse
+	err := json.Unmarshal(w.Body.Bytes(), &er)
+	assert.Nil(t, err, "Converting from JSON to an error should not throw an error")
+	assert.Contains(t, er.Error, "unexpected identifier", "Error should contain the Kapacitor parse error")
+	assert.Equal(t, 1, er.Line, "Error should contain the line of the error")
+	assert.Equal(t, "web crit slack", er.Text, "Error should contain the offending line of the template")
+	assert.Equal(t, []string{
+		"DELETE /kapacitor/v1/tasks/foo-space-test-web-validate",
+		"POST /kapacitor/v1/tasks validate-<id> disabled",
+	}, requests, "Nothing but the validation task should be changed in Kapacitor when the script is rejected")
+
+	// Tasks are validated with a disabled copy that is then removed, without touching their template
+	task, tpl := kapacitorTask{ID: "foo-space-test-web", TemplateID: "test.web", Status: "enabled"}, kapacitorTemplate{ID: "test.web", Script: "web crit"}
+	requests, ids = nil, nil
+	err = validateKapacitorTask(context.Background(), instance(DefaultInstance), task, tpl)
+	assert.Nil(t, err, "Valid template should not throw an error")
+	err = validateKapacitorTask(context.Background(), instance(DefaultInstance), task, tpl)
+	assert.Nil(t, err, "Valid template should not throw an error")
+	assert.Len(t, ids, 2, "Every validation should define a task")
+	assert.NotEqual(t, ids[0], ids[1], "Validation tasks should not share an ID")
+	assert.False(t, d.Pattern.MatchString(ids[0]), "Validation task should not match the pattern of the alert type")
+	assert.Equal(t, []string{
+		"DELETE /kapacitor/v1/tasks/foo-space-test-web-validate",
+		"POST /kapacitor/v1/tasks validate-<id> disabled",
+		"DELETE /kapacitor/v1/tasks/validate-<id>",
+		"DELETE /kapacitor/v1/tasks/foo-space-test-web-validate",
+		"POST /kapacitor/v1/tasks validate-<id> disabled",
+		"DELETE /kapacitor/v1/tasks/validate-<id>",
+	}, requests, "Validation should not create or update the template, and validation tasks should be removed")
+}
+
+// TestSyncTemplates - Make sure that only the templates of an alert type that have changed are updated in Kapacitor
+func TestSyncTemplates(t *testing.T) {
+	deployed = make(map[string]string)
+	var requests []string
+	kapacitor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body kapacitorRequestBody
+		json.NewDecoder(r.Body).Decode(&body)
+		requests = append(requests, strings.TrimSpace(r.Method+" "+r.URL.Path+" "+body.ID))
+		switch {
+		case r.URL.Path == "/kapacitor/v1/templates":
+			assert.Equal(t, "test*", r.URL.Query().Get("pattern"), "Templates should be listed by the name of the alert type")
+			w.Write([]byte(`{"templates":[
+				{"id":"test.web","type":"batch","script":"web crit"},
+				{"id":"test.slack","type":"batch","script":"old"},
+				{"id":"testing.slack","type":"batch","script":"old"}
+			]}`))
+		case r.Method == "GET":
+			w.Write([]byte(`{"id":"test.slack","type":"batch","script":"old"}`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer kapacitor.Close()
+	defer useKapacitor(t, kapacitor.URL)()
+
+	d := newTestDescriptor(t)
+	updated, err := d.SyncTemplates(context.Background())
+	assert.Nil(t, err, "Syncing templates should not throw an error")
+	assert.Equal(t, []string{"test.slack"}, updated, "Only templates that changed should be updated")
+	assert.Equal(t, []string{
+		"GET /kapacitor/v1/templates",
+		"GET /kapacitor/v1/templates/test.slack",
+		"PATCH /kapacitor/v1/templates/test.slack test.slack",
+	}, requests, "Templates of other alert types should not be touched")
+}
+
+// TestNewScriptError - Make sure that the offending line is only included when Kapacitor reports one within the script
+func TestNewScriptError(t *testing.T) {
+	script := "batch\n  |query('x')\n  |alert()"
+	e := newScriptError(script, "line 3 char 4: no method or property \"foo\" on *pipeline.AlertNode")
+	assert.Equal(t, 3, e.Line, "Line should be parsed from the error")
+	assert.Equal(t, "|alert()", e.Text, "Text should be the trimmed line of the script")
+
+	e = newScriptError(script, "line 9 char 1: unexpected EOF")
+	assert.Equal(t, 0, e.Line, "Lines outside of the script should be ignored")
+
+	e = newScriptError(script, "unknown dbrp")
+	assert.Equal(t, "", e.Text, "Errors without a position should not have a line")
+	assert.Equal(t, "Invalid TICKscript: unknown dbrp", e.Response().Error, "Response should contain the error")
+
+	// Updated tasks rejected by Kapacitor are reported with the offending line of their template too
+	kapacitor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"error":"line 3 char 4: no method or property \"foo\" on *pipeline.AlertNode"}`))
+	}))
+	defer kapacitor.Close()
+	defer useKapacitor(t, kapacitor.URL)()
+	err := updateKapacitorTask(context.Background(), instance(DefaultInstance), kapacitorTask{ID: "foo-space-test-web"}, script)
+	se, ok := err.(*ScriptError)
+	if assert.True(t, ok, "Rejected update should throw a script error") {
+		assert.Equal(t, "|alert()", se.Text, "Script error of an update should contain the offending line")
+	}
+}
+
+// TestEscaping - Make sure that values cannot break out of the TICKscript and InfluxQL literals they are rendered into
+func TestEscaping(t *testing.T) {
+	assert.Equal(t, `it\'s \\ fine`, TickString(`it's \ fine`), "Quotes and backslashes should be escaped in TICKscript strings")
+	assert.Equal(t, `foo\'\'\' or 1=1`, InfluxString(`foo''' or 1=1`), "Quotes should be escaped in InfluxQL strings")
+	assert.Equal(t, `sample\"memory`, InfluxIdent(`sample"memory`), "Double quotes should be escaped in InfluxQL identifiers")
+	assert.Equal(t, `web\|worker`, InfluxRegex(`web|worker`), "Alternation should be matched literally")
+	assert.Equal(t, `\.\*`, InfluxRegex(`.*`), "Wildcards should be matched literally")
+	assert.Equal(t, `a\/ or 1=1`, InfluxRegex(`a/ or 1=1`), "Slashes should not end the regex")
+
+	d, err := New(&Descriptor{Name: "test", Template: `[[define "out"]]'[[ .Slack | tick ]]' "[[ .App | influxident ]]" /[[ .App | influxregex ]]/ [[ .App | urlquery ]][[end]]`})
+	assert.Nil(t, err, "Escaping functions should be available in templates")
+	vars, err := d.defines(&testSpec{App: "a/b", Notify: Notify{Slack: "#it's"}}, d.current(), make(map[string]structs.Var))
+	assert.Nil(t, err, "Rendering the template should not throw an error")
+	assert.Equal(t, `'#it\'s' "a/b" /a\/b/ a%2Fb`, vars["out"].Value, "Values should be escaped for where they are rendered")
+
+	assert.Nil(t, CheckDuration("Window", "10m"), "Valid duration should not throw an error")
+	assert.NotNil(t, CheckDuration("Window", "10m) |log("), "Expression should not be accepted as a duration")
+	assert.Nil(t, CheckNumber("Crit", "1.5", "MB"), "Valid number should not throw an error")
+	assert.NotNil(t, CheckNumber("Crit", "1 OR true", "MB"), "Expression should not be accepted as a number")
+
+	router := gin.New()
+	router.POST("/task/test/preview", func(c *gin.Context) { PreviewTask(newTestDescriptor(t), c) })
+	req, _ := http.NewRequest("POST", "/task/test/preview", strings.NewReader(`{"app":"foo'space","dynotype":"web","crit":"500"}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "Keys that Kapacitor does not allow in task IDs should be rejected")
+}
+
+// TestRedeploy - Make sure that stored tasks are re-rendered and only changed tasks are updated, or reported in a dry run
+func TestRedeploy(t *testing.T) {
+	deployed = make(map[string]string)
+	var requests []string
+	var lock sync.Mutex
+	kapacitor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/kapacitor/v1/tasks/same-test-web":
+			w.Write([]byte(`{"id":"same-test-web","template-id":"test.web.slack","vars":{
+				"app":{"type":"string","value":"same"},"dynotype":{"type":"string","value":"web"},"crit":{"type":"int","value":500},
+				"id":{"type":"string","value":"same-test-web"},"type":{"type":"string","value":"batch"},"slack":{"type":"string","value":"#"},
+				"summary":{"type":"string","value":"same web > 500"}}}`))
+		case r.Method == "GET" && r.URL.Path == "/kapacitor/v1/tasks/changed-test-web":
+			w.Write([]byte(`{"id":"changed-test-web","template-id":"test.web.slack","vars":{
+				"app":{"type":"string","value":"changed"},"dynotype":{"type":"string","value":"web"},"crit":{"type":"int","value":100},
+				"id":{"type":"string","value":"changed-test-web"},"type":{"type":"string","value":"batch"},"slack":{"type":"string","value":"#"},
+				"summary":{"type":"string","value":"changed web > 100"},"old":{"type":"string","value":"x"}}}`))
+		case r.Method == "GET" && r.URL.Path == "/kapacitor/v1/templates/test.web.slack":
+			w.Write([]byte(`{"id":"test.web.slack","type":"batch","script":"web crit slack"}`))
+		case r.Method == "GET":
+			w.WriteHeader(404)
+			w.Write([]byte(`{"error":"not found"}`))
+		default:
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer kapacitor.Close()
+	defer useKapacitor(t, kapacitor.URL)()
+
+	d := newTestDescriptor(t)
+	tasks := []redeployTask{
+		{d, map[string]string{"app": "same", "dynotype": "web", "crit": "500"}},
+		{d, map[string]string{"app": "changed", "dynotype": "web", "crit": "500"}},
+		{d, map[string]string{"app": "missing", "dynotype": "worker", "crit": "500"}},
+		{d, map[string]string{"app": "invalid", "dynotype": "web"}},
+	}
+	newJob := func(dryrun bool) *Redeploy {
+		return &Redeploy{DryRun: dryrun, Concurrency: 2, Total: len(tasks), checked: make(map[string]bool)}
+	}
+
+	// Dry run - changes are reported without touching Kapacitor
+	job := newJob(true)
+	job.run(tasks)
+	result := job.Snapshot()
+	assert.Equal(t, "finished", result.Status, "Redeploy should be finished")
+	assert.Equal(t, 4, result.Done, "Every task should be processed")
+	assert.Equal(t, 2, result.Updated, "Changed and missing tasks should be updated")
+	assert.Equal(t, 1, result.Unchanged, "Unchanged task should be left alone")
+	assert.Equal(t, []TaskFailure{{ID: "invalid-test-web", Type: "test", Error: "Crit is required"}}, result.Failed, "Invalid task should be reported")
+	assert.Empty(t, requests, "Dry run should not change anything in Kapacitor")
+
+	changes := make(map[string]TaskChange)
+	for _, change := range result.Changes {
+		changes[change.ID] = change
+	}
+	assert.Equal(t, "update", changes["changed-test-web"].Action, "Existing task should be updated")
+	assert.Equal(t, Change{Old: float64(100), New: 500}, changes["changed-test-web"].Vars["crit"], "Changed var should be reported")
+	assert.Equal(t, Change{Old: "x"}, changes["changed-test-web"].Vars["old"], "Removed var should be reported")
+	assert.Nil(t, changes["changed-test-web"].TemplateID, "Unchanged template should not be reported")
+	assert.Equal(t, "create", changes["missing-test-worker"].Action, "Missing task should be created")
+	assert.Equal(t, &Change{Old: "", New: "test.slack"}, changes["missing-test-worker"].TemplateID, "Template of a missing task should be reported")
+	assert.Equal(t, []TemplateChange{{ID: "test.slack", Action: "create", New: "crit slack"}}, result.Templates, "Missing template should be reported")
+
+	// Redeploy - only changed tasks are updated
+	job = newJob(false)
+	job.run(tasks)
+	result = job.Snapshot()
+	assert.Equal(t, 2, result.Updated, "Changed and missing tasks should be updated")
+	assert.Empty(t, result.Changes, "Changes should only be listed in a dry run")
+	sort.Strings(requests)
+	assert.Equal(t, []string{
+		"PATCH /kapacitor/v1/tasks/changed-test-web",
+		"POST /kapacitor/v1/tasks",
+		"POST /kapacitor/v1/templates",
+	}, requests, "Only the changed task should be updated, and the missing task and template created")
+}
+
+// TestSameVar - Make sure that vars are compared by value, however Kapacitor returns them
+func TestSameVar(t *testing.T) {
+	assert.True(t, sameVar(structs.Var{Type: "int", Value: float64(5)}, structs.Var{Type: "int", Value: 5}), "Numbers should be compared as floats")
+	assert.True(t, sameVar(structs.Var{Type: "duration", Value: float64(10 * time.Minute)}, structs.Var{Type: "duration", Value: "10m"}), "Durations in nanoseconds should match literals")
+	assert.True(t, sameVar(structs.Var{Type: "duration", Value: "1h"}, structs.Var{Type: "duration", Value: "60m"}), "Equal durations should match")
+	assert.False(t, sameVar(structs.Var{Type: "string", Value: "10m"}, structs.Var{Type: "duration", Value: "10m"}), "Type changes should be detected")
+	assert.False(t, sameVar(structs.Var{Type: "duration", Value: "10ms"}, structs.Var{Type: "duration", Value: "10m"}), "Units should be compared")
+}
+
+// TestCanary - Make sure that only the chosen apps run the template being rolled out, and that reloads keep the
+// stable template until the canary is promoted, and never bring back a rolled back template
+func TestCanary(t *testing.T) {
+	d := Register(newTestDescriptor(t))
+	defer func() { descriptors = nil }()
+
+	canaryTemplate := `[[define "summary"]]canary [[ .App ]][[end]]canary`
+	r, err := d.parseRollout(rolloutRow{Alerttype: "test", Status: "canary", Stable: testTemplate, Canary: canaryTemplate, Apps: []string{"foo-space"}})
+	assert.Nil(t, err, "Valid rollout should not throw an error")
+	templatesLock.Lock()
+	d.pin(r)
+	templatesLock.Unlock()
+
+	// Apps in the canary run the template being rolled out, the rest run the stable template
+	task, tpl, err := d.build(&testSpec{App: "foo-space", Dynotype: "web", Crit: "500"})
+	assert.Nil(t, err, "Rendering the canary should not throw an error")
+	assert.Equal(t, "test.canary.web", tpl.ID, "Canary tasks should use canary templates")
+	assert.Equal(t, "canary", tpl.Script, "Canary templates should be rendered with the canary")
+	assert.Equal(t, TemplateVersion(canaryTemplate), tpl.version, "Canary tasks should run the canary version")
+	assert.Equal(t, "canary foo-space", task.Vars["summary"].Value, "Canary vars should be rendered with the canary")
+
+	task, tpl, _ = d.build(&testSpec{App: "bar-space", Dynotype: "web", Crit: "500"})
+	assert.Equal(t, "test.web", tpl.ID, "Other tasks should use the stable templates")
+	assert.Equal(t, TemplateVersion(testTemplate), tpl.version, "Other tasks should run the stable version")
+	assert.Equal(t, "bar-space web > 500", task.Vars["summary"].Value, "Other vars should be rendered with the stable template")
+
+	// Apps are picked by percentage consistently, and raising the percentage only adds apps
+	picked := 0
+	for i := 0; i < 1000; i++ {
+		app := "app-" + strconv.Itoa(i)
+		r.Percent = 20
+		in := r.includes(app)
+		r.Percent = 50
+		if in {
+			assert.True(t, r.includes(app), "Raising the percentage should keep "+app+" in the canary")
+		}
+		if r.includes(app) {
+			picked++
+		}
+	}
+	assert.InDelta(t, 500, picked, 75, "About half of the apps should be picked")
+	r.Percent = 0
+
+	// Reloading keeps the stable template while the canary is rolled out
+	dir, err := ioutil.TempDir("", "templates")
+	assert.Nil(t, err, "Creating a temporary directory should not throw an error")
+	defer os.RemoveAll(dir)
+	assert.Nil(t, ioutil.WriteFile(TemplatePath(dir, "test"), []byte(canaryTemplate), 0644))
+
+	info, err := LoadTemplates(dir)
+	assert.Nil(t, err, "Reloading during a canary should not throw an error")
+	assert.Equal(t, []TemplateInfo{{Type: "test", Source: "rollout", Version: TemplateVersion(testTemplate), Canary: TemplateVersion(canaryTemplate)}},
+		info, "Stable template should be kept during a canary")
+
+	// A rolled back template is not reloaded, but the next change to the file is
+	rolledback := *r
+	rolledback.Status = "rolledback"
+	templatesLock.Lock()
+	d.pin(&rolledback)
+	templatesLock.Unlock()
+
+	_, tpl, _ = d.build(&testSpec{App: "foo-space", Dynotype: "web", Crit: "500"})
+	assert.Equal(t, "test.web", tpl.ID, "Rolled back tasks should use the stable templates")
+	info, _ = LoadTemplates(dir)
+	assert.Equal(t, TemplateVersion(testTemplate), info[0].Version, "Rolled back template should not be reloaded")
+
+	fixed := `[[define "summary"]]fixed [[ .App ]][[end]]crit`
+	assert.Nil(t, ioutil.WriteFile(TemplatePath(dir, "test"), []byte(fixed), 0644))
+	info, _ = LoadTemplates(dir)
+	assert.Equal(t, TemplateInfo{Type: "test", Source: TemplatePath(dir, "test"), Version: TemplateVersion(fixed)}, info[0], "Changed template should be reloaded")
+}
+
+// TestInstances - Make sure that tasks are routed to the Kapacitor instance of their region, stored instance, or space
+func TestInstances(t *testing.T) {
+	cfg := config.Kapacitor{
+		URL:       "http://kapacitor:9092",
+		Username:  "alerts",
+		Password:  "secret",
+		Timeout:   config.Duration(5 * time.Second),
+		Instances: map[string]string{"us": "http://kapacitor-us:9092", "eu": "http://kapacitor-eu:9092/"},
+		Spaces:    map[string]string{"test-eu": "eu", "prod-eu": "eu"},
+	}
+	defer useInstances(t, cfg)()
+
+	var loaded []Instance
+	for _, k := range Instances() {
+		assert.Equal(t, 5*time.Second, k.client.Timeout, "Instances should use the configured timeout")
+		assert.Equal(t, "alerts", k.username, "Instances should use the configured credentials")
+		loaded = append(loaded, Instance{Name: k.Name, URL: k.URL, Spaces: k.Spaces})
+	}
+	assert.Equal(t, []Instance{
+		{Name: "default", URL: "http://kapacitor:9092", Spaces: []string{}},
+		{Name: "eu", URL: "http://kapacitor-eu:9092", Spaces: []string{"prod-eu", "test-eu"}},
+		{Name: "us", URL: "http://kapacitor-us:9092", Spaces: []string{}},
+	}, loaded, "Instances should be loaded from the configuration, default first")
+
+	d := newTestDescriptor(t)
+	routes := []struct {
+		app, region, stored, instance string
+	}{
+		{"foo-prod-eu", "", "", "eu"},
+		{"foo--worker-test-eu", "", "", "eu"},
+		{"foo-prod", "", "", "default"},
+		{"foo-prod-eu", "us", "", "us"},
+		{"foo-prod-eu", "", "us", "us"},
+		{"foo-prod", "eu", "us", "eu"},
+	}
+	for _, r := range routes {
+		k, err := d.route([]string{r.app, "web"}, r.region, r.stored)
+		assert.Nil(t, err, "Routing "+r.app+" should not throw an error")
+		assert.Equal(t, r.instance, k.Name, "Task of "+r.app+" should be routed to "+r.instance)
+	}
+
+	_, err := d.route([]string{"foo-prod", "web"}, "ap", "")
+	assert.NotNil(t, err, "Unknown region should throw an error")
+	_, err = d.route([]string{"foo-prod", "web"}, "", "ap")
+	assert.NotNil(t, err, "Unknown stored instance should throw an error")
+
+	assert.Equal(t, "memory.slack", qualifiedID(instance("default"), "memory.slack"), "Templates on the default instance should not be prefixed")
+	assert.Equal(t, "eu/memory.slack", qualifiedID(instance("eu"), "memory.slack"), "Templates on other instances should be prefixed")
+
+	cfg.Spaces = map[string]string{"prod-eu": "ap"}
+	assert.NotNil(t, LoadInstances(cfg), "Space routed to an unknown instance should throw an error")
+	assert.Equal(t, 3, len(Instances()), "Invalid instances should not replace the current ones")
+}
+
+// TestStandbys - Make sure that tasks are copied to standbys with the configured status, and follow failovers
+func TestStandbys(t *testing.T) {
+	deployed = make(map[string]string)
+	var requests []string
+	standby := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body kapacitorRequestBody
+		json.NewDecoder(r.Body).Decode(&body)
+		requests = append(requests, strings.TrimSpace(r.Method+" "+r.URL.Path+" "+body.ID+" "+body.Status))
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/kapacitor/v1/tasks/old-test-web":
+			w.Write([]byte(`{"id":"old-test-web","template-id":"test.web","status":"enabled","vars":{}}`))
+		case r.Method == "GET":
+			w.WriteHeader(404)
+			w.Write([]byte(`{"error":"not found"}`))
+		case r.Method == "DELETE":
+			w.WriteHeader(204)
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer standby.Close()
+	cfg := config.Kapacitor{
+		URL:       "http://kapacitor:9092",
+		Instances: map[string]string{"backup": standby.URL},
+		Standbys:  map[string]string{"backup": DefaultInstance},
+	}
+	defer useInstances(t, cfg)()
+
+	k, backup := instance(DefaultInstance), instance("backup")
+	assert.Equal(t, []string{"backup"}, k.Standbys, "Standbys should be loaded from the configuration")
+	assert.Equal(t, DefaultInstance, backup.Primary, "Standbys should know their instance")
+
+	d := newTestDescriptor(t)
+	_, err := d.route([]string{"foo-prod", "web"}, "backup", "")
+	assert.NotNil(t, err, "Tasks should not be routed to a standby")
+
+	// Missing tasks are created disabled, and existing tasks are disabled
+	tpl := kapacitorTemplate{ID: "test.web", Type: "batch", Script: "web crit"}
+	d.replicate(context.Background(), k, kapacitorTask{ID: "new-test-web", TemplateID: "test.web", Status: "enabled"}, tpl)
+	d.replicate(context.Background(), k, kapacitorTask{ID: "old-test-web", TemplateID: "test.web", Status: "enabled", Vars: map[string]structs.Var{}}, tpl)
+	unreplicate(context.Background(), k, "new-test-web")
+	assert.Equal(t, []string{
+		"GET /kapacitor/v1/templates/test.web",
+		"POST /kapacitor/v1/templates test.web",
+		"GET /kapacitor/v1/tasks/new-test-web",
+		"POST /kapacitor/v1/tasks new-test-web disabled",
+		"GET /kapacitor/v1/tasks/old-test-web",
+		"PATCH /kapacitor/v1/tasks/old-test-web old-test-web disabled",
+		"DELETE /kapacitor/v1/tasks/new-test-web",
+	}, requests, "Tasks should be copied to the standby with its status")
+
+	// Once failed over, tasks are written to the standby and there are no other copies to keep
+	assert.Equal(t, k, k.active(), "Tasks should run on their instance until it fails over")
+	failovers[DefaultInstance] = Failover{Instance: DefaultInstance, Standby: "backup"}
+	assert.Equal(t, backup, k.active(), "Tasks should run on the standby once failed over")
+	assert.Empty(t, k.replicas(), "The failed instance should not be written to")
+
+	invalid := []map[string]string{
+		{"backup": "eu"},
+		{"default": "backup"},
+		{"backup": "default", "other": "backup"},
+	}
+	cfg.Instances["other"] = "http://other:9092"
+	for _, standbys := range invalid {
+		cfg.Standbys = standbys
+		assert.NotNil(t, LoadInstances(cfg), "Invalid standbys should throw an error")
+	}
+	cfg.Standbys = map[string]string{"backup": DefaultInstance}
+	cfg.Spaces = map[string]string{"prod": "backup"}
+	assert.NotNil(t, LoadInstances(cfg), "Spaces should not be routed to a standby")
+}
+
+// TestPruneTasks - Make sure that tasks deleted or moved while an instance was failed over are deleted from it on failback
+func TestPruneTasks(t *testing.T) {
+	var deleted []string
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			w.Write([]byte(`{"tasks":[{"id":"kept-test-web"},{"id":"invalid-test-web"},{"id":"deleted-test-web"},{"id":"moved-test-web"},{"id":"manual-task"}]}`))
+		case "DELETE":
+			deleted = append(deleted, strings.TrimPrefix(r.URL.Path, "/kapacitor/v1/tasks/"))
+			w.WriteHeader(204)
+		}
+	}))
+	defer primary.Close()
+	defer useInstances(t, config.Kapacitor{URL: primary.URL, Instances: map[string]string{"eu": "http://kapacitor-eu:9092"}})()
+	k := instance(DefaultInstance)
+
+	// The task of deleted was removed from the database while the instance was down, and moved now runs on eu
+	d := newTestDescriptor(t)
+	tasks := []redeployTask{
+		{d, map[string]string{"app": "kept", "dynotype": "web", "crit": "500"}},
+		{d, map[string]string{"app": "invalid", "dynotype": "web"}},
+		{d, map[string]string{"app": "moved", "dynotype": "web", "crit": "500"}},
+	}
+	pruned, err := pruneTasks(context.Background(), k, []*Descriptor{d}, tasks, map[string]string{"moved-test-web": "eu"})
+	assert.Nil(t, err, "Pruning tasks should not throw an error")
+	assert.Equal(t, 2, pruned, "Deleted and moved tasks should be counted")
+	assert.Equal(t, []string{"deleted-test-web", "moved-test-web"}, deleted, "Only tasks of the alert types that no longer run on the instance should be deleted")
+
+	primary.Close()
+	_, err = pruneTasks(context.Background(), k, []*Descriptor{d}, tasks, nil)
+	_, ok := err.(*utils.UnreachableError)
+	assert.True(t, ok, "Instance that cannot be reached should be reported as unreachable, so it is not failed back")
+}
+
+// TestDescriptorOf - Make sure that a dynotype ending in the suffix of another alert type is matched to its own type
+func TestDescriptorOf(t *testing.T) {
+	memory := &Descriptor{Name: "memory", Pattern: regexp.MustCompile(`-sample\.memory_total-[-\w]+$`)}
+	crashed := &Descriptor{Name: "crashed", Pattern: regexp.MustCompile(`-crash$`)}
+	custom := &Descriptor{Name: "crash", Pattern: regexp.MustCompile(`-custom-crash$`)}
+
+	for _, descriptors := range [][]*Descriptor{{crashed, memory, custom}, {custom, memory, crashed}} {
+		assert.Equal(t, memory, descriptorOf(descriptors, "app-sample.memory_total-crash"), "Memory task with a colliding dynotype should be matched to memory")
+		assert.Equal(t, crashed, descriptorOf(descriptors, "app-crash"), "Crashed task should be matched to crashed")
+		assert.Equal(t, custom, descriptorOf(descriptors, "app-custom-crash"), "Custom task named after a built-in suffix should be matched to its type")
+		assert.Nil(t, descriptorOf(descriptors, "manual-task"), "Unknown task should not be matched")
+	}
+}
+
+// TestDeployTask - Make sure that updated tasks are changed in place, and moved tasks are created before they are removed
+func TestDeployTask(t *testing.T) {
+	deployed = make(map[string]string)
+	var requests []string
+	fake := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, name+" "+r.Method+" "+r.URL.Path)
+			switch {
+			case r.Method == "GET" && r.URL.Path == "/kapacitor/v1/templates/test.web":
+				w.Write([]byte(`{"id":"test.web","type":"batch","script":"web crit"}`))
+			case r.Method == "GET" && name == "default":
+				w.Write([]byte(`{"id":"foo-space-test-web","template-id":"test.web","status":"enabled","vars":{}}`))
+			case r.Method == "GET":
+				w.WriteHeader(404)
+				w.Write([]byte(`{"error":"not found"}`))
+			case r.Method == "DELETE":
+				w.WriteHeader(204)
+			default:
+				w.Write([]byte(`{}`))
+			}
+		}))
+	}
+	primary, eu := fake("default"), fake("eu")
+	defer primary.Close()
+	defer eu.Close()
+	defer useInstances(t, config.Kapacitor{URL: primary.URL, Instances: map[string]string{"eu": eu.URL}})()
+	k, other := instance(DefaultInstance), instance("eu")
+
+	d := newTestDescriptor(t)
+	task := kapacitorTask{ID: "foo-space-test-web", TemplateID: "test.web", Status: "enabled"}
+	tpl := kapacitorTemplate{ID: "test.web", Type: "batch", Script: "web crit"}
+	err := d.deployTask(context.Background(), k, k, task, tpl)
+	assert.Nil(t, err, "Updating a task should not throw an error")
+	assert.Equal(t, []string{
+		"default GET /kapacitor/v1/templates/test.web",
+		"default GET /kapacitor/v1/tasks/foo-space-test-web",
+		"default PATCH /kapacitor/v1/tasks/foo-space-test-web",
+	}, requests, "Task on the same instance should be updated in place, not deleted and created again")
+
+	requests = nil
+	err = d.deployTask(context.Background(), k, other, task, tpl)
+	assert.Nil(t, err, "Moving a task should not throw an error")
+	assert.Equal(t, []string{
+		"eu GET /kapacitor/v1/templates/test.web",
+		"eu POST /kapacitor/v1/tasks",
+		"default DELETE /kapacitor/v1/tasks/foo-space-test-web",
+	}, requests, "Task moved to another instance should be created there before it is removed")
+}
+
+// TestMove - Make sure that moved tasks are deployed to the target, verified, and removed from where they ran
+func TestMove(t *testing.T) {
+	deployed = make(map[string]string)
+	var lock sync.Mutex
+	var removed []string
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		removed = append(removed, r.Method+" "+r.URL.Path)
+		w.WriteHeader(204)
+	}))
+	defer source.Close()
+	tasks := make(map[string][]byte)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/kapacitor/v1/tasks":
+			var task kapacitorTask
+			json.Unmarshal(body, &task)
+			if task.Vars["app"].Value == "broken-prod" {
+				task.Error = "query failed"
+			}
+			tasks[task.ID], _ = json.Marshal(task)
+			w.Write([]byte(`{}`))
+		case r.Method == "GET" && tasks[strings.TrimPrefix(r.URL.Path, "/kapacitor/v1/tasks/")] != nil:
+			w.Write(tasks[strings.TrimPrefix(r.URL.Path, "/kapacitor/v1/tasks/")])
+		case r.Method == "GET":
+			w.WriteHeader(404)
+			w.Write([]byte(`{"error":"not found"}`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer target.Close()
+	defer useInstances(t, config.Kapacitor{URL: source.URL, Instances: map[string]string{"eu": target.URL}})()
+
+	d := newTestDescriptor(t)
+	m := &move{target: instance("eu"), space: "prod", remove: true}
+	assert.True(t, m.includes(d, map[string]string{"app": "foo-prod", "dynotype": "web"}), "Tasks in the space should be moved")
+	assert.False(t, m.includes(d, map[string]string{"app": "foo-dev", "dynotype": "web"}), "Tasks in other spaces should not be moved")
+	m.app = "bar-prod"
+	assert.False(t, m.includes(d, map[string]string{"app": "foo-prod", "dynotype": "web"}), "Tasks of other apps should not be moved")
+	m.app = ""
+
+	job := &Redeploy{Concurrency: 1, Total: 2, checked: make(map[string]bool), move: m, Target: "eu"}
+	job.run([]redeployTask{
+		{d, map[string]string{"app": "foo-prod", "dynotype": "web", "crit": "500"}},
+		{d, map[string]string{"app": "broken-prod", "dynotype": "web", "crit": "500"}},
+	})
+	result := job.Snapshot()
+	assert.Equal(t, 1, result.Moved, "Verified task should be moved")
+	assert.Equal(t, []TaskFailure{{ID: "broken-prod-test-web", Type: "test", Error: "Task failed on eu: query failed"}}, result.Failed, "Task that failed on the target should be reported")
+	assert.Equal(t, []string{"DELETE /kapacitor/v1/tasks/foo-prod-test-web"}, removed, "Only the verified task should be removed from where it ran")
+}
+
+// TestInflux - Make sure that the InfluxDB layout is loaded from the configuration, with the overrides of each alert type
+func TestInflux(t *testing.T) {
+	defer LoadInflux(config.InfluxDB{})
+	LoadInflux(config.InfluxDB{
+		Layout: config.Layout{Database: "metrics", Measurements: map[string]string{"events": "app.events"}},
+		Overrides: map[string]config.Layout{
+			"test": {RetentionPolicy: "short", Measurements: map[string]string{"memory": "mem.total"}},
+		},
+	})
+
+	d, err := New(&Descriptor{
+		Name:     "test",
+		Template: `[[define "influx_query"]]from [[ dbrp ]]."[[ measurement "memory" | influxident ]]", "[[ measurement "events" ]]"[[end]]`,
+		NewSpec:  func() Spec { return &testSpec{} },
+	})
+	assert.Nil(t, err, "Template using the InfluxDB layout should not throw an error")
+	vars, err := d.defines(&testSpec{}, d.current(), make(map[string]structs.Var))
+	assert.Nil(t, err, "Rendering the InfluxDB layout should not throw an error")
+	assert.Equal(t, `from "metrics"."short"."mem.total", "app.events"`, vars["influx_query"].Value, "Alert type should use its overrides over the global layout")
+	assert.Equal(t, Influx{Database: "metrics", RetentionPolicy: "retention_policy", Measurements: map[string]string{
+		"memory": "sample.memory_total", "cpu": "sample.cpu_usage", "router_status": "router.status", "router_service": "router.service", "events": "app.events",
+	}}, (&Descriptor{Name: "memory"}).Influx(), "Alert types without overrides should use the global layout")
+
+	d, _ = New(&Descriptor{Name: "test", Template: `[[define "influx_query"]][[ measurement "disk" ]][[end]]`})
+	_, err = d.defines(&testSpec{}, d.current(), make(map[string]structs.Var))
+	assert.NotNil(t, err, "Unknown measurement should throw an error")
+}
+
+// TestRetries - Make sure that idempotent Kapacitor requests are retried, and unreachable instances are reported as a 504
+func TestRetries(t *testing.T) {
+	var lock sync.Mutex
+	var requests []string
+	kapacitor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.Method == "GET" && len(requests) == 3 {
+			w.Write([]byte(`{"id":"foo-space-test-web","status":"enabled"}`))
+			return
+		}
+		w.WriteHeader(503)
+		w.Write([]byte(`{"error":"unavailable"}`))
+	}))
+	cfg := config.Kapacitor{URL: kapacitor.URL, Timeout: config.Duration(time.Second), Retries: 2, RetryBackoff: config.Duration(time.Millisecond)}
+	defer useInstances(t, cfg)()
+	k := instance(DefaultInstance)
+
+	task, err := getKapacitorTask(context.Background(), k, "foo-space-test-web")
+	assert.Nil(t, err, "GET should succeed once Kapacitor is available again")
+	assert.Equal(t, "foo-space-test-web", task.ID, "Task should be read from the retried request")
+	err = createKapacitorTask(context.Background(), k, kapacitorTask{ID: "foo-space-test-web"})
+	assert.NotNil(t, err, "Unavailable Kapacitor should throw an error")
+	_, err = getKapacitorTask(context.Background(), k, "foo-space-test-web")
+	_, ok := err.(*utils.UnreachableError)
+	assert.True(t, ok, "GET that is still unavailable after every retry should be reported as unreachable")
+	assert.Equal(t, []string{
+		"GET /kapacitor/v1/tasks/foo-space-test-web",
+		"GET /kapacitor/v1/tasks/foo-space-test-web",
+		"GET /kapacitor/v1/tasks/foo-space-test-web",
+		"POST /kapacitor/v1/tasks",
+		"GET /kapacitor/v1/tasks/foo-space-test-web",
+		"GET /kapacitor/v1/tasks/foo-space-test-web",
+		"GET /kapacitor/v1/tasks/foo-space-test-web",
+	}, requests, "Only GET requests should be retried")
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		base := 100 * time.Millisecond << uint(attempt-1)
+		d := backoff(100*time.Millisecond, attempt)
+		assert.True(t, d >= base/2 && d <= base, "Backoff should double with each retry, with jitter")
+	}
+
+	kapacitor.Close()
+	_, err = getKapacitorTask(context.Background(), k, "foo-space-test-web")
+	_, ok = err.(*utils.UnreachableError)
+	assert.True(t, ok, "Kapacitor that cannot be reached should be reported as unreachable")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = getKapacitorTask(ctx, k, "foo-space-test-web")
+	assert.NotNil(t, err, "Request with a cancelled context should throw an error")
+
+	d := newTestDescriptor(t)
+	_, err = d.SyncTemplates(context.Background())
+	_, ok = err.(*utils.UnreachableError)
+	assert.True(t, ok, "Syncing templates on a Kapacitor that cannot be reached should be reported as unreachable")
+
+	router := gin.New()
+	router.POST("/task/test", func(c *gin.Context) { ProcessRequest(d, c) })
+	req, _ := http.NewRequest("POST", "/task/test", strings.NewReader(`{"app":"foo-space","dynotype":"web","crit":"500"}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code, "HTTP response code for an unreachable Kapacitor should be 504")
+}
+
+// TestInstanceTasks - Make sure that every page of tasks is read with its vars, and errors from Kapacitor are reported
+func TestInstanceTasks(t *testing.T) {
+	var queries []string
+	failing := false
+	kapacitor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.RawQuery)
+		if failing {
+			w.WriteHeader(500)
+			w.Write([]byte(`{"error":"broken"}`))
+			return
+		}
+		count := 100
+		if r.URL.Query().Get("offset") != "0" {
+			count = 1
+		}
+		var tasks []string
+		for i := 0; i < count; i++ {
+			tasks = append(tasks, `{"id":"foo-space-test-web","template-id":"test","vars":{"crit":{"type":"float","value":500}}}`)
+		}
+		w.Write([]byte(`{"tasks":[` + strings.Join(tasks, ",") + `]}`))
+	}))
+	defer kapacitor.Close()
+	defer useInstances(t, config.Kapacitor{URL: kapacitor.URL, Timeout: config.Duration(time.Second)})()
+	k := instance(DefaultInstance)
+
+	tasks, err := k.Tasks(context.Background())
+	assert.Nil(t, err, "Listing tasks should not throw an error")
+	assert.Len(t, tasks, 101, "Tasks should be read from every page")
+	assert.Equal(t, "500", StringVar(tasks[100].Vars, "crit"), "Tasks should be read with their vars")
+	assert.Equal(t, "test", tasks[100].TemplateID, "Tasks should be read with their template")
+	assert.Equal(t, []string{"fields=vars&fields=template-id&limit=100&offset=0", "fields=vars&fields=template-id&limit=100&offset=100"}, queries, "Tasks should be read a page at a time")
+
+	failing = true
+	_, err = k.Tasks(context.Background())
+	assert.Equal(t, "broken", err.Error(), "Error from Kapacitor should be reported")
+}
+
+// TestImportedVersion - Make sure that imported tasks only get the current version if they run the current Kapacitor template
+func TestImportedVersion(t *testing.T) {
+	script := "stream|from()"
+	kapacitor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, "/kapacitor/v1/templates/") {
+		case "test":
+			w.Write([]byte(`{"id":"test","type":"stream","script":"` + script + `"}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer kapacitor.Close()
+	defer useInstances(t, config.Kapacitor{URL: kapacitor.URL, Timeout: config.Duration(time.Second)})()
+	k := instance(DefaultInstance)
+
+	versions := map[string]struct {
+		task InstanceTask
+		tpl  kapacitorTemplate
+		want string
+	}{
+		"current":          {InstanceTask{TemplateID: "test"}, kapacitorTemplate{ID: "test", Script: script, version: "abc"}, "abc"},
+		"changed":          {InstanceTask{TemplateID: "test"}, kapacitorTemplate{ID: "test", Script: "batch|query()", version: "abc"}, legacyVersion},
+		"other template":   {InstanceTask{TemplateID: "old"}, kapacitorTemplate{ID: "test", Script: script, version: "abc"}, legacyVersion},
+		"own script":       {InstanceTask{}, kapacitorTemplate{ID: "test", Script: script, version: "abc"}, legacyVersion},
+		"missing template": {InstanceTask{TemplateID: "gone"}, kapacitorTemplate{ID: "gone", Script: script, version: "abc"}, legacyVersion},
+	}
+	for name, v := range versions {
+		version, err := importedVersion(context.Background(), k, v.task, v.tpl)
+		assert.Nil(t, err, "Checking the version of an imported task should not throw an error")
+		assert.Equal(t, v.want, version, "Version of a task with "+name+" template")
+	}
+}
@@ -0,0 +1,78 @@
+// Package enginetest - Checks shared by the tests of the alert types
+package enginetest
+
+import (
+	"encoding/json"
+	structs "kapacitor-alerts-api/structs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// HostileInput - A request body with hostile values, the response code the preview endpoint of an alert type should
+// give it, and values the vars of the previewed task should contain
+type HostileInput struct {
+	Name string
+	Body string
+	Code int
+	Vars [][2]string
+}
+
+// Accepted - Hostile input that should be escaped, leaving each of the given values in the named var
+func Accepted(name string, body string, vars ...[2]string) HostileInput {
+	return HostileInput{Name: name, Body: body, Code: 200, Vars: vars}
+}
+
+// Rejected - Hostile input that should be rejected
+func Rejected(name string, body string) HostileInput {
+	return HostileInput{Name: name, Body: body, Code: 400}
+}
+
+// HostileNotify - Hostile notification settings and app names that every alert type should escape or reject, added
+// to the other fields of a valid request of the alert type (e.g. `"dynotype":"web"`)
+func HostileNotify(fields string) []HostileInput {
+	body := func(app string, extra string) string {
+		parts := []string{`"app":"` + app + `"`}
+		for _, part := range []string{fields, extra} {
+			if part != "" {
+				parts = append(parts, part)
+			}
+		}
+		return "{" + strings.Join(parts, ",") + "}"
+	}
+
+	return []HostileInput{
+		Accepted("quote in slack channel", body("gotest-hostile", `"slack":"al'erts"`), [2]string{"slack", `#al'erts`}),
+		Accepted("quotes in emails", body("gotest-hostile", `"email":"a'b@example.com,c\\d@example.com"`), [2]string{"email_0", `a'b@example.com`}, [2]string{"email_1", `c\d@example.com`}),
+		Accepted("quote in post url", body("gotest-hostile", `"post":"http://example.com/');.exec('x"`), [2]string{"post", `http://example.com/');.exec('x`}),
+		Rejected("quote in app", body("gotest-host'ile", "")),
+	}
+}
+
+// CheckHostileInputs - Send each input to the preview endpoint of an alert type and check the response. Previews
+// do not touch Kapacitor or the database, so neither is needed.
+func CheckHostileInputs(t *testing.T, preview gin.HandlerFunc, inputs []HostileInput) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/preview", preview)
+
+	for _, input := range inputs {
+		req, _ := http.NewRequest("POST", "/preview", strings.NewReader(input.Body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, input.Code, w.Code, "HTTP response code for "+input.Name+" should match")
+
+		var task struct {
+			Vars map[string]structs.Var `json:"vars"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &task)
+		for _, v := range input.Vars {
+			assert.Contains(t, task.Vars[v[0]].Value, v[1], "Var "+v[0]+" should contain the value for "+input.Name)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package engine
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// taskIDRegex - Characters that Kapacitor allows in task IDs
+var taskIDRegex = regexp.MustCompile(`^[-\._\p{L}0-9]+$`)
+
+// durationRegex - A TICKscript duration literal (e.g. 30s, 10m, 1h)
+var durationRegex = regexp.MustCompile(`^[0-9]+(u|µ|ms|s|m|h|d|w)$`)
+
+var (
+	quoteEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	identEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	regexEscaper = strings.NewReplacer(`/`, `\/`)
+)
+
+// TickString - Escape a value for a single-quoted TICKscript string literal, e.g. .id('[[ .App | tick ]]-custom')
+func TickString(s string) string {
+	return quoteEscaper.Replace(s)
+}
+
+// InfluxString - Escape a value for a single-quoted InfluxQL string literal, e.g. "app"='[[ .App | influxstr ]]'.
+// Quotes are always escaped, so the value cannot close the triple-quoted TICKscript string around the query.
+func InfluxString(s string) string {
+	return quoteEscaper.Replace(s)
+}
+
+// InfluxIdent - Escape a value for a double-quoted InfluxQL identifier, e.g. "[[ .Metric | influxident ]]"
+func InfluxIdent(s string) string {
+	return identEscaper.Replace(s)
+}
+
+// InfluxRegex - Escape a value so that it is matched literally in an InfluxQL regex, e.g. =~ /[[ .App | influxregex ]]/
+func InfluxRegex(s string) string {
+	return regexEscaper.Replace(regexp.QuoteMeta(s))
+}
+
+// templateFuncs - Escaping functions available in alert templates, alongside the built-in html and urlquery
+var templateFuncs = template.FuncMap{
+	"tick":        TickString,
+	"influxstr":   InfluxString,
+	"influxident": InfluxIdent,
+	"influxregex": InfluxRegex,
+}
+
+// CheckDuration - Make sure that a value can be used as a TICKscript duration
+func CheckDuration(name string, value string) error {
+	if !durationRegex.MatchString(value) {
+		return errors.New(name + " must be a duration (e.g. 30s, 10m, 1h)")
+	}
+	return nil
+}
+
+// CheckNumber - Make sure that a value can be used as a TICKscript number
+func CheckNumber(name string, value string, unit string) error {
+	if _, err := strconv.ParseFloat(value, 64); err != nil {
+		return errors.New(name + " must be a number (in " + unit + ")")
+	}
+	return nil
+}
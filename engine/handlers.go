@@ -0,0 +1,506 @@
+package engine
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	structs "kapacitor-alerts-api/structs"
+	"kapacitor-alerts-api/utils"
+	"log"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+// keysFromParams - Get the values of the Params of an alert type from the route
+func (d *Descriptor) keysFromParams(c *gin.Context) []string {
+	var keys []string
+	for _, param := range d.Params {
+		keys = append(keys, c.Param(param))
+	}
+	return keys
+}
+
+// args - Convert keys into arguments for a SQL query
+func args(keys []string) []interface{} {
+	var a []interface{}
+	for _, key := range keys {
+		a = append(a, key)
+	}
+	return a
+}
+
+// Find - Get the config of a task from the database
+func (d *Descriptor) Find(keys []string, c *gin.Context) (interface{}, error) {
+	db, err := utils.GetDBFromContext(c)
+	if err != nil {
+		return nil, errors.New("Unable to access database")
+	}
+
+	task := reflect.New(reflect.TypeOf(d.Model)).Interface()
+
+	ctx, cancel := utils.DBContext(c)
+	defer cancel()
+	err = db.GetContext(ctx, task, "SELECT * FROM "+d.Table+" WHERE "+d.where(len(keys)), args(keys)...)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, sql.ErrNoRows
+		}
+		return nil, errors.New("Unable to access database")
+	}
+	return task, nil
+}
+
+// build - Render the Kapacitor template and task for a prepared request. The template is shared by every
+// task with the same shape (and canary), and the values of the task are passed to it as vars.
+func (d *Descriptor) build(spec Spec) (kapacitorTask, kapacitorTemplate, error) {
+	var task kapacitorTask
+	var tpl kapacitorTemplate
+	var dbrp structs.DbrpSpec
+
+	t, version, canary := d.templateFor(spec)
+	shape := d.shape(spec)
+	shape.canary = canary
+	script, err := execute(t, shape)
+	if err != nil {
+		return task, tpl, err
+	}
+	tpl.ID = d.TemplateID(shape)
+	tpl.Type = d.TaskType
+	tpl.Script = script
+	tpl.version = version
+
+	task.ID = d.ID(spec.Keys())
+	task.TemplateID = tpl.ID
+	i := d.Influx()
+	dbrp.Db = i.Database
+	dbrp.Rp = i.RetentionPolicy
+	task.Dbrps = []structs.DbrpSpec{dbrp}
+	task.Status = "enabled"
+
+	n := spec.notify()
+	vars := spec.TaskVars()
+	vars = utils.AddVar("id", task.ID, "string", vars)
+	vars = utils.AddVar("type", d.TaskType, "string", vars)
+	vars = utils.AddVar("slack", n.Slack, "string", vars)
+	vars = utils.AddVar("post", n.Post, "string", vars)
+	vars = utils.AddVar("email", n.Email, "string", vars)
+	for i, email := range n.emails() {
+		vars = utils.AddVar(shape.Emails[i], email, "string", vars)
+	}
+
+	vars, err = d.defines(spec, t, vars)
+	if err != nil {
+		return task, tpl, err
+	}
+	task.Vars = vars
+
+	return task, tpl, nil
+}
+
+// readRequest - Read, validate, and render a task from the request body, reporting any errors to the client
+func (d *Descriptor) readRequest(c *gin.Context) (Spec, kapacitorTask, kapacitorTemplate, bool) {
+	var task kapacitorTask
+	var tpl kapacitorTemplate
+
+	bodybytes, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		utils.ReportError(err, c, "Server Error while reading response")
+		return nil, task, tpl, false
+	}
+
+	spec := d.NewSpec()
+	err = json.Unmarshal(bodybytes, spec)
+	if err != nil {
+		utils.ReportInvalidRequest(c, "Invalid "+d.Name+" task: "+err.Error())
+		return nil, task, tpl, false
+	}
+
+	err = spec.Prepare()
+	if err != nil {
+		utils.ReportInvalidRequest(c, err.Error())
+		return nil, task, tpl, false
+	}
+	spec.notify().prepare()
+
+	for i, key := range spec.Keys() {
+		if key == "" {
+			utils.ReportInvalidRequest(c, strings.Title(d.Params[i])+" is required")
+			return nil, task, tpl, false
+		}
+	}
+
+	// Keys end up in the task ID, which Kapacitor restricts to a few characters
+	if id := d.ID(spec.Keys()); !taskIDRegex.MatchString(id) {
+		utils.ReportInvalidRequest(c, "Invalid task ID "+id+" - "+strings.Join(d.Params, " and ")+" may only contain letters, numbers, '-', '.', and '_'")
+		return nil, task, tpl, false
+	}
+
+	if region := spec.notify().Region; region != "" {
+		if k := instance(region); k == nil {
+			utils.ReportInvalidRequest(c, "Unknown region "+region)
+			return nil, task, tpl, false
+		} else if k.Primary != "" {
+			utils.ReportInvalidRequest(c, "Region "+region+" is a standby of "+k.Primary)
+			return nil, task, tpl, false
+		}
+	}
+
+	task, tpl, err = d.build(spec)
+	if err != nil {
+		utils.ReportInvalidRequest(c, "Unable to render template: "+err.Error())
+		return nil, task, tpl, false
+	}
+
+	return spec, task, tpl, true
+}
+
+// ProcessRequest - POST | PATCH /task/<type>
+func ProcessRequest(d *Descriptor, c *gin.Context) {
+	spec, task, tpl, ok := d.readRequest(c)
+	if !ok {
+		return
+	}
+	keys := spec.Keys()
+
+	var stored string
+	var previous *Instance
+	if c.Request.Method == "PATCH" {
+		// Check if task exists before trying to patch it
+		_, err := d.Find(keys, c)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(404, nil)
+			} else {
+				utils.ReportError(err, c, "")
+			}
+			return
+		}
+
+		// Updated tasks stay on their Kapacitor instance unless they are given a region
+		db, _ := utils.GetDBFromContext(c)
+		ctx, cancel := utils.DBContext(c)
+		stored, err = storedInstance(ctx, db, task.ID)
+		cancel()
+		if err != nil {
+			utils.ReportError(err, c, "")
+			return
+		}
+		previous, err = d.route(keys, "", stored)
+		if err != nil {
+			utils.ReportError(err, c, "")
+			return
+		}
+	}
+
+	k, err := d.route(keys, spec.notify().Region, stored)
+	if err != nil {
+		utils.ReportError(err, c, "")
+		return
+	}
+
+	// Make sure Kapacitor accepts the script before changing anything
+	err = validateKapacitorTask(c.Request.Context(), k.active(), task, tpl)
+	if err != nil {
+		if se, ok := err.(*ScriptError); ok {
+			c.JSON(400, se.Response())
+		} else {
+			utils.ReportError(err, c, "")
+		}
+		return
+	}
+
+	err = d.saveTask(previous, k, task, tpl, spec, c)
+	if err != nil {
+		utils.ReportError(err, c, "")
+		return
+	}
+
+	c.String(201, "")
+}
+
+// preview - A rendered task and the template it is created from
+type preview struct {
+	kapacitorTask
+	Template kapacitorTemplate `json:"template"`
+}
+
+// PreviewTask - POST /task/<type>/preview - Render a task without creating it in Kapacitor or the database
+func PreviewTask(d *Descriptor, c *gin.Context) {
+	_, task, tpl, ok := d.readRequest(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(200, preview{task, tpl})
+}
+
+// saveTask - Create a task on a Kapacitor instance (or the standby it failed over to) from its template, or update
+// the task that ran on previous, copy it to the standbys of the instance, and save its config to the database. Once
+// a task has been validated it is saved even if the client goes away, so Kapacitor and the database are not left out
+// of step - each Kapacitor request is still bounded by its timeout, and the database writes by the database timeout.
+func (d *Descriptor) saveTask(previous *Instance, k *Instance, task kapacitorTask, tpl kapacitorTemplate, spec Spec, c *gin.Context) error {
+	db, err := utils.GetDBFromContext(c)
+	if err != nil {
+		return errors.New("Unable to access database")
+	}
+
+	err = d.deployTask(context.Background(), previous, k, task, tpl)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := utils.DetachedDBContext(c)
+	defer cancel()
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.New("Unable to access database")
+	}
+	defer tx.Rollback()
+
+	if previous != nil {
+		keys := spec.Keys()
+		_, err = tx.ExecContext(ctx, "DELETE FROM "+d.Table+" WHERE "+d.where(len(keys)), args(keys)...)
+		if err != nil {
+			return errors.New("Unable to access database")
+		}
+	}
+	err = d.insert(ctx, tx, spec)
+	if err != nil {
+		return err
+	}
+	err = d.saveInstance(ctx, tx, task.ID, k)
+	if err != nil {
+		return err
+	}
+	err = d.saveVersion(ctx, tx, task.ID, tpl.version)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.New("Unable to save to database")
+	}
+	return nil
+}
+
+// deployTask - Create a task on a Kapacitor instance (or the standby it failed over to) and copy it to the standbys
+// of the instance. A task that already ran on the instance (previous) is updated in place, keeping its alert state.
+// A task that ran on another instance is created before it is removed from there.
+func (d *Descriptor) deployTask(ctx context.Context, previous *Instance, k *Instance, task kapacitorTask, tpl kapacitorTemplate) error {
+	active := k.active()
+	err := ensureTemplate(ctx, active, tpl)
+	if err != nil {
+		return err
+	}
+
+	var current *kapacitorTask
+	if previous == k {
+		current, err = getKapacitorTask(ctx, active, task.ID)
+		if err != nil {
+			return err
+		}
+	}
+	if current == nil {
+		err = createKapacitorTask(ctx, active, task)
+	} else {
+		err = updateKapacitorTask(ctx, active, task, tpl.Script)
+	}
+	if err != nil {
+		return err
+	}
+	d.replicate(ctx, k, task, tpl)
+
+	if previous != nil && previous != k {
+		// The task already runs on its new instance, so a copy left behind is logged rather than failing the request
+		err = deleteKapacitorTask(ctx, previous.active(), task.ID)
+		if err != nil {
+			log.Println("✖ Unable to delete task " + task.ID + " from " + previous.active().Name + " after moving it to " + k.Name + ": " + err.Error())
+		}
+		unreplicate(ctx, previous, task.ID)
+	}
+	return nil
+}
+
+// insert - Save the config of a task to the database
+func (d *Descriptor) insert(ctx context.Context, db sqlx.ExecerContext, spec Spec) error {
+	row := spec.Row()
+	var params []string
+	for i := range row {
+		params = append(params, "$"+strconv.Itoa(i+1))
+	}
+
+	_, err := db.ExecContext(ctx, "INSERT INTO "+d.Table+" VALUES ("+strings.Join(params, ", ")+")", row...)
+	if err != nil {
+		return errors.New("Unable to save to database")
+	}
+
+	return nil
+}
+
+// deleteTask - Delete a task from Kapacitor and remove its config from the database
+func (d *Descriptor) deleteTask(keys []string, c *gin.Context) error {
+	db, err := utils.GetDBFromContext(c)
+	if err != nil {
+		return errors.New("Unable to access database")
+	}
+
+	dbctx, cancel := utils.DBContext(c)
+	k, err := d.instanceOf(dbctx, db, keys)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	// Once the task is deleted from Kapacitor, its config is removed even if the client goes away
+	ctx := context.Background()
+	err = deleteKapacitorTask(ctx, k.active(), d.ID(keys))
+	if err != nil {
+		return err
+	}
+	unreplicate(ctx, k, d.ID(keys))
+
+	ctx, cancel = utils.DetachedDBContext(c)
+	defer cancel()
+	_, err = db.ExecContext(ctx, "DELETE FROM "+d.Table+" WHERE "+d.where(len(keys)), args(keys)...)
+	if err != nil {
+		return errors.New("Unable to access database")
+	}
+
+	err = d.deleteInstance(ctx, db, d.ID(keys))
+	if err != nil {
+		return err
+	}
+
+	return d.deleteVersion(ctx, db, d.ID(keys))
+}
+
+// DeleteTask - DELETE /task/<type>/<params>
+func DeleteTask(d *Descriptor, c *gin.Context) {
+	keys := d.keysFromParams(c)
+
+	// Check if task exists before trying to delete it
+	_, err := d.Find(keys, c)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(404, nil)
+		} else {
+			utils.ReportError(err, c, "")
+		}
+		return
+	}
+
+	// Delete the task from Kapacitor and remove the config from the database
+	err = d.deleteTask(keys, c)
+	if err != nil {
+		utils.ReportError(err, c, "")
+	} else {
+		c.String(200, "")
+	}
+}
+
+// GetTask - GET /task/<type>/<params>
+func GetTask(d *Descriptor, c *gin.Context) {
+	task, err := d.Find(d.keysFromParams(c), c)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(404, nil)
+		} else {
+			utils.ReportError(err, c, "")
+		}
+		return
+	}
+
+	c.JSON(200, task)
+}
+
+// ListTasks - GET /tasks/<type>[/<params>] - Filtered by any leading Params present in the route
+func ListTasks(d *Descriptor, c *gin.Context) {
+	db, err := utils.GetDBFromContext(c)
+	if err != nil {
+		utils.ReportError(err, c, "Unable to access database")
+		return
+	}
+
+	var keys []string
+	for _, param := range d.Params {
+		if c.Param(param) == "" {
+			break
+		}
+		keys = append(keys, c.Param(param))
+	}
+
+	query := "SELECT * FROM " + d.Table
+	if len(keys) > 0 {
+		query += " WHERE " + d.where(len(keys))
+	}
+	query += " ORDER BY " + strings.Join(d.Columns, " ASC, ") + " ASC"
+
+	tasks := reflect.New(reflect.SliceOf(reflect.TypeOf(d.Model)))
+	ctx, cancel := utils.DBContext(c)
+	defer cancel()
+	err = db.SelectContext(ctx, tasks.Interface(), query, args(keys)...)
+	if err != nil {
+		utils.ReportError(err, c, "Unable to access database")
+		return
+	}
+
+	if tasks.Elem().Len() == 0 {
+		c.JSON(200, nil)
+		return
+	}
+
+	c.JSON(200, tasks.Interface())
+}
+
+// GetTaskState - GET /task/<type>/<params>/state
+func GetTaskState(d *Descriptor, c *gin.Context) {
+	var stateresp structs.SimpleTaskState
+	keys := d.keysFromParams(c)
+
+	_, err := d.Find(keys, c)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(404, nil)
+		} else {
+			utils.ReportError(err, c, "")
+		}
+		return
+	}
+
+	db, err := utils.GetDBFromContext(c)
+	if err != nil {
+		utils.ReportError(err, c, "Unable to access database")
+		return
+	}
+
+	ctx, cancel := utils.DBContext(c)
+	k, err := d.instanceOf(ctx, db, keys)
+	cancel()
+	if err != nil {
+		utils.ReportError(err, c, "")
+		return
+	}
+
+	taskstate, err := getKapacitorTaskState(c.Request.Context(), k.active(), d.ID(keys))
+	if err != nil {
+		utils.ReportError(err, c, "")
+		return
+	}
+
+	stateresp.App = c.Param("app")
+	if len(taskstate.Topics) > 0 {
+		stateresp.State = taskstate.Topics[0].Level
+	} else {
+		// The alert topic is only created once the task has processed data
+		stateresp.State = "OK"
+	}
+
+	c.JSON(200, stateresp)
+}
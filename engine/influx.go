@@ -0,0 +1,92 @@
+package engine
+
+import (
+	"errors"
+	"kapacitor-alerts-api/config"
+	"sync"
+	"text/template"
+)
+
+// Influx - Where the metrics queried by an alert type are stored in InfluxDB
+type Influx struct {
+	Database        string            `json:"database"`
+	RetentionPolicy string            `json:"retention_policy"`
+	Measurements    map[string]string `json:"measurements"` // Measurements queried by the alert type, by name
+}
+
+// DefaultMeasurements - Measurements queried by the built-in alert types, by name. router_status is the prefix
+// of the measurements of each status code (e.g. router.status.404).
+var DefaultMeasurements = map[string]string{
+	"memory":         "sample.memory_total",
+	"cpu":            "sample.cpu_usage",
+	"router_status":  "router.status",
+	"router_service": "router.service",
+	"events":         "events",
+}
+
+// influx - The InfluxDB layout of every alert type, and the overrides of each type by name
+var influx = Influx{Database: "opentsdb", RetentionPolicy: "retention_policy", Measurements: DefaultMeasurements}
+var influxOverrides = make(map[string]Influx)
+var influxLock sync.RWMutex
+
+// merge - The layout with the settings of another layout that are set
+func (i Influx) merge(other Influx) Influx {
+	merged := Influx{Database: i.Database, RetentionPolicy: i.RetentionPolicy, Measurements: make(map[string]string)}
+	if other.Database != "" {
+		merged.Database = other.Database
+	}
+	if other.RetentionPolicy != "" {
+		merged.RetentionPolicy = other.RetentionPolicy
+	}
+	for name, m := range i.Measurements {
+		merged.Measurements[name] = m
+	}
+	for name, m := range other.Measurements {
+		merged.Measurements[name] = m
+	}
+	return merged
+}
+
+// LoadInflux - Load the InfluxDB database, retention policy, and measurements queried by alert types, along with the
+// overrides of any alert type
+func LoadInflux(cfg config.InfluxDB) {
+	loaded := Influx{Database: "opentsdb", RetentionPolicy: "retention_policy", Measurements: DefaultMeasurements}.merge(fromLayout(cfg.Layout))
+	overrides := make(map[string]Influx)
+	for name, layout := range cfg.Overrides {
+		overrides[config.OverrideName(name)] = fromLayout(layout)
+	}
+
+	influxLock.Lock()
+	influx, influxOverrides = loaded, overrides
+	influxLock.Unlock()
+}
+
+// fromLayout - The InfluxDB layout of a configured layout
+func fromLayout(l config.Layout) Influx {
+	return Influx{Database: l.Database, RetentionPolicy: l.RetentionPolicy, Measurements: l.Measurements}
+}
+
+// Influx - Where the metrics queried by the alert type are stored in InfluxDB
+func (d *Descriptor) Influx() Influx {
+	influxLock.RLock()
+	defer influxLock.RUnlock()
+	return influx.merge(influxOverrides[config.OverrideName(d.Name)])
+}
+
+// influxFuncs - Functions available to the template of the alert type that render where its metrics are stored,
+// e.g. from [[ dbrp ]]."[[ measurement "events" | influxident ]]"
+func (d *Descriptor) influxFuncs() template.FuncMap {
+	return template.FuncMap{
+		"dbrp": func() string {
+			i := d.Influx()
+			return `"` + InfluxIdent(i.Database) + `"."` + InfluxIdent(i.RetentionPolicy) + `"`
+		},
+		"measurement": func(name string) (string, error) {
+			m, ok := d.Influx().Measurements[name]
+			if !ok {
+				return "", errors.New("Unknown measurement " + name)
+			}
+			return m, nil
+		},
+	}
+}
@@ -0,0 +1,228 @@
+package engine
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"kapacitor-alerts-api/config"
+	"kapacitor-alerts-api/utils"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Instance - A Kapacitor instance that tasks are deployed to, e.g. the one of an Akkeris region
+type Instance struct {
+	Name   string   `json:"name"`
+	URL    string   `json:"url"`
+	Spaces []string `json:"spaces"` // Spaces whose tasks are deployed to the instance
+
+	Primary  string   `json:"primary,omitempty"`  // Instance whose tasks the standby replicates
+	Standbys []string `json:"standbys,omitempty"` // Standby instances that replicate the tasks of the instance
+
+	standbys []*Instance
+	client   *http.Client
+	username string
+	password string
+	retries  int
+	backoff  time.Duration
+}
+
+// sortedKeys - The keys of a map in order
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// DefaultInstance - Name of the Kapacitor instance at the Kapacitor URL, which runs every task that is not routed elsewhere
+const DefaultInstance = config.DefaultInstance
+
+var instances []*Instance
+var spaces map[string]*Instance
+var instancesLock sync.RWMutex
+
+// Configure - Load the Kapacitor instances and InfluxDB layout of the configuration
+func Configure(cfg *config.Config) error {
+	err := LoadInstances(cfg.Kapacitor)
+	if err != nil {
+		return err
+	}
+	LoadInflux(cfg.InfluxDB)
+	return nil
+}
+
+// LoadInstances - Load the Kapacitor instances - the default instance at the Kapacitor URL and the other instances,
+// with the spaces routed to each and their standbys
+func LoadInstances(cfg config.Kapacitor) error {
+	names := []string{DefaultInstance}
+	urls := map[string]string{DefaultInstance: cfg.URL}
+	for _, name := range sortedKeys(cfg.Instances) {
+		names = append(names, name)
+		urls[name] = cfg.Instances[name]
+	}
+
+	client := &http.Client{Timeout: time.Duration(cfg.Timeout)}
+	loaded := make(map[string]*Instance)
+	var list []*Instance
+	for _, name := range names {
+		k := &Instance{Name: name, URL: strings.TrimSuffix(urls[name], "/"), Spaces: []string{}}
+		k.client, k.username, k.password = client, cfg.Username, cfg.Password
+		k.retries, k.backoff = cfg.Retries, time.Duration(cfg.RetryBackoff)
+		loaded[name] = k
+		list = append(list, k)
+	}
+
+	routed := make(map[string]*Instance)
+	for _, space := range sortedKeys(cfg.Spaces) {
+		k, ok := loaded[cfg.Spaces[space]]
+		if !ok {
+			return errors.New("Space " + space + " is routed to unknown Kapacitor instance " + cfg.Spaces[space])
+		}
+		routed[space] = k
+		k.Spaces = append(k.Spaces, space)
+	}
+
+	err := loadStandbys(loaded, cfg.Standbys)
+	if err != nil {
+		return err
+	}
+	for space, k := range routed {
+		if k.Primary != "" {
+			return errors.New("Space " + space + " is routed to " + k.Name + ", which is a standby of " + k.Primary)
+		}
+	}
+
+	instancesLock.Lock()
+	instances, spaces, standbyStatus = list, routed, cfg.StandbyStatus
+	failovers = make(map[string]Failover)
+	instancesLock.Unlock()
+
+	deployedLock.Lock()
+	deployed = make(map[string]string)
+	deployedLock.Unlock()
+	return nil
+}
+
+// Instances - Every configured Kapacitor instance, starting with the default
+func Instances() []*Instance {
+	instancesLock.RLock()
+	defer instancesLock.RUnlock()
+	return append([]*Instance(nil), instances...)
+}
+
+// instance - The Kapacitor instance with the given name, or nil if it is not configured
+func instance(name string) *Instance {
+	instancesLock.RLock()
+	defer instancesLock.RUnlock()
+	return findInstance(name)
+}
+
+// findInstance - The Kapacitor instance with the given name. Must be called with instancesLock held.
+func findInstance(name string) *Instance {
+	for _, k := range instances {
+		if k.Name == name {
+			return k
+		}
+	}
+	return nil
+}
+
+// route - The Kapacitor instance of a task - the one of its region if it has one, then the one it is stored on,
+// then the one its space is routed to, or the default instance
+func (d *Descriptor) route(keys []string, region string, stored string) (*Instance, error) {
+	if region != "" {
+		k := instance(region)
+		if k == nil {
+			return nil, errors.New("Unknown region " + region)
+		}
+		if k.Primary != "" {
+			return nil, errors.New("Region " + region + " is a standby of " + k.Primary)
+		}
+		return k, nil
+	}
+	if stored != "" {
+		if k := instance(stored); k != nil {
+			return k, nil
+		}
+		return nil, errors.New("Kapacitor instance " + stored + " is not configured")
+	}
+
+	instancesLock.RLock()
+	defer instancesLock.RUnlock()
+	if k, ok := spaces[utils.ParseAppName(d.app(keys)).Space]; ok {
+		return k, nil
+	}
+	if len(instances) == 0 {
+		return nil, errors.New("No Kapacitor instances are configured")
+	}
+	return instances[0], nil
+}
+
+// storedInstance - Name of the Kapacitor instance a task was deployed to, or an empty string for tasks deployed
+// before instances were recorded
+func storedInstance(ctx context.Context, db *sqlx.DB, id string) (string, error) {
+	var name string
+	err := db.GetContext(ctx, &name, "SELECT instance FROM task_instances WHERE id = $1", id)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.New("Unable to access database")
+	}
+	return name, nil
+}
+
+// instanceOf - The Kapacitor instance a stored task runs on
+func (d *Descriptor) instanceOf(ctx context.Context, db *sqlx.DB, keys []string) (*Instance, error) {
+	stored, err := storedInstance(ctx, db, d.ID(keys))
+	if err != nil {
+		return nil, err
+	}
+	return d.route(keys, "", stored)
+}
+
+// storedInstances - Names of the Kapacitor instances the tasks of the alert types were deployed to, by task ID
+func storedInstances(db *sqlx.DB, descriptors []*Descriptor) (map[string]string, error) {
+	stored := make(map[string]string)
+	for _, d := range descriptors {
+		var rows []struct {
+			ID       string `db:"id"`
+			Instance string `db:"instance"`
+		}
+		err := db.Select(&rows, "SELECT id, instance FROM task_instances WHERE alerttype = $1", d.Name)
+		if err != nil {
+			return nil, errors.New("Unable to access database")
+		}
+		for _, row := range rows {
+			stored[row.ID] = row.Instance
+		}
+	}
+	return stored, nil
+}
+
+// saveInstance - Record the Kapacitor instance a task was deployed to
+func (d *Descriptor) saveInstance(ctx context.Context, db sqlx.ExecerContext, id string, k *Instance) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO task_instances (id, alerttype, instance) VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET alerttype = $2, instance = $3`, id, d.Name, k.Name)
+	if err != nil {
+		return errors.New("Unable to save to database")
+	}
+	return nil
+}
+
+// deleteInstance - Forget the Kapacitor instance of a deleted task
+func (d *Descriptor) deleteInstance(ctx context.Context, db *sqlx.DB, id string) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM task_instances WHERE id = $1", id)
+	if err != nil {
+		return errors.New("Unable to access database")
+	}
+	return nil
+}
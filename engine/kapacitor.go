@@ -0,0 +1,389 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	structs "kapacitor-alerts-api/structs"
+	"kapacitor-alerts-api/utils"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// kapacitorTask - Task definition sent to Kapacitor
+type kapacitorTask struct {
+	ID         string                 `json:"id"`
+	TemplateID string                 `json:"template-id"`
+	Dbrps      []structs.DbrpSpec     `json:"dbrps"`
+	Status     string                 `json:"status"`
+	Vars       map[string]structs.Var `json:"vars"`
+	Error      string                 `json:"error,omitempty"` // Why the task stopped, as reported by Kapacitor
+}
+
+// kapacitorTemplate - Template definition sent to Kapacitor
+type kapacitorTemplate struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Script string `json:"script"`
+
+	version string // Version of the alert template the script was rendered from
+}
+
+// kapacitorRequest - Send a request to the API of a Kapacitor instance, returning the status code and body of the response
+func kapacitorRequest(ctx context.Context, k *Instance, method string, path string, body interface{}) (int, []byte, error) {
+	return k.Request(ctx, method, path, body)
+}
+
+// Request - Send a request to the API of the Kapacitor instance with its credentials, returning the status code and
+// body of the response. GET and DELETE requests that cannot reach the instance, or that a proxy in front of it
+// rejects as unavailable, are retried with backoff. Returns a *utils.UnreachableError if the instance cannot be reached,
+// or is still unavailable after the last attempt.
+func (k *Instance) Request(ctx context.Context, method string, path string, body interface{}) (int, []byte, error) {
+	var p []byte
+	if body != nil {
+		var err error
+		p, err = json.Marshal(body)
+		if err != nil {
+			return 0, nil, errors.New("Server Error while reading response")
+		}
+	}
+
+	attempts := 1
+	if method == "GET" || method == "DELETE" {
+		attempts += k.retries
+	}
+	for attempt := 1; ; attempt++ {
+		status, bodybytes, err := k.send(ctx, method, path, p)
+		retry := err != nil || status == 502 || status == 503 || status == 504
+		if !retry {
+			return status, bodybytes, nil
+		}
+		if err == nil {
+			err = &utils.UnreachableError{Service: "Kapacitor instance " + k.Name, Err: errors.New("responded with status " + strconv.Itoa(status))}
+		}
+		if attempt == attempts || ctx.Err() != nil {
+			return status, bodybytes, err
+		}
+
+		select {
+		case <-time.After(backoff(k.backoff, attempt)):
+		case <-ctx.Done():
+			return 0, nil, &utils.UnreachableError{Service: "Kapacitor instance " + k.Name, Err: ctx.Err()}
+		}
+	}
+}
+
+// send - Send a single request to the API of the Kapacitor instance
+func (k *Instance) send(ctx context.Context, method string, path string, p []byte) (int, []byte, error) {
+	client := k.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	var reader io.Reader
+	if p != nil {
+		reader = bytes.NewReader(p)
+	}
+
+	req, err := http.NewRequest(method, k.URL+path, reader)
+	if err != nil {
+		return 0, nil, errors.New("Server Error while reading response")
+	}
+	req = req.WithContext(ctx)
+	if k.username != "" {
+		req.SetBasicAuth(k.username, k.password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, &utils.UnreachableError{Service: "Kapacitor instance " + k.Name, Err: err}
+	}
+
+	defer resp.Body.Close()
+	bodybytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, &utils.UnreachableError{Service: "Kapacitor instance " + k.Name, Err: err}
+	}
+
+	return resp.StatusCode, bodybytes, nil
+}
+
+// backoff - How long to wait before retrying a request - the base delay doubled for each previous retry, half of
+// it random so that retries from concurrent requests are spread out
+func backoff(base time.Duration, attempt int) time.Duration {
+	d := base << uint(attempt-1)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// kapacitorError - The error message in a Kapacitor response
+func kapacitorError(bodybytes []byte) error {
+	var er structs.ErrorResponse
+	err := json.Unmarshal(bodybytes, &er)
+	if err != nil {
+		return errors.New("Server Error while reading response")
+	}
+	return errors.New(er.Error)
+}
+
+// describeError - Prefix an error with what failed, unless it is a *utils.UnreachableError, which is returned as is
+// so that it is still reported as a 504
+func describeError(msg string, err error) error {
+	if _, ok := err.(*utils.UnreachableError); ok {
+		return err
+	}
+	return errors.New(msg + ": " + err.Error())
+}
+
+// joinErrors - Combine the errors of several Kapacitor instances or templates. A single error is returned as is.
+func joinErrors(errs []error, sep string) error {
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return errors.New(strings.Join(msgs, sep))
+}
+
+// createKapacitorTask - Create a task in Kapacitor
+func createKapacitorTask(ctx context.Context, k *Instance, task kapacitorTask) error {
+	status, bodybytes, err := kapacitorRequest(ctx, k, "POST", "/kapacitor/v1/tasks", task)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return kapacitorError(bodybytes)
+	}
+	return nil
+}
+
+// getKapacitorTask - Get a task from Kapacitor, or nil if it does not exist
+func getKapacitorTask(ctx context.Context, k *Instance, id string) (*kapacitorTask, error) {
+	status, bodybytes, err := kapacitorRequest(ctx, k, "GET", "/kapacitor/v1/tasks/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+	if status == 404 {
+		return nil, nil
+	}
+	if status != 200 {
+		return nil, kapacitorError(bodybytes)
+	}
+
+	var task kapacitorTask
+	err = json.Unmarshal(bodybytes, &task)
+	if err != nil {
+		return nil, errors.New("Server Error while reading response")
+	}
+	return &task, nil
+}
+
+// updateKapacitorTask - Update the template and vars of a task in Kapacitor, keeping its alert state. The script of
+// its template is used to find the offending line if Kapacitor rejects the task.
+func updateKapacitorTask(ctx context.Context, k *Instance, task kapacitorTask, script string) error {
+	status, bodybytes, err := kapacitorRequest(ctx, k, "PATCH", "/kapacitor/v1/tasks/"+task.ID, task)
+	if err != nil {
+		return err
+	}
+	if status == 400 {
+		return newScriptError(script, kapacitorError(bodybytes).Error())
+	}
+	if status != 200 {
+		return kapacitorError(bodybytes)
+	}
+	return nil
+}
+
+// setKapacitorTaskStatus - Enable or disable a task in Kapacitor
+func setKapacitorTaskStatus(ctx context.Context, k *Instance, id string, taskStatus string) error {
+	status, bodybytes, err := kapacitorRequest(ctx, k, "PATCH", "/kapacitor/v1/tasks/"+id, map[string]string{"status": taskStatus})
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return kapacitorError(bodybytes)
+	}
+	return nil
+}
+
+// listKapacitorTasks - Get the ID and status of every task in Kapacitor
+func listKapacitorTasks(ctx context.Context, k *Instance) ([]kapacitorTask, error) {
+	return listKapacitorTaskFields(ctx, k, "status")
+}
+
+// listKapacitorTaskFields - Get the ID and the given fields of every task in Kapacitor, a page at a time
+func listKapacitorTaskFields(ctx context.Context, k *Instance, fields ...string) ([]kapacitorTask, error) {
+	var tasks []kapacitorTask
+	for offset := 0; ; offset += 100 {
+		path := "/kapacitor/v1/tasks?fields=" + strings.Join(fields, "&fields=") + "&limit=100&offset=" + strconv.Itoa(offset)
+		status, bodybytes, err := kapacitorRequest(ctx, k, "GET", path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if status != 200 {
+			return nil, kapacitorError(bodybytes)
+		}
+
+		var page struct {
+			Tasks []kapacitorTask `json:"tasks"`
+		}
+		err = json.Unmarshal(bodybytes, &page)
+		if err != nil {
+			return nil, errors.New("Server Error while reading response")
+		}
+		tasks = append(tasks, page.Tasks...)
+		if len(page.Tasks) < 100 {
+			return tasks, nil
+		}
+	}
+}
+
+// InstanceTask - A task on a Kapacitor instance, with the vars and the template it was created from
+type InstanceTask struct {
+	ID         string
+	TemplateID string // Empty if the task has its own script
+	Vars       map[string]structs.Var
+}
+
+// Tasks - Get every task on the Kapacitor instance with its vars and template
+func (k *Instance) Tasks(ctx context.Context) ([]InstanceTask, error) {
+	listed, err := listKapacitorTaskFields(ctx, k, "vars", "template-id")
+	if err != nil {
+		return nil, err
+	}
+	tasks := make([]InstanceTask, 0, len(listed))
+	for _, task := range listed {
+		tasks = append(tasks, InstanceTask{ID: task.ID, TemplateID: task.TemplateID, Vars: task.Vars})
+	}
+	return tasks, nil
+}
+
+// deleteKapacitorTask - Delete a task from Kapacitor
+func deleteKapacitorTask(ctx context.Context, k *Instance, id string) error {
+	status, bodybytes, err := kapacitorRequest(ctx, k, "DELETE", "/kapacitor/v1/tasks/"+id, nil)
+	if err != nil {
+		return err
+	}
+	if status != 204 {
+		return kapacitorError(bodybytes)
+	}
+	return nil
+}
+
+// getKapacitorTaskState - Get the alert topics of a task from Kapacitor
+func getKapacitorTaskState(ctx context.Context, k *Instance, id string) (*structs.TaskState, error) {
+	_, bodybytes, err := kapacitorRequest(ctx, k, "GET", "/kapacitor/v1preview/alerts/topics?pattern=*"+id+"*", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var taskstate structs.TaskState
+	err = json.Unmarshal(bodybytes, &taskstate)
+	if err != nil {
+		return nil, errors.New("Server Error while reading response")
+	}
+
+	return &taskstate, nil
+}
+
+// getKapacitorTemplate - Get a template from Kapacitor, or nil if it does not exist
+func getKapacitorTemplate(ctx context.Context, k *Instance, id string) (*kapacitorTemplate, error) {
+	status, bodybytes, err := kapacitorRequest(ctx, k, "GET", "/kapacitor/v1/templates/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+	if status == 404 {
+		return nil, nil
+	}
+	if status != 200 {
+		return nil, kapacitorError(bodybytes)
+	}
+
+	var t kapacitorTemplate
+	err = json.Unmarshal(bodybytes, &t)
+	if err != nil {
+		return nil, errors.New("Server Error while reading response")
+	}
+	return &t, nil
+}
+
+// listKapacitorTemplates - Get all templates from Kapacitor with IDs matching a pattern
+func listKapacitorTemplates(ctx context.Context, k *Instance, pattern string) ([]kapacitorTemplate, error) {
+	var templates []kapacitorTemplate
+	for offset := 0; ; offset += 100 {
+		path := "/kapacitor/v1/templates?pattern=" + url.QueryEscape(pattern) + "&limit=100&offset=" + strconv.Itoa(offset)
+		status, bodybytes, err := kapacitorRequest(ctx, k, "GET", path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if status != 200 {
+			return nil, kapacitorError(bodybytes)
+		}
+
+		var page struct {
+			Templates []kapacitorTemplate `json:"templates"`
+		}
+		err = json.Unmarshal(bodybytes, &page)
+		if err != nil {
+			return nil, errors.New("Server Error while reading response")
+		}
+		templates = append(templates, page.Templates...)
+		if len(page.Templates) < 100 {
+			return templates, nil
+		}
+	}
+}
+
+// createKapacitorTemplate - Create a template in Kapacitor. Returns a *ScriptError if Kapacitor rejects the script.
+func createKapacitorTemplate(ctx context.Context, k *Instance, t kapacitorTemplate) error {
+	status, bodybytes, err := kapacitorRequest(ctx, k, "POST", "/kapacitor/v1/templates", t)
+	if err != nil {
+		return err
+	}
+	if status == 400 {
+		return newScriptError(t.Script, kapacitorError(bodybytes).Error())
+	}
+	if status != 200 {
+		return kapacitorError(bodybytes)
+	}
+	return nil
+}
+
+// updateKapacitorTemplate - Update a template in Kapacitor, which also updates every task created from it.
+// Returns a *ScriptError if Kapacitor rejects the script.
+func updateKapacitorTemplate(ctx context.Context, k *Instance, t kapacitorTemplate) error {
+	status, bodybytes, err := kapacitorRequest(ctx, k, "PATCH", "/kapacitor/v1/templates/"+t.ID, t)
+	if err != nil {
+		return err
+	}
+	if status == 400 {
+		return newScriptError(t.Script, kapacitorError(bodybytes).Error())
+	}
+	if status != 200 {
+		return kapacitorError(bodybytes)
+	}
+	return nil
+}
+
+// deleteKapacitorTemplate - Delete a template from Kapacitor
+func deleteKapacitorTemplate(ctx context.Context, k *Instance, id string) error {
+	status, bodybytes, err := kapacitorRequest(ctx, k, "DELETE", "/kapacitor/v1/templates/"+id, nil)
+	if err != nil {
+		return err
+	}
+	if status != 204 {
+		return kapacitorError(bodybytes)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package engine
+
+import (
+	"context"
+	structs "kapacitor-alerts-api/structs"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Import - Save the config of a task on a Kapacitor instance to the database of its alert type.
+// Returns false if the task does not belong to any built-in alert type or any of the given registered ones.
+func Import(db *sqlx.DB, k *Instance, task InstanceTask, registered []*Descriptor) (bool, error) {
+	d := descriptorOf(append(Descriptors(), registered...), task.ID)
+	if d == nil {
+		return false, nil
+	}
+	return true, d.Import(db, k, task)
+}
+
+// Import - Rebuild a task of the alert type from its Kapacitor vars and save its config to the database,
+// along with the Kapacitor instance it runs on and the version of the template it is rendered from
+func (d *Descriptor) Import(db *sqlx.DB, k *Instance, task InstanceTask) error {
+	vars := task.Vars
+	spec := d.FromVars(vars)
+	n := spec.notify()
+	n.Slack = StringVar(vars, "slack")
+	n.Post = StringVar(vars, "post")
+	n.Email = StringVar(vars, "email")
+
+	err := spec.Prepare()
+	if err != nil {
+		return err
+	}
+	spec.notify().prepare()
+
+	_, tpl, err := d.build(spec)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	version, err := importedVersion(ctx, k, task, tpl)
+	if err != nil {
+		return err
+	}
+
+	err = d.insert(ctx, db, spec)
+	if err != nil {
+		return err
+	}
+	err = d.saveInstance(ctx, db, d.ID(spec.Keys()), k)
+	if err != nil {
+		return err
+	}
+	return d.saveVersion(ctx, db, d.ID(spec.Keys()), version)
+}
+
+// importedVersion - The version of the template an imported task runs - the current one if it runs from the Kapacitor
+// template of its shape and that template matches the current one, otherwise legacyVersion until it is redeployed
+func importedVersion(ctx context.Context, k *Instance, task InstanceTask, tpl kapacitorTemplate) (string, error) {
+	if task.TemplateID != tpl.ID {
+		return legacyVersion, nil
+	}
+	current, err := getKapacitorTemplate(ctx, k, tpl.ID)
+	if err != nil {
+		return "", err
+	}
+	if current == nil || current.Script != tpl.Script {
+		return legacyVersion, nil
+	}
+	return tpl.version, nil
+}
+
+// StringVar - Get the value of a Kapacitor var as a string, or an empty string if it is not present
+func StringVar(vars map[string]structs.Var, name string) string {
+	switch value := vars[name].Value.(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	}
+	return ""
+}
+
+// BoolVar - Get the value of a boolean Kapacitor var, or false if it is not present
+func BoolVar(vars map[string]structs.Var, name string) bool {
+	value, _ := vars[name].Value.(bool)
+	return value
+}
+
+// durationUnit - A TICKscript duration unit
+type durationUnit struct {
+	suffix string
+	length time.Duration
+}
+
+// durationUnits - TICKscript duration units, largest first
+var durationUnits = []durationUnit{
+	{"w", 7 * 24 * time.Hour}, {"d", 24 * time.Hour}, {"h", time.Hour}, {"m", time.Minute},
+	{"s", time.Second}, {"ms", time.Millisecond}, {"u", time.Microsecond},
+}
+
+// DurationVar - Get the value of a duration Kapacitor var as a TICKscript duration literal (e.g. 10m), or an empty
+// string if it is not present. Tasks created before templates were used saved durations as strings, which are
+// returned as is.
+func DurationVar(vars map[string]structs.Var, name string) string {
+	value, ok := vars[name].Value.(float64)
+	if !ok {
+		return StringVar(vars, name)
+	}
+
+	d := time.Duration(value)
+	for _, unit := range durationUnits {
+		if d != 0 && d%unit.length == 0 {
+			return strconv.FormatInt(int64(d/unit.length), 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64(d), 10) + "ns"
+}
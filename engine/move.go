@@ -0,0 +1,93 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"kapacitor-alerts-api/utils"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// MoveRequest - Options of moving stored tasks to another Kapacitor instance
+type MoveRequest struct {
+	RedeployRequest
+	Target string `json:"target"` // Kapacitor instance to move the tasks to
+	App    string `json:"app"`    // Only move the tasks of the app
+	Space  string `json:"space"`  // Only move the tasks of apps in the space
+	Delete bool   `json:"delete"` // Delete the tasks from the instance they are moved from
+}
+
+// moveError - A move that was refused because of the request
+type moveError string
+
+func (e moveError) Error() string {
+	return string(e)
+}
+
+// move - Where a redeploy moves its tasks to, and which tasks it moves
+type move struct {
+	target *Instance
+	app    string
+	space  string
+	remove bool
+}
+
+// includes - Whether a stored task of the alert type is moved
+func (m *move) includes(d *Descriptor, row interface{}) bool {
+	if m.app == "" && m.space == "" {
+		return true
+	}
+	spec, _ := d.fromRow(row)
+	if spec == nil {
+		return false
+	}
+	app := d.app(spec.Keys())
+	if m.app != "" && app != m.app {
+		return false
+	}
+	return m.space == "" || utils.ParseAppName(app).Space == m.space
+}
+
+// StartMove - Deploy the stored tasks of the requested alert types (or those of an app or space) to a Kapacitor
+// instance in the background, verifying each and recording it as running there. Returns nil if the alert type or
+// instance does not exist.
+func StartMove(db *sqlx.DB, r MoveRequest) (*Redeploy, error) {
+	target := instance(r.Target)
+	if target == nil {
+		return nil, nil
+	}
+	if target.Primary != "" {
+		return nil, moveError(target.Name + " is a standby of " + target.Primary)
+	}
+	if running() {
+		return nil, ErrRedeployRunning
+	}
+
+	descriptors, err := redeployDescriptors(db, r.Type)
+	if err != nil || descriptors == nil {
+		return nil, err
+	}
+	m := &move{target: target, app: r.App, space: r.Space, remove: r.Delete}
+	return startRedeploy(db, descriptors, r.RedeployRequest, m, nil)
+}
+
+// verifyTask - Check that a task was deployed to a Kapacitor instance as rendered, and is running
+func verifyTask(ctx context.Context, d *Descriptor, k *Instance, task kapacitorTask) error {
+	current, err := getKapacitorTask(ctx, k, task.ID)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return errors.New("Task is missing from " + k.Name + " after being deployed")
+	}
+	if diffTask(d, current, task) != nil {
+		return errors.New("Task on " + k.Name + " does not match the deployed task")
+	}
+	if current.Status != "enabled" {
+		return errors.New("Task is " + current.Status + " on " + k.Name)
+	}
+	if current.Error != "" {
+		return errors.New("Task failed on " + k.Name + ": " + current.Error)
+	}
+	return nil
+}
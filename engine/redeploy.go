@@ -0,0 +1,524 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	structs "kapacitor-alerts-api/structs"
+	"log"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Registered - Describes the alert types registered at runtime, so they can be redeployed along with the
+// built-in alert types. Set by the server, as registered alert types are stored in the database.
+var Registered func(db *sqlx.DB) ([]*Descriptor, error)
+
+// RedeployRequest - Options of a bulk redeploy
+type RedeployRequest struct {
+	Type        string `json:"type"`        // Alert type to redeploy, or every alert type if empty
+	DryRun      bool   `json:"dryrun"`      // Only report what would change
+	Concurrency int    `json:"concurrency"` // Number of tasks to redeploy at once
+}
+
+// Change - A value that differs between Kapacitor and the re-rendered task
+type Change struct {
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+// TaskChange - How a task would be changed by a redeploy
+type TaskChange struct {
+	ID         string            `json:"id"`
+	Type       string            `json:"type"`
+	Instance   string            `json:"instance"`
+	From       string            `json:"from,omitempty"` // Instance the task is moved from, if it is moved
+	Action     string            `json:"action"`         // create if the task is missing from Kapacitor, move if it is only moved, otherwise update
+	TemplateID *Change           `json:"template-id,omitempty"`
+	Vars       map[string]Change `json:"vars,omitempty"`
+}
+
+// TemplateChange - How a Kapacitor template would be changed by a redeploy
+type TemplateChange struct {
+	ID     string `json:"id"`     // Template ID, prefixed with the instance if it is not the default (e.g. eu/memory.slack)
+	Action string `json:"action"` // create if the template is missing from Kapacitor, otherwise update
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new"`
+}
+
+// TaskFailure - A task that could not be redeployed
+type TaskFailure struct {
+	ID    string `json:"id"`
+	Type  string `json:"type"`
+	Error string `json:"error"`
+}
+
+// Redeploy - The progress of a bulk redeploy
+type Redeploy struct {
+	ID          string           `json:"id"`
+	Types       []string         `json:"types"`
+	DryRun      bool             `json:"dryrun"`
+	Concurrency int              `json:"concurrency"`
+	Status      string           `json:"status"` // running or finished
+	Total       int              `json:"total"`
+	Done        int              `json:"done"`
+	Updated     int              `json:"updated"`
+	Unchanged   int              `json:"unchanged"`
+	Target      string           `json:"target,omitempty"` // Instance the tasks are moved to, if they are moved
+	Moved       int              `json:"moved,omitempty"`
+	Changes     []TaskChange     `json:"changes,omitempty"`
+	Templates   []TemplateChange `json:"templates,omitempty"`
+	Failed      []TaskFailure    `json:"failed"`
+	Started     time.Time        `json:"started"`
+	Finished    *time.Time       `json:"finished,omitempty"`
+
+	lock    sync.Mutex
+	checked map[string]bool
+	db      *sqlx.DB            // Where the template version and instance of each task are saved (not saved if nil)
+	stored  map[string]string   // Kapacitor instance each task was deployed to, by task ID
+	after   func(job *Redeploy) // Called once the redeploy has finished
+	move    *move               // Where the tasks are moved to, if they are moved
+}
+
+// redeployTask - A stored task to redeploy
+type redeployTask struct {
+	d   *Descriptor
+	row interface{}
+}
+
+var redeploys = make(map[string]*Redeploy)
+var redeploysLock sync.Mutex
+
+// DefaultConcurrency and MaxConcurrency - How many tasks are redeployed at once
+const (
+	DefaultConcurrency = 4
+	MaxConcurrency     = 32
+)
+
+// ErrRedeployRunning - Only one bulk redeploy can run at a time
+var ErrRedeployRunning = errors.New("A redeploy is already running")
+
+// rows - All stored tasks of the alert type
+func (d *Descriptor) rows(db *sqlx.DB) ([]interface{}, error) {
+	query := "SELECT * FROM " + d.Table
+	if len(d.Scope) > 0 {
+		query += " WHERE " + d.where(len(d.Scope))
+	}
+
+	rows := reflect.New(reflect.SliceOf(reflect.TypeOf(d.Model)))
+	err := db.Select(rows.Interface(), query, args(d.Scope)...)
+	if err != nil {
+		return nil, errors.New("Unable to access database")
+	}
+
+	var result []interface{}
+	for i := 0; i < rows.Elem().Len(); i++ {
+		result = append(result, rows.Elem().Index(i).Interface())
+	}
+	return result, nil
+}
+
+// fromRow - Rebuild the request of a stored task. Rows have the same JSON fields as requests, so the row is
+// converted through JSON. The spec is returned along with any validation error, to identify the task.
+func (d *Descriptor) fromRow(row interface{}) (Spec, error) {
+	p, err := json.Marshal(row)
+	if err != nil {
+		return nil, err
+	}
+	spec := d.NewSpec()
+	err = json.Unmarshal(p, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	err = spec.Prepare()
+	if err != nil {
+		return spec, err
+	}
+	spec.notify().prepare()
+	return spec, nil
+}
+
+// redeployDescriptors - The alert types to redeploy - the named type, or every built-in and registered type
+func redeployDescriptors(db *sqlx.DB, name string) ([]*Descriptor, error) {
+	all := Descriptors()
+	if Registered != nil {
+		registered, err := Registered(db)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, registered...)
+	}
+
+	if name == "" {
+		return all, nil
+	}
+	for _, d := range all {
+		if d.Name == name {
+			return []*Descriptor{d}, nil
+		}
+	}
+	return nil, nil
+}
+
+// StartRedeploy - Re-render every stored task of the requested alert types and update them in Kapacitor in the
+// background. Returns nil if the alert type does not exist.
+func StartRedeploy(db *sqlx.DB, r RedeployRequest) (*Redeploy, error) {
+	if running() {
+		return nil, ErrRedeployRunning
+	}
+
+	descriptors, err := redeployDescriptors(db, r.Type)
+	if err != nil || descriptors == nil {
+		return nil, err
+	}
+	return startRedeploy(db, descriptors, r, nil, nil)
+}
+
+// startRedeploy - Redeploy every stored task of the alert types in the background, moving the tasks picked by m if it
+// is set, and calling after once finished
+func startRedeploy(db *sqlx.DB, descriptors []*Descriptor, r RedeployRequest, m *move, after func(job *Redeploy)) (*Redeploy, error) {
+	if r.Concurrency == 0 {
+		r.Concurrency = DefaultConcurrency
+	}
+
+	job := &Redeploy{
+		ID:          strconv.FormatInt(time.Now().UnixNano(), 36),
+		DryRun:      r.DryRun,
+		Concurrency: r.Concurrency,
+		Status:      "running",
+		Failed:      []TaskFailure{},
+		Started:     time.Now(),
+		checked:     make(map[string]bool),
+		db:          db,
+		after:       after,
+		stored:      make(map[string]string),
+		move:        m,
+	}
+	if m != nil {
+		job.Target = m.target.Name
+	}
+	if db != nil {
+		stored, err := storedInstances(db, descriptors)
+		if err != nil {
+			return nil, err
+		}
+		job.stored = stored
+	}
+
+	var tasks []redeployTask
+	for _, d := range descriptors {
+		rows, err := d.rows(db)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			if m == nil || m.includes(d, row) {
+				tasks = append(tasks, redeployTask{d, row})
+			}
+		}
+		job.Types = append(job.Types, d.Name)
+	}
+	job.Total = len(tasks)
+
+	redeploysLock.Lock()
+	defer redeploysLock.Unlock()
+	for _, other := range redeploys {
+		if other.Snapshot().Status == "running" {
+			return nil, ErrRedeployRunning
+		}
+	}
+	redeploys[job.ID] = job
+
+	go job.run(tasks)
+	return job, nil
+}
+
+// GetRedeploy - The progress of a bulk redeploy, or nil if it does not exist
+func GetRedeploy(id string) *Redeploy {
+	redeploysLock.Lock()
+	defer redeploysLock.Unlock()
+	return redeploys[id]
+}
+
+// running - Whether any bulk redeploy is still running
+func running() bool {
+	redeploysLock.Lock()
+	defer redeploysLock.Unlock()
+	for _, job := range redeploys {
+		if job.Snapshot().Status == "running" {
+			return true
+		}
+	}
+	return false
+}
+
+// Snapshot - A copy of the current progress of the redeploy
+func (job *Redeploy) Snapshot() Redeploy {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return Redeploy{
+		ID: job.ID, Types: job.Types, DryRun: job.DryRun, Concurrency: job.Concurrency, Status: job.Status,
+		Total: job.Total, Done: job.Done, Updated: job.Updated, Unchanged: job.Unchanged, Target: job.Target, Moved: job.Moved,
+		Changes:   append([]TaskChange(nil), job.Changes...),
+		Templates: append([]TemplateChange(nil), job.Templates...),
+		Failed:    append([]TaskFailure{}, job.Failed...),
+		Started:   job.Started, Finished: job.Finished,
+	}
+}
+
+// run - Redeploy the tasks, at most Concurrency at a time
+func (job *Redeploy) run(tasks []redeployTask) {
+	queue := make(chan redeployTask)
+	var wg sync.WaitGroup
+	for i := 0; i < job.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range queue {
+				job.redeploy(t.d, t.row)
+			}
+		}()
+	}
+	for _, t := range tasks {
+		queue <- t
+	}
+	close(queue)
+	wg.Wait()
+
+	if job.after != nil {
+		job.after(job)
+	}
+
+	job.lock.Lock()
+	finished := time.Now()
+	job.Status, job.Finished = "finished", &finished
+	log.Println("✓ Redeploy " + job.ID + " finished - " + strconv.Itoa(job.Updated) + " updated, " +
+		strconv.Itoa(job.Unchanged) + " unchanged, " + strconv.Itoa(len(job.Failed)) + " failed")
+	job.lock.Unlock()
+}
+
+// redeploy - Re-render a stored task and update it in Kapacitor if it has changed
+func (job *Redeploy) redeploy(d *Descriptor, row interface{}) {
+	spec, err := d.fromRow(row)
+	if err != nil {
+		id := ""
+		if spec != nil {
+			id = d.ID(spec.Keys())
+		}
+		job.fail(d, id, err)
+		return
+	}
+	task, tpl, err := d.build(spec)
+	if err != nil {
+		job.fail(d, task.ID, err)
+		return
+	}
+
+	k, err := d.route(spec.Keys(), "", job.stored[task.ID])
+	if err != nil {
+		job.fail(d, task.ID, err)
+		return
+	}
+	source := k
+	if job.move != nil {
+		k = job.move.target
+	}
+	active := k.active()
+
+	// Redeploys run in the background, so they are not cancelled with the request that started them
+	ctx := context.Background()
+	current, err := getKapacitorTask(ctx, active, task.ID)
+	if err != nil {
+		job.fail(d, task.ID, err)
+		return
+	}
+	change := diffTask(d, current, task)
+	if change == nil && source != k {
+		change = &TaskChange{ID: task.ID, Type: d.Name, Action: "move"}
+	}
+	if change != nil {
+		change.Instance = active.Name
+	}
+	if change != nil && source != k {
+		change.From = source.Name
+	}
+
+	if job.DryRun {
+		err = job.checkTemplate(active, tpl)
+		if err != nil {
+			job.fail(d, task.ID, err)
+			return
+		}
+		job.finish(change)
+		return
+	}
+
+	err = ensureTemplate(ctx, active, tpl)
+	if err == nil && change != nil && current == nil {
+		err = createKapacitorTask(ctx, active, task)
+	} else if err == nil && change != nil {
+		err = updateKapacitorTask(ctx, active, task, tpl.Script)
+	}
+	for _, s := range k.replicas() {
+		if err == nil {
+			err = d.replicateTask(ctx, s, task, tpl)
+		}
+	}
+	if err == nil && job.move != nil {
+		err = verifyTask(ctx, d, active, task)
+	}
+	if err == nil && job.db != nil {
+		err = d.saveInstance(ctx, job.db, task.ID, k)
+	}
+	if err == nil && job.db != nil {
+		err = d.saveVersion(ctx, job.db, task.ID, tpl.version)
+	}
+	if err != nil {
+		job.fail(d, task.ID, err)
+		return
+	}
+
+	if source != k && job.move.remove {
+		err = deleteKapacitorTask(ctx, source.active(), task.ID)
+		if err != nil {
+			job.fail(d, task.ID, errors.New("Moved to "+k.Name+", but unable to delete from "+source.Name+": "+err.Error()))
+			return
+		}
+		unreplicate(ctx, source, task.ID)
+	}
+	if source != k {
+		job.lock.Lock()
+		job.Moved++
+		job.lock.Unlock()
+	}
+	job.finish(change)
+}
+
+// checkTemplate - Record how a template would be changed on a Kapacitor instance, checking each template once per redeploy
+func (job *Redeploy) checkTemplate(k *Instance, tpl kapacitorTemplate) error {
+	id := qualifiedID(k, tpl.ID)
+	job.lock.Lock()
+	checked := job.checked[id]
+	job.checked[id] = true
+	job.lock.Unlock()
+	if checked {
+		return nil
+	}
+
+	current, err := getKapacitorTemplate(context.Background(), k, tpl.ID)
+	if err != nil {
+		return err
+	}
+
+	change := TemplateChange{ID: id, Action: "create", New: tpl.Script}
+	if current != nil {
+		if current.Script == tpl.Script {
+			return nil
+		}
+		change.Action, change.Old = "update", current.Script
+	}
+
+	job.lock.Lock()
+	job.Templates = append(job.Templates, change)
+	job.lock.Unlock()
+	return nil
+}
+
+// finish - Record a task that was redeployed (or would be, in a dry run)
+func (job *Redeploy) finish(change *TaskChange) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.Done++
+	if change == nil {
+		job.Unchanged++
+		return
+	}
+	job.Updated++
+	if job.DryRun {
+		job.Changes = append(job.Changes, *change)
+	}
+}
+
+// fail - Record a task that could not be redeployed
+func (job *Redeploy) fail(d *Descriptor, id string, err error) {
+	log.Println("✖ Unable to redeploy " + d.Name + " task " + id + ": " + err.Error())
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.Done++
+	job.Failed = append(job.Failed, TaskFailure{ID: id, Type: d.Name, Error: err.Error()})
+}
+
+// diffTask - How a task in Kapacitor differs from the re-rendered task, or nil if it does not
+func diffTask(d *Descriptor, current *kapacitorTask, task kapacitorTask) *TaskChange {
+	change := &TaskChange{ID: task.ID, Type: d.Name, Action: "update", Vars: make(map[string]Change)}
+	if current == nil {
+		change.Action = "create"
+		current = &kapacitorTask{}
+	}
+
+	if current.TemplateID != task.TemplateID {
+		change.TemplateID = &Change{Old: current.TemplateID, New: task.TemplateID}
+	}
+	for name, v := range task.Vars {
+		old, ok := current.Vars[name]
+		if !ok {
+			change.Vars[name] = Change{New: v.Value}
+		} else if !sameVar(old, v) {
+			change.Vars[name] = Change{Old: old.Value, New: v.Value}
+		}
+	}
+	for name, old := range current.Vars {
+		if _, ok := task.Vars[name]; !ok {
+			change.Vars[name] = Change{Old: old.Value}
+		}
+	}
+
+	if change.Action == "update" && change.TemplateID == nil && len(change.Vars) == 0 {
+		return nil
+	}
+	return change
+}
+
+// sameVar - Whether two Kapacitor vars hold the same value. Kapacitor returns numbers as floats and may
+// return durations in nanoseconds, so values are compared by what they mean rather than how they are written.
+func sameVar(a structs.Var, b structs.Var) bool {
+	if a.Type != b.Type {
+		return false
+	}
+	return reflect.DeepEqual(varValue(a), varValue(b))
+}
+
+// varValue - The value of a Kapacitor var in a form that can be compared
+func varValue(v structs.Var) interface{} {
+	switch value := v.Value.(type) {
+	case int:
+		return float64(value)
+	case float64:
+		if v.Type == "duration" {
+			return time.Duration(value)
+		}
+	case string:
+		if d, ok := parseDuration(value); ok && v.Type == "duration" {
+			return d
+		}
+	}
+	return v.Value
+}
+
+// parseDuration - Parse a TICKscript duration literal (e.g. 10m)
+func parseDuration(s string) (time.Duration, bool) {
+	if !durationRegex.MatchString(s) {
+		return 0, false
+	}
+	for _, unit := range append(durationUnits, durationUnit{"µ", time.Microsecond}) {
+		if n, err := strconv.ParseInt(s[:len(s)-len(unit.suffix)], 10, 64); err == nil && s[len(s)-len(unit.suffix):] == unit.suffix {
+			return time.Duration(n) * unit.length, true
+		}
+	}
+	return 0, false
+}
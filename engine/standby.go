@@ -0,0 +1,366 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Failover - A Kapacitor instance whose tasks run on one of its standbys until it is failed back
+type Failover struct {
+	Instance string    `json:"instance" db:"instance"`
+	Standby  string    `json:"standby" db:"standby"`
+	Started  time.Time `json:"started" db:"started"`
+
+	Enabled int               `json:"enabled,omitempty"` // Tasks enabled on the standby by the failover
+	Failed  map[string]string `json:"failed,omitempty"`  // Tasks that could not be enabled, with the error of each
+}
+
+// FailoverRequest - The instance to fail over, and the standby to move its tasks to
+type FailoverRequest struct {
+	Instance string `json:"instance"`
+	Standby  string `json:"standby"` // Optional if the instance has a single standby
+}
+
+// failoverError - A failover that was refused because of the request
+type failoverError string
+
+func (e failoverError) Error() string {
+	return string(e)
+}
+
+// ErrNoFailover - Failing back an instance that has not failed over
+var ErrNoFailover = errors.New("The Kapacitor instance has not failed over")
+
+// standbyStatus - Status of the tasks on standbys that have not been failed over to
+var standbyStatus = "disabled"
+
+// failovers - Failovers in effect, by the name of the failed instance
+var failovers = make(map[string]Failover)
+
+// loadStandbys - Make the standbys of the Kapacitor instances replicate their instance
+func loadStandbys(loaded map[string]*Instance, standbys map[string]string) error {
+	for _, name := range sortedKeys(standbys) {
+		k, ok := loaded[name]
+		if !ok {
+			return errors.New("Standby " + name + " is not a Kapacitor instance")
+		}
+		if name == DefaultInstance {
+			return errors.New(DefaultInstance + " cannot be a standby - it is the instance at the Kapacitor URL")
+		}
+		primary, ok := loaded[standbys[name]]
+		if !ok {
+			return errors.New(name + " is a standby of unknown Kapacitor instance " + standbys[name])
+		}
+		if _, ok := standbys[primary.Name]; ok {
+			return errors.New(name + " is a standby of " + primary.Name + ", which is itself a standby")
+		}
+		k.Primary = primary.Name
+		primary.Standbys = append(primary.Standbys, name)
+		primary.standbys = append(primary.standbys, k)
+	}
+	return nil
+}
+
+// active - The Kapacitor instance the tasks of the instance run on - the standby it failed over to, or itself
+func (k *Instance) active() *Instance {
+	instancesLock.RLock()
+	defer instancesLock.RUnlock()
+	if f, ok := failovers[k.Name]; ok {
+		for _, s := range k.standbys {
+			if s.Name == f.Standby {
+				return s
+			}
+		}
+	}
+	return k
+}
+
+// replicas - The standbys that replicate the tasks of the instance, other than the one it failed over to
+func (k *Instance) replicas() []*Instance {
+	active := k.active()
+	var replicas []*Instance
+	for _, s := range k.standbys {
+		if s != active {
+			replicas = append(replicas, s)
+		}
+	}
+	return replicas
+}
+
+// replica - The copy of a task on a standby
+func replica(task kapacitorTask) kapacitorTask {
+	instancesLock.RLock()
+	task.Status = standbyStatus
+	instancesLock.RUnlock()
+	return task
+}
+
+// replicateTask - Create or update the copy of a task on a standby
+func (d *Descriptor) replicateTask(ctx context.Context, s *Instance, task kapacitorTask, tpl kapacitorTemplate) error {
+	err := ensureTemplate(ctx, s, tpl)
+	if err != nil {
+		return err
+	}
+
+	task = replica(task)
+	current, err := getKapacitorTask(ctx, s, task.ID)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return createKapacitorTask(ctx, s, task)
+	}
+	if diffTask(d, current, task) != nil || current.Status != task.Status {
+		return updateKapacitorTask(ctx, s, task, tpl.Script)
+	}
+	return nil
+}
+
+// replicate - Copy a task to every standby of its instance. Standbys that cannot be reached are logged and
+// skipped, so they do not stop alerting on the instance - redeploying brings them up to date.
+func (d *Descriptor) replicate(ctx context.Context, k *Instance, task kapacitorTask, tpl kapacitorTemplate) {
+	for _, s := range k.replicas() {
+		err := d.replicateTask(ctx, s, task, tpl)
+		if err != nil {
+			log.Println("✖ Unable to replicate task " + task.ID + " to standby " + s.Name + ": " + err.Error())
+		}
+	}
+}
+
+// unreplicate - Delete a task from every standby of its instance, logging any standbys that cannot be reached
+func unreplicate(ctx context.Context, k *Instance, id string) {
+	for _, s := range k.replicas() {
+		err := deleteKapacitorTask(ctx, s, id)
+		if err != nil {
+			log.Println("✖ Unable to delete task " + id + " from standby " + s.Name + ": " + err.Error())
+		}
+	}
+}
+
+// LoadFailovers - Restore the failovers saved in the database. Must be called after the instances are loaded.
+func LoadFailovers(ctx context.Context, db *sqlx.DB) error {
+	var rows []Failover
+	err := db.SelectContext(ctx, &rows, "SELECT instance, standby, started FROM kapacitor_failovers")
+	if err != nil {
+		return errors.New("Unable to access database")
+	}
+
+	instancesLock.Lock()
+	defer instancesLock.Unlock()
+	for _, f := range rows {
+		s := findInstance(f.Standby)
+		if s == nil || s.Primary != f.Instance {
+			log.Println("✖ Ignoring failover of " + f.Instance + " to " + f.Standby + ", which is no longer one of its standbys")
+			continue
+		}
+		failovers[f.Instance] = f
+		log.Println("✓ Tasks of Kapacitor instance " + f.Instance + " run on its standby " + f.Standby)
+	}
+	return nil
+}
+
+// Failovers - The failovers in effect, by instance
+func Failovers() []Failover {
+	instancesLock.RLock()
+	defer instancesLock.RUnlock()
+	list := []Failover{}
+	for _, f := range failovers {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Instance < list[j].Instance })
+	return list
+}
+
+// StartFailover - Move the tasks of a Kapacitor instance to one of its standbys by enabling every task on the standby.
+// Tasks created, updated, and deleted afterwards are written to the standby until the instance is failed back.
+// Returns nil if the instance does not exist.
+func StartFailover(ctx context.Context, db *sqlx.DB, r FailoverRequest) (*Failover, error) {
+	k := instance(r.Instance)
+	if k == nil {
+		return nil, nil
+	}
+	if k.Primary != "" {
+		return nil, failoverError(k.Name + " is a standby of " + k.Primary)
+	}
+
+	if len(k.standbys) == 0 {
+		return nil, failoverError(k.Name + " has no standbys")
+	}
+	var s *Instance
+	for _, standby := range k.standbys {
+		if standby.Name == r.Standby || (r.Standby == "" && len(k.standbys) == 1) {
+			s = standby
+		}
+	}
+	if s == nil && r.Standby == "" {
+		return nil, failoverError("Standby is required - " + k.Name + " has " + strconv.Itoa(len(k.standbys)) + " standbys")
+	}
+	if s == nil {
+		return nil, failoverError(r.Standby + " is not a standby of " + k.Name)
+	}
+	if active := k.active(); active != k && active != s {
+		return nil, failoverError(k.Name + " has already failed over to " + active.Name + " - fail it back first")
+	}
+
+	// Failovers run to completion even if the client goes away, so the standby is not left half enabled. Only the
+	// database write is bounded by the context of the request.
+	kctx := context.Background()
+	tasks, err := listKapacitorTasks(kctx, s)
+	if err != nil {
+		return nil, describeError("Unable to list tasks on "+s.Name, err)
+	}
+
+	f := Failover{Instance: k.Name, Standby: s.Name, Started: time.Now()}
+	_, err = db.ExecContext(ctx, `INSERT INTO kapacitor_failovers (instance, standby, started) VALUES ($1, $2, $3)
+		ON CONFLICT (instance) DO UPDATE SET standby = $2, started = $3`, f.Instance, f.Standby, f.Started)
+	if err != nil {
+		return nil, errors.New("Unable to save to database")
+	}
+	instancesLock.Lock()
+	failovers[k.Name] = f
+	instancesLock.Unlock()
+	log.Println("✓ Failed over Kapacitor instance " + k.Name + " to its standby " + s.Name)
+
+	f.Failed = make(map[string]string)
+	for _, task := range tasks {
+		if task.Status == "enabled" {
+			continue
+		}
+		err = setKapacitorTaskStatus(kctx, s, task.ID, "enabled")
+		if err != nil {
+			f.Failed[task.ID] = err.Error()
+			continue
+		}
+		f.Enabled++
+	}
+	if len(f.Failed) > 0 {
+		log.Println("✖ Unable to enable " + strconv.Itoa(len(f.Failed)) + " tasks on " + s.Name + ": " + strings.Join(failedIDs(f.Failed), ", "))
+	}
+	return &f, nil
+}
+
+// failedIDs - The sorted IDs of the tasks that failed
+func failedIDs(failed map[string]string) []string {
+	var ids []string
+	for id := range failed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// FailBack - Move the tasks of a failed over Kapacitor instance back to it, redeploying every alert type so the
+// instance has the tasks changed while it was down and its standbys are returned to the configured standby status.
+// Tasks deleted while it was down are deleted from it first, and it stays failed over if they cannot be.
+func FailBack(ctx context.Context, db *sqlx.DB, name string, concurrency int) (*Redeploy, error) {
+	k := instance(name)
+	if k == nil {
+		return nil, nil
+	}
+	if k.active() == k {
+		return nil, ErrNoFailover
+	}
+	if running() {
+		return nil, ErrRedeployRunning
+	}
+
+	descriptors, err := redeployDescriptors(db, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Tasks deleted or moved while the instance was down were only removed from its standby. Like failovers,
+	// removing them from the instance is not stopped by the request ending.
+	stored, err := storedInstances(db, descriptors)
+	if err != nil {
+		return nil, err
+	}
+	var tasks []redeployTask
+	for _, d := range descriptors {
+		rows, err := d.rows(db)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			tasks = append(tasks, redeployTask{d, row})
+		}
+	}
+	pruned, err := pruneTasks(context.Background(), k, descriptors, tasks, stored)
+	if err != nil {
+		return nil, describeError("Unable to remove deleted tasks from "+k.Name, err)
+	}
+	if pruned > 0 {
+		log.Println("✓ Deleted " + strconv.Itoa(pruned) + " tasks from " + k.Name + " that were deleted or moved while it was failed over")
+	}
+
+	_, err = db.ExecContext(ctx, "DELETE FROM kapacitor_failovers WHERE instance = $1", k.Name)
+	if err != nil {
+		return nil, errors.New("Unable to access database")
+	}
+	instancesLock.Lock()
+	delete(failovers, k.Name)
+	instancesLock.Unlock()
+	log.Println("✓ Failed back Kapacitor instance " + k.Name)
+
+	// The instance may have lost its templates while it was down
+	forgetInstance(k)
+	return startRedeploy(db, descriptors, RedeployRequest{Concurrency: concurrency}, nil, nil)
+}
+
+// pruneTasks - Delete the tasks of the alert types from a failed over Kapacitor instance that no stored task routes
+// to it any more, as they were deleted or moved while it was down. Tasks of other alert types are left alone.
+// Returns the number of tasks deleted.
+func pruneTasks(ctx context.Context, k *Instance, descriptors []*Descriptor, tasks []redeployTask, stored map[string]string) (int, error) {
+	current, err := listKapacitorTasks(ctx, k)
+	if err != nil {
+		return 0, err
+	}
+
+	keep := make(map[string]bool)
+	for _, t := range tasks {
+		spec, err := t.d.fromRow(t.row)
+		if spec == nil {
+			return 0, err
+		}
+		id := t.d.ID(spec.Keys())
+		// Tasks that cannot be routed are kept, as it is not known where they run
+		if target, err := t.d.route(spec.Keys(), "", stored[id]); err != nil || target == k {
+			keep[id] = true
+		}
+	}
+
+	pruned := 0
+	for _, task := range current {
+		if keep[task.ID] || descriptorOf(descriptors, task.ID) == nil {
+			continue
+		}
+		err = deleteKapacitorTask(ctx, k, task.ID)
+		if err != nil {
+			return pruned, err
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+// descriptorOf - The alert type whose task ID pattern matches a Kapacitor task, or nil if there is none.
+// Patterns match a suffix of the ID, and since a dynotype may itself end in another suffix (app-sample.memory_total-crash),
+// the pattern whose match starts earliest, i.e. the most specific one, wins
+func descriptorOf(descriptors []*Descriptor, id string) *Descriptor {
+	var match *Descriptor
+	start := len(id) + 1
+	for _, d := range descriptors {
+		loc := d.Pattern.FindStringIndex(id)
+		if loc != nil && loc[0] < start {
+			match, start = d, loc[0]
+		}
+	}
+	return match
+}
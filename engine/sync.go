@@ -0,0 +1,190 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"kapacitor-alerts-api/utils"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// deployed - Scripts of the Kapacitor templates known to be up to date, by instance and template ID
+var deployed = make(map[string]string)
+var deployedLock sync.Mutex
+
+// qualifiedID - ID of a template on a Kapacitor instance - the template ID on the default instance,
+// otherwise prefixed with the name of the instance (e.g. eu/memory.slack)
+func qualifiedID(k *Instance, id string) string {
+	if k.Name == DefaultInstance {
+		return id
+	}
+	return k.Name + "/" + id
+}
+
+// ensureTemplate - Create a template on a Kapacitor instance, or update it if its script has changed. Updating
+// a template updates every task created from it.
+func ensureTemplate(ctx context.Context, k *Instance, tpl kapacitorTemplate) error {
+	deployedLock.Lock()
+	defer deployedLock.Unlock()
+
+	if script, ok := deployed[qualifiedID(k, tpl.ID)]; ok && script == tpl.Script {
+		return nil
+	}
+
+	current, err := getKapacitorTemplate(ctx, k, tpl.ID)
+	if err != nil {
+		return err
+	}
+
+	if current == nil {
+		err = createKapacitorTemplate(ctx, k, tpl)
+	} else if current.Script != tpl.Script || current.Type != tpl.Type {
+		err = updateKapacitorTemplate(ctx, k, tpl)
+	}
+	if err != nil {
+		return err
+	}
+
+	deployed[qualifiedID(k, tpl.ID)] = tpl.Script
+	return nil
+}
+
+// forgetTemplate - Drop a template from the cache, so it is checked against Kapacitor the next time it is used
+func forgetTemplate(k *Instance, id string) {
+	deployedLock.Lock()
+	delete(deployed, qualifiedID(k, id))
+	deployedLock.Unlock()
+}
+
+// forgetInstance - Drop every template of a Kapacitor instance from the cache
+func forgetInstance(k *Instance) {
+	deployedLock.Lock()
+	defer deployedLock.Unlock()
+	for id := range deployed {
+		if strings.HasPrefix(id, k.Name+"/") || (k.Name == DefaultInstance && !strings.Contains(id, "/")) {
+			delete(deployed, id)
+		}
+	}
+}
+
+// templates - The templates of the alert type on a Kapacitor instance
+func (d *Descriptor) templates(ctx context.Context, k *Instance) ([]kapacitorTemplate, error) {
+	all, err := listKapacitorTemplates(ctx, k, d.Name+"*")
+	if err != nil {
+		return nil, err
+	}
+
+	// The pattern also matches types that share a prefix (e.g. cpu and cpufoo)
+	var templates []kapacitorTemplate
+	for _, t := range all {
+		if _, ok := d.parseTemplateID(t.ID); ok {
+			templates = append(templates, t)
+		}
+	}
+	return templates, nil
+}
+
+// SyncTemplates - Re-render the Kapacitor templates of the alert type on every instance with its current template,
+// which updates every existing task. Returns the IDs of the templates that changed (see qualifiedID).
+func (d *Descriptor) SyncTemplates(ctx context.Context) ([]string, error) {
+	var updated []string
+	var failed []error
+	for _, k := range Instances() {
+		ids, err := d.syncTemplates(ctx, k)
+		updated = append(updated, ids...)
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+
+	if len(failed) > 0 {
+		return updated, joinErrors(failed, "; ")
+	}
+	return updated, nil
+}
+
+// syncTemplates - Re-render the templates of the alert type on a Kapacitor instance
+func (d *Descriptor) syncTemplates(ctx context.Context, k *Instance) ([]string, error) {
+	templates, err := d.templates(ctx, k)
+	if err != nil {
+		return nil, describeError("Unable to list templates on "+k.Name, err)
+	}
+
+	var updated []string
+	var failed []string
+	for _, t := range templates {
+		shape, _ := d.parseTemplateID(t.ID)
+		if d.templateOf(shape) == nil {
+			// Canary templates are left until their tasks have been moved off them
+			continue
+		}
+		script, err := d.script(shape)
+		if err != nil {
+			failed = append(failed, qualifiedID(k, t.ID)+": "+err.Error())
+			continue
+		}
+		if script == t.Script {
+			continue
+		}
+
+		forgetTemplate(k, t.ID)
+		err = ensureTemplate(ctx, k, kapacitorTemplate{ID: t.ID, Type: d.TaskType, Script: script})
+		if _, ok := err.(*utils.UnreachableError); ok {
+			return updated, err
+		}
+		if err != nil {
+			failed = append(failed, qualifiedID(k, t.ID)+": "+err.Error())
+			continue
+		}
+		updated = append(updated, qualifiedID(k, t.ID))
+	}
+
+	if len(failed) > 0 {
+		return updated, errors.New("Unable to update templates " + strings.Join(failed, ", "))
+	}
+	return updated, nil
+}
+
+// DeleteTemplates - Remove the templates of the alert type from every Kapacitor instance
+func (d *Descriptor) DeleteTemplates(ctx context.Context) error {
+	for _, k := range Instances() {
+		templates, err := d.templates(ctx, k)
+		if err != nil {
+			return err
+		}
+
+		for _, t := range templates {
+			forgetTemplate(k, t.ID)
+			err = deleteKapacitorTemplate(ctx, k, t.ID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Deploy - Sync the Kapacitor templates of the alert type with its current template, and record the new
+// version of the tasks that run them. Returns the IDs of the templates that changed.
+func (d *Descriptor) Deploy(ctx context.Context, db *sqlx.DB) ([]string, error) {
+	updated, err := d.SyncTemplates(ctx)
+	if len(updated) == 0 {
+		return updated, err
+	}
+
+	templatesLock.RLock()
+	version, canary := TemplateVersion(d.text), ""
+	if d.rollout != nil && d.rollout.Status == "canary" {
+		canary = d.rollout.Version
+	}
+	templatesLock.RUnlock()
+
+	// Legacy tasks may not run from the updated templates, so they keep their version until they are redeployed
+	_, dberr := db.ExecContext(ctx, "UPDATE task_templates SET version = $1, updated = now() WHERE alerttype = $2 AND version <> $3 AND version <> $4", version, d.Name, canary, legacyVersion)
+	if dberr != nil && err == nil {
+		err = errors.New("Unable to access database")
+	}
+	return updated, err
+}
@@ -0,0 +1,145 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	structs "kapacitor-alerts-api/structs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"text/template"
+)
+
+// templatesLock - Guards the templates of registered alert types while they are reloaded
+var templatesLock sync.RWMutex
+
+// TemplateInfo - Where the template of an alert type was loaded from
+type TemplateInfo struct {
+	Type    string `json:"type"`
+	Source  string `json:"source"`           // Path of the template file, "embedded" for the built-in default, or "rollout" if pinned by a rollout
+	Version string `json:"version"`          // Version of the template
+	Canary  string `json:"canary,omitempty"` // Version of the template being rolled out, if any
+}
+
+// TemplateVersion - Version of a template - a hash of its text, so the same template always has the same version
+func TemplateVersion(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// defineNameRegex - [[define]] blocks are rendered into TICKscript vars, so their names must be valid identifiers
+var defineNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// reservedVars - Vars added to every task, which [[define]] blocks cannot replace
+var reservedVars = map[string]bool{"id": true, "type": true, "slack": true, "post": true, "email": true}
+
+// fullShape - A shape with every option and notification enabled, used to check the body of a template
+func (d *Descriptor) fullShape() Shape {
+	shape := Shape{Options: d.options(), Slack: true, Post: true, Emails: []string{"email_0"}}
+	for name := range shape.Options {
+		shape.Options[name] = true
+	}
+	return shape
+}
+
+// parseTemplate - Parse a TICKscript template and check that its body only depends on the shape of a task
+func (d *Descriptor) parseTemplate(text string) (*template.Template, error) {
+	t, err := template.New(d.Name).Delims("[[", "]]").Funcs(templateFuncs).Funcs(d.influxFuncs()).Funcs(d.Funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, define := range t.Templates() {
+		name := define.Name()
+		if name == t.Name() {
+			continue
+		}
+		if !defineNameRegex.MatchString(name) || reservedVars[name] || emailVarRegex.MatchString(name) {
+			return nil, errors.New("Invalid var name " + name + " - [[define]] blocks must be named after the var they are rendered into")
+		}
+	}
+
+	// Values of a task are not available to the body, as it is shared by every task with the same shape
+	_, err = execute(t, d.fullShape())
+	if err != nil {
+		return nil, errors.New("Unable to render template body: " + err.Error())
+	}
+	return t, nil
+}
+
+// checkTemplate - Parse the template of a built-in alert type and check that its [[define]] blocks render
+// with an empty request, which catches references to fields that the alert type does not have
+func (d *Descriptor) checkTemplate(text string) (*template.Template, error) {
+	t, err := d.parseTemplate(text)
+	if err != nil {
+		return nil, err
+	}
+	_, err = d.defines(d.NewSpec(), t, make(map[string]structs.Var))
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// TemplatePath - Path of the template file of an alert type in a template directory
+func TemplatePath(dir string, name string) string {
+	return filepath.Join(dir, name+".tick")
+}
+
+// LoadTemplates - Load the templates of all registered alert types from <dir>/<type>.tick, falling back to
+// the embedded default for types without a file. Every template is validated before any are replaced,
+// so an invalid file leaves all of the current templates in place. Templates pinned by a rollout are kept.
+func LoadTemplates(dir string) ([]TemplateInfo, error) {
+	parsed := make([]*template.Template, len(descriptors))
+	texts := make([]string, len(descriptors))
+	sources := make([]string, len(descriptors))
+
+	for i, d := range descriptors {
+		text, source := d.Template, "embedded"
+		if dir != "" {
+			path := TemplatePath(dir, d.Name)
+			buf, err := ioutil.ReadFile(path)
+			if err == nil {
+				text, source = string(buf), path
+			} else if !os.IsNotExist(err) {
+				return nil, errors.New("Unable to read " + path + ": " + err.Error())
+			}
+		}
+
+		t, err := d.checkTemplate(text)
+		if err != nil {
+			return nil, errors.New("Invalid template " + source + " for " + d.Name + ": " + err.Error())
+		}
+		parsed[i], texts[i], sources[i] = t, text, source
+	}
+
+	templatesLock.Lock()
+	for i, d := range descriptors {
+		if d.pinned(texts[i]) {
+			continue
+		}
+		d.template, d.text, d.source = parsed[i], texts[i], sources[i]
+	}
+	templatesLock.Unlock()
+
+	return Templates(), nil
+}
+
+// Templates - Where the current template of each registered alert type was loaded from
+func Templates() []TemplateInfo {
+	templatesLock.RLock()
+	defer templatesLock.RUnlock()
+
+	var info []TemplateInfo
+	for _, d := range descriptors {
+		t := TemplateInfo{Type: d.Name, Source: d.source, Version: TemplateVersion(d.text)}
+		if d.rollout != nil && d.rollout.Status == "canary" {
+			t.Canary = d.rollout.Version
+		}
+		info = append(info, t)
+	}
+	return info
+}
@@ -0,0 +1,112 @@
+package engine
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	structs "kapacitor-alerts-api/structs"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// scriptLineRegex - Position of a TICKscript error as reported by Kapacitor (e.g. "line 5 char 9")
+var scriptLineRegex = regexp.MustCompile(`line (\d+) char \d+`)
+
+// ScriptError - A rendered TICKscript that Kapacitor refused to define
+type ScriptError struct {
+	Message string
+	Line    int
+	Text    string
+}
+
+func (e *ScriptError) Error() string {
+	return e.Message
+}
+
+// Response - Error message returned to the client, with the offending line of the script if Kapacitor reported one
+func (e *ScriptError) Response() structs.ScriptErrorResponse {
+	return structs.ScriptErrorResponse{
+		Error: "Invalid TICKscript: " + e.Message,
+		Line:  e.Line,
+		Text:  e.Text,
+	}
+}
+
+// newScriptError - Find the line of the script that a Kapacitor error message refers to
+func newScriptError(script string, msg string) *ScriptError {
+	e := &ScriptError{Message: msg}
+	res := scriptLineRegex.FindStringSubmatch(msg)
+	if res == nil {
+		return e
+	}
+	line, _ := strconv.Atoi(res[1])
+	lines := strings.Split(script, "\n")
+	if line >= 1 && line <= len(lines) {
+		e.Line = line
+		e.Text = strings.TrimSpace(lines[line-1])
+	}
+	return e
+}
+
+// validationTask - Disabled copy of a task defined with the script of its template rather than the template itself,
+// so that validating a task never changes a template that other tasks run
+type validationTask struct {
+	ID     string                 `json:"id"`
+	Type   string                 `json:"type"`
+	Dbrps  []structs.DbrpSpec     `json:"dbrps"`
+	Script string                 `json:"script"`
+	Status string                 `json:"status"`
+	Vars   map[string]structs.Var `json:"vars"`
+}
+
+// validationID - A unique ID for a validation task. It only has a prefix and random hex digits, so no task ID Pattern
+// matches it and it is never mistaken for a task of an alert type, and concurrent requests never share one.
+func validationID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "validate-" + hex.EncodeToString(b)
+}
+
+// validateKapacitorTask - Check that a Kapacitor instance accepts a task by defining a disabled copy of it with the
+// script of its template, which is removed again once it has been accepted. Returns a *ScriptError if the script or
+// vars were rejected.
+func validateKapacitorTask(ctx context.Context, k *Instance, task kapacitorTask, tpl kapacitorTemplate) error {
+	// Validation tasks used to be named after their task, and one left behind would match its alert type
+	status, bodybytes, err := kapacitorRequest(ctx, k, "DELETE", "/kapacitor/v1/tasks/"+task.ID+"-validate", nil)
+	if err != nil {
+		return err
+	}
+	if status != 204 && status != 404 {
+		return kapacitorError(bodybytes)
+	}
+
+	v := validationTask{
+		ID:     validationID(),
+		Type:   tpl.Type,
+		Dbrps:  task.Dbrps,
+		Script: tpl.Script,
+		Status: "disabled",
+		Vars:   task.Vars,
+	}
+
+	status, bodybytes, err = kapacitorRequest(ctx, k, "POST", "/kapacitor/v1/tasks", v)
+	if err != nil {
+		return err
+	}
+	if status == 400 {
+		return newScriptError(tpl.Script, kapacitorError(bodybytes).Error())
+	}
+	if status != 200 {
+		return kapacitorError(bodybytes)
+	}
+
+	// A disabled task does nothing, so failing to clean it up should not fail the request
+	err = deleteKapacitorTask(ctx, k, v.ID)
+	if err != nil {
+		log.Println("Unable to delete validation task " + v.ID + ": " + err.Error())
+	}
+
+	return nil
+}
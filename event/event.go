@@ -0,0 +1,130 @@
+package event
+
+import (
+	"errors"
+	"kapacitor-alerts-api/engine"
+	structs "kapacitor-alerts-api/structs"
+	"kapacitor-alerts-api/utils"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const eventalerttemplate = `
+[[define "influx_query"]]
+select text,title,app from [[ dbrp ]]."[[ measurement "events" | influxident ]]" where "app"='[[ .App | influxstr ]]' and "title" =~ /^([[ .Titles ]])$/
+[[end]]
+var influx_query string
+[[if .Slack ]]
+var slack string
+[[end]]
+[[if .Post ]]
+var post string
+[[end]]
+[[range .Emails ]]
+var [[ . ]] string
+[[end]]
+
+	batch
+    |	query(influx_query)
+      	.period(60s)
+      	.every(61s)
+    | alert()
+        .warn(lambda: 1 > 0)
+        [[if .Slack ]]
+        	.slack()
+        	.channel(slack)
+        [[end]]
+        .message('{{ index .Fields "app" }} {{ index .Fields "title" }}: {{ index .Fields "text" }}')
+        .details('''
+					<h3>{{ .Message }}</h3>
+					{{ index .Fields "app" }} {{ index .Fields "title" }}: {{ index .Fields "text" }}
+				''')
+        [[range .Emails ]]
+        	.email([[ . ]])
+        [[end]]
+        [[if .Post ]]
+        	.post(post)
+        [[end]]
+`
+
+var titleRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+var descriptor = engine.Register(&engine.Descriptor{
+	Name:     "event",
+	Table:    "event_tasks",
+	Params:   []string{"app"},
+	Columns:  []string{"app"},
+	Template: eventalerttemplate,
+	ID:       func(keys []string) string { return keys[0] + "-event" },
+	Pattern:  regexp.MustCompile(`-event$`),
+	NewSpec:  func() engine.Spec { return &EventTaskSpec{} },
+	FromVars: func(vars map[string]structs.Var) engine.Spec {
+		task := &EventTaskSpec{App: engine.StringVar(vars, "app")}
+		if events := engine.StringVar(vars, "events"); events != "" {
+			task.Events = strings.Split(events, ",")
+		}
+		return task
+	},
+	Model: EventDBTask{},
+})
+
+// Prepare - Validate the event titles
+func (task *EventTaskSpec) Prepare() error {
+	// Event titles are matched in a regex, so only allow simple names (e.g. released, crashed, config_change)
+	if len(task.Events) == 0 {
+		return errors.New("At least one event title must be provided")
+	}
+	for _, title := range task.Events {
+		if !titleRegex.MatchString(title) {
+			return errors.New("Invalid event title " + title)
+		}
+	}
+	task.Titles = strings.Join(task.Events, "|")
+	return nil
+}
+
+// Keys - App
+func (task *EventTaskSpec) Keys() []string {
+	return []string{task.App}
+}
+
+// TaskVars - Variables saved with the task in Kapacitor
+func (task *EventTaskSpec) TaskVars() map[string]structs.Var {
+	vars := make(map[string]structs.Var)
+	vars = utils.AddVar("app", task.App, "string", vars)
+	vars = utils.AddVar("events", strings.Join(task.Events, ","), "string", vars)
+	return vars
+}
+
+// Row - Values saved to event_tasks
+func (task *EventTaskSpec) Row() []interface{} {
+	return []interface{}{task.App, pq.StringArray(task.Events), task.Slack, task.Post, task.Email}
+}
+
+// ProcessEventRequest - POST | PATCH /task/event
+func ProcessEventRequest(c *gin.Context) {
+	engine.ProcessRequest(descriptor, c)
+}
+
+// PreviewEventTask - POST /task/event/preview
+func PreviewEventTask(c *gin.Context) {
+	engine.PreviewTask(descriptor, c)
+}
+
+// DeleteEventTask - DELETE /task/event/:app
+func DeleteEventTask(c *gin.Context) {
+	engine.DeleteTask(descriptor, c)
+}
+
+// GetEventTask - GET /task/event/:app
+func GetEventTask(c *gin.Context) {
+	engine.GetTask(descriptor, c)
+}
+
+// ListEventTasks - GET /tasks/event
+func ListEventTasks(c *gin.Context) {
+	engine.ListTasks(descriptor, c)
+}
@@ -0,0 +1,197 @@
+package event
+
+import (
+	"bytes"
+	"encoding/json"
+	"kapacitor-alerts-api/config"
+	"kapacitor-alerts-api/engine"
+	"kapacitor-alerts-api/engine/enginetest"
+	"kapacitor-alerts-api/utils"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gopkg.in/guregu/null.v3/zero"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+/********************************************************
+*    Endpoints tested:
+*
+*    Method   Endpoint              Function
+*    ---------------------------------------------------
+*    POST     /task/event         TestCreateEventTask
+*    PATCH    /task/event         TestUpdateEventTask
+*    POST     /task/event/preview TestHostileEventInput
+*    DELETE   /task/event/:app    TestDeleteEventTask
+*    GET      /tasks/event        TestCreateEventTask
+*    GET      /task/event/:app    TestCreateEventTask
+ */
+
+// setupRouter - Setup Gin routes for current test type
+func setupRouter() *gin.Engine {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Panicln(err)
+	}
+	pool := utils.GetDB(cfg.Database)
+	if pool == nil {
+		log.Panicln("Unable to connect to database")
+	}
+	if err := engine.Configure(cfg); err != nil {
+		log.Panicln(err)
+	}
+
+	router := gin.Default()
+	gin.SetMode(gin.DebugMode)
+	router.Use(utils.DBMiddleware(pool))
+	router.Use(config.Middleware(cfg))
+
+	router.POST("/task/event", ProcessEventRequest)
+	router.GET("/task/event/:app", GetEventTask)
+	router.PATCH("/task/event", ProcessEventRequest)
+	router.POST("/task/event/preview", PreviewEventTask)
+	router.DELETE("/task/event/:app", DeleteEventTask)
+	router.GET("/tasks/event", ListEventTasks)
+
+	return router
+}
+
+// TestCreateEventTask - Make sure that creating an event task works and we can successfully get info about the created task
+func TestCreateEventTask(t *testing.T) {
+	router := setupRouter()
+
+	// Create a new task
+	var task EventDBTask
+	task.App = "gotest-voltron"
+	task.Events = pq.StringArray{"released", "crashed"}
+	task.Slack = zero.StringFrom("#cobra")
+	taskBytes, err := json.Marshal(task)
+	assert.Nil(t, err, "Converting from EventDBTask to JSON should not throw an error")
+
+	req, _ := http.NewRequest("POST", "/task/event", bytes.NewBuffer(taskBytes))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusCreated, w.Code, "HTTP response code for POST /task/event should be 201")
+
+	// Check that the new task exists and contains expected data
+	req, _ = http.NewRequest("GET", "/task/event/gotest-voltron", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for GET /task/event/:app should be 200")
+
+	var returnedTask EventDBTask
+	err = json.Unmarshal([]byte(w.Body.String()), &returnedTask)
+
+	assert.Nil(t, err, "Converting from JSON to EventDBTask should not throw an error")
+	assert.Equal(t, returnedTask.App, task.App, "Task app name should match")
+	assert.Equal(t, returnedTask.Events, task.Events, "Task events should match")
+	assert.Equal(t, returnedTask.Slack, task.Slack, "Task slack should match")
+	assert.Equal(t, returnedTask.Email, task.Email, "Task email should match")
+	assert.Equal(t, returnedTask.Post, task.Post, "Task post should match")
+
+	// Check that the new task exists in the list of all tasks
+	req, _ = http.NewRequest("GET", "/tasks/event", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for GET /tasks/event should be 200")
+
+	var returnedTasks []EventDBTask
+	err = json.Unmarshal([]byte(w.Body.String()), &returnedTasks)
+
+	assert.Nil(t, err, "Converting from JSON to []EventDBTask should not throw an error")
+
+	var foundTask EventDBTask
+
+	for _, n := range returnedTasks {
+		if n.App == task.App {
+			foundTask = n
+		}
+	}
+
+	assert.NotNil(t, foundTask, "Task should exist in returned list of tasks")
+
+	assert.Equal(t, foundTask.App, task.App, "Task app name should match")
+	assert.Equal(t, foundTask.Events, task.Events, "Task events should match")
+	assert.Equal(t, foundTask.Slack, task.Slack, "Task slack should match")
+	assert.Equal(t, foundTask.Email, task.Email, "Task email should match")
+	assert.Equal(t, foundTask.Post, task.Post, "Task post should match")
+}
+
+// TestUpdateEventTask - Make sure that updating an event task's config works
+func TestUpdateEventTask(t *testing.T) {
+	router := setupRouter()
+
+	// Create a task with updated information
+	// Slack - #cobra => nil
+	// Post - nil => http://example.com/
+	// Events - released, crashed => restarted, config_change
+	var task EventDBTask
+	task.App = "gotest-voltron"
+	task.Events = pq.StringArray{"restarted", "config_change"}
+	task.Post = zero.StringFrom("http://example.com/")
+	taskBytes, err := json.Marshal(task)
+	assert.Nil(t, err, "Converting from EventDBTask to JSON should not throw an error")
+
+	req, _ := http.NewRequest("PATCH", "/task/event", bytes.NewBuffer(taskBytes))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusCreated, w.Code, "HTTP response code for PATCH /task/event should be 201")
+
+	// Check that the new task exists and contains expected data
+	req, _ = http.NewRequest("GET", "/task/event/gotest-voltron", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for GET /task/event/:app should be 200")
+
+	var returnedTask EventDBTask
+	err = json.Unmarshal([]byte(w.Body.String()), &returnedTask)
+
+	// API sets nil slack channels to #
+	task.Slack = zero.StringFrom("#")
+
+	assert.Nil(t, err, "Converting from JSON to EventDBTask should not throw an error")
+	assert.Equal(t, returnedTask.App, task.App, "Task app name should match")
+	assert.Equal(t, returnedTask.Events, task.Events, "Task events should match")
+	assert.Equal(t, returnedTask.Slack, task.Slack, "Task slack should match")
+	assert.Equal(t, returnedTask.Email, task.Email, "Task email should match")
+	assert.Equal(t, returnedTask.Post, task.Post, "Task post should match")
+}
+
+// TestDeleteEventTask - Make sure that deleting an event task works and that we cannot access it anymore
+func TestDeleteEventTask(t *testing.T) {
+	router := setupRouter()
+
+	// Delete the task that was created in TestCreateEventTask
+	req, _ := http.NewRequest("DELETE", "/task/event/gotest-voltron", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for DELETE /task/event/:app should be 200")
+
+	// Check that the deleted task doesn't exist anymore
+	req, _ = http.NewRequest("GET", "/task/event/gotest-voltron", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code, "HTTP response code for GET /task/event/:app on invalid app should be 404")
+}
+
+// TestHostileEventInput - Make sure that user input is passed through vars or escaped in the rendered query, or rejected if it cannot be
+func TestHostileEventInput(t *testing.T) {
+	inputs := append(enginetest.HostileNotify(`"events":["released"]`),
+		enginetest.Accepted("dot in app", `{"app":"gotest.hostile","events":["released"]}`, [2]string{"influx_query", `"app"='gotest.hostile'`}),
+		enginetest.Rejected("regex in event title", `{"app":"gotest-hostile","events":["released|.*"]}`),
+		enginetest.Rejected("quote in event title", `{"app":"gotest-hostile","events":["released'"]}`),
+	)
+	enginetest.CheckHostileInputs(t, PreviewEventTask, inputs)
+}
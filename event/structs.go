@@ -0,0 +1,25 @@
+package event
+
+import (
+	"kapacitor-alerts-api/engine"
+
+	"github.com/lib/pq"
+	"gopkg.in/guregu/null.v3/zero"
+)
+
+// EventTaskSpec - Used to create or update an event task
+type EventTaskSpec struct {
+	App    string   `json:"app"`
+	Events []string `json:"events"`
+	Titles string   `json:"-"`
+	engine.Notify
+}
+
+// EventDBTask - Used for retrieval of task information from the database
+type EventDBTask struct {
+	App    string         `json:"app"`
+	Events pq.StringArray `json:"events"`
+	Slack  zero.String    `json:"slack"`
+	Post   zero.String    `json:"post"`
+	Email  zero.String    `json:"email"`
+}
@@ -6,5 +6,6 @@ require (
 	github.com/gin-gonic/gin v1.6.2
 	github.com/jmoiron/sqlx v1.2.0
 	github.com/lib/pq v1.3.0
+	github.com/stretchr/testify v1.4.0
 	gopkg.in/guregu/null.v3 v3.4.0
 )
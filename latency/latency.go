@@ -0,0 +1,180 @@
+package latency
+
+import (
+	"errors"
+	"kapacitor-alerts-api/engine"
+	structs "kapacitor-alerts-api/structs"
+	"kapacitor-alerts-api/utils"
+	"regexp"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const latencyalerttemplate = `
+[[define "influx_query"]]
+select [[ .Selector ]] as value from [[ dbrp ]]."[[ measurement "router_service" | influxident ]]" where "fqdn" =~ /[[ .App | influxregex ]]/
+[[end]]
+[[define "alert_message"]]
+[[ .App ]]: Response time ([[ .Aggregate ]]) is {{ .Level }} : {{ index .Fields "rvalue" }} ms - limits [[ .Warn ]]/[[ .Crit ]] ms
+[[end]]
+[[define "alert_details"]]
+<h3>{{ .Message }}</h3>
+<a href="https://membanks.octanner.io/dashboard/db/alamo-router-scanner?var-url=[[ .App | urlquery ]]&from=now-1h&to=now&fullscreen">Link To Memory Banks</a>
+[[end]]
+var influx_query string
+var crit float
+var warn float
+var window duration
+var every duration
+var alert_message string
+var alert_details string
+[[if .Slack ]]
+var slack string
+[[end]]
+[[if .Post ]]
+var post string
+[[end]]
+[[range .Emails ]]
+var [[ . ]] string
+[[end]]
+
+	batch
+    |	query(influx_query)
+        .period(window)
+        .every(every)
+    |	eval(lambda: ceil("value")).as('rvalue').keep('value','rvalue')
+    |	alert()
+        .crit(lambda: "value" > crit)
+        .warn(lambda: "value" > warn)
+        .stateChangesOnly()
+        [[if .Slack ]]
+      	  .slack()
+      	  .channel(slack)
+        [[end]]
+        .message(alert_message)
+        .details(alert_details)
+        [[range .Emails ]]
+        	.email([[ . ]])
+        [[end]]
+        [[if .Post ]]
+        	.post(post)
+        [[end]]
+`
+
+var percentileRegex = regexp.MustCompile(`^p([1-9][0-9]?)$`)
+
+var descriptor = engine.Register(&engine.Descriptor{
+	Name:     "latency",
+	Table:    "latency_tasks",
+	Params:   []string{"app"},
+	Columns:  []string{"app"},
+	Template: latencyalerttemplate,
+	ID:       func(keys []string) string { return keys[0] + "-latency" },
+	Pattern:  regexp.MustCompile(`-latency$`),
+	NewSpec:  func() engine.Spec { return &LatencyTaskSpec{} },
+	FromVars: func(vars map[string]structs.Var) engine.Spec {
+		return &LatencyTaskSpec{
+			App:       engine.StringVar(vars, "app"),
+			Aggregate: engine.StringVar(vars, "aggregate"),
+			Warn:      engine.StringVar(vars, "warn"),
+			Crit:      engine.StringVar(vars, "crit"),
+			Window:    engine.DurationVar(vars, "window"),
+			Every:     engine.DurationVar(vars, "every"),
+		}
+	},
+	Model: LatencyDBTask{},
+})
+
+// Prepare - Validate the thresholds and fill in the default aggregate, window, and interval
+func (task *LatencyTaskSpec) Prepare() error {
+	// Compare the mean response time or a percentile (defaults to p95) against the thresholds
+	if task.Aggregate == "" {
+		task.Aggregate = "p95"
+	}
+	if task.Aggregate == "mean" {
+		task.Selector = "mean(value)"
+	} else if res := percentileRegex.FindStringSubmatch(task.Aggregate); res != nil {
+		task.Selector = "percentile(value, " + res[1] + ")"
+	} else {
+		return errors.New("Aggregate must be one of mean or a percentile (p1 - p99)")
+	}
+
+	if err := engine.CheckNumber("Warn", task.Warn, "ms"); err != nil {
+		return err
+	}
+	if err := engine.CheckNumber("Crit", task.Crit, "ms"); err != nil {
+		return err
+	}
+	warn, _ := strconv.ParseFloat(task.Warn, 64)
+	crit, _ := strconv.ParseFloat(task.Crit, 64)
+	if warn >= crit {
+		return errors.New("Warn must be less than crit")
+	}
+
+	if task.Window == "" {
+		task.Window = "10m"
+	}
+	if task.Every == "" {
+		task.Every = "1m"
+	}
+	if err := engine.CheckDuration("Window", task.Window); err != nil {
+		return err
+	}
+	return engine.CheckDuration("Every", task.Every)
+}
+
+// Keys - App
+func (task *LatencyTaskSpec) Keys() []string {
+	return []string{task.App}
+}
+
+// TaskVars - Variables saved with the task in Kapacitor
+func (task *LatencyTaskSpec) TaskVars() map[string]structs.Var {
+	vars := make(map[string]structs.Var)
+	vars = utils.AddVar("app", task.App, "string", vars)
+	vars = utils.AddVar("aggregate", task.Aggregate, "string", vars)
+	vars = utils.AddVar("warn", task.Warn, "float", vars)
+	vars = utils.AddVar("crit", task.Crit, "float", vars)
+	vars = utils.AddVar("window", task.Window, "duration", vars)
+	vars = utils.AddVar("every", task.Every, "duration", vars)
+	return vars
+}
+
+// Row - Values saved to latency_tasks
+func (task *LatencyTaskSpec) Row() []interface{} {
+	return []interface{}{
+		task.App, task.Aggregate, task.Crit, task.Warn, task.Window, task.Every,
+		task.Slack, task.Post, task.Email,
+	}
+}
+
+// ProcessLatencyRequest - POST | PATCH /task/latency
+func ProcessLatencyRequest(c *gin.Context) {
+	engine.ProcessRequest(descriptor, c)
+}
+
+// PreviewLatencyTask - POST /task/latency/preview
+func PreviewLatencyTask(c *gin.Context) {
+	engine.PreviewTask(descriptor, c)
+}
+
+// DeleteLatencyTask - DELETE /task/latency/:app
+func DeleteLatencyTask(c *gin.Context) {
+	engine.DeleteTask(descriptor, c)
+}
+
+// GetLatencyTask - GET /task/latency/:app
+func GetLatencyTask(c *gin.Context) {
+	engine.GetTask(descriptor, c)
+}
+
+// ListLatencyTasks - GET /tasks/latency
+func ListLatencyTasks(c *gin.Context) {
+	engine.ListTasks(descriptor, c)
+}
+
+// GetLatencyTaskState - GET /task/latency/:app/state
+func GetLatencyTaskState(c *gin.Context) {
+	engine.GetTaskState(descriptor, c)
+}
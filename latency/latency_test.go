@@ -0,0 +1,240 @@
+package latency
+
+import (
+	"bytes"
+	"encoding/json"
+	"kapacitor-alerts-api/config"
+	"kapacitor-alerts-api/engine"
+	"kapacitor-alerts-api/engine/enginetest"
+	structs "kapacitor-alerts-api/structs"
+	"kapacitor-alerts-api/utils"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gopkg.in/guregu/null.v3/zero"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+/********************************************************
+*    Endpoints tested:
+*
+*    Method   Endpoint              Function
+*    ---------------------------------------------------
+*    POST     /task/latency             TestCreateLatencyTask
+*    PATCH    /task/latency             TestUpdateLatencyTask
+*    POST     /task/latency/preview     TestHostileLatencyInput
+*    DELETE   /task/latency/:app        TestDeleteLatencyTask
+*    GET      /tasks/latency            TestCreateLatencyTask
+*    GET      /task/latency/:app        TestCreateLatencyTask
+*    GET      /task/latency/:app/state  TestGetLatencyTaskState
+ */
+
+// setupRouter - Setup Gin routes for current test type
+func setupRouter() *gin.Engine {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Panicln(err)
+	}
+	pool := utils.GetDB(cfg.Database)
+	if pool == nil {
+		log.Panicln("Unable to connect to database")
+	}
+	if err := engine.Configure(cfg); err != nil {
+		log.Panicln(err)
+	}
+
+	router := gin.Default()
+	router.Use(utils.DBMiddleware(pool))
+	router.Use(config.Middleware(cfg))
+
+	router.POST("/task/latency", ProcessLatencyRequest)
+	router.PATCH("/task/latency", ProcessLatencyRequest)
+	router.POST("/task/latency/preview", PreviewLatencyTask)
+	router.DELETE("/task/latency/:app", DeleteLatencyTask)
+	router.GET("/task/latency/:app", GetLatencyTask)
+	router.GET("/task/latency/:app/state", GetLatencyTaskState)
+	router.GET("/tasks/latency", ListLatencyTasks)
+
+	return router
+}
+
+// TestCreateLatencyTask - Make sure that creating a latency task works and we can successfully get info about the created task
+func TestCreateLatencyTask(t *testing.T) {
+	router := setupRouter()
+
+	// Create a new task
+	var task LatencyDBTask
+	task.App = "gotest-voltron"
+	task.Aggregate = "p95"
+	task.Warn = "500"
+	task.Crit = "1000"
+	task.Wind = "10m"
+	task.Every = "1m"
+	task.Slack = zero.StringFrom("#cobra")
+	taskBytes, err := json.Marshal(task)
+	assert.Nil(t, err, "Converting from LatencyDBTask to JSON should not throw an error")
+
+	req, _ := http.NewRequest("POST", "/task/latency", bytes.NewBuffer(taskBytes))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusCreated, w.Code, "HTTP response code for POST /task/latency should be 201")
+
+	// Check that the new task exists and contains expected data
+	req, _ = http.NewRequest("GET", "/task/latency/gotest-voltron", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for GET /task/latency/:app should be 200")
+
+	var returnedTask LatencyDBTask
+	err = json.Unmarshal([]byte(w.Body.String()), &returnedTask)
+
+	assert.Nil(t, err, "Converting from JSON to LatencyDBTask should not throw an error")
+	assert.Equal(t, returnedTask.App, task.App, "Task app name should match")
+	assert.Equal(t, returnedTask.Aggregate, task.Aggregate, "Task aggregate should match")
+	assert.Equal(t, returnedTask.Warn, task.Warn, "Task warn should match")
+	assert.Equal(t, returnedTask.Crit, task.Crit, "Task crit should match")
+	assert.Equal(t, returnedTask.Wind, task.Wind, "Task window should match")
+	assert.Equal(t, returnedTask.Every, task.Every, "Task every should match")
+	assert.Equal(t, returnedTask.Slack, task.Slack, "Task slack should match")
+	assert.Equal(t, returnedTask.Email, task.Email, "Task email should match")
+	assert.Equal(t, returnedTask.Post, task.Post, "Task post should match")
+
+	// Check that the new task exists in the list of all tasks
+	req, _ = http.NewRequest("GET", "/tasks/latency", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for GET /tasks/latency should be 200")
+
+	var returnedTasks []LatencyDBTask
+	err = json.Unmarshal([]byte(w.Body.String()), &returnedTasks)
+
+	assert.Nil(t, err, "Converting from JSON to []LatencyDBTask should not throw an error")
+
+	var foundTask LatencyDBTask
+
+	for _, n := range returnedTasks {
+		if n.App == task.App {
+			foundTask = n
+		}
+	}
+
+	assert.NotNil(t, foundTask, "Task should exist in returned list of tasks")
+
+	assert.Equal(t, foundTask.App, task.App, "Task app name should match")
+	assert.Equal(t, foundTask.Aggregate, task.Aggregate, "Task aggregate should match")
+	assert.Equal(t, foundTask.Warn, task.Warn, "Task warn should match")
+	assert.Equal(t, foundTask.Crit, task.Crit, "Task crit should match")
+	assert.Equal(t, foundTask.Wind, task.Wind, "Task window should match")
+	assert.Equal(t, foundTask.Every, task.Every, "Task every should match")
+	assert.Equal(t, foundTask.Slack, task.Slack, "Task slack should match")
+	assert.Equal(t, foundTask.Email, task.Email, "Task email should match")
+	assert.Equal(t, foundTask.Post, task.Post, "Task post should match")
+}
+
+// TestGetLatencyTaskStatus - Make sure that we can get status information about a latency task
+func TestGetLatencyTaskState(t *testing.T) {
+	router := setupRouter()
+
+	req, _ := http.NewRequest("GET", "/task/latency/gotest-voltron/state", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for GET /task/latency/:app/state should be 200")
+
+	var taskState structs.SimpleTaskState
+	err := json.Unmarshal([]byte(w.Body.String()), &taskState)
+
+	assert.Nil(t, err, "Converting from JSON to structs.SimpleTaskState should not throw an error")
+	assert.Equal(t, taskState.App, "gotest-voltron", "Task app name should match")
+	assert.Equal(t, taskState.State, "OK", "Task state should be OK")
+}
+
+// TestUpdateLatencyTask - Make sure that updating a latency task's config works
+func TestUpdateLatencyTask(t *testing.T) {
+	router := setupRouter()
+
+	// Create a task with updated information
+	// Slack - #cobra => nil
+	// Post - nil => http://example.com/
+	// Aggregate - p95 => p99
+	// Warn - 500 => 750
+	// Crit - 1000 => 1500
+	var task LatencyDBTask
+	task.App = "gotest-voltron"
+	task.Aggregate = "p99"
+	task.Warn = "750"
+	task.Crit = "1500"
+	task.Wind = "10m"
+	task.Every = "1m"
+	task.Post = zero.StringFrom("http://example.com/")
+	taskBytes, err := json.Marshal(task)
+	assert.Nil(t, err, "Converting from LatencyDBTask to JSON should not throw an error")
+
+	req, _ := http.NewRequest("PATCH", "/task/latency", bytes.NewBuffer(taskBytes))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusCreated, w.Code, "HTTP response code for PATCH /task/latency should be 201")
+
+	// Check that the new task exists and contains expected data
+	req, _ = http.NewRequest("GET", "/task/latency/gotest-voltron", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for GET /task/latency/:app should be 200")
+
+	var returnedTask LatencyDBTask
+	err = json.Unmarshal([]byte(w.Body.String()), &returnedTask)
+
+	// API sets nil slack channels to #
+	task.Slack = zero.StringFrom("#")
+
+	assert.Nil(t, err, "Converting from JSON to LatencyDBTask should not throw an error")
+	assert.Equal(t, returnedTask.App, task.App, "Task app name should match")
+	assert.Equal(t, returnedTask.Aggregate, task.Aggregate, "Task aggregate should match")
+	assert.Equal(t, returnedTask.Warn, task.Warn, "Task warn should match")
+	assert.Equal(t, returnedTask.Crit, task.Crit, "Task crit should match")
+	assert.Equal(t, returnedTask.Wind, task.Wind, "Task window should match")
+	assert.Equal(t, returnedTask.Every, task.Every, "Task every should match")
+	assert.Equal(t, returnedTask.Slack, task.Slack, "Task slack should match")
+	assert.Equal(t, returnedTask.Email, task.Email, "Task email should match")
+	assert.Equal(t, returnedTask.Post, task.Post, "Task post should match")
+}
+
+// TestDeleteLatencyTask - Make sure that deleting a latency task works and that we cannot access it anymore
+func TestDeleteLatencyTask(t *testing.T) {
+	router := setupRouter()
+
+	// Delete the task that was created in TestCreateLatencyTask
+	req, _ := http.NewRequest("DELETE", "/task/latency/gotest-voltron", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for DELETE /task/latency/:app should be 200")
+
+	// Check that the deleted task doesn't exist anymore
+	req, _ = http.NewRequest("GET", "/task/latency/gotest-voltron", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code, "HTTP response code for GET /task/latency/:app on invalid app should be 404")
+}
+
+// TestHostileLatencyInput - Make sure that user input is passed through vars or escaped in the rendered query, or rejected if it cannot be
+func TestHostileLatencyInput(t *testing.T) {
+	inputs := append(enginetest.HostileNotify(`"warn":"500","crit":"1000"`),
+		enginetest.Accepted("dot in app", `{"app":"gotest.hostile","warn":"500","crit":"1000"}`, [2]string{"influx_query", `"fqdn" =~ /gotest\.hostile/`}),
+		enginetest.Rejected("expression in crit", `{"app":"gotest-hostile","warn":"500","crit":"1 OR true"}`),
+		enginetest.Rejected("expression in window", `{"app":"gotest-hostile","warn":"500","crit":"1000","window":"10m) |log("}`),
+		enginetest.Rejected("expression in every", `{"app":"gotest-hostile","warn":"500","crit":"1000","every":"1m'"}`),
+		enginetest.Rejected("warn above crit", `{"app":"gotest-hostile","warn":"1000","crit":"500"}`),
+	)
+	enginetest.CheckHostileInputs(t, PreviewLatencyTask, inputs)
+}
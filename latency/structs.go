@@ -0,0 +1,32 @@
+package latency
+
+import (
+	"kapacitor-alerts-api/engine"
+
+	"gopkg.in/guregu/null.v3/zero"
+)
+
+// LatencyTaskSpec - Used to create or update a latency task
+type LatencyTaskSpec struct {
+	App       string `json:"app"`
+	Aggregate string `json:"aggregate"`
+	Selector  string `json:"-"`
+	Warn      string `json:"warn"`
+	Crit      string `json:"crit"`
+	Window    string `json:"window"`
+	Every     string `json:"every"`
+	engine.Notify
+}
+
+// LatencyDBTask - Used for retrieval of task information from the database
+type LatencyDBTask struct {
+	App       string      `json:"app"`
+	Aggregate string      `json:"aggregate"`
+	Crit      string      `json:"crit"`
+	Warn      string      `json:"warn"`
+	Wind      string      `json:"window"`
+	Every     string      `json:"every"`
+	Slack     zero.String `json:"slack"`
+	Post      zero.String `json:"post"`
+	Email     zero.String `json:"email"`
+}
@@ -1,396 +1,285 @@
 package memory
 
 import (
-	"bufio"
-	"bytes"
-	"database/sql"
-	"encoding/json"
 	"errors"
-	"io/ioutil"
+	"kapacitor-alerts-api/engine"
 	structs "kapacitor-alerts-api/structs"
 	utils "kapacitor-alerts-api/utils"
-	"net/http"
-	"os"
-	"strings"
-	"text/template"
+	"regexp"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"gopkg.in/guregu/null.v3/zero"
 )
 
 const memoryalerttemplate = `
+[[define "influx_query"]]
+select [[ .Selector ]]/1024/1024 as value from [[ dbrp ]]."[[ .Metric | influxident ]]" where "app"='[[ .App | influxstr ]]' and "dyno" [[ .DynoFilter ]]
+[[end]]
+[[define "alert_message"]]
+Memory is {{ .Level }} for {{ .Group }} : {{ index .Fields "rvalue" }} MB - limits [[ .Warn ]]/[[ .Crit ]]
+[[end]]
+[[define "alert_details"]]
+<h3>{{ .Message }}</h3>
+<h3>Value: {{ index .Fields "rvalue" }}</h3>
+[[end]]
+[[define "growth_message"]]
+[[if .Growth ]]Memory is growing for {{ .Group }} : at least {{ index .Fields "rgrowth" }} MB/hour for [[ .Growthwindow ]] - limit [[ .Growth ]] MB/hour[[end]]
+[[end]]
+[[define "growth_details"]]
+[[if .Growth ]]<h3>{{ .Message }}</h3>
+<h3>Growth: {{ index .Fields "rgrowth" }} MB/hour</h3>[[end]]
+[[end]]
+var influx_query string
+var crit float
+var warn float
+var window duration
+var every duration
+var alert_message string
+var alert_details string
+[[if .Options.growth ]]
+var growth float
+var growthwindow duration
+var growth_message string
+var growth_details string
+[[end]]
+[[if .Slack ]]
+var slack string
+[[end]]
+[[if .Post ]]
+var post string
+[[end]]
+[[range .Emails ]]
+var [[ . ]] string
+[[end]]
+
 	batch
-    |	query('''
-				select mean(value)/1024/1024 as value from "opentsdb"."retention_policy"."[[ .Metric ]]" where "app"='[[ .App ]]' and "dyno" [[ .Dynotype ]]
-    	''')
-        .period([[ .Window ]])
-        .every([[ .Every ]])
+    |	query(influx_query)
+        .period(window)
+        .every(every)
+        [[if .Options.bydynotype ]]
+        .groupBy('app')
+        [[else]]
         .groupBy('app','dyno')
+        [[end]]
     |	eval(lambda: ceil("value")).as('rvalue').keep('value','rvalue')
     |	alert()
-        .crit(lambda: "value" > [[ .Crit ]])
-        .warn(lambda: "value" > [[ .Warn ]])
+        .crit(lambda: "value" > crit)
+        .warn(lambda: "value" > warn)
+        .stateChangesOnly()
+        [[if .Slack ]]
+        	.slack()
+        	.channel(slack)
+        [[end]]
+        .message(alert_message)
+        .details(alert_details)
+        [[range .Emails ]]
+        	.email([[ . ]])
+        [[end]]
+        [[if .Post ]]
+        	.post(post)
+        [[end]]
+[[if .Options.growth ]]
+	batch
+    |	query(influx_query)
+        .period(growthwindow)
+        .every(every)
+        [[if .Options.bydynotype ]]
+        .groupBy(time(1h),'app')
+        [[else]]
+        .groupBy(time(1h),'app','dyno')
+        [[end]]
+    |	derivative('value')
+        .unit(1h)
+        .as('growth')
+    |	min('growth')
+        .as('growth')
+    |	eval(lambda: ceil("growth")).as('rgrowth').keep('growth','rgrowth')
+    |	alert()
+        .id('{{ .Name }}-growth:{{ .Group }}')
+        .warn(lambda: "growth" > growth)
         .stateChangesOnly()
         [[if .Slack ]]
         	.slack()
-        	.channel('[[ .Slack ]]')
+        	.channel(slack)
         [[end]]
-        .message('Memory is {{ .Level }} for {{ .Group }} : {{ index .Fields "rvalue" }} MB - limits [[ .Warn ]]/[[ .Crit ]]')
-        .details('''
-					<h3>{{ .Message }}</h3>
-					<h3>Value: {{ index .Fields "rvalue" }}</h3>
-				''')
-				[[if .Email]]
-					[[ range $email := .EmailArray ]] 
-						.email('[[ $email ]]')
-					[[end]]
-				[[end]]
-        [[if .Post]]
-        	.post('[[ .Post ]]')
+        .message(growth_message)
+        .details(growth_details)
+        [[range .Emails ]]
+        	.email([[ . ]])
         [[end]]
+        [[if .Post ]]
+        	.post(post)
+        [[end]]
+[[end]]
 `
 
-// getTaskByID - Get a task from the database by its ID
-func getTaskByID(id string, c *gin.Context) (*MemoryDBTask, error) {
-	db, err := utils.GetDBFromContext(c)
-	if err != nil {
-		return nil, errors.New("Unable to access database")
-	}
+// metric - Name of the metric in task IDs, which stays the same if the measurement queried is configured
+const metric = "sample.memory_total"
 
-	task := MemoryDBTask{}
+var percentileRegex = regexp.MustCompile(`^p([1-9][0-9]?)$`)
 
-	err = db.Get(&task, "SELECT * FROM memory_tasks WHERE id=$1", id)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, sql.ErrNoRows
-		}
-		return nil, errors.New("Unable to access database")
-	}
-	return &task, nil
+// taskID - Kapacitor task ID of the memory task of an app and dynotype
+func taskID(keys []string) string {
+	return keys[0] + "-" + metric + "-" + keys[1]
 }
 
-func getTaskByNameAndDyno(app string, dyno string, c *gin.Context) (*MemoryDBTask, error) {
-	db, err := utils.GetDBFromContext(c)
-	if err != nil {
-		return nil, errors.New("Unable to access database")
-	}
-
-	task := MemoryDBTask{}
-
-	err = db.Get(&task, "SELECT * FROM memory_tasks WHERE app=$1 AND dynotype=$2", app, dyno)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, sql.ErrNoRows
+var descriptor = engine.Register(&engine.Descriptor{
+	Name:     "memory",
+	Table:    "memory_tasks",
+	Params:   []string{"app", "dyno"},
+	Columns:  []string{"app", "dynotype"},
+	Template: memoryalerttemplate,
+	ID:       taskID,
+	Pattern:  regexp.MustCompile(`-sample\.memory_total-[-\w]+$`),
+	NewSpec:  func() engine.Spec { return &MemoryTaskSpec{} },
+	FromVars: func(vars map[string]structs.Var) engine.Spec {
+		return &MemoryTaskSpec{
+			App:          engine.StringVar(vars, "app"),
+			Dynotype:     engine.StringVar(vars, "dynotyperequest"),
+			Crit:         engine.StringVar(vars, "crit"),
+			Warn:         engine.StringVar(vars, "warn"),
+			Window:       engine.DurationVar(vars, "window"),
+			Every:        engine.DurationVar(vars, "every"),
+			Growth:       engine.StringVar(vars, "growth"),
+			Growthwindow: engine.DurationVar(vars, "growthwindow"),
+			Aggregate:    engine.StringVar(vars, "aggregate"),
+			Groupby:      engine.StringVar(vars, "groupby"),
 		}
-		return nil, errors.New("Unable to access database")
-	}
-	return &task, nil
-}
-
-// ProcessInstanceMemoryRequest - POST | PATCH /task/memory
-func ProcessInstanceMemoryRequest(c *gin.Context) {
-	var vars map[string]structs.Var
-	vars = make(map[string]structs.Var)
-	var dbrps []structs.DbrpSpec
-	var dbrp structs.DbrpSpec
-	var task MemoryTaskSpec
+	},
+	Model: MemoryDBTask{},
+})
 
-	bodybytes, err := ioutil.ReadAll(c.Request.Body)
-	if err != nil {
-		utils.ReportError(err, c, "Server Error while reading response")
-		return
+// checkSettings - Make sure that the thresholds and intervals can be rendered into the TICKscript
+func checkSettings(crit string, warn string, window string, every string) error {
+	if err := engine.CheckNumber("Crit", crit, "MB"); err != nil {
+		return err
 	}
-
-	err = json.Unmarshal(bodybytes, &task)
-	if err != nil {
-		utils.ReportError(err, c, "Server Error while reading response")
-		return
+	if err := engine.CheckNumber("Warn", warn, "MB"); err != nil {
+		return err
 	}
-
-	task.ID = task.App + "-memory"
-	task.Metric = "sample.memory_total"
-	vars = utils.AddVar("metric", task.Metric, "string", vars)
-	vars = utils.AddVar("dynotyperequest", task.Dynotype, "string", vars)
-
-	if task.Dynotype != "all" {
-		task.ID = task.App + "-" + task.Metric + "-" + task.Dynotype
-	} else {
-		task.ID = task.App + "-" + task.Metric + "-all"
+	if err := engine.CheckDuration("Window", window); err != nil {
+		return err
 	}
-	vars = utils.AddVar("id", task.ID, "string", vars)
-
-	task.Type = "batch"
-	vars = utils.AddVar("type", task.Type, "string", vars)
+	return engine.CheckDuration("Every", every)
+}
 
-	dbrp.Db = "opentsdb"
-	dbrp.Rp = "retention_policy"
-	dbrps = append(dbrps, dbrp)
+// Prepare - Validate the thresholds, intervals, aggregate, grouping, and growth settings and fill in their defaults
+func (task *MemoryTaskSpec) Prepare() error {
+	task.Metric = descriptor.Influx().Measurements["memory"]
 
 	if task.Dynotype == "all" {
-		task.Dynotype = " =~ /.*/ "
+		task.DynoFilter = " =~ /.*/ "
 	} else if task.Dynotype == "web" {
-		task.Dynotype = " !~ /--/ "
+		task.DynoFilter = " !~ /--/ "
 	} else {
-		task.Dynotype = " =~ /" + task.Dynotype + "/ "
+		task.DynoFilter = " =~ /" + engine.InfluxRegex(task.Dynotype) + "/ "
 	}
-	vars = utils.AddVar("dynotype", task.Dynotype, "string", vars)
-
-	task.Dbrps = dbrps
-	task.Script = ""
-	task.Status = "enabled"
 
-	if !strings.HasPrefix(task.Slack, "#") && !strings.HasPrefix(task.Slack, "@") {
-		task.Slack = "#" + task.Slack
+	if err := checkSettings(task.Crit, task.Warn, task.Window, task.Every); err != nil {
+		return err
 	}
 
-	task.EmailArray = strings.Split(task.Email, ",")
-
-	t := template.Must(template.New("memoryalerttemplate").Delims("[[", "]]").Parse(memoryalerttemplate))
-
-	var sb bytes.Buffer
-	swr := bufio.NewWriter(&sb)
-	err = t.Execute(swr, task)
-	if err != nil {
-		utils.ReportError(err, c, "Server Error while reading response")
-		return
+	// Aggregate each dyno's memory with mean (default), max, or a percentile (e.g. p95)
+	if task.Aggregate == "" {
+		task.Aggregate = "mean"
 	}
-
-	swr.Flush()
-	task.Script = string(sb.Bytes())
-	vars = utils.AddVar("app", task.App, "string", vars)
-	vars = utils.AddVar("crit", task.Crit, "int", vars)
-	vars = utils.AddVar("warn", task.Warn, "int", vars)
-	vars = utils.AddVar("slack", task.Slack, "string", vars)
-	vars = utils.AddVar("window", task.Window, "string", vars)
-	vars = utils.AddVar("every", task.Every, "string", vars)
-	vars = utils.AddVar("post", task.Post, "string", vars)
-	vars = utils.AddVar("email", task.Email, "string", vars)
-
-	task.Vars = vars
-
-	bodybytes, err = json.Marshal(task)
-	if err != nil {
-		utils.ReportError(err, c, "Server Error while reading response")
-		return
+	if task.Aggregate == "mean" || task.Aggregate == "max" {
+		task.Selector = task.Aggregate + "(value)"
+	} else if res := percentileRegex.FindStringSubmatch(task.Aggregate); res != nil {
+		task.Selector = "percentile(value, " + res[1] + ")"
+	} else {
+		return errors.New("Aggregate must be one of mean, max, or a percentile (p1 - p99)")
 	}
 
-	if c.Request.Method == "POST" {
-		err = createInstanceMemoryTask(task, c)
-		if err != nil {
-			utils.ReportError(err, c, "")
-			return
-		}
+	// Alert on each dyno instance (default) or on all instances of the dynotype together
+	if task.Groupby == "" {
+		task.Groupby = "instance"
+	}
+	if task.Groupby != "instance" && task.Groupby != "dynotype" {
+		return errors.New("Groupby must be one of instance or dynotype")
 	}
 
-	if c.Request.Method == "PATCH" {
-		// Check if task exists before trying to patch it
-		_, err := getTaskByID(task.ID, c)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				c.JSON(404, nil)
-			} else {
-				utils.ReportError(err, c, "")
-			}
-			return
+	// Growth (leak) detection is optional - only validate it when requested
+	if task.Growth != "" {
+		if _, err := strconv.ParseFloat(task.Growth, 64); err != nil {
+			return errors.New("Growth must be a number (in MB/hour)")
 		}
-
-		err = deleteInstanceMemoryTask(task.ID, c)
-		if err != nil {
-			utils.ReportError(err, c, "")
-			return
+		if task.Growthwindow == "" {
+			task.Growthwindow = "6h"
 		}
-
-		err = createInstanceMemoryTask(task, c)
-		if err != nil {
-			utils.ReportError(err, c, "")
-			return
+		if err := engine.CheckDuration("Growthwindow", task.Growthwindow); err != nil {
+			return err
 		}
+	} else {
+		task.Growthwindow = ""
 	}
-
-	c.String(201, "")
+	return nil
 }
 
-// createInstanceMemoryTask - Create memory task in Kapacitor and save config to the database
-func createInstanceMemoryTask(task MemoryTaskSpec, c *gin.Context) error {
-	db, err := utils.GetDBFromContext(c)
-	if err != nil {
-		return errors.New("Unable to access database")
-	}
-
-	client := http.Client{}
-
-	p, err := json.Marshal(task)
-	if err != nil {
-		return errors.New("Server Error while reading response")
-	}
-
-	req, err := http.NewRequest("POST", os.Getenv("KAPACITOR_URL")+"/kapacitor/v1/tasks", bytes.NewBuffer(p))
-	if err != nil {
-		return errors.New("Server Error while reading response")
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return errors.New("Server Error while reading response")
-	}
+// Options - Growth detection, and alerting on all instances of the dynotype together
+func (task *MemoryTaskSpec) Options() map[string]bool {
+	return map[string]bool{"growth": task.Growth != "", "bydynotype": task.Groupby == "dynotype"}
+}
 
-	defer resp.Body.Close()
-	bodybytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return errors.New("Server Error while reading response")
-	}
+// Keys - App and dynotype
+func (task *MemoryTaskSpec) Keys() []string {
+	return []string{task.App, task.Dynotype}
+}
 
-	if resp.StatusCode != 200 {
-		var er structs.ErrorResponse
-		err = json.Unmarshal(bodybytes, &er)
-		if err != nil {
-			return errors.New("Server Error while reading response")
-		}
-		return errors.New(er.Error)
-	}
+// TaskVars - Variables saved with the task in Kapacitor
+func (task *MemoryTaskSpec) TaskVars() map[string]structs.Var {
+	vars := make(map[string]structs.Var)
+	vars = utils.AddVar("metric", task.Metric, "string", vars)
+	vars = utils.AddVar("dynotyperequest", task.Dynotype, "string", vars)
+	vars = utils.AddVar("dynotype", task.DynoFilter, "string", vars)
+	vars = utils.AddVar("app", task.App, "string", vars)
+	vars = utils.AddVar("crit", task.Crit, "float", vars)
+	vars = utils.AddVar("warn", task.Warn, "float", vars)
+	vars = utils.AddVar("window", task.Window, "duration", vars)
+	vars = utils.AddVar("every", task.Every, "duration", vars)
+	vars = utils.AddVar("aggregate", task.Aggregate, "string", vars)
+	vars = utils.AddVar("groupby", task.Groupby, "string", vars)
+	vars = utils.AddVar("growth", task.Growth, "float", vars)
+	vars = utils.AddVar("growthwindow", task.Growthwindow, "duration", vars)
+	return vars
+}
 
-	_, err = db.Exec(
-		"INSERT INTO memory_tasks VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
-		task.ID, task.App, task.Vars["dynotyperequest"].Value, task.Crit, task.Warn,
+// Row - Values saved to memory_tasks
+func (task *MemoryTaskSpec) Row() []interface{} {
+	return []interface{}{
+		taskID(task.Keys()), task.App, task.Dynotype, task.Crit, task.Warn,
 		task.Window, task.Every, task.Slack, task.Post, task.Email,
-	)
-
-	if err != nil {
-		return errors.New("Unable to save to database")
+		zero.StringFrom(task.Growth), zero.StringFrom(task.Growthwindow), task.Aggregate, task.Groupby,
 	}
-
-	return nil
 }
 
-// DeleteMemoryTask - DELETE /task/memory/:app/:dyno
-func DeleteMemoryTask(c *gin.Context) {
-	app := c.Param("app")
-	dyno := c.Param("dyno")
-
-	// Check if task exists before trying to delete it
-	task, err := getTaskByNameAndDyno(app, dyno, c)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(404, nil)
-		} else {
-			utils.ReportError(err, c, "")
-		}
-		return
-	}
-
-	err = deleteInstanceMemoryTask(task.ID, c)
-	if err != nil {
-		utils.ReportError(err, c, "")
-		return
-	}
-
-	c.String(200, "")
+// ProcessInstanceMemoryRequest - POST | PATCH /task/memory
+func ProcessInstanceMemoryRequest(c *gin.Context) {
+	engine.ProcessRequest(descriptor, c)
 }
 
-// deleteInstanceMemoryTask - Delete memory task from Kapacitor and the database
-func deleteInstanceMemoryTask(id string, c *gin.Context) error {
-	db, err := utils.GetDBFromContext(c)
-	if err != nil {
-		return errors.New("Unable to access database")
-	}
-
-	client := http.Client{}
-	req, err := http.NewRequest("DELETE", os.Getenv("KAPACITOR_URL")+"/kapacitor/v1/tasks/"+id, nil)
-	if err != nil {
-		return errors.New("Server Error while reading response")
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return errors.New("Server Error while reading response")
-	}
-
-	defer resp.Body.Close()
-	bodybytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return errors.New("Server Error while reading response")
-	}
-
-	if resp.StatusCode != 204 {
-		var er structs.ErrorResponse
-		err = json.Unmarshal(bodybytes, &er)
-		if err != nil {
-			return errors.New("Server Error while reading response")
-		}
-		return errors.New(er.Error)
-	}
-
-	_, err = db.Exec("DELETE FROM memory_tasks WHERE id=$1", id)
-	if err != nil {
-		return errors.New("Unable to access database")
-	}
+// PreviewMemoryTask - POST /task/memory/preview
+func PreviewMemoryTask(c *gin.Context) {
+	engine.PreviewTask(descriptor, c)
+}
 
-	return nil
+// DeleteMemoryTask - DELETE /task/memory/:app/:dyno
+func DeleteMemoryTask(c *gin.Context) {
+	engine.DeleteTask(descriptor, c)
 }
 
-// GetMemoryTask - GET /task/memory/:app/:dyno
+// GetMemoryTask - GET /tasks/memory/:app/:dyno
 func GetMemoryTask(c *gin.Context) {
-	app := c.Param("app")
-	dyno := c.Param("dyno")
-
-	task, err := getTaskByNameAndDyno(app, dyno, c)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(404, nil)
-		} else {
-			utils.ReportError(err, c, "")
-		}
-		return
-	}
-
-	c.JSON(200, task)
+	engine.GetTask(descriptor, c)
 }
 
 // GetMemoryTasksForApp - GET /tasks/memory/:app
 func GetMemoryTasksForApp(c *gin.Context) {
-	app := c.Param("app")
-
-	db, err := utils.GetDBFromContext(c)
-	if err != nil {
-		utils.ReportError(err, c, "Unable to access database")
-		return
-	}
-
-	tasks := []MemoryDBTask{}
-
-	err = db.Select(&tasks, "SELECT * FROM memory_tasks WHERE app=$1 ORDER BY id ASC", app)
-	if err != nil {
-		utils.ReportError(err, c, "Unable to access database")
-		return
-	}
-
-	if len(tasks) == 0 {
-		c.JSON(200, nil)
-		return
-	}
-
-	c.JSON(200, tasks)
+	engine.ListTasks(descriptor, c)
 }
 
 // ListMemoryTasks - GET /tasks/memory
 func ListMemoryTasks(c *gin.Context) {
-	db, err := utils.GetDBFromContext(c)
-	if err != nil {
-		utils.ReportError(err, c, "Unable to access database")
-		return
-	}
-
-	tasks := []MemoryDBTask{}
-
-	err = db.Select(&tasks, "SELECT * FROM memory_tasks ORDER BY app ASC")
-	if err != nil {
-		utils.ReportError(err, c, "Unable to access database")
-		return
-	}
-
-	if len(tasks) == 0 {
-		c.JSON(200, nil)
-		return
-	}
-
-	c.JSON(200, tasks)
+	engine.ListTasks(descriptor, c)
 }
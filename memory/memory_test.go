@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"kapacitor-alerts-api/config"
+	"kapacitor-alerts-api/engine"
+	"kapacitor-alerts-api/engine/enginetest"
 	"kapacitor-alerts-api/utils"
 	"log"
 	"net/http"
 	"net/http/httptest"
-	"os"
 	"testing"
 
 	"gopkg.in/guregu/null.v3/zero"
@@ -24,6 +26,7 @@ import (
 *    ---------------------------------------------------
 *    POST     /task/memory                TestCreateMemoryTask
 *    PATCH    /task/memory                TestUpdateMemoryTask
+*    POST     /task/memory/preview        TestHostileMemoryInput
 *    DELETE   /task/memory/:app/:dyno     TestDeleteMemoryTask
 *    GET      /tasks/memory               TestCreateMemoryTask
 *    GET      /tasks/memory/:app          TestCreateMemoryTask
@@ -32,16 +35,25 @@ import (
 
 // setupRouter - Setup Gin routes for current test type
 func setupRouter() *gin.Engine {
-	pool := utils.GetDB(os.Getenv("DATABASE_URL"))
+	cfg, err := config.Load()
+	if err != nil {
+		log.Panicln(err)
+	}
+	pool := utils.GetDB(cfg.Database)
 	if pool == nil {
 		log.Panicln("Unable to connect to database")
 	}
+	if err := engine.Configure(cfg); err != nil {
+		log.Panicln(err)
+	}
 
 	router := gin.Default()
 	router.Use(utils.DBMiddleware(pool))
+	router.Use(config.Middleware(cfg))
 
 	router.POST("/task/memory", ProcessInstanceMemoryRequest)
 	router.PATCH("/task/memory", ProcessInstanceMemoryRequest)
+	router.POST("/task/memory/preview", PreviewMemoryTask)
 	router.DELETE("/task/memory/:app/:dyno", DeleteMemoryTask)
 	router.GET("/tasks/memory/:app", GetMemoryTasksForApp)
 	router.GET("/tasks/memory/:app/:dyno", GetMemoryTask)
@@ -64,6 +76,8 @@ func TestCreateMemoryTask(t *testing.T) {
 	task1.Wind = "12h"
 	task1.Every = "1m"
 	task1.Slack = zero.StringFrom("#cobra")
+	task1.Aggregate = "mean"
+	task1.Groupby = "instance"
 
 	var task2 MemoryDBTask
 	task2.ID = ""
@@ -74,6 +88,8 @@ func TestCreateMemoryTask(t *testing.T) {
 	task2.Wind = "6h"
 	task2.Every = "30s"
 	task2.Slack = zero.StringFrom("#cobra")
+	task2.Aggregate = "p95"
+	task2.Groupby = "dynotype"
 
 	task1Bytes, err := json.Marshal(task1)
 	assert.Nil(t, err, "Converting from MemoryDBTask to JSON should not throw an error")
@@ -126,6 +142,8 @@ func TestCreateMemoryTask(t *testing.T) {
 		assert.Equal(t, returnedTask.Slack, compareTask.Slack, "Task slack should match")
 		assert.Equal(t, returnedTask.Email, compareTask.Email, "Task email should match")
 		assert.Equal(t, returnedTask.Post, compareTask.Post, "Task post should match")
+		assert.Equal(t, returnedTask.Aggregate, compareTask.Aggregate, "Task aggregate should match")
+		assert.Equal(t, returnedTask.Groupby, compareTask.Groupby, "Task groupby should match")
 	}
 
 	// Check individual task endpoints
@@ -148,6 +166,8 @@ func TestCreateMemoryTask(t *testing.T) {
 		assert.Equal(t, returnedTask.Slack, verifyTask.Slack, "Task slack should match")
 		assert.Equal(t, returnedTask.Email, verifyTask.Email, "Task email should match")
 		assert.Equal(t, returnedTask.Post, verifyTask.Post, "Task post should match")
+		assert.Equal(t, returnedTask.Aggregate, verifyTask.Aggregate, "Task aggregate should match")
+		assert.Equal(t, returnedTask.Groupby, verifyTask.Groupby, "Task groupby should match")
 	}
 
 	// Check that the new tasks exist in the list of all tasks
@@ -185,6 +205,8 @@ func TestCreateMemoryTask(t *testing.T) {
 		assert.Equal(t, returnedTask.Slack, verifyTask.Slack, "Task slack should match")
 		assert.Equal(t, returnedTask.Email, verifyTask.Email, "Task email should match")
 		assert.Equal(t, returnedTask.Post, verifyTask.Post, "Task post should match")
+		assert.Equal(t, returnedTask.Aggregate, verifyTask.Aggregate, "Task aggregate should match")
+		assert.Equal(t, returnedTask.Groupby, verifyTask.Groupby, "Task groupby should match")
 	}
 
 	assert.True(t, found[0], "Task 1 should exist in list of all tasks")
@@ -202,6 +224,7 @@ func TestUpdateMemoryTask(t *testing.T) {
 	// Every - 1m => 2m
 	// Slack - #cobra => nil
 	// Post - nil => http://example.com/
+	// Growth - nil => 50 MB/hour over 3h
 	var task MemoryDBTask
 	task.ID = ""
 	task.App = "gotest-voltron"
@@ -211,6 +234,8 @@ func TestUpdateMemoryTask(t *testing.T) {
 	task.Wind = "1d"
 	task.Every = "2m"
 	task.Post = zero.StringFrom("http://example.com")
+	task.Growth = zero.StringFrom("50")
+	task.Growthwindow = zero.StringFrom("3h")
 
 	taskBytes, err := json.Marshal(task)
 	assert.Nil(t, err, "Converting from MemoryDBTask to JSON should not throw an error")
@@ -244,6 +269,8 @@ func TestUpdateMemoryTask(t *testing.T) {
 	assert.Equal(t, returnedTask.Slack, task.Slack, "Task slack should match")
 	assert.Equal(t, returnedTask.Email, task.Email, "Task email should match")
 	assert.Equal(t, returnedTask.Post, task.Post, "Task post should match")
+	assert.Equal(t, returnedTask.Growth, task.Growth, "Task growth should match")
+	assert.Equal(t, returnedTask.Growthwindow, task.Growthwindow, "Task growth window should match")
 }
 
 // TestDeleteMemoryTask - Make sure that deleting a memory task works and that we cannot access it anymore
@@ -287,3 +314,25 @@ func TestDeleteMemoryTask(t *testing.T) {
 	assert.Equal(t, http.StatusOK, w.Code, "HTTP response for GET /tasks/memory/:app should be 200")
 	assert.Equal(t, len(response), 0, "Result for GET /tasks/memory/:app should be empty when no tasks are present")
 }
+
+// TestHostileMemoryInput - Make sure that user input is passed through vars or escaped in the rendered query, or rejected if it cannot be
+func TestHostileMemoryInput(t *testing.T) {
+	inputs := append(enginetest.HostileNotify(`"dynotype":"worker","crit":"1000","warn":"750","window":"5m","every":"1m"`),
+		enginetest.Accepted("dot in app", `{"app":"gotest.hostile","dynotype":"worker","crit":"1000","warn":"750","window":"5m","every":"1m"}`, [2]string{"influx_query", `"app"='gotest.hostile'`}),
+		enginetest.Rejected("regex in dynotype", `{"app":"gotest-hostile","dynotype":"web|worker","crit":"1000","warn":"750","window":"5m","every":"1m"}`),
+		enginetest.Rejected("wildcard dynotype", `{"app":"gotest-hostile","dynotype":".*","crit":"1000","warn":"750","window":"5m","every":"1m"}`),
+		enginetest.Accepted("dot in dynotype", `{"app":"gotest-hostile","dynotype":"w.b","crit":"1000","warn":"750","window":"5m","every":"1m"}`, [2]string{"influx_query", `"dyno"  =~ /w\.b/`}),
+		enginetest.Rejected("expression in warn", `{"app":"gotest-hostile","dynotype":"worker","crit":"1000","warn":"1 OR true","window":"5m","every":"1m"}`),
+		enginetest.Rejected("expression in every", `{"app":"gotest-hostile","dynotype":"worker","crit":"1000","warn":"750","window":"5m","every":"1m) |log("}`),
+		enginetest.Rejected("expression in growth window", `{"app":"gotest-hostile","dynotype":"worker","crit":"1000","warn":"750","window":"5m","every":"1m","growth":"10","growthwindow":"6h) |log("}`),
+	)
+	enginetest.CheckHostileInputs(t, PreviewMemoryTask, inputs)
+}
+
+// TestMemoryTaskPattern - Make sure that the task IDs of every dynotype are recognised as memory tasks
+func TestMemoryTaskPattern(t *testing.T) {
+	for _, dynotype := range []string{"web", "worker_2", "worker-large"} {
+		assert.True(t, descriptor.Pattern.MatchString(taskID([]string{"gotest-hostile", dynotype})), "Task of dynotype "+dynotype+" should match the pattern")
+	}
+	assert.False(t, descriptor.Pattern.MatchString("gotest-hostile-sample.cpu_usage-web"), "CPU task should not match the pattern")
+}
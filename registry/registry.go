@@ -0,0 +1,296 @@
+package registry
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"kapacitor-alerts-api/engine"
+	"kapacitor-alerts-api/utils"
+	"log"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+var typeNameRegex = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// builtinTypes - Alert types that have their own endpoints and cannot be registered
+var builtinTypes = map[string]bool{
+	"memory": true, "cpu": true, "4xx": true, "5xx": true, "latency": true, "deadman": true,
+	"crash": true, "crashed": true, "release": true, "event": true, "custom": true,
+}
+
+// getAlertType - Get an alert type from the database by its name
+func getAlertType(name string, c *gin.Context) (*AlertType, error) {
+	db, err := utils.GetDBFromContext(c)
+	if err != nil {
+		return nil, errors.New("Unable to access database")
+	}
+
+	alertType := AlertType{}
+
+	ctx, cancel := utils.DBContext(c)
+	defer cancel()
+	err = db.GetContext(ctx, &alertType, "SELECT * FROM alert_types WHERE name=$1", name)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, sql.ErrNoRows
+		}
+		return nil, errors.New("Unable to access database")
+	}
+	return &alertType, nil
+}
+
+// ProcessAlertTypeRequest - POST | PATCH /type
+func ProcessAlertTypeRequest(c *gin.Context) {
+	bodybytes, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		utils.ReportError(err, c, "Server Error while reading response")
+		return
+	}
+
+	var spec AlertTypeSpec
+	err = json.Unmarshal(bodybytes, &spec)
+	if err != nil {
+		utils.ReportInvalidRequest(c, "Invalid alert type: "+err.Error())
+		return
+	}
+
+	if !typeNameRegex.MatchString(spec.Name) || builtinTypes[spec.Name] {
+		utils.ReportInvalidRequest(c, "Invalid alert type name "+spec.Name)
+		return
+	}
+
+	if spec.Type == "" {
+		spec.Type = "batch"
+	}
+	if spec.Type != "batch" && spec.Type != "stream" {
+		utils.ReportInvalidRequest(c, "Type must be one of batch or stream")
+		return
+	}
+
+	// Validate the schema and template before saving them
+	err = spec.Schema.Check()
+	if err != nil {
+		utils.ReportInvalidRequest(c, err.Error())
+		return
+	}
+
+	_, err = engine.New(&engine.Descriptor{Name: spec.Name, Template: spec.Template})
+	if err != nil {
+		utils.ReportInvalidRequest(c, "Invalid template: "+err.Error())
+		return
+	}
+
+	schema, err := json.Marshal(spec.Schema)
+	if err != nil {
+		utils.ReportError(err, c, "Server Error while reading response")
+		return
+	}
+
+	db, err := utils.GetDBFromContext(c)
+	if err != nil {
+		utils.ReportError(err, c, "Unable to access database")
+		return
+	}
+
+	ctx, cancel := utils.DBContext(c)
+	defer cancel()
+	if c.Request.Method == "POST" {
+		res, err := db.ExecContext(ctx,
+			"INSERT INTO alert_types VALUES ($1, $2, $3, $4, $5) ON CONFLICT (name) DO NOTHING",
+			spec.Name, spec.Description, spec.Type, spec.Template, string(schema),
+		)
+		if err != nil {
+			utils.ReportError(err, c, "Unable to save to database")
+			return
+		}
+		if rows, _ := res.RowsAffected(); rows == 0 {
+			utils.ReportConflict(c, "Alert type "+spec.Name+" already exists")
+			return
+		}
+	}
+
+	if c.Request.Method == "PATCH" {
+		// The alert type is locked until its Kapacitor templates have been updated, and the update is rolled back
+		// if they cannot be. The transaction outlives the request, so it is not rolled back once Kapacitor has changed.
+		tx, err := db.BeginTxx(context.Background(), nil)
+		if err != nil {
+			utils.ReportError(err, c, "Unable to access database")
+			return
+		}
+		defer tx.Rollback()
+
+		previous := AlertType{}
+		err = tx.GetContext(ctx, &previous, "SELECT * FROM alert_types WHERE name=$1 FOR UPDATE", spec.Name)
+		if err == sql.ErrNoRows {
+			c.JSON(404, nil)
+			return
+		}
+		if err != nil {
+			utils.ReportError(err, c, "Unable to access database")
+			return
+		}
+
+		_, err = tx.ExecContext(ctx,
+			"UPDATE alert_types SET description=$2, tasktype=$3, template=$4, schema=$5 WHERE name=$1",
+			spec.Name, spec.Description, spec.Type, spec.Template, string(schema),
+		)
+		if err != nil {
+			utils.ReportError(err, c, "Unable to save to database")
+			return
+		}
+
+		// Existing tasks keep their vars, so they must still be valid under the new schema
+		tasks := []CustomDBTask{}
+		err = tx.SelectContext(ctx, &tasks, "SELECT * FROM custom_tasks WHERE alerttype=$1", spec.Name)
+		if err != nil {
+			utils.ReportError(err, c, "Unable to access database")
+			return
+		}
+		for _, task := range tasks {
+			var vars map[string]interface{}
+			err = json.Unmarshal(task.Vars, &vars)
+			if err == nil {
+				_, err = spec.Schema.Apply(vars)
+			}
+			if err != nil {
+				utils.ReportInvalidRequest(c, "Task "+task.ID+" does not match the schema: "+err.Error())
+				return
+			}
+		}
+
+		// Update the Kapacitor templates of the alert type, which updates all of its existing tasks
+		d, err := descriptorFor(&AlertType{Name: spec.Name, Tasktype: spec.Type, Template: spec.Template, Schema: schema})
+		if err != nil {
+			utils.ReportError(err, c, "Server Error while reading response")
+			return
+		}
+		_, err = d.Deploy(context.Background(), db)
+		if err == nil {
+			err = tx.Commit()
+			if err != nil {
+				err = errors.New("Unable to save to database")
+			}
+		}
+		if err != nil {
+			restoreTemplates(db, &previous)
+			utils.ReportError(err, c, "")
+			return
+		}
+	}
+
+	c.String(201, "")
+}
+
+// restoreTemplates - Put back the Kapacitor templates of an alert type whose update failed, which may have
+// changed them on some instances
+func restoreTemplates(db *sqlx.DB, alertType *AlertType) {
+	d, err := descriptorFor(alertType)
+	if err == nil {
+		_, err = d.Deploy(context.Background(), db)
+	}
+	if err != nil {
+		log.Println("Unable to restore the templates of alert type " + alertType.Name + ": " + err.Error())
+	}
+}
+
+// DeleteAlertType - DELETE /type/:name
+func DeleteAlertType(c *gin.Context) {
+	name := c.Param("name")
+
+	alertType, err := getAlertType(name, c)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(404, nil)
+		} else {
+			utils.ReportError(err, c, "")
+		}
+		return
+	}
+
+	db, err := utils.GetDBFromContext(c)
+	if err != nil {
+		utils.ReportError(err, c, "Unable to access database")
+		return
+	}
+
+	// Alert types can only be removed once all of their tasks have been deleted
+	var count int
+	ctx, cancel := utils.DBContext(c)
+	err = db.GetContext(ctx, &count, "SELECT COUNT(*) FROM custom_tasks WHERE alerttype=$1", name)
+	cancel()
+	if err != nil {
+		utils.ReportError(err, c, "Unable to access database")
+		return
+	}
+	if count > 0 {
+		utils.ReportConflict(c, "Alert type "+name+" still has tasks")
+		return
+	}
+
+	d, err := descriptorFor(alertType)
+	if err != nil {
+		utils.ReportError(err, c, "Server Error while reading response")
+		return
+	}
+	err = d.DeleteTemplates(c.Request.Context())
+	if err != nil {
+		utils.ReportError(err, c, "")
+		return
+	}
+
+	ctx, cancel = utils.DBContext(c)
+	defer cancel()
+	_, err = db.ExecContext(ctx, "DELETE FROM alert_types WHERE name=$1", name)
+	if err != nil {
+		utils.ReportError(err, c, "Unable to access database")
+		return
+	}
+
+	c.String(200, "")
+}
+
+// GetAlertType - GET /type/:name
+func GetAlertType(c *gin.Context) {
+	alertType, err := getAlertType(c.Param("name"), c)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(404, nil)
+		} else {
+			utils.ReportError(err, c, "")
+		}
+		return
+	}
+
+	c.JSON(200, alertType)
+}
+
+// ListAlertTypes - GET /types
+func ListAlertTypes(c *gin.Context) {
+	db, err := utils.GetDBFromContext(c)
+	if err != nil {
+		utils.ReportError(err, c, "Unable to access database")
+		return
+	}
+
+	alertTypes := []AlertType{}
+
+	ctx, cancel := utils.DBContext(c)
+	defer cancel()
+	err = db.SelectContext(ctx, &alertTypes, "SELECT * FROM alert_types ORDER BY name ASC")
+	if err != nil {
+		utils.ReportError(err, c, "Unable to access database")
+		return
+	}
+
+	if len(alertTypes) == 0 {
+		c.JSON(200, nil)
+		return
+	}
+
+	c.JSON(200, alertTypes)
+}
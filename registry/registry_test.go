@@ -0,0 +1,346 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"kapacitor-alerts-api/config"
+	"kapacitor-alerts-api/engine"
+	"kapacitor-alerts-api/utils"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+/********************************************************
+*    Endpoints tested:
+*
+*    Method   Endpoint                     Function
+*    ----------------------------------------------------------
+*    POST     /type                        TestCreateAlertType
+*    GET      /type/:name                  TestCreateAlertType
+*    GET      /types                       TestCreateAlertType
+*    POST     /task/custom/:type           TestCreateCustomTask
+*    GET      /task/custom/:type/:app      TestCreateCustomTask
+*    GET      /tasks/custom/:type          TestCreateCustomTask
+*    PATCH    /task/custom/:type           TestUpdateCustomTask
+*    PATCH    /type                        TestUpdateCustomTask
+*    DELETE   /type/:name                  TestDeleteCustomTask
+*    DELETE   /task/custom/:type/:app      TestDeleteCustomTask
+ */
+
+// setupRouter - Setup Gin routes for current test type
+func setupRouter() *gin.Engine {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Panicln(err)
+	}
+	pool := utils.GetDB(cfg.Database)
+	if pool == nil {
+		log.Panicln("Unable to connect to database")
+	}
+	if err := engine.Configure(cfg); err != nil {
+		log.Panicln(err)
+	}
+
+	router := gin.Default()
+	gin.SetMode(gin.DebugMode)
+	router.Use(utils.DBMiddleware(pool))
+	router.Use(config.Middleware(cfg))
+
+	router.POST("/type", ProcessAlertTypeRequest)
+	router.PATCH("/type", ProcessAlertTypeRequest)
+	router.DELETE("/type/:name", DeleteAlertType)
+	router.GET("/type/:name", GetAlertType)
+	router.GET("/types", ListAlertTypes)
+
+	router.POST("/task/custom/:type", ProcessCustomRequest)
+	router.PATCH("/task/custom/:type", ProcessCustomRequest)
+	router.DELETE("/task/custom/:type/:app", DeleteCustomTask)
+	router.GET("/task/custom/:type/:app", GetCustomTask)
+	router.GET("/tasks/custom/:type", ListCustomTasks)
+
+	return router
+}
+
+const testTemplate = `
+[[define "influx_query"]]
+select count(value) as value from "opentsdb"."retention_policy"."router.status.502" where "fqdn" =~ /[[ .App | influxregex ]]/
+[[end]]
+var id string
+var influx_query string
+var threshold int
+var window duration
+[[if .Slack ]]
+var slack string
+[[end]]
+
+	batch
+	|	query(influx_query)
+		.period(window)
+		.every(window)
+	|	alert()
+		.id(id)
+		.crit(lambda: "value" > threshold)
+		[[if .Slack ]]
+		.slack()
+		.channel(slack)
+		[[end]]
+`
+
+// TestCreateAlertType - Make sure that registering an alert type works and we can successfully get info about it
+func TestCreateAlertType(t *testing.T) {
+	router := setupRouter()
+
+	min := float64(1)
+	var spec AlertTypeSpec
+	spec.Name = "gotest_502"
+	spec.Description = "Too many 502 responses"
+	spec.Template = testTemplate
+	spec.Schema = Schema{
+		Type: "object",
+		Properties: map[string]Property{
+			"threshold": Property{Type: "integer", Minimum: &min},
+			"window":    Property{Type: "duration", Default: "5m"},
+		},
+		Required: []string{"threshold"},
+	}
+	specBytes, err := json.Marshal(spec)
+	assert.Nil(t, err, "Converting from AlertTypeSpec to JSON should not throw an error")
+
+	req, _ := http.NewRequest("POST", "/type", bytes.NewBuffer(specBytes))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusCreated, w.Code, "HTTP response code for POST /type should be 201")
+
+	// Check that the new alert type exists and contains expected data
+	req, _ = http.NewRequest("GET", "/type/gotest_502", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for GET /type/:name should be 200")
+
+	var returnedType AlertType
+	err = json.Unmarshal([]byte(w.Body.String()), &returnedType)
+
+	assert.Nil(t, err, "Converting from JSON to AlertType should not throw an error")
+	assert.Equal(t, spec.Name, returnedType.Name, "Alert type name should match")
+	assert.Equal(t, "batch", returnedType.Tasktype, "Alert type should default to batch")
+	assert.Equal(t, spec.Template, returnedType.Template, "Alert type template should match")
+
+	// Check that the new alert type exists in the list of all alert types
+	req, _ = http.NewRequest("GET", "/types", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for GET /types should be 200")
+
+	var returnedTypes []AlertType
+	err = json.Unmarshal([]byte(w.Body.String()), &returnedTypes)
+	assert.Nil(t, err, "Converting from JSON to []AlertType should not throw an error")
+
+	found := false
+	for _, n := range returnedTypes {
+		if n.Name == spec.Name {
+			found = true
+		}
+	}
+	assert.True(t, found, "Alert type should exist in returned list of alert types")
+
+	// Registering the same name again is a conflict
+	req, _ = http.NewRequest("POST", "/type", bytes.NewBuffer(specBytes))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusConflict, w.Code, "HTTP response code for POST /type with an existing name should be 409")
+
+	// Built-in alert types and invalid templates cannot be registered
+	spec.Name = "memory"
+	specBytes, _ = json.Marshal(spec)
+	req, _ = http.NewRequest("POST", "/type", bytes.NewBuffer(specBytes))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code, "HTTP response code for POST /type with a built-in name should be 400")
+
+	spec.Name = "gotest_invalid"
+	spec.Template = "[[ if .App ]]"
+	specBytes, _ = json.Marshal(spec)
+	req, _ = http.NewRequest("POST", "/type", bytes.NewBuffer(specBytes))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code, "HTTP response code for POST /type with an invalid template should be 400")
+}
+
+// TestCreateCustomTask - Make sure that creating a task of an alert type works and we can successfully get info about it
+func TestCreateCustomTask(t *testing.T) {
+	router := setupRouter()
+
+	var task CustomTaskSpec
+	task.App = "gotest-voltron"
+	task.Slack = "#cobra"
+	task.Vars = map[string]interface{}{"threshold": 10}
+	taskBytes, err := json.Marshal(task)
+	assert.Nil(t, err, "Converting from CustomTaskSpec to JSON should not throw an error")
+
+	req, _ := http.NewRequest("POST", "/task/custom/gotest_502", bytes.NewBuffer(taskBytes))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusCreated, w.Code, "HTTP response code for POST /task/custom/:type should be 201")
+
+	// Check that the new task exists and contains expected data
+	req, _ = http.NewRequest("GET", "/task/custom/gotest_502/gotest-voltron", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for GET /task/custom/:type/:app should be 200")
+
+	var returnedTask CustomDBTask
+	err = json.Unmarshal([]byte(w.Body.String()), &returnedTask)
+	assert.Nil(t, err, "Converting from JSON to CustomDBTask should not throw an error")
+
+	var vars map[string]interface{}
+	err = json.Unmarshal(returnedTask.Vars, &vars)
+	assert.Nil(t, err, "Task vars should be valid JSON")
+	assert.Equal(t, task.App, returnedTask.App, "Task app name should match")
+	assert.Equal(t, "gotest-voltron-custom-gotest_502", returnedTask.ID, "Task ID should match")
+	assert.Equal(t, float64(10), vars["threshold"], "Task threshold should match")
+	assert.Equal(t, "5m", vars["window"], "Task window should default to 5m")
+	assert.Equal(t, task.Slack, returnedTask.Slack.String, "Task slack should match")
+
+	// Check that the new task exists in the list of tasks of the alert type
+	req, _ = http.NewRequest("GET", "/tasks/custom/gotest_502", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for GET /tasks/custom/:type should be 200")
+
+	var returnedTasks []CustomDBTask
+	err = json.Unmarshal([]byte(w.Body.String()), &returnedTasks)
+	assert.Nil(t, err, "Converting from JSON to []CustomDBTask should not throw an error")
+
+	found := false
+	for _, n := range returnedTasks {
+		if n.App == task.App {
+			found = true
+		}
+	}
+	assert.True(t, found, "Task should exist in returned list of tasks")
+
+	// Variables that don't match the schema are rejected
+	task.Vars = map[string]interface{}{"threshold": 0}
+	taskBytes, _ = json.Marshal(task)
+	req, _ = http.NewRequest("POST", "/task/custom/gotest_502", bytes.NewBuffer(taskBytes))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code, "HTTP response code for POST /task/custom/:type with invalid vars should be 400")
+}
+
+// TestUpdateCustomTask - Make sure that updating a task of an alert type works
+func TestUpdateCustomTask(t *testing.T) {
+	router := setupRouter()
+
+	// Create a task with updated information
+	// Slack - #cobra => nil
+	// Post - nil => http://example.com/
+	// Window - 5m => 10m
+	var task CustomTaskSpec
+	task.App = "gotest-voltron"
+	task.Post = "http://example.com/"
+	task.Vars = map[string]interface{}{"threshold": 10, "window": "10m"}
+	taskBytes, err := json.Marshal(task)
+	assert.Nil(t, err, "Converting from CustomTaskSpec to JSON should not throw an error")
+
+	req, _ := http.NewRequest("PATCH", "/task/custom/gotest_502", bytes.NewBuffer(taskBytes))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusCreated, w.Code, "HTTP response code for PATCH /task/custom/:type should be 201")
+
+	req, _ = http.NewRequest("GET", "/task/custom/gotest_502/gotest-voltron", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var returnedTask CustomDBTask
+	err = json.Unmarshal([]byte(w.Body.String()), &returnedTask)
+	assert.Nil(t, err, "Converting from JSON to CustomDBTask should not throw an error")
+
+	var vars map[string]interface{}
+	err = json.Unmarshal(returnedTask.Vars, &vars)
+	assert.Nil(t, err, "Task vars should be valid JSON")
+	assert.Equal(t, "10m", vars["window"], "Task window should match")
+	// API sets nil slack channels to #
+	assert.Equal(t, "#", returnedTask.Slack.String, "Task slack should match")
+	assert.Equal(t, task.Post, returnedTask.Post.String, "Task post should match")
+
+	// Schema changes that existing tasks do not satisfy are rejected, and the alert type is left as it was
+	min := float64(20)
+	var spec AlertTypeSpec
+	spec.Name = "gotest_502"
+	spec.Template = testTemplate
+	spec.Schema = Schema{
+		Type:       "object",
+		Properties: map[string]Property{"threshold": Property{Type: "integer", Minimum: &min}, "window": Property{Type: "duration"}},
+		Required:   []string{"threshold"},
+	}
+	specBytes, err := json.Marshal(spec)
+	assert.Nil(t, err, "Converting from AlertTypeSpec to JSON should not throw an error")
+
+	req, _ = http.NewRequest("PATCH", "/type", bytes.NewBuffer(specBytes))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code, "HTTP response code for PATCH /type with a schema existing tasks do not satisfy should be 400")
+
+	req, _ = http.NewRequest("GET", "/type/gotest_502", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var alertType AlertType
+	err = json.Unmarshal(w.Body.Bytes(), &alertType)
+	assert.Nil(t, err, "Converting from JSON to AlertType should not throw an error")
+	assert.Equal(t, "Too many 502 responses", alertType.Description.String, "Rejected update should not change the alert type")
+}
+
+// TestDeleteCustomTask - Make sure that deleting a task and its alert type works
+func TestDeleteCustomTask(t *testing.T) {
+	router := setupRouter()
+
+	// Alert types with tasks cannot be deleted
+	req, _ := http.NewRequest("DELETE", "/type/gotest_502", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusConflict, w.Code, "HTTP response code for DELETE /type/:name with tasks should be 409")
+
+	req, _ = http.NewRequest("DELETE", "/task/custom/gotest_502/gotest-voltron", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for DELETE /task/custom/:type/:app should be 200")
+
+	req, _ = http.NewRequest("GET", "/task/custom/gotest_502/gotest-voltron", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code, "HTTP response code for GET /task/custom/:type/:app on invalid app should be 404")
+
+	req, _ = http.NewRequest("DELETE", "/type/gotest_502", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "HTTP response code for DELETE /type/:name should be 200")
+
+	req, _ = http.NewRequest("GET", "/type/gotest_502", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code, "HTTP response code for GET /type/:name on invalid name should be 404")
+}
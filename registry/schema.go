@@ -0,0 +1,180 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"kapacitor-alerts-api/engine"
+	"math"
+	"regexp"
+	"strconv"
+)
+
+// Schema - A JSON schema describing the variables of an alert type.
+// Only a subset of JSON schema is supported: an object with typed properties, required properties,
+// and defaults, enums, patterns, minimums and maximums on properties.
+type Schema struct {
+	Type       string              `json:"type,omitempty"`
+	Properties map[string]Property `json:"properties"`
+	Required   []string            `json:"required,omitempty"`
+}
+
+// Property - A variable of an alert type
+type Property struct {
+	Type        string        `json:"type"`
+	Description string        `json:"description,omitempty"`
+	Default     interface{}   `json:"default,omitempty"`
+	Enum        []interface{} `json:"enum,omitempty"`
+	Pattern     string        `json:"pattern,omitempty"`
+	Minimum     *float64      `json:"minimum,omitempty"`
+	Maximum     *float64      `json:"maximum,omitempty"`
+}
+
+// kapacitorTypes - Kapacitor var types for each supported JSON schema type
+var kapacitorTypes = map[string]string{
+	"string":   "string",
+	"number":   "float",
+	"integer":  "int",
+	"boolean":  "bool",
+	"duration": "duration",
+}
+
+var varNameRegex = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// reservedVars - Variables that are always passed to templates and cannot be redefined
+var reservedVars = map[string]bool{
+	"id": true, "app": true, "slack": true, "post": true, "email": true, "type": true, "alerttype": true,
+}
+
+// emailVarRegex - Variables holding each email address to notify (email_0, email_1, ...)
+var emailVarRegex = regexp.MustCompile(`^email_[0-9]+$`)
+
+// Check - Make sure that the schema itself is valid
+func (s Schema) Check() error {
+	if s.Type != "" && s.Type != "object" {
+		return errors.New("Schema type must be object")
+	}
+
+	for name, prop := range s.Properties {
+		if !varNameRegex.MatchString(name) {
+			return errors.New("Invalid variable name " + name)
+		}
+		if reservedVars[name] || emailVarRegex.MatchString(name) {
+			return errors.New("Variable name " + name + " is reserved")
+		}
+		if _, ok := kapacitorTypes[prop.Type]; !ok {
+			return errors.New("Variable " + name + " must have a type of string, number, integer, boolean, or duration")
+		}
+		if prop.Pattern != "" {
+			if _, err := regexp.Compile(prop.Pattern); err != nil {
+				return errors.New("Variable " + name + " has an invalid pattern: " + err.Error())
+			}
+		}
+		if prop.Default != nil {
+			if err := prop.check(name, prop.Default); err != nil {
+				return errors.New("Invalid default: " + err.Error())
+			}
+		}
+	}
+
+	for _, name := range s.Required {
+		if _, ok := s.Properties[name]; !ok {
+			return errors.New("Required variable " + name + " is not defined")
+		}
+	}
+
+	return nil
+}
+
+// Apply - Validate the variables of a task against the schema, filling in any defaults
+func (s Schema) Apply(vars map[string]interface{}) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+
+	for name, value := range vars {
+		prop, ok := s.Properties[name]
+		if !ok {
+			return nil, errors.New("Unknown variable " + name)
+		}
+		if err := prop.check(name, value); err != nil {
+			return nil, err
+		}
+		result[name] = value
+	}
+
+	for name, prop := range s.Properties {
+		if _, ok := result[name]; !ok && prop.Default != nil {
+			result[name] = prop.Default
+		}
+	}
+
+	for _, name := range s.Required {
+		if _, ok := result[name]; !ok {
+			return nil, errors.New("Missing required variable " + name)
+		}
+	}
+
+	return result, nil
+}
+
+// check - Make sure that a value matches the property
+func (p Property) check(name string, value interface{}) error {
+	switch p.Type {
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return errors.New("Variable " + name + " must be a string")
+		}
+		if p.Pattern != "" && !regexp.MustCompile(p.Pattern).MatchString(str) {
+			return errors.New("Variable " + name + " must match " + p.Pattern)
+		}
+	case "number", "integer":
+		num, ok := value.(float64)
+		if !ok {
+			return errors.New("Variable " + name + " must be a number")
+		}
+		if p.Type == "integer" && num != math.Trunc(num) {
+			return errors.New("Variable " + name + " must be an integer")
+		}
+		if p.Minimum != nil && num < *p.Minimum {
+			return errors.New("Variable " + name + " must be at least " + strconv.FormatFloat(*p.Minimum, 'f', -1, 64))
+		}
+		if p.Maximum != nil && num > *p.Maximum {
+			return errors.New("Variable " + name + " must be at most " + strconv.FormatFloat(*p.Maximum, 'f', -1, 64))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return errors.New("Variable " + name + " must be true or false")
+		}
+	case "duration":
+		str, ok := value.(string)
+		if !ok {
+			return errors.New("Variable " + name + " must be a duration (e.g. 30s, 10m, 1h)")
+		}
+		if err := engine.CheckDuration("Variable "+name, str); err != nil {
+			return err
+		}
+	}
+
+	if len(p.Enum) > 0 {
+		for _, allowed := range p.Enum {
+			if allowed == value {
+				return nil
+			}
+		}
+		return errors.New("Variable " + name + " must be one of " + fmt.Sprint(p.Enum))
+	}
+
+	return nil
+}
+
+// varString - Format a variable for utils.AddVar
+func varString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,66 @@
+package registry
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSchemaCheck - Make sure that invalid schemas are rejected
+func TestSchemaCheck(t *testing.T) {
+	valid := Schema{
+		Properties: map[string]Property{
+			"threshold": Property{Type: "number", Default: float64(5)},
+			"window":    Property{Type: "string", Enum: []interface{}{"5m", "10m"}},
+		},
+		Required: []string{"threshold"},
+	}
+	assert.Nil(t, valid.Check(), "Valid schema should not throw an error")
+
+	invalid := []Schema{
+		{Type: "array"},
+		{Properties: map[string]Property{"app": Property{Type: "string"}}},
+		{Properties: map[string]Property{"bad-name": Property{Type: "string"}}},
+		{Properties: map[string]Property{"threshold": Property{Type: "object"}}},
+		{Properties: map[string]Property{"threshold": Property{Type: "number", Default: "5"}}},
+		{Properties: map[string]Property{"window": Property{Type: "string", Pattern: "("}}},
+		{Properties: map[string]Property{}, Required: []string{"threshold"}},
+	}
+	for _, s := range invalid {
+		assert.NotNil(t, s.Check(), "Invalid schema should throw an error")
+	}
+}
+
+// TestSchemaApply - Make sure that task variables are validated and defaults are filled in
+func TestSchemaApply(t *testing.T) {
+	min := float64(1)
+	s := Schema{
+		Properties: map[string]Property{
+			"threshold": Property{Type: "integer", Minimum: &min},
+			"window":    Property{Type: "string", Pattern: "^[0-9]+m$", Default: "5m"},
+			"enabled":   Property{Type: "boolean"},
+		},
+		Required: []string{"threshold"},
+	}
+
+	vars, err := s.Apply(map[string]interface{}{"threshold": float64(3)})
+	assert.Nil(t, err, "Valid vars should not throw an error")
+	assert.Equal(t, map[string]interface{}{"threshold": float64(3), "window": "5m"}, vars, "Defaults should be filled in")
+
+	invalid := []map[string]interface{}{
+		{},
+		{"threshold": float64(0)},
+		{"threshold": 1.5},
+		{"threshold": "3"},
+		{"threshold": float64(3), "window": "5h"},
+		{"threshold": float64(3), "enabled": "yes"},
+		{"threshold": float64(3), "unknown": "value"},
+	}
+	for _, v := range invalid {
+		_, err := s.Apply(v)
+		assert.NotNil(t, err, "Invalid vars should throw an error")
+	}
+
+	assert.Equal(t, "3", varString(float64(3)), "Whole numbers should not have a decimal point")
+	assert.Equal(t, "true", varString(true), "Booleans should be formatted as true or false")
+}
@@ -0,0 +1,49 @@
+package registry
+
+import (
+	"kapacitor-alerts-api/engine"
+
+	"github.com/jmoiron/sqlx/types"
+	"gopkg.in/guregu/null.v3/zero"
+)
+
+// AlertTypeSpec - Used to register or update an alert type
+type AlertTypeSpec struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Type        string `json:"type"`
+	Template    string `json:"template"`
+	Schema      Schema `json:"schema"`
+}
+
+// AlertType - Used for retrieval of alert types from the database
+type AlertType struct {
+	Name        string         `json:"name"`
+	Description zero.String    `json:"description"`
+	Tasktype    string         `json:"type"`
+	Template    string         `json:"template"`
+	Schema      types.JSONText `json:"schema"`
+}
+
+// CustomTaskSpec - Used to create or update a task of a registered alert type. The [[define]] blocks of
+// templates have access to the ID, App, Slack, Post, Email, and Vars of the task.
+type CustomTaskSpec struct {
+	ID   string                 `json:"-"`
+	Type string                 `json:"-"`
+	App  string                 `json:"app"`
+	Vars map[string]interface{} `json:"vars"`
+	engine.Notify
+
+	schema Schema
+}
+
+// CustomDBTask - Used for retrieval of task information from the database
+type CustomDBTask struct {
+	ID        string         `json:"id"`
+	Alerttype string         `json:"type"`
+	App       string         `json:"app"`
+	Vars      types.JSONText `json:"vars"`
+	Slack     zero.String    `json:"slack"`
+	Post      zero.String    `json:"post"`
+	Email     zero.String    `json:"email"`
+}
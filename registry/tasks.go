@@ -0,0 +1,152 @@
+package registry
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"kapacitor-alerts-api/engine"
+	structs "kapacitor-alerts-api/structs"
+	"kapacitor-alerts-api/utils"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+// taskID - The Kapacitor task ID of a task of an alert type
+func taskID(keys []string) string {
+	return keys[1] + "-custom-" + keys[0]
+}
+
+// descriptorFor - Describe a registered alert type to the engine
+func descriptorFor(alertType *AlertType) (*engine.Descriptor, error) {
+	var schema Schema
+	err := json.Unmarshal(alertType.Schema, &schema)
+	if err != nil {
+		return nil, err
+	}
+
+	return engine.New(&engine.Descriptor{
+		Name:     alertType.Name,
+		Table:    "custom_tasks",
+		Params:   []string{"type", "app"},
+		Columns:  []string{"alerttype", "app"},
+		Scope:    []string{alertType.Name},
+		TaskType: alertType.Tasktype,
+		Template: alertType.Template,
+		ID:       taskID,
+		Pattern:  regexp.MustCompile(`-custom-` + regexp.QuoteMeta(alertType.Name) + `$`),
+		NewSpec:  func() engine.Spec { return &CustomTaskSpec{Type: alertType.Name, schema: schema} },
+		FromVars: func(vars map[string]structs.Var) engine.Spec {
+			task := &CustomTaskSpec{Type: alertType.Name, schema: schema, Vars: make(map[string]interface{})}
+			task.App = engine.StringVar(vars, "app")
+			for name, prop := range schema.Properties {
+				if v, ok := vars[name]; ok && prop.Type == "duration" {
+					task.Vars[name] = engine.DurationVar(vars, name)
+				} else if ok {
+					task.Vars[name] = v.Value
+				}
+			}
+			return task
+		},
+		Model: CustomDBTask{},
+	})
+}
+
+// Descriptors - Describe every registered alert type to the engine
+func Descriptors(db *sqlx.DB) ([]*engine.Descriptor, error) {
+	alertTypes := []AlertType{}
+	err := db.Select(&alertTypes, "SELECT * FROM alert_types ORDER BY name ASC")
+	if err != nil {
+		return nil, errors.New("Unable to access database")
+	}
+
+	var descriptors []*engine.Descriptor
+	for i := range alertTypes {
+		d, err := descriptorFor(&alertTypes[i])
+		if err != nil {
+			return nil, errors.New("Invalid alert type " + alertTypes[i].Name + ": " + err.Error())
+		}
+		descriptors = append(descriptors, d)
+	}
+	return descriptors, nil
+}
+
+// withDescriptor - Run an engine handler for the alert type in the route
+func withDescriptor(c *gin.Context, handler func(*engine.Descriptor, *gin.Context)) {
+	alertType, err := getAlertType(c.Param("type"), c)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(404, nil)
+		} else {
+			utils.ReportError(err, c, "")
+		}
+		return
+	}
+
+	d, err := descriptorFor(alertType)
+	if err != nil {
+		utils.ReportError(err, c, "Server Error while reading response")
+		return
+	}
+
+	handler(d, c)
+}
+
+// Prepare - Validate the variables against the schema of the alert type, filling in any defaults
+func (task *CustomTaskSpec) Prepare() error {
+	vars, err := task.schema.Apply(task.Vars)
+	if err != nil {
+		return err
+	}
+	task.Vars = vars
+	task.ID = taskID(task.Keys())
+	return nil
+}
+
+// Keys - Alert type and app
+func (task *CustomTaskSpec) Keys() []string {
+	return []string{task.Type, task.App}
+}
+
+// TaskVars - Variables saved with the task in Kapacitor
+func (task *CustomTaskSpec) TaskVars() map[string]structs.Var {
+	vars := make(map[string]structs.Var)
+	vars = utils.AddVar("alerttype", task.Type, "string", vars)
+	vars = utils.AddVar("app", task.App, "string", vars)
+	for name, value := range task.Vars {
+		vars = utils.AddVar(name, varString(value), kapacitorTypes[task.schema.Properties[name].Type], vars)
+	}
+	return vars
+}
+
+// Row - Values saved to custom_tasks
+func (task *CustomTaskSpec) Row() []interface{} {
+	vars, _ := json.Marshal(task.Vars)
+	return []interface{}{task.ID, task.Type, task.App, string(vars), task.Slack, task.Post, task.Email}
+}
+
+// ProcessCustomRequest - POST | PATCH /task/custom/:type
+func ProcessCustomRequest(c *gin.Context) {
+	withDescriptor(c, engine.ProcessRequest)
+}
+
+// PreviewCustomTask - POST /task/custom/:type/preview
+func PreviewCustomTask(c *gin.Context) {
+	withDescriptor(c, engine.PreviewTask)
+}
+
+// DeleteCustomTask - DELETE /task/custom/:type/:app
+func DeleteCustomTask(c *gin.Context) {
+	withDescriptor(c, engine.DeleteTask)
+}
+
+// GetCustomTask - GET /task/custom/:type/:app
+func GetCustomTask(c *gin.Context) {
+	withDescriptor(c, engine.GetTask)
+}
+
+// ListCustomTasks - GET /tasks/custom/:type
+func ListCustomTasks(c *gin.Context) {
+	withDescriptor(c, engine.ListTasks)
+}
@@ -1,319 +1,178 @@
 package released
 
 import (
-	"bufio"
-	"bytes"
-	"database/sql"
-	"encoding/json"
 	"errors"
-	"io/ioutil"
+	"kapacitor-alerts-api/engine"
 	structs "kapacitor-alerts-api/structs"
 	"kapacitor-alerts-api/utils"
-	"net/http"
-	"os"
-	"strings"
+	"regexp"
+	"strconv"
 	"text/template"
 
 	"github.com/gin-gonic/gin"
+	"gopkg.in/guregu/null.v3/zero"
 )
 
 const releasealerttemplate = `
+[[define "influx_query"]]
+select text,title,app,tags from [[ dbrp ]]."[[ measurement "events" | influxident ]]" where "app"='[[ .App | influxstr ]]' and "title"= 'released'
+[[end]]
+[[define "alert_message"]]
+{{ index .Fields "app" }} {{ if eq (index .Fields "status") "failed" }}release failed{{ else }}released{{ end }}[[if .Pipeline ]] from pipeline [[ .Pipeline ]][[end]].  New image is {{ index .Fields "text" }}[[if .Previous ]] (previous image was {{ index .Fields "previous" }})[[end]]
+[[end]]
+[[define "alert_details"]]
+<h3>{{ .Message }}</h3>
+{{ index .Fields "app" }} {{ if eq (index .Fields "status") "failed" }}release failed{{ else }}released{{ end }}[[if .Pipeline ]] from pipeline [[ .Pipeline | html ]][[end]].  New image is {{ index .Fields "text" }}[[if .Previous ]] (previous image was {{ index .Fields "previous" }})[[end]]
+[[end]]
+var influx_query string
+var alert_message string
+var alert_details string
+[[if .Options.pipeline ]]
+var pipeline string
+[[end]]
+[[if .Options.space ]]
+var space string
+[[end]]
+[[if .Slack ]]
+var slack string
+[[end]]
+[[if .Post ]]
+var post string
+[[end]]
+[[range .Emails ]]
+var [[ . ]] string
+[[end]]
+
 	batch
-    |	query('''
-				select text,title,app from "opentsdb"."retention_policy"."events" where "app"='[[ .App ]]' and "title"= 'released'
-    	''')
+    |	query(influx_query)
       	.period(60s)
       	.every(61s)
+    [[ releasetags ]]
+    [[if .Options.pipeline ]]
+    |	where(lambda: "pipeline" == pipeline)
+    [[end]]
+    [[if .Options.space ]]
+    |	where(lambda: "space" == space)
+    [[end]]
+    [[if .Options.succeeded ]]
+    |	where(lambda: "status" != 'failed')
+    [[else if .Options.failed ]]
+    |	where(lambda: "status" == 'failed')
+    [[end]]
     | alert()
-        .warn(lambda: 1 > 0)
+        .crit(lambda: "status" == 'failed')
+        .warn(lambda: "status" != 'failed')
         [[if .Slack ]]
         	.slack()
-        	.channel('[[ .Slack ]]')
+        	.channel(slack)
+        [[end]]
+        .message(alert_message)
+        .details(alert_details)
+        [[range .Emails ]]
+        	.email([[ . ]])
         [[end]]
-        .message('{{ index .Fields "app" }} released.  New image is {{ index .Fields "text" }}')
-        .details('''
-					<h3>{{ .Message }}</h3>
-					{{ index .Fields "app" }} released.  New image is {{ index .Fields "text" }}
-				''')
-				[[if .Email]]
-					[[ range $email := .EmailArray ]] 
-						.email('[[ $email ]]')
-					[[end]]
-				[[end]]
-        [[if .Post]]
-        	.post('[[ .Post ]]')
+        [[if .Post ]]
+        	.post(post)
         [[end]]
 `
 
-// getTaskByName - Get a task from the database
-func getTaskByName(app string, c *gin.Context) (*ReleasedDBTask, error) {
-	db, err := utils.GetDBFromContext(c)
-	if err != nil {
-		return nil, errors.New("Unable to access database")
-	}
-
-	task := ReleasedDBTask{}
-
-	err = db.Get(&task, "SELECT * FROM released_tasks WHERE app=$1", app)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, sql.ErrNoRows
-		}
-		return nil, errors.New("Unable to access database")
-	}
-	return &task, nil
-}
-
-// ProcessReleaseRequest - POST | PATCH /task/release
-func ProcessReleaseRequest(c *gin.Context) {
-	var vars map[string]structs.Var
-	vars = make(map[string]structs.Var)
-
-	bodybytes, err := ioutil.ReadAll(c.Request.Body)
-	if err != nil {
-		utils.ReportError(err, c, "Server Error while reading response")
-		return
-	}
-
-	var dbrps []structs.DbrpSpec
-	var dbrp structs.DbrpSpec
-	var task ReleaseTaskSpec
-	err = json.Unmarshal(bodybytes, &task)
-	if err != nil {
-		utils.ReportError(err, c, "Server Error while reading response")
-		return
-	}
-
-	task.ID = task.App + "-release"
-	task.Type = "batch"
-	vars = utils.AddVar("type", task.Type, "string", vars)
-
-	dbrp.Db = "opentsdb"
-	dbrp.Rp = "retention_policy"
-	dbrps = append(dbrps, dbrp)
-	task.Dbrps = dbrps
-	task.Script = ""
-	task.Status = "enabled"
-
-	if !strings.HasPrefix(task.Slack, "#") && !strings.HasPrefix(task.Slack, "@") {
-		task.Slack = "#" + task.Slack
-	}
-
-	task.EmailArray = strings.Split(task.Email, ",")
-
-	t := template.Must(template.New("releasealerttemplate").Delims("[[", "]]").Parse(releasealerttemplate))
-	var sb bytes.Buffer
-	swr := bufio.NewWriter(&sb)
-	err = t.Execute(swr, task)
-	if err != nil {
-		utils.ReportError(err, c, "Server Error while reading response")
-		return
-	}
-
-	swr.Flush()
-	task.Script = string(sb.Bytes())
-	vars = utils.AddVar("app", task.App, "string", vars)
-	vars = utils.AddVar("slack", task.Slack, "string", vars)
-	vars = utils.AddVar("post", task.Post, "string", vars)
-	vars = utils.AddVar("email", task.Email, "string", vars)
-
-	task.Vars = vars
-
-	bodybytes, err = json.Marshal(task)
-	if err != nil {
-		utils.ReportError(err, c, "Server Error while reading response")
-		return
-	}
-
-	if c.Request.Method == "POST" {
-		err = createReleaseTask(task, c)
-		if err != nil {
-			utils.ReportError(err, c, "")
-			return
+var pipelineRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+var spaceRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+var descriptor = engine.Register(&engine.Descriptor{
+	Name:     "release",
+	Table:    "released_tasks",
+	Params:   []string{"app"},
+	Columns:  []string{"app"},
+	Template: releasealerttemplate,
+	Funcs:    template.FuncMap{"releasetags": utils.ReleaseTagsEval},
+	ID:       func(keys []string) string { return keys[0] + "-release" },
+	Pattern:  regexp.MustCompile(`-release$`),
+	NewSpec:  func() engine.Spec { return &ReleaseTaskSpec{} },
+	FromVars: func(vars map[string]structs.Var) engine.Spec {
+		return &ReleaseTaskSpec{
+			App:      engine.StringVar(vars, "app"),
+			Pipeline: engine.StringVar(vars, "pipeline"),
+			Space:    engine.StringVar(vars, "space"),
+			Outcome:  engine.StringVar(vars, "outcome"),
+			Previous: engine.BoolVar(vars, "previous"),
 		}
-	}
+	},
+	Model: ReleasedDBTask{},
+})
 
-	if c.Request.Method == "PATCH" {
-		// Check if task exists before trying to patch it
-		_, err := getTaskByName(task.App, c)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				c.JSON(404, nil)
-			} else {
-				utils.ReportError(err, c, "")
-			}
-			return
-		}
-
-		err = deleteReleaseTask(task.App, c)
-		if err != nil {
-			utils.ReportError(err, c, "")
-			return
-		}
-
-		err = createReleaseTask(task, c)
-		if err != nil {
-			utils.ReportError(err, c, "")
-			return
-		}
-	}
-
-	c.String(201, "")
-}
-
-// deleteReleaseTask - Delete a task from Kapacitor and remove its config from the database
-func deleteReleaseTask(app string, c *gin.Context) error {
-	db, err := utils.GetDBFromContext(c)
-	if err != nil {
-		return errors.New("Unable to access database")
-	}
-
-	client := http.Client{}
-	req, err := http.NewRequest("DELETE", os.Getenv("KAPACITOR_URL")+"/kapacitor/v1/tasks/"+app+"-release", nil)
-	if err != nil {
-		return errors.New("Server Error while reading response")
+// Prepare - Validate the pipeline, space, and outcome filters
+func (task *ReleaseTaskSpec) Prepare() error {
+	// Optionally only alert on releases promoted through a pipeline
+	if task.Pipeline != "" && !pipelineRegex.MatchString(task.Pipeline) {
+		return errors.New("Invalid pipeline name " + task.Pipeline)
 	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return errors.New("Server Error while reading response")
+	// Optionally only alert on releases in a space
+	if task.Space != "" && !spaceRegex.MatchString(task.Space) {
+		return errors.New("Invalid space name " + task.Space)
 	}
 
-	defer resp.Body.Close()
-	bodybytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return errors.New("Server Error while reading response")
+	// Alert on all releases (default), or only successful or failed ones
+	if task.Outcome == "" {
+		task.Outcome = "all"
 	}
-
-	if resp.StatusCode != 204 {
-		var er structs.ErrorResponse
-		err = json.Unmarshal(bodybytes, &er)
-		if err != nil {
-			return errors.New("Server Error while reading response")
-		}
-		return errors.New(er.Error)
+	if task.Outcome != "all" && task.Outcome != "succeeded" && task.Outcome != "failed" {
+		return errors.New("Outcome must be one of all, succeeded, or failed")
 	}
-
-	_, err = db.Exec("DELETE FROM released_tasks WHERE app=$1", app)
-	if err != nil {
-		return errors.New("Unable to access database")
-	}
-
 	return nil
 }
 
-// createReleaseTask - Create a task in Kapacitor and save its config to the database
-func createReleaseTask(task ReleaseTaskSpec, c *gin.Context) error {
-	db, err := utils.GetDBFromContext(c)
-	if err != nil {
-		return errors.New("Unable to access database")
-	}
-
-	client := http.Client{}
-
-	p, err := json.Marshal(task)
-	if err != nil {
-		return errors.New("Server Error while reading response")
-	}
-
-	req, err := http.NewRequest("POST", os.Getenv("KAPACITOR_URL")+"/kapacitor/v1/tasks", bytes.NewBuffer(p))
-	if err != nil {
-		return errors.New("Server Error while reading response")
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return errors.New("Server Error while reading response")
-	}
+// Options - Filters on the pipeline, space, and outcome of the release
+func (task *ReleaseTaskSpec) Options() map[string]bool {
+	return map[string]bool{"pipeline": task.Pipeline != "", "space": task.Space != "", "succeeded": task.Outcome == "succeeded", "failed": task.Outcome == "failed"}
+}
 
-	defer resp.Body.Close()
-	bodybytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return errors.New("Server Error while reading response")
-	}
+// Keys - App
+func (task *ReleaseTaskSpec) Keys() []string {
+	return []string{task.App}
+}
 
-	if resp.StatusCode != 200 {
-		var er structs.ErrorResponse
-		err = json.Unmarshal(bodybytes, &er)
-		if err != nil {
-			return errors.New("Server Error while reading response")
-		}
-		return errors.New(er.Error)
-	}
+// TaskVars - Variables saved with the task in Kapacitor
+func (task *ReleaseTaskSpec) TaskVars() map[string]structs.Var {
+	vars := make(map[string]structs.Var)
+	vars = utils.AddVar("app", task.App, "string", vars)
+	vars = utils.AddVar("pipeline", task.Pipeline, "string", vars)
+	vars = utils.AddVar("space", task.Space, "string", vars)
+	vars = utils.AddVar("outcome", task.Outcome, "string", vars)
+	vars = utils.AddVar("previous", strconv.FormatBool(task.Previous), "bool", vars)
+	return vars
+}
 
-	_, err = db.Exec(
-		"INSERT INTO released_tasks VALUES ($1, $2, $3, $4)",
+// Row - Values saved to released_tasks
+func (task *ReleaseTaskSpec) Row() []interface{} {
+	return []interface{}{
 		task.App, task.Slack, task.Post, task.Email,
-	)
-
-	if err != nil {
-		return errors.New("Unable to save to database")
+		zero.StringFrom(task.Pipeline), task.Outcome, task.Previous, zero.StringFrom(task.Space),
 	}
+}
 
-	return nil
+// ProcessReleaseRequest - POST | PATCH /task/release
+func ProcessReleaseRequest(c *gin.Context) {
+	engine.ProcessRequest(descriptor, c)
+}
+
+// PreviewReleaseTask - POST /task/release/preview
+func PreviewReleaseTask(c *gin.Context) {
+	engine.PreviewTask(descriptor, c)
 }
 
 // DeleteReleaseTask - DELETE /task/release/:app
 func DeleteReleaseTask(c *gin.Context) {
-	app := c.Param("app")
-
-	// Check if task exists before trying to delete it
-	_, err := getTaskByName(app, c)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(404, nil)
-		} else {
-			utils.ReportError(err, c, "")
-		}
-		return
-	}
-
-	// Delete the task from Kapacitor and remove the config from the database
-	err = deleteReleaseTask(app, c)
-	if err != nil {
-		utils.ReportError(err, c, "")
-	} else {
-		c.String(200, "")
-	}
+	engine.DeleteTask(descriptor, c)
 }
 
 // GetReleaseTask - GET /task/release/:app
 func GetReleaseTask(c *gin.Context) {
-	app := c.Param("app")
-
-	task, err := getTaskByName(app, c)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(404, nil)
-		} else {
-			utils.ReportError(err, c, "")
-		}
-		return
-	}
-
-	c.JSON(200, task)
+	engine.GetTask(descriptor, c)
 }
 
 // ListReleaseTasks - GET /tasks/release
 func ListReleaseTasks(c *gin.Context) {
-	db, err := utils.GetDBFromContext(c)
-	if err != nil {
-		utils.ReportError(err, c, "Unable to access database")
-		return
-	}
-
-	tasks := []ReleasedDBTask{}
-
-	err = db.Select(&tasks, "SELECT * FROM released_tasks ORDER BY app ASC")
-	if err != nil {
-		utils.ReportError(err, c, "Unable to access database")
-		return
-	}
-
-	if len(tasks) == 0 {
-		c.JSON(200, nil)
-		return
-	}
-
-	c.JSON(200, tasks)
+	engine.ListTasks(descriptor, c)
 }
@@ -3,11 +3,13 @@ package released
 import (
 	"bytes"
 	"encoding/json"
+	"kapacitor-alerts-api/config"
+	"kapacitor-alerts-api/engine"
+	"kapacitor-alerts-api/engine/enginetest"
 	"kapacitor-alerts-api/utils"
 	"log"
 	"net/http"
 	"net/http/httptest"
-	"os"
 	"testing"
 
 	"gopkg.in/guregu/null.v3/zero"
@@ -23,6 +25,7 @@ import (
 *    ---------------------------------------------------
 *    POST     /task/release         TestCreateReleasedTask
 *    PATCH    /task/release         TestUpdateReleasedTask
+*    POST     /task/release/preview TestHostileReleaseInput
 *    DELETE   /task/release/:app    TestDeleteReleasedTask
 *    GET      /tasks/release        TestCreateReleasedTask
 *    GET      /task/release/:app    TestCreateReleasedTask
@@ -30,18 +33,27 @@ import (
 
 // setupRouter - Setup Gin routes for current test type
 func setupRouter() *gin.Engine {
-	pool := utils.GetDB(os.Getenv("DATABASE_URL"))
+	cfg, err := config.Load()
+	if err != nil {
+		log.Panicln(err)
+	}
+	pool := utils.GetDB(cfg.Database)
 	if pool == nil {
 		log.Panicln("Unable to connect to database")
 	}
+	if err := engine.Configure(cfg); err != nil {
+		log.Panicln(err)
+	}
 
 	router := gin.Default()
 	gin.SetMode(gin.DebugMode)
 	router.Use(utils.DBMiddleware(pool))
+	router.Use(config.Middleware(cfg))
 
 	router.POST("/task/release", ProcessReleaseRequest)
 	router.GET("/task/release/:app", GetReleaseTask)
 	router.PATCH("/task/release", ProcessReleaseRequest)
+	router.POST("/task/release/preview", PreviewReleaseTask)
 	router.DELETE("/task/release/:app", DeleteReleaseTask)
 	router.GET("/tasks/release", ListReleaseTasks)
 
@@ -116,9 +128,17 @@ func TestUpdateReleasedTask(t *testing.T) {
 	// Create a task with updated information
 	// Slack - #cobra => nil
 	// Post - nil => http://example.com/
+	// Pipeline - nil => voltron-pipeline
+	// Space - nil => voltron-space
+	// Outcome - all => failed
+	// Previous - false => true
 	var task ReleasedDBTask
 	task.App = "gotest-voltron"
 	task.Post = zero.StringFrom("http://example.com/")
+	task.Pipeline = zero.StringFrom("voltron-pipeline")
+	task.Space = zero.StringFrom("voltron-space")
+	task.Outcome = "failed"
+	task.Previous = true
 	taskBytes, err := json.Marshal(task)
 	assert.Nil(t, err, "Converting from ReleasedDBTask to JSON should not throw an error")
 
@@ -146,6 +166,10 @@ func TestUpdateReleasedTask(t *testing.T) {
 	assert.Equal(t, returnedTask.Slack, task.Slack, "Task slack should match")
 	assert.Equal(t, returnedTask.Email, task.Email, "Task email should match")
 	assert.Equal(t, returnedTask.Post, task.Post, "Task post should match")
+	assert.Equal(t, returnedTask.Pipeline, task.Pipeline, "Task pipeline should match")
+	assert.Equal(t, returnedTask.Space, task.Space, "Task space should match")
+	assert.Equal(t, returnedTask.Outcome, task.Outcome, "Task outcome should match")
+	assert.Equal(t, returnedTask.Previous, task.Previous, "Task previous should match")
 }
 
 // TestDeleteReleasedTask - Make sure that deleting a released task works and that we cannot access it anymore
@@ -166,3 +190,13 @@ func TestDeleteReleasedTask(t *testing.T) {
 
 	assert.Equal(t, http.StatusNotFound, w.Code, "HTTP response code for GET /task/release/:app on invalid app should be 404")
 }
+
+// TestHostileReleaseInput - Make sure that user input is passed through vars or escaped in the rendered query, or rejected if it cannot be
+func TestHostileReleaseInput(t *testing.T) {
+	inputs := append(enginetest.HostileNotify(""),
+		enginetest.Accepted("dot in app", `{"app":"gotest.hostile"}`, [2]string{"influx_query", `"app"='gotest.hostile'`}),
+		enginetest.Rejected("quote in pipeline", `{"app":"gotest-hostile","pipeline":"prod') |log("}`),
+		enginetest.Rejected("quote in space", `{"app":"gotest-hostile","space":"prod' || true"}`),
+	)
+	enginetest.CheckHostileInputs(t, PreviewReleaseTask, inputs)
+}
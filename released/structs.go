@@ -1,70 +1,29 @@
 package released
 
 import (
-	structs "kapacitor-alerts-api/structs"
+	"kapacitor-alerts-api/engine"
 
 	"gopkg.in/guregu/null.v3/zero"
 )
 
-type ReleaseVars struct {
-	App struct {
-		Type        string `json:"type"`
-		Value       string `json:"value"`
-		Description string `json:"description"`
-	} `json:"app"`
-	ID struct {
-		Type        string `json:"type"`
-		Value       string `json:"value"`
-		Description string `json:"description"`
-	} `json:"id"`
-	Slack struct {
-		Type        string `json:"type"`
-		Value       string `json:"value"`
-		Description string `json:"description"`
-	} `json:"slack"`
-	Type struct {
-		Type        string `json:"type"`
-		Value       string `json:"value"`
-		Description string `json:"description"`
-	} `json:"type"`
-	Email struct {
-		Type        string `json:"type"`
-		Value       string `json:"value"`
-		Description string `json:"description"`
-	} `json:"email"`
-	Post struct {
-		Type        string `json:"type"`
-		Value       string `json:"value"`
-		Description string `json:"description"`
-	} `json:"post"`
-}
-
-type ReleaseTaskList struct {
-	Tasks []struct {
-		ID   string      `json:"id"`
-		Vars ReleaseVars `json:"vars"`
-	} `json:"tasks"`
-}
-
+// ReleaseTaskSpec - Used to create or update a release task
 type ReleaseTaskSpec struct {
-	ID         string             `json:"id"`
-	Type       string             `json:"type"`
-	Dbrps      []structs.DbrpSpec `json:"dbrps"`
-	Status     string             `json:"status"`
-	Script     string             `json:"script"`
-	App        string             `json:"app"`
-	Slack      string             `json:"slack"`
-	Post       string             `json:"post"`
-	Email      string             `json:"email"`
-	EmailArray []string           `json:"emailarray"`
-	//    Opsgenie string         `json:"opsgenie"`
-	Vars map[string]structs.Var `json:"vars"`
+	App      string `json:"app"`
+	Pipeline string `json:"pipeline"`
+	Outcome  string `json:"outcome"`
+	Previous bool   `json:"previous"`
+	Space    string `json:"space"`
+	engine.Notify
 }
 
 // ReleasedDBTask - Used for retrieval of task information from the database
 type ReleasedDBTask struct {
-	App   string      `json:"app"`
-	Slack zero.String `json:"slack"`
-	Post  zero.String `json:"post"`
-	Email zero.String `json:"email"`
+	App      string      `json:"app"`
+	Slack    zero.String `json:"slack"`
+	Post     zero.String `json:"post"`
+	Email    zero.String `json:"email"`
+	Pipeline zero.String `json:"pipeline"`
+	Outcome  string      `json:"outcome"`
+	Previous bool        `json:"previous"`
+	Space    zero.String `json:"space"`
 }
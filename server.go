@@ -1,71 +1,194 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	_4xx "kapacitor-alerts-api/4xx"
 	_5xx "kapacitor-alerts-api/5xx"
+	"kapacitor-alerts-api/config"
+	cpu "kapacitor-alerts-api/cpu"
 	crashed "kapacitor-alerts-api/crashed"
+	deadman "kapacitor-alerts-api/deadman"
+	"kapacitor-alerts-api/engine"
+	event "kapacitor-alerts-api/event"
+	latency "kapacitor-alerts-api/latency"
 	memory "kapacitor-alerts-api/memory"
+	registry "kapacitor-alerts-api/registry"
 	released "kapacitor-alerts-api/released"
 	utils "kapacitor-alerts-api/utils"
 
+	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
 )
 
-// checkEnv - Verify required environment variables exist
-func checkEnv() {
-	_, dbURL := os.LookupEnv("DATABASE_URL")
-	_, kapURL := os.LookupEnv("KAPACITOR_URL")
-
-	if !dbURL {
-		panic("✖ Environment variable DATABASE_URL not found.")
-	} else if !kapURL {
-		panic("✖ Environment variable KAPACITOR_URL not found.")
+func main() {
+	// Read the settings from $CONFIG_FILE and the environment
+	cfg, err := config.Load()
+	if err != nil {
+		panic("✖ " + err.Error())
 	}
-}
 
-func main() {
-	checkEnv()
+	// Load the Kapacitor instances that tasks are deployed to, and where the metrics queried by alert types are
+	// stored in InfluxDB
+	if err := engine.Configure(cfg); err != nil {
+		panic("✖ " + err.Error())
+	}
 
-	pool := utils.GetDB(os.Getenv("DATABASE_URL"))
+	pool := utils.GetDB(cfg.Database)
 
-	_, migrate := os.LookupEnv("RUN_MIGRATION")
-	if migrate {
-		fmt.Println("Detected $RUN_MIGRATION environment variable")
+	if cfg.RunMigration {
+		fmt.Println("Detected run_migration setting")
 		runMigration(pool)
 	} else {
 		utils.InitDB(pool)
 	}
 
+	// Load alert templates from the template directory, keeping the embedded defaults if any are invalid
+	if cfg.TemplateDir != "" {
+		engine.ReloadTemplates(cfg.TemplateDir)
+	}
+
+	// Pin the templates of any alert types being rolled out, so only the chosen tasks run the canary
+	ctx, cancel := utils.BackgroundDBContext(cfg.Database)
+	if err := engine.LoadCanaries(ctx, pool); err != nil {
+		log.Println("✖ " + err.Error())
+	}
+	cancel()
+
+	// Keep writing the tasks of failed over Kapacitor instances to their standbys
+	ctx, cancel = utils.BackgroundDBContext(cfg.Database)
+	if err := engine.LoadFailovers(ctx, pool); err != nil {
+		log.Println("✖ " + err.Error())
+	}
+	cancel()
+
+	// Registered alert types are stored in the database, so the engine looks them up there to redeploy them
+	engine.Registered = registry.Descriptors
+
+	// Bring existing tasks up to date with the templates of this version
+	if cfg.Features.DeployTemplates {
+		engine.DeployTemplates(context.Background(), pool)
+	}
+
+	// Reload alert templates on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if _, err := engine.ReloadTemplates(cfg.TemplateDir); err == nil && cfg.Features.DeployTemplates {
+				engine.DeployTemplates(context.Background(), pool)
+			}
+		}
+	}()
+
 	router := gin.Default()
 	router.Use(utils.DBMiddleware(pool))
+	router.Use(config.Middleware(cfg))
 
 	router.POST("/task/memory", memory.ProcessInstanceMemoryRequest)
 	router.PATCH("/task/memory", memory.ProcessInstanceMemoryRequest)
+	router.POST("/task/memory/preview", memory.PreviewMemoryTask)
 	router.DELETE("/task/memory/:app/:dyno", memory.DeleteMemoryTask)
 	router.GET("/tasks/memory/:app", memory.GetMemoryTasksForApp)
 	router.GET("/tasks/memory/:app/:dyno", memory.GetMemoryTask)
 	router.GET("/tasks/memory", memory.ListMemoryTasks)
 
+	router.POST("/task/cpu", cpu.ProcessInstanceCPURequest)
+	router.PATCH("/task/cpu", cpu.ProcessInstanceCPURequest)
+	router.POST("/task/cpu/preview", cpu.PreviewCPUTask)
+	router.DELETE("/task/cpu/:app/:dyno", cpu.DeleteCPUTask)
+	router.GET("/tasks/cpu/:app", cpu.GetCPUTasksForApp)
+	router.GET("/tasks/cpu/:app/:dyno", cpu.GetCPUTask)
+	router.GET("/tasks/cpu", cpu.ListCPUTasks)
+
 	router.POST("/task/5xx", _5xx.Process5xxRequest)
 	router.PATCH("/task/5xx", _5xx.Process5xxRequest)
+	router.POST("/task/5xx/preview", _5xx.Preview5xxTask)
 	router.DELETE("/task/5xx/:app", _5xx.Delete5xxTask)
 	router.GET("/task/5xx/:app", _5xx.Get5xxTask)
 	router.GET("/task/5xx/:app/state", _5xx.Get5xxTaskState)
 	router.GET("/tasks/5xx", _5xx.List5xxTasks)
 
+	router.POST("/task/4xx", _4xx.Process4xxRequest)
+	router.PATCH("/task/4xx", _4xx.Process4xxRequest)
+	router.POST("/task/4xx/preview", _4xx.Preview4xxTask)
+	router.DELETE("/task/4xx/:app", _4xx.Delete4xxTask)
+	router.GET("/task/4xx/:app", _4xx.Get4xxTask)
+	router.GET("/task/4xx/:app/state", _4xx.Get4xxTaskState)
+	router.GET("/tasks/4xx", _4xx.List4xxTasks)
+
+	router.POST("/task/latency", latency.ProcessLatencyRequest)
+	router.PATCH("/task/latency", latency.ProcessLatencyRequest)
+	router.POST("/task/latency/preview", latency.PreviewLatencyTask)
+	router.DELETE("/task/latency/:app", latency.DeleteLatencyTask)
+	router.GET("/task/latency/:app", latency.GetLatencyTask)
+	router.GET("/task/latency/:app/state", latency.GetLatencyTaskState)
+	router.GET("/tasks/latency", latency.ListLatencyTasks)
+
+	router.POST("/task/deadman", deadman.ProcessDeadmanRequest)
+	router.PATCH("/task/deadman", deadman.ProcessDeadmanRequest)
+	router.POST("/task/deadman/preview", deadman.PreviewDeadmanTask)
+	router.DELETE("/task/deadman/:app", deadman.DeleteDeadmanTask)
+	router.GET("/task/deadman/:app", deadman.GetDeadmanTask)
+	router.GET("/task/deadman/:app/state", deadman.GetDeadmanTaskState)
+	router.GET("/tasks/deadman", deadman.ListDeadmanTasks)
+
 	router.POST("/task/release", released.ProcessReleaseRequest)
 	router.GET("/task/release/:app", released.GetReleaseTask)
 	router.PATCH("/task/release", released.ProcessReleaseRequest)
+	router.POST("/task/release/preview", released.PreviewReleaseTask)
 	router.DELETE("/task/release/:app", released.DeleteReleaseTask)
 	router.GET("/tasks/release", released.ListReleaseTasks)
 
 	router.POST("/task/crashed", crashed.ProcessCrashedRequest)
 	router.GET("/task/crashed/:app", crashed.GetCrashedTask)
+	router.GET("/task/crashed/:app/history", crashed.GetCrashedTaskHistory)
 	router.PATCH("/task/crashed", crashed.ProcessCrashedRequest)
+	router.POST("/task/crashed/preview", crashed.PreviewCrashedTask)
 	router.DELETE("/task/crashed/:app", crashed.DeleteCrashedTask)
 	router.GET("/tasks/crashed", crashed.ListCrashedTasks)
 
-	router.Run()
+	router.POST("/task/event", event.ProcessEventRequest)
+	router.GET("/task/event/:app", event.GetEventTask)
+	router.PATCH("/task/event", event.ProcessEventRequest)
+	router.POST("/task/event/preview", event.PreviewEventTask)
+	router.DELETE("/task/event/:app", event.DeleteEventTask)
+	router.GET("/tasks/event", event.ListEventTasks)
+
+	router.POST("/type", registry.ProcessAlertTypeRequest)
+	router.PATCH("/type", registry.ProcessAlertTypeRequest)
+	router.DELETE("/type/:name", registry.DeleteAlertType)
+	router.GET("/type/:name", registry.GetAlertType)
+	router.GET("/types", registry.ListAlertTypes)
+
+	// Registered alert types live under /task/custom, as gin cannot mix a /task/:type wildcard with the routes above
+	router.POST("/task/custom/:type", registry.ProcessCustomRequest)
+	router.PATCH("/task/custom/:type", registry.ProcessCustomRequest)
+	router.POST("/task/custom/:type/preview", registry.PreviewCustomTask)
+	router.DELETE("/task/custom/:type/:app", registry.DeleteCustomTask)
+	router.GET("/task/custom/:type/:app", registry.GetCustomTask)
+	router.GET("/tasks/custom/:type", registry.ListCustomTasks)
+
+	if cfg.Features.Admin {
+		router.GET("/admin/templates", engine.GetTemplates)
+		router.POST("/admin/templates/reload", engine.ProcessTemplateReload)
+		router.POST("/admin/redeploy", engine.ProcessRedeploy)
+		router.GET("/admin/redeploy/:id", engine.GetRedeployStatus)
+		router.GET("/admin/instances", engine.GetInstances)
+		router.POST("/admin/move", engine.ProcessMove)
+		router.GET("/admin/failover", engine.GetFailovers)
+		router.POST("/admin/failover", engine.ProcessFailover)
+		router.DELETE("/admin/failover/:instance", engine.ProcessFailBack)
+		router.GET("/admin/canary", engine.GetCanaries)
+		router.GET("/admin/canary/:type", engine.GetCanaries)
+		router.POST("/admin/canary", engine.ProcessCanary)
+		router.POST("/admin/canary/:type/promote", engine.ProcessCanaryPromote)
+		router.POST("/admin/canary/:type/rollback", engine.ProcessCanaryRollback)
+	}
+
+	router.Run(":" + cfg.Port)
 }
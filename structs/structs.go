@@ -10,7 +10,45 @@ type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
+// ScriptErrorResponse - A TICKscript rejected by Kapacitor, with the line of the rendered template at fault
+type ScriptErrorResponse struct {
+	Error string `json:"error"`
+	Line  int    `json:"line,omitempty"`
+	Text  string `json:"text,omitempty"`
+}
+
 type DbrpSpec struct {
 	Db string `json:"db"`
 	Rp string `json:"rp"`
 }
+
+// TaskState - Alert topics of a task in Kapacitor
+type TaskState struct {
+	Link struct {
+		Rel  string `json:"rel"`
+		Href string `json:"href"`
+	} `json:"link"`
+	Topics []struct {
+		Link struct {
+			Rel  string `json:"rel"`
+			Href string `json:"href"`
+		} `json:"link"`
+		ID         string `json:"id"`
+		Level      string `json:"level"`
+		Collected  int    `json:"collected"`
+		EventsLink struct {
+			Rel  string `json:"rel"`
+			Href string `json:"href"`
+		} `json:"events-link"`
+		HandlersLink struct {
+			Rel  string `json:"rel"`
+			Href string `json:"href"`
+		} `json:"handlers-link"`
+	} `json:"topics"`
+}
+
+// SimpleTaskState - The current alert level of a task
+type SimpleTaskState struct {
+	App   string `json:"app"`
+	State string `json:"state"`
+}
@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+)
+
+// AppParts - The parts of an Akkeris app name (app-space or app--dynotype-space)
+type AppParts struct {
+	App      string `json:"app"`
+	Dynotype string `json:"dynotype"`
+	Space    string `json:"space"`
+}
+
+// ParseAppName - Split a full Akkeris app name into its app, dynotype, and space
+func ParseAppName(full string) AppParts {
+	var parts AppParts
+	if strings.Contains(full, "--") {
+		parts.App = strings.Split(full, "--")[0]
+		rest := strings.Split(strings.Split(full, "--")[1], "-")
+		parts.Dynotype = rest[0]
+		parts.Space = strings.Join(rest[1:], "-")
+	} else {
+		parts.App = strings.Split(full, "-")[0]
+		parts.Dynotype = "web"
+		parts.Space = strings.Join(strings.Split(full, "-")[1:], "-")
+	}
+	return parts
+}
+
+// parseTags - Split the comma separated tags of an Akkeris event into the given fields (in order).
+// The last field may contain commas, and fields that are not present are empty.
+func parseTags(tags string, fields []string) map[string]string {
+	values := make(map[string]string)
+	parts := strings.SplitN(tags, ",", len(fields))
+	for i, part := range parts {
+		values[fields[i]] = part
+	}
+	return values
+}
+
+// tagsEval - TICKscript eval node that parses the tags of an Akkeris event into the same fields as
+// parseTags, except app (which is already a field of the event)
+func tagsEval(fields []string) string {
+	var lambdas, names []string
+	for i, name := range fields {
+		if name == "app" {
+			continue
+		}
+		// Skip the fields before this one and capture this one - the last field may contain commas.
+		// Fields that are not present match the second alternative and are set to an empty string.
+		capture := "([^,]*).*"
+		if i == len(fields)-1 {
+			capture = "(.*)"
+		}
+		pattern := "^(?:[^,]*,){" + strconv.Itoa(i) + "}" + capture + "$|^.*$"
+		lambdas = append(lambdas, "lambda: regexReplace(/"+pattern+"/, \"tags\", '$1')")
+		names = append(names, "'"+name+"'")
+	}
+	return "|\teval(\n\t\t\t\t\t" + strings.Join(lambdas, ",\n\t\t\t\t\t") + "\n\t\t\t\t)\n" +
+		"\t\t\t\t.as(" + strings.Join(names, ", ") + ")\n" +
+		"\t\t\t\t.keep()"
+}
+
+// CrashTagFields - Fields present (in order) in the comma separated tags of an Akkeris crash event.
+// Exit code and reason are only present on some events.
+var CrashTagFields = []string{"space", "app", "dynotype", "dyno", "exitcode", "reason"}
+
+// CrashDetails - Structured information about an Akkeris crash event
+type CrashDetails struct {
+	Space    string `json:"space"`
+	App      string `json:"app"`
+	Dynotype string `json:"dynotype"`
+	Dyno     string `json:"dyno"`
+	ExitCode string `json:"exitcode,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// ParseCrashTags - Parse the tags of an Akkeris crash event into structured details
+func ParseCrashTags(tags string) CrashDetails {
+	values := parseTags(tags, CrashTagFields)
+	return CrashDetails{
+		Space:    values["space"],
+		App:      values["app"],
+		Dynotype: values["dynotype"],
+		Dyno:     values["dyno"],
+		ExitCode: values["exitcode"],
+		Reason:   values["reason"],
+	}
+}
+
+// CrashTagsEval - TICKscript eval node that parses the tags of an Akkeris crash event into the same
+// fields as ParseCrashTags for use in alert messages
+func CrashTagsEval() string {
+	return tagsEval(CrashTagFields)
+}
+
+// ReleaseTagFields - Fields present (in order) in the comma separated tags of an Akkeris release event.
+// Pipeline is only present on releases promoted through a pipeline, and status defaults to succeeded.
+var ReleaseTagFields = []string{"space", "app", "previous", "pipeline", "status"}
+
+// ReleaseDetails - Structured information about an Akkeris release event
+type ReleaseDetails struct {
+	Space    string `json:"space"`
+	App      string `json:"app"`
+	Previous string `json:"previous"`
+	Pipeline string `json:"pipeline,omitempty"`
+	Status   string `json:"status"`
+}
+
+// ParseReleaseTags - Parse the tags of an Akkeris release event into structured details
+func ParseReleaseTags(tags string) ReleaseDetails {
+	values := parseTags(tags, ReleaseTagFields)
+	details := ReleaseDetails{
+		Space:    values["space"],
+		App:      values["app"],
+		Previous: values["previous"],
+		Pipeline: values["pipeline"],
+		Status:   values["status"],
+	}
+	if details.Status == "" {
+		details.Status = "succeeded"
+	}
+	return details
+}
+
+// ReleaseTagsEval - TICKscript eval node that parses the tags of an Akkeris release event into the same
+// fields as ParseReleaseTags for use in filters and alert messages
+func ReleaseTagsEval() string {
+	return tagsEval(ReleaseTagFields)
+}
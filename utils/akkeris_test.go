@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestParseAppName - Make sure that app names with and without a dynotype are split correctly
+func TestParseAppName(t *testing.T) {
+	parts := ParseAppName("voltron-default")
+	assert.Equal(t, AppParts{App: "voltron", Dynotype: "web", Space: "default"}, parts, "App without a dynotype should default to web")
+
+	parts = ParseAppName("voltron--worker-my-space")
+	assert.Equal(t, AppParts{App: "voltron", Dynotype: "worker", Space: "my-space"}, parts, "App with a dynotype should be split on --")
+}
+
+// TestParseCrashTags - Make sure that crash event tags are parsed into structured details
+func TestParseCrashTags(t *testing.T) {
+	details := ParseCrashTags("default,voltron,web,web.1234,137,OOMKilled, out of memory")
+	assert.Equal(t, "default", details.Space, "Space should match")
+	assert.Equal(t, "voltron", details.App, "App should match")
+	assert.Equal(t, "web", details.Dynotype, "Dynotype should match")
+	assert.Equal(t, "web.1234", details.Dyno, "Dyno should match")
+	assert.Equal(t, "137", details.ExitCode, "Exit code should match")
+	assert.Equal(t, "OOMKilled, out of memory", details.Reason, "Reason should keep any commas")
+
+	details = ParseCrashTags("default,voltron,web,web.1234")
+	assert.Equal(t, "web.1234", details.Dyno, "Dyno should match")
+	assert.Equal(t, "", details.ExitCode, "Exit code should be empty when not present")
+	assert.Equal(t, "", details.Reason, "Reason should be empty when not present")
+}
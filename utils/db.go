@@ -1,27 +1,29 @@
 package utils
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"kapacitor-alerts-api/config"
 	"log"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq" //driver
 )
 
-//GetDB centralized access point
-func GetDB(uri string) *sqlx.DB {
-	db, dberr := sqlx.Open("postgres", uri)
+//GetDB centralized access point, with the connection pool of the configuration
+func GetDB(cfg config.Database) *sqlx.DB {
+	db, dberr := sqlx.Open("postgres", cfg.URL)
 	if dberr != nil {
 		fmt.Println(dberr)
 		return nil
 	}
-	// not available in 1.5 golang, youll want to turn it on for v1.6 or higher once upgraded.
-	//pool.SetConnMaxLifetime(time.ParseDuration("1h"));
-	db.SetMaxIdleConns(4)
-	db.SetMaxOpenConns(20)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetConnMaxLifetime(time.Duration(cfg.ConnMaxLifetime))
 	return db
 }
 
@@ -34,6 +36,35 @@ func GetDBFromContext(c *gin.Context) (*sqlx.DB, error) {
 	return db.(*sqlx.DB), nil
 }
 
+// DBContext - Context of the database queries of a request, cancelled when the client goes away or the configured
+// database timeout passes
+func DBContext(c *gin.Context) (context.Context, context.CancelFunc) {
+	cfg, err := config.FromContext(c)
+	if err != nil || cfg.Database.Timeout == 0 {
+		return context.WithCancel(c.Request.Context())
+	}
+	return context.WithTimeout(c.Request.Context(), time.Duration(cfg.Database.Timeout))
+}
+
+// BackgroundDBContext - Context of database queries made outside of a request (e.g. at startup), cancelled once
+// the configured database timeout passes
+func BackgroundDBContext(cfg config.Database) (context.Context, context.CancelFunc) {
+	if cfg.Timeout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), time.Duration(cfg.Timeout))
+}
+
+// DetachedDBContext - Context of database writes that must finish even if the client of the request goes away,
+// cancelled once the configured database timeout passes
+func DetachedDBContext(c *gin.Context) (context.Context, context.CancelFunc) {
+	cfg, err := config.FromContext(c)
+	if err != nil {
+		return context.WithCancel(context.Background())
+	}
+	return BackgroundDBContext(cfg.Database)
+}
+
 // DBMiddleware - Add a SQL database connection to the Gin context
 func DBMiddleware(db *sqlx.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
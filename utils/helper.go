@@ -10,7 +10,7 @@ import (
 func AddVar(name string, value string, vtype string, flistin map[string]structs.Var) (flistout map[string]structs.Var) {
 	if value != "" {
 		var var1 structs.Var
-		if vtype == "string" {
+		if vtype == "string" || vtype == "duration" {
 			var1.Value = value
 		}
 		if vtype == "int" {
@@ -21,6 +21,10 @@ func AddVar(name string, value string, vtype string, flistin map[string]structs.
 			floatvalue, _ := strconv.ParseFloat(value, 64)
 			var1.Value = floatvalue
 		}
+		if vtype == "bool" {
+			boolvalue, _ := strconv.ParseBool(value)
+			var1.Value = boolvalue
+		}
 		var1.Type = vtype
 		var1.Description = name
 		flistin[name] = var1
@@ -8,8 +8,25 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-// ReportError - Send an error message to the client
+// UnreachableError - A service that did not respond in time, such as a Kapacitor instance. Reported to the client
+// as a 504 gateway timeout.
+type UnreachableError struct {
+	Service string
+	Err     error
+}
+
+func (e *UnreachableError) Error() string {
+	return e.Service + " is unreachable: " + e.Err.Error()
+}
+
+// ReportError - Send an error message to the client, or a 504 if a service it depends on is unreachable
 func ReportError(err error, c *gin.Context, msg string) {
+	if ue, ok := err.(*UnreachableError); ok {
+		ReportGatewayTimeout(c, ue.Service+" is unreachable")
+		log.Println(err)
+		return
+	}
+
 	var er structs.ErrorResponse
 	if msg != "" {
 		er.Error = msg
@@ -29,3 +46,31 @@ func ReportInvalidRequest(c *gin.Context, msg string) {
 	er.Error = msg
 	c.JSON(400, er)
 }
+
+// ReportConflict - Send a 409 conflict message to the client
+func ReportConflict(c *gin.Context, msg string) {
+	var er structs.ErrorResponse
+	er.Error = msg
+	c.JSON(409, er)
+}
+
+// ReportNotFound - Send a 404 not found message to the client
+func ReportNotFound(c *gin.Context, msg string) {
+	var er structs.ErrorResponse
+	er.Error = msg
+	c.JSON(404, er)
+}
+
+// ReportBadGateway - Send a 502 bad gateway message to the client, for errors returned by a service it depends on
+func ReportBadGateway(c *gin.Context, msg string) {
+	var er structs.ErrorResponse
+	er.Error = msg
+	c.JSON(502, er)
+}
+
+// ReportGatewayTimeout - Send a 504 gateway timeout message to the client
+func ReportGatewayTimeout(c *gin.Context, msg string) {
+	var er structs.ErrorResponse
+	er.Error = msg
+	c.JSON(504, er)
+}